@@ -7,6 +7,42 @@
 
 #define ETH_P_IP     0x0800
 
+#define DNS_PORT     53
+// bytes of L4 payload appended to the sample for DNS packets
+#define DNS_SNAPLEN  1500
+// bytes of the first client payload captured on new TCP connections, enough
+// for a ClientHello in a single segment
+#define TLS_SNAPLEN  1500
+// bytes of TCP payload captured on ports registered in capture_ports, enough
+// for an HTTP request or status line and the first headers
+#define L7_SNAPLEN   512
+
+// event flags
+#define EVENT_F_IOC        0x01 // an endpoint is in ioc_lpm
+#define EVENT_F_DROPPED    0x02 // dropped by the policy rule in rule_id
+#define EVENT_F_WOULD_DROP 0x04 // a policy rule matched in dry-run mode
+#define EVENT_F_RL_START   0x08 // the source started being rate limited
+#define EVENT_F_RL_STOP    0x10 // the source is no longer rate limited
+
+#define POLICY_MAX_RULES   256
+
+#define POLICY_MODE_OFF     0
+#define POLICY_MODE_DRY_RUN 1
+#define POLICY_MODE_ENFORCE 2
+
+#define POLICY_DIR_ANY     0
+#define POLICY_DIR_INGRESS 1
+#define POLICY_DIR_EGRESS  2
+
+#define NSEC_PER_SEC     1000000000ULL
+// longest idle time credited to a bucket, keeps tokens * rate in range
+#define RL_MAX_IDLE_NS   (60 * NSEC_PER_SEC)
+
+#define RL_PASS  0
+#define RL_DROP  1
+#define RL_START 2 // first drop after passing
+#define RL_STOP  3 // first pass after dropping
+
 struct {
   __uint(type, BPF_MAP_TYPE_PERF_EVENT_ARRAY);
   __uint(key_size, sizeof(int));
@@ -14,6 +50,134 @@ struct {
   __uint(max_entries, 1024);
 } events SEC(".maps");
 
+// TCP connections whose SYN we saw and whose first payload we still want,
+// keyed from the client side
+struct conn_key {
+  __u32 saddr;
+  __u32 daddr;
+  __u16 sport;
+  __u16 dport;
+};
+
+struct {
+  __uint(type, BPF_MAP_TYPE_LRU_HASH);
+  __uint(max_entries, 65536);
+  __type(key, struct conn_key);
+  __type(value, __u8);
+} new_conns SEC(".maps");
+
+// TCP ports whose payload prefix is captured on every segment, filled from Go
+struct {
+  __uint(type, BPF_MAP_TYPE_HASH);
+  __uint(max_entries, 64);
+  __type(key, __u16);
+  __type(value, __u8);
+} capture_ports SEC(".maps");
+
+// Threat-intel networks, filled from Go. Matching here flags the event so
+// userspace only has to look up the indicator for flagged packets.
+struct ioc_key {
+  __u32 prefixlen;
+  __u32 addr; // network byte order
+};
+
+struct {
+  __uint(type, BPF_MAP_TYPE_LPM_TRIE);
+  __uint(max_entries, 262144);
+  __uint(map_flags, BPF_F_NO_PREALLOC);
+  __type(key, struct ioc_key);
+  __type(value, __u8);
+} ioc_lpm SEC(".maps");
+
+// Deny rules. The remote address is the source on ingress and the
+// destination on egress, the port is always the destination port.
+struct policy_rule {
+  __u32 id;       // reported in events
+  __u32 addr;     // network byte order
+  __u32 mask;     // network byte order, 0 matches every address
+  __u16 port_min; // 0-0 matches every port
+  __u16 port_max;
+  __u8 protocol;  // 0 matches every protocol
+  __u8 direction; // POLICY_DIR_*
+  __u16 pad;
+};
+
+// The rules live in two banks of POLICY_MAX_RULES entries. Go writes the
+// inactive bank and then flips policy_config in a single update, packets
+// checked after the flip see only the new rules. Map updates aren't atomic
+// for the reader though: a packet racing the flip can read parts of both
+// configs, and one racing two updates in a row the bank being rewritten.
+struct policy_config {
+  __u32 mode;   // POLICY_MODE_*
+  __u32 active; // bank holding the live rules, 0 or 1
+  __u32 count;  // number of live rules
+};
+
+struct {
+  __uint(type, BPF_MAP_TYPE_ARRAY);
+  __uint(max_entries, 2 * POLICY_MAX_RULES);
+  __uint(pinning, LIBBPF_PIN_BY_NAME);
+  __type(key, __u32);
+  __type(value, struct policy_rule);
+} policy_rules SEC(".maps");
+
+struct {
+  __uint(type, BPF_MAP_TYPE_ARRAY);
+  __uint(max_entries, 1);
+  __uint(pinning, LIBBPF_PIN_BY_NAME);
+  __type(key, __u32);
+  __type(value, struct policy_config);
+} policy_config SEC(".maps");
+
+// Ingress token buckets. Rules are keyed by destination port, port 0 is the
+// default for ports without their own rule.
+struct rl_rule {
+  __u32 rate;     // packets per second
+  __u32 burst;    // bucket size in packets
+  __u8 per_port;  // one bucket per source and port instead of per source
+  __u8 syn_only;  // only TCP SYNs take tokens
+  __u16 pad;
+};
+
+struct rl_key {
+  __u32 saddr;
+  __u16 dport; // 0 unless the rule is per_port
+  __u16 pad;
+};
+
+// Updated without locking from every CPU, so counts are approximate under
+// contention.
+struct rl_bucket {
+  __u64 tokens; // in packets * NSEC_PER_SEC
+  __u64 last_ns;
+  __u64 passed;
+  __u64 dropped;
+};
+
+struct {
+  __uint(type, BPF_MAP_TYPE_HASH);
+  __uint(max_entries, 64);
+  __type(key, __u16);
+  __type(value, struct rl_rule);
+} ratelimit_rules SEC(".maps");
+
+struct {
+  __uint(type, BPF_MAP_TYPE_LRU_HASH);
+  __uint(max_entries, 65536);
+  __type(key, struct rl_key);
+  __type(value, struct rl_bucket);
+} ratelimit_buckets SEC(".maps");
+
+// Sources dropping since their last passed packet. Kept apart from the
+// buckets so userspace can clear a source by deleting its key without
+// writing back a bucket the kernel may be updating.
+struct {
+  __uint(type, BPF_MAP_TYPE_LRU_HASH);
+  __uint(max_entries, 65536);
+  __type(key, struct rl_key);
+  __type(value, __u8);
+} ratelimit_limited SEC(".maps");
+
 struct event {
   __u32 src_ip;
   __u32 dst_ip;
@@ -21,9 +185,107 @@ struct event {
   __u16 dst_port;
   __u8 protocol;
   __u8 direction;
-  __u8 tcp_flags; 
+  __u8 tcp_flags;
+  __u8 flags;        // EVENT_F_*
+  __u32 pkt_len;     // skb->len at the hook
+  __u16 payload_off; // offset of the L4 payload from the start of the packet
+  __u16 cap_len;     // packet bytes appended after the event, 0 if none
+  __u64 ts_ns;       // bpf_ktime_get_ns() when the packet was seen
+  __u32 rule_id;     // policy rule that matched, if EVENT_F_*DROP* is set
+  __u32 pad2;
 };
 
+// policy_match returns the id of the first rule matching the event, or 0.
+static __always_inline __u32 policy_match(struct event *e,
+                                          struct policy_config *cfg) {
+  __u32 remote = e->direction ? e->dst_ip : e->src_ip;
+  __u8 dir = e->direction ? POLICY_DIR_EGRESS : POLICY_DIR_INGRESS;
+
+  for (__u32 i = 0; i < POLICY_MAX_RULES; i++) {
+    if (i >= cfg->count)
+      break;
+    __u32 idx = (cfg->active & 1) * POLICY_MAX_RULES + i;
+    struct policy_rule *r = bpf_map_lookup_elem(&policy_rules, &idx);
+    if (!r)
+      break;
+    if (r->direction != POLICY_DIR_ANY && r->direction != dir)
+      continue;
+    if (r->protocol && r->protocol != e->protocol)
+      continue;
+    if ((remote & r->mask) != r->addr)
+      continue;
+    if (r->port_max &&
+        (e->dst_port < r->port_min || e->dst_port > r->port_max))
+      continue;
+    return r->id;
+  }
+  return 0;
+}
+
+// rate_limit takes a token from the bucket of the packet's source and
+// returns one of RL_*.
+static __always_inline int rate_limit(struct event *e) {
+  __u16 port = e->dst_port;
+  struct rl_rule *rule = bpf_map_lookup_elem(&ratelimit_rules, &port);
+  if (!rule) {
+    port = 0;
+    rule = bpf_map_lookup_elem(&ratelimit_rules, &port);
+  }
+  if (!rule || !rule->rate || !rule->burst)
+    return RL_PASS;
+  // SYN without ACK
+  if (rule->syn_only &&
+      (e->protocol != IPPROTO_TCP || (e->tcp_flags & 0x12) != 0x02))
+    return RL_PASS;
+
+  struct rl_key key = {.saddr = e->src_ip};
+  if (rule->per_port)
+    key.dport = e->dst_port;
+
+  __u64 cap = (__u64)rule->burst * NSEC_PER_SEC;
+  struct rl_bucket *b = bpf_map_lookup_elem(&ratelimit_buckets, &key);
+  if (!b) {
+    struct rl_bucket nb = {
+        .tokens = cap - NSEC_PER_SEC,
+        .last_ns = e->ts_ns,
+        .passed = 1,
+    };
+    bpf_map_update_elem(&ratelimit_buckets, &key, &nb, BPF_NOEXIST);
+    return RL_PASS;
+  }
+
+  // Another CPU may already have stored a newer time
+  __u64 last = b->last_ns;
+  __u64 elapsed = e->ts_ns > last ? e->ts_ns - last : 0;
+  if (elapsed > RL_MAX_IDLE_NS)
+    elapsed = RL_MAX_IDLE_NS;
+  // elapsed * rate overflows for fast rules after a long pause, so a
+  // refill that would top up the bucket fills it without the product
+  __u64 tokens = b->tokens;
+  if (tokens >= cap || elapsed > (cap - tokens) / rule->rate)
+    tokens = cap;
+  else
+    tokens += elapsed * rule->rate;
+  if (e->ts_ns > last)
+    b->last_ns = e->ts_ns;
+
+  if (tokens < NSEC_PER_SEC) {
+    b->tokens = tokens;
+    b->dropped++;
+    // Only the CPU that inserts the key reports the start
+    __u8 one = 1;
+    if (bpf_map_update_elem(&ratelimit_limited, &key, &one, BPF_NOEXIST) == 0)
+      return RL_START;
+    return RL_DROP;
+  }
+
+  b->tokens = tokens - NSEC_PER_SEC;
+  b->passed++;
+  if (bpf_map_delete_elem(&ratelimit_limited, &key) == 0)
+    return RL_STOP;
+  return RL_PASS;
+}
+
 // to avoid duplication :>
 static __always_inline int process_packet(struct __sk_buff *skb,
                                           unsigned char direction) {
@@ -42,15 +304,31 @@ static __always_inline int process_packet(struct __sk_buff *skb,
   if ((void *)(ip + 1) > data_end)
     return TC_ACT_SHOT;
 
+  __u32 ihl = ip->ihl * 4;
+  if (ihl < sizeof(*ip))
+    return TC_ACT_OK;
+  void *l4 = (void *)ip + ihl;
+
   // event creation
   struct event e = {0};
   e.src_ip = ip->saddr;
   e.dst_ip = ip->daddr;
   e.protocol = ip->protocol;
   e.direction = direction;
+  e.pkt_len = skb->len;
+  e.ts_ns = bpf_ktime_get_ns();
+
+  struct ioc_key ik = {.prefixlen = 32, .addr = e.src_ip};
+  if (bpf_map_lookup_elem(&ioc_lpm, &ik)) {
+    e.flags |= EVENT_F_IOC;
+  } else {
+    ik.addr = e.dst_ip;
+    if (bpf_map_lookup_elem(&ioc_lpm, &ik))
+      e.flags |= EVENT_F_IOC;
+  }
 
   if (ip->protocol == IPPROTO_TCP) {
-    struct tcphdr *tcp = (struct tcphdr *)(ip + 1);
+    struct tcphdr *tcp = l4;
     if ((void *)(tcp + 1) > data_end)
       return TC_ACT_SHOT;
 
@@ -59,22 +337,93 @@ static __always_inline int process_packet(struct __sk_buff *skb,
     e.tcp_flags = tcp->fin | (tcp->syn << 1) | (tcp->rst << 2) |
                   (tcp->psh << 3) | (tcp->ack << 4) | (tcp->urg << 5) |
                   (tcp->ece << 6) | (tcp->cwr << 7);
+    e.payload_off = sizeof(*eth) + ihl + tcp->doff * 4;
+
+    struct conn_key ck = {
+        .saddr = e.src_ip,
+        .daddr = e.dst_ip,
+        .sport = e.src_port,
+        .dport = e.dst_port,
+    };
+    if (tcp->syn && !tcp->ack) {
+      __u8 one = 1;
+      bpf_map_update_elem(&new_conns, &ck, &one, BPF_ANY);
+    } else if (e.payload_off < skb->len &&
+               bpf_map_lookup_elem(&new_conns, &ck)) {
+      // first client payload of the connection, e.g. a TLS ClientHello
+      bpf_map_delete_elem(&new_conns, &ck);
+      __u32 cap = skb->len;
+      if (cap > e.payload_off + TLS_SNAPLEN)
+        cap = e.payload_off + TLS_SNAPLEN;
+      e.cap_len = cap;
+    } else if (e.payload_off < skb->len &&
+               (bpf_map_lookup_elem(&capture_ports, &e.dst_port) ||
+                bpf_map_lookup_elem(&capture_ports, &e.src_port))) {
+      __u32 cap = skb->len;
+      if (cap > e.payload_off + L7_SNAPLEN)
+        cap = e.payload_off + L7_SNAPLEN;
+      e.cap_len = cap;
+    }
   } else if (ip->protocol == IPPROTO_UDP) {
-    struct udphdr *udp = (struct udphdr *)(ip + 1);
+    struct udphdr *udp = l4;
     if ((void *)(udp + 1) > data_end)
       return TC_ACT_SHOT;
 
     e.src_port = bpf_ntohs(udp->source);
     e.dst_port = bpf_ntohs(udp->dest);
+    e.payload_off = sizeof(*eth) + ihl + sizeof(*udp);
   } else {
     e.src_port = 0;
     e.dst_port = 0;
     e.tcp_flags = 0;
   }
-  // outputing the data via a perf event array map
-  bpf_perf_event_output(skb, &events, BPF_F_CURRENT_CPU, &e, sizeof(e));
 
-  return TC_ACT_OK;
+  // DNS payloads are appended to the sample for passive name learning
+  if (!e.cap_len && (e.src_port == DNS_PORT || e.dst_port == DNS_PORT) &&
+      e.payload_off < skb->len) {
+    __u32 cap = skb->len;
+    if (cap > e.payload_off + DNS_SNAPLEN)
+      cap = e.payload_off + DNS_SNAPLEN;
+    e.cap_len = cap;
+  }
+
+  // deny policy, mode, bank and count are read once for the whole check
+  int verdict = TC_ACT_OK;
+  __u32 zero = 0;
+  struct policy_config *pcfg = bpf_map_lookup_elem(&policy_config, &zero);
+  if (pcfg && pcfg->mode != POLICY_MODE_OFF) {
+    struct policy_config cfg = *pcfg;
+    e.rule_id = policy_match(&e, &cfg);
+    if (e.rule_id && cfg.mode == POLICY_MODE_ENFORCE) {
+      e.flags |= EVENT_F_DROPPED;
+      verdict = TC_ACT_SHOT;
+    } else if (e.rule_id) {
+      e.flags |= EVENT_F_WOULD_DROP;
+    }
+  }
+
+  // anti-flood guard, drops while limited are only counted in the bucket so
+  // a flood doesn't turn into a flood of events
+  if (verdict == TC_ACT_OK && direction == 0) {
+    switch (rate_limit(&e)) {
+    case RL_DROP:
+      return TC_ACT_SHOT;
+    case RL_START:
+      e.flags |= EVENT_F_RL_START;
+      verdict = TC_ACT_SHOT;
+      break;
+    case RL_STOP:
+      e.flags |= EVENT_F_RL_STOP;
+      break;
+    }
+  }
+
+  // outputing the data via a perf event array map, the upper 32 bits of the
+  // flags tell the helper how many bytes of the skb to append to the sample
+  __u64 flags = BPF_F_CURRENT_CPU | ((__u64)e.cap_len << 32);
+  bpf_perf_event_output(skb, &events, flags, &e, sizeof(e));
+
+  return verdict;
 }
 
 SEC("tc")
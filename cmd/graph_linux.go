@@ -0,0 +1,60 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"kernelKoala/pkg/detection"
+	"os"
+)
+
+const graphUsage = `usage: kernelkoala graph dump -state file [-format text|json|dot]
+
+commands:
+  dump  print the connection graph saved by the graph detector
+`
+
+// runGraph prints the connection graph an agent saved with -graph-state.
+func runGraph(args []string) int {
+	fs := flag.NewFlagSet("graph", flag.ExitOnError)
+	state := fs.String("state", "", "Graph file written by the agent's -graph-state")
+	format := fs.String("format", "text", "Output format: text, json or dot")
+	fs.Usage = func() { fmt.Fprint(os.Stderr, graphUsage) }
+	if len(args) == 0 || args[0] != "dump" {
+		fs.Usage()
+		return 2
+	}
+	fs.Parse(args[1:])
+	if *state == "" {
+		fs.Usage()
+		return 2
+	}
+
+	g, err := detection.LoadGraph(*state)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "❌ %v\n", err)
+		return 1
+	}
+
+	switch *format {
+	case "text":
+		err = g.WriteText(os.Stdout)
+	case "json":
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		err = enc.Encode(g)
+	case "dot":
+		err = g.WriteDot(os.Stdout)
+	default:
+		fmt.Fprintf(os.Stderr, "❌ unknown format %q\n", *format)
+		return 2
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "❌ %v\n", err)
+		return 1
+	}
+	return 0
+}
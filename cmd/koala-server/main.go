@@ -0,0 +1,230 @@
+// Command koala-server collects flows and alerts from KernelKoala agents
+// and answers cluster-wide queries over them.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	l "kernelKoala/internal/logger"
+	"kernelKoala/pkg/alerting"
+	"kernelKoala/pkg/auth"
+	"kernelKoala/pkg/koala"
+	"net"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+)
+
+const usage = `usage: koala-server [serve] [flags]
+       koala-server flows|alerts [-addr host:port] [-where field=value]... [flags]
+       koala-server nodes [-addr host:port]
+
+The query commands use TLS when -ca or -cert is given.
+
+commands:
+  serve   accept agent streams and serve queries (default)
+  flows   list merged flows of all nodes
+  alerts  list alerts of all nodes
+  nodes   list connected agents
+`
+
+func main() {
+	cmd := "serve"
+	args := os.Args[1:]
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		cmd, args = args[0], args[1:]
+	}
+	switch cmd {
+	case "serve":
+		os.Exit(serve(args))
+	case "flows", "alerts", "nodes":
+		os.Exit(query(cmd, args))
+	default:
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+}
+
+func serve(args []string) int {
+	cfg := koala.DefaultServerConfig()
+	fs := flag.NewFlagSet("serve", flag.ExitOnError)
+	listen := fs.String("listen", ":7070", "Address agents and clients connect to")
+	fs.DurationVar(&cfg.Retention, "retention", cfg.Retention, "How long flows and alerts are kept")
+	fs.IntVar(&cfg.MaxFlows, "max-flows", cfg.MaxFlows, "Merged flows kept in memory")
+	fs.IntVar(&cfg.MaxAlerts, "max-alerts", cfg.MaxAlerts, "Alerts kept in memory")
+	fs.DurationVar(&cfg.MergeSlack, "merge-slack", cfg.MergeSlack, "Clock skew tolerated when merging the reports of both ends")
+	tlsCert := fs.String("tls-cert", "", "Server certificate, enables TLS")
+	tlsKey := fs.String("tls-key", "", "Key of -tls-cert")
+	clientCA := fs.String("client-ca", "", "CA bundle agents and clients must present a certificate of (mutual TLS)")
+	tlsReload := fs.Duration("tls-reload", time.Minute, "How often the certificates are checked for changes (0 disables)")
+	fs.Usage = func() { fmt.Fprint(os.Stderr, usage); fs.PrintDefaults() }
+	fs.Parse(args)
+
+	log, err := l.NewLogger(l.DefaultConfig())
+	if err != nil {
+		fmt.Println("log not configured")
+		return 1
+	}
+
+	lis, err := net.Listen("tcp", *listen)
+	if err != nil {
+		log.Error("failed to listen on %s: %v", *listen, err)
+		return 1
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	srv := koala.NewServer(cfg, func(err error) { log.Warn("%v", err) })
+	go srv.Run(ctx)
+
+	var opts []grpc.ServerOption
+	if *tlsCert != "" {
+		certs, err := auth.LoadCerts(*tlsCert, *tlsKey, *clientCA, *tlsReload, func(err error) {
+			log.Warn("certificate reload failed: %v", err)
+		})
+		if err != nil {
+			log.Error("failed to load certificates: %v", err)
+			return 1
+		}
+		defer certs.Close()
+		opts = append(opts, grpc.Creds(credentials.NewTLS(certs.ServerConfig())))
+	} else if *clientCA != "" {
+		log.Error("-client-ca needs -tls-cert and -tls-key")
+		return 1
+	}
+
+	grpcServer := grpc.NewServer(opts...)
+	koala.RegisterCollector(grpcServer, srv)
+	go func() {
+		<-ctx.Done()
+		done := make(chan struct{})
+		go func() {
+			grpcServer.GracefulStop()
+			close(done)
+		}()
+		select {
+		case <-done:
+		case <-time.After(10 * time.Second):
+			grpcServer.Stop()
+		}
+	}()
+
+	log.Info("Koala Server listening on %s", lis.Addr())
+	if err := grpcServer.Serve(lis); err != nil {
+		log.Error("server failed: %v", err)
+		return 1
+	}
+	log.Info("Shutdown complete")
+	return 0
+}
+
+func query(cmd string, args []string) int {
+	var where alerting.Conditions
+	fs := flag.NewFlagSet(cmd, flag.ExitOnError)
+	addr := fs.String("addr", "127.0.0.1:7070", "Koala Server address")
+	fs.Var(&where, "where", "Condition such as dst_port=443, bytes=>1000 or src_ip=10.0.0.0/8, repeatable")
+	node := fs.String("node", "", "Only records reported by this node")
+	since := fs.Duration("since", 0, "Only records of the last duration, e.g. 15m")
+	sortBy := fs.String("sort", "bytes", "Flow order: bytes, packets, duration or last_seen")
+	top := fs.Int("top", 20, "Maximum records returned")
+	format := fs.String("format", "text", "Output format: text or json")
+	ca := fs.String("ca", "", "CA bundle verifying the server, enables TLS")
+	cert := fs.String("cert", "", "Client certificate for mutual TLS, enables TLS")
+	key := fs.String("key", "", "Key of -cert")
+	fs.Usage = func() { fmt.Fprint(os.Stderr, usage); fs.PrintDefaults() }
+	fs.Parse(args)
+
+	creds := insecure.NewCredentials()
+	if *ca != "" || *cert != "" {
+		certs, err := auth.LoadCerts(*cert, *key, *ca, 0, nil)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "❌ %v\n", err)
+			return 1
+		}
+		creds = credentials.NewTLS(certs.ClientConfig())
+	}
+	opts := append(koala.DialOptions(), grpc.WithTransportCredentials(creds))
+	conn, err := grpc.NewClient(*addr, opts...)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "❌ %v\n", err)
+		return 1
+	}
+	defer conn.Close()
+	client := koala.NewClient(conn)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	q := &koala.Query{Where: where, Node: *node, Sort: *sortBy, Limit: *top}
+	if *since > 0 {
+		q.Since = time.Now().Add(-*since)
+	}
+
+	var resp any
+	switch cmd {
+	case "flows":
+		resp, err = client.Flows(ctx, q)
+	case "alerts":
+		resp, err = client.Alerts(ctx, q)
+	default:
+		resp, err = client.Nodes(ctx)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "❌ %v\n", err)
+		return 1
+	}
+
+	if *format == "json" {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		enc.Encode(resp)
+		return 0
+	}
+	switch r := resp.(type) {
+	case *koala.FlowsResponse:
+		for _, f := range r.Flows {
+			nodes := make([]string, 0, len(f.Observations))
+			for _, o := range f.Observations {
+				nodes = append(nodes, o.Node)
+			}
+			fmt.Printf("%s %s:%d -> %s:%d | packets=%d bytes=%d duration=%s | nodes=%s\n",
+				f.Protocol, endpointName(f.SrcIP, f.SrcName), f.SrcPort, endpointName(f.DstIP, f.DstName), f.DstPort,
+				f.Packets, f.Bytes, f.LastSeen.Sub(f.FirstSeen).Round(time.Millisecond), strings.Join(nodes, ","))
+		}
+		fmt.Printf("%d of %d flows\n", len(r.Flows), r.Total)
+	case *koala.AlertsResponse:
+		for _, a := range r.Alerts {
+			fmt.Printf("[%s] %s\n", a.Node, a.Alert.String())
+		}
+		fmt.Printf("%d of %d alerts\n", len(r.Alerts), r.Total)
+	case *koala.NodesResponse:
+		for _, n := range r.Nodes {
+			state := "disconnected"
+			if n.Connected {
+				state = "connected"
+			}
+			peer := n.Peer
+			if n.Identity != "" {
+				peer += "(" + n.Identity + ")"
+			}
+			fmt.Printf("%-20s %-12s peer=%s batches=%d flows=%d alerts=%d duplicates=%d\n",
+				n.Name, state, peer, n.Batches, n.Flows, n.Alerts, n.Duplicates)
+		}
+	}
+	return 0
+}
+
+func endpointName(ip, name string) string {
+	if name == "" {
+		return ip
+	}
+	return fmt.Sprintf("%s(%s)", ip, name)
+}
@@ -12,6 +12,16 @@ import (
 )
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "policy" {
+		os.Exit(runPolicy(os.Args[2:]))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "graph" {
+		os.Exit(runGraph(os.Args[2:]))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "query" {
+		os.Exit(runQuery(os.Args[2:]))
+	}
+
 	header.PrintHeader()
 	config := l.DefaultConfig()
 	log, err := l.NewLogger(config)
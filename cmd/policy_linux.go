@@ -0,0 +1,102 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"kernelKoala/pkg/policy"
+	"os"
+	"strconv"
+)
+
+const policyUsage = `usage: kernelkoala policy [-pin-path dir] <command>
+
+commands:
+  list                      show the mode and the live rules
+  add key=value...          add a rule: cidr=, port=, proto=, dir=, id=
+  remove <id>               remove a rule
+  mode off|dry-run|enforce  switch the enforcement mode
+`
+
+// runPolicy edits the deny policy of a running agent through its pinned
+// maps.
+func runPolicy(args []string) int {
+	fs := flag.NewFlagSet("policy", flag.ExitOnError)
+	pinPath := fs.String("pin-path", policy.DefaultPinPath, "bpffs directory holding the agent's policy maps")
+	fs.Usage = func() { fmt.Fprint(os.Stderr, policyUsage) }
+	fs.Parse(args)
+
+	switch fs.Arg(0) {
+	case "list", "add", "remove", "mode":
+	default:
+		fs.Usage()
+		return 2
+	}
+
+	table, err := policy.OpenPinned(*pinPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "❌ %v\n", err)
+		return 1
+	}
+	defer table.Close()
+
+	cmd, rest := fs.Arg(0), fs.Args()[1:]
+	switch cmd {
+	case "list":
+		err = policyList(table)
+	case "add":
+		var rule policy.Rule
+		if rule, err = policy.ParseRule(rest); err == nil {
+			if rule, err = table.Add(rule); err == nil {
+				fmt.Println("added", rule)
+			}
+		}
+	case "remove":
+		if len(rest) != 1 {
+			fs.Usage()
+			return 2
+		}
+		var id uint64
+		if id, err = strconv.ParseUint(rest[0], 10, 32); err == nil {
+			if err = table.Remove(uint32(id)); err == nil {
+				fmt.Println("removed rule", id)
+			}
+		}
+	case "mode":
+		if len(rest) != 1 {
+			fs.Usage()
+			return 2
+		}
+		var mode policy.Mode
+		if mode, err = policy.ParseMode(rest[0]); err == nil {
+			if err = table.SetMode(mode); err == nil {
+				fmt.Println("mode", mode)
+			}
+		}
+	}
+
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "❌ %v\n", err)
+		return 1
+	}
+	return 0
+}
+
+func policyList(table *policy.Table) error {
+	mode, err := table.Mode()
+	if err != nil {
+		return err
+	}
+	rules, err := table.List()
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("mode: %s\n", mode)
+	for _, rule := range rules {
+		fmt.Println(rule)
+	}
+	return nil
+}
@@ -0,0 +1,169 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"kernelKoala/pkg/alerting"
+	"kernelKoala/pkg/flowstore"
+	"kernelKoala/pkg/koala"
+	"net/netip"
+	"os"
+	"strings"
+	"time"
+)
+
+const queryUsage = `usage: kernelkoala query [-dir dir] [-since 1h | -from time -to time]
+                         [-ip addr|cidr] [-port n] [-proto tcp|udp|icmp] [-where field=value]...
+                         [-group-by field,... [-interval 5m] [-sort bytes|packets|flows]] [flags]
+
+Lists the flows an agent stored with -store-dir, in export order, or sums
+them up per group-by key.
+
+`
+
+// runQuery searches the flow store of an agent.
+func runQuery(args []string) int {
+	var where alerting.Conditions
+	fs := flag.NewFlagSet("query", flag.ExitOnError)
+	dir := fs.String("dir", flowstore.DefaultDir, "Flow store directory, the agent's -store-dir")
+	since := fs.Duration("since", time.Hour, "Only flows of the last duration (0 for all)")
+	from := fs.String("from", "", "Start of the time range, RFC 3339, overrides -since")
+	to := fs.String("to", "", "End of the time range, RFC 3339")
+	ip := fs.String("ip", "", "Address or CIDR of either end")
+	port := fs.Uint("port", 0, "Port of either end")
+	proto := fs.String("proto", "", "Protocol: tcp, udp or icmp")
+	fs.Var(&where, "where", "Condition such as dst_port=443, bytes=>1000 or src_country=!US, repeatable")
+	groupBy := fs.String("group-by", "", "Comma-separated fields to sum flows by, e.g. src_ip,dst_port")
+	interval := fs.Duration("interval", 0, "Also group by time buckets of this length")
+	sortBy := fs.String("sort", "bytes", "Group order: bytes, packets or flows")
+	top := fs.Int("top", 50, "Maximum flows or groups printed (0 for all)")
+	format := fs.String("format", "text", "Output format: text or json")
+	fs.Usage = func() { fmt.Fprint(os.Stderr, queryUsage); fs.PrintDefaults() }
+	fs.Parse(args)
+
+	q := flowstore.Query{Protocol: *proto, Where: where}
+	if *since > 0 {
+		q.Since = time.Now().Add(-*since)
+	}
+	var err error
+	if *from != "" {
+		if q.Since, err = time.Parse(time.RFC3339, *from); err != nil {
+			return queryFailed(fmt.Errorf("-from: %v", err))
+		}
+	}
+	if *to != "" {
+		if q.Until, err = time.Parse(time.RFC3339, *to); err != nil {
+			return queryFailed(fmt.Errorf("-to: %v", err))
+		}
+	}
+	if *ip != "" {
+		if q.IP, err = parsePrefix(*ip); err != nil {
+			return queryFailed(fmt.Errorf("-ip: %v", err))
+		}
+	}
+	if *port > 65535 {
+		return queryFailed(fmt.Errorf("-port: %d is not a port", *port))
+	}
+	q.Port = uint16(*port)
+	switch *sortBy {
+	case "bytes", "packets", "flows":
+	default:
+		return queryFailed(fmt.Errorf("-sort must be bytes, packets or flows"))
+	}
+
+	var fields []string
+	for _, f := range strings.Split(*groupBy, ",") {
+		if f = strings.TrimSpace(f); f != "" {
+			fields = append(fields, f)
+		}
+	}
+
+	if len(fields) == 0 && *interval == 0 {
+		var flows []koala.Flow
+		stats, err := flowstore.Scan(*dir, q, func(f *koala.Flow) bool {
+			flows = append(flows, *f)
+			return *top == 0 || len(flows) < *top
+		})
+		if err != nil {
+			return queryFailed(err)
+		}
+		if *format == "json" {
+			if flows == nil {
+				flows = []koala.Flow{}
+			}
+			printQueryJSON(map[string]any{"flows": flows, "stats": stats})
+			return 0
+		}
+		for i := range flows {
+			f := &flows[i]
+			fmt.Printf("%s %s %s:%d -> %s:%d | packets=%d bytes=%d duration=%s\n",
+				f.FirstSeen.Local().Format(time.DateTime), f.Protocol,
+				storedEndpoint(f.SrcIP, f.SrcName), f.SrcPort, storedEndpoint(f.DstIP, f.DstName), f.DstPort,
+				f.Packets, f.Bytes, f.LastSeen.Sub(f.FirstSeen).Round(time.Millisecond))
+		}
+		printQueryStats(stats)
+		return 0
+	}
+
+	agg := flowstore.NewAggregator(fields, *interval)
+	stats, err := flowstore.Scan(*dir, q, func(f *koala.Flow) bool {
+		agg.Add(f)
+		return true
+	})
+	if err != nil {
+		return queryFailed(err)
+	}
+	groups := agg.Groups(*sortBy)
+	if *top > 0 && len(groups) > *top {
+		groups = groups[:*top]
+	}
+	if *format == "json" {
+		printQueryJSON(map[string]any{"columns": agg.Columns(), "groups": groups, "stats": stats})
+		return 0
+	}
+	fmt.Printf("%s | flows packets bytes\n", strings.Join(agg.Columns(), " "))
+	for _, g := range groups {
+		fmt.Printf("%s | %d %d %d\n", strings.Join(g.Key, " "), g.Flows, g.Packets, g.Bytes)
+	}
+	printQueryStats(stats)
+	return 0
+}
+
+// parsePrefix accepts a CIDR or a single address.
+func parsePrefix(s string) (netip.Prefix, error) {
+	if strings.Contains(s, "/") {
+		return netip.ParsePrefix(s)
+	}
+	addr, err := netip.ParseAddr(s)
+	if err != nil {
+		return netip.Prefix{}, err
+	}
+	return netip.PrefixFrom(addr, addr.BitLen()), nil
+}
+
+func storedEndpoint(ip, name string) string {
+	if name == "" {
+		return ip
+	}
+	return fmt.Sprintf("%s(%s)", ip, name)
+}
+
+func printQueryJSON(v any) {
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	enc.Encode(v)
+}
+
+func printQueryStats(s flowstore.QueryStats) {
+	fmt.Fprintf(os.Stderr, "%d flows matched, %d scanned in %d of %d blocks (%d of %d segments skipped)\n",
+		s.Matched, s.Scanned, s.Blocks-s.BlocksSkipped, s.Blocks, s.SegmentsSkipped, s.Segments)
+}
+
+func queryFailed(err error) int {
+	fmt.Fprintf(os.Stderr, "❌ %v\n", err)
+	return 1
+}
@@ -0,0 +1,13 @@
+//go:build linux
+// +build linux
+
+package main
+
+// Register the database/sql drivers the -db-dialect defaults name:
+// "pgx" for postgres, "clickhouse" and "sqlite". SQLite is pure Go, so
+// the binary still builds without cgo.
+import (
+	_ "github.com/ClickHouse/clickhouse-go/v2"
+	_ "github.com/jackc/pgx/v5/stdlib"
+	_ "modernc.org/sqlite"
+)
@@ -0,0 +1,91 @@
+// Package alert defines the alerts raised by KernelKoala's detectors.
+package alert
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Severity ranks how urgent an alert is.
+type Severity string
+
+const (
+	SeverityInfo     Severity = "info"
+	SeverityLow      Severity = "low"
+	SeverityMedium   Severity = "medium"
+	SeverityHigh     Severity = "high"
+	SeverityCritical Severity = "critical"
+)
+
+// Rank orders severities from 1 for info to 5 for critical, unknown
+// severities rank 0.
+func (s Severity) Rank() int {
+	switch s {
+	case SeverityInfo:
+		return 1
+	case SeverityLow:
+		return 2
+	case SeverityMedium:
+		return 3
+	case SeverityHigh:
+		return 4
+	case SeverityCritical:
+		return 5
+	default:
+		return 0
+	}
+}
+
+// Alert is a single finding about observed traffic.
+type Alert struct {
+	Time     time.Time `json:"time"`
+	Type     string    `json:"type"`
+	Severity Severity  `json:"severity"`
+	Message  string    `json:"message"`
+
+	Protocol string `json:"protocol,omitempty"`
+	SrcIP    string `json:"src_ip,omitempty"`
+	SrcPort  uint16 `json:"src_port,omitempty"`
+	DstIP    string `json:"dst_ip,omitempty"`
+	DstPort  uint16 `json:"dst_port,omitempty"`
+	Iface    string `json:"iface,omitempty"`
+
+	// Fields carries detector specific details, e.g. the matched indicator.
+	Fields map[string]string `json:"fields,omitempty"`
+}
+
+func (a Alert) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "ALERT [%s] %s: %s", a.Severity, a.Type, a.Message)
+	if a.SrcIP != "" || a.DstIP != "" {
+		fmt.Fprintf(&b, " | %s %s -> %s", a.Protocol, endpoint(a.SrcIP, a.SrcPort), endpoint(a.DstIP, a.DstPort))
+	}
+	if a.Iface != "" {
+		fmt.Fprintf(&b, " | iface=%s", a.Iface)
+	}
+
+	keys := make([]string, 0, len(a.Fields))
+	for k := range a.Fields {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		fmt.Fprintf(&b, " %s=%s", k, a.Fields[k])
+	}
+	return b.String()
+}
+
+// endpoint renders ip:port, "*" standing for any address.
+func endpoint(ip string, port uint16) string {
+	if ip == "" {
+		ip = "*"
+	}
+	if port == 0 {
+		return ip
+	}
+	return net.JoinHostPort(ip, strconv.Itoa(int(port)))
+}
@@ -0,0 +1,269 @@
+// Package alerting evaluates declarative rules over packets, flows and
+// detector alerts, deduplicates the resulting alerts and delivers them to
+// webhook, file and syslog notifiers.
+package alerting
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"kernelKoala/pkg/alert"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Config is the alerting config file.
+type Config struct {
+	Rules     []Rule           `json:"rules"`
+	Notifiers []NotifierConfig `json:"notifiers"`
+	// Dedup suppresses repeats of an alert, same type and endpoints, for
+	// this long.
+	Dedup Duration `json:"dedup"`
+	// QueueSize is the number of alerts each notifier can fall behind by.
+	QueueSize int `json:"queue_size"`
+}
+
+// LoadConfig reads a JSON config file.
+func LoadConfig(path string) (Config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return Config{}, err
+	}
+	var cfg Config
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return Config{}, fmt.Errorf("%s: %v", path, err)
+	}
+	return cfg, nil
+}
+
+// notifierEntry is a notifier with a queue of its own, so one that is
+// slow or retrying doesn't hold up the others.
+type notifierEntry struct {
+	n           Notifier
+	minSeverity int
+	queue       chan alert.Alert
+}
+
+// Stats counts what happened to alerts. Delivered, Failed and Dropped
+// count per notifier.
+type Stats struct {
+	Raised     uint64
+	Suppressed uint64
+	Delivered  uint64
+	Failed     uint64
+	Dropped    uint64
+}
+
+// Engine is the alerting pipeline. Observe feeds records to the rules,
+// Notify takes alerts from anywhere, rule alerts included, and queues them
+// for the notifiers.
+type Engine struct {
+	rules     map[string][]*ruleState
+	notifiers []*notifierEntry
+	dedup     time.Duration
+	raise     func(alert.Alert)
+	onError   func(error)
+
+	mu   sync.Mutex
+	seen map[string]time.Time
+
+	done  chan struct{}
+	stats Stats
+}
+
+// New compiles the rules and opens the notifiers. Alerts fired by rules
+// are passed to raise, which is expected to hand them back to Notify after
+// printing them, delivery errors to onError.
+func New(cfg Config, raise func(alert.Alert), onError func(error)) (*Engine, error) {
+	e := &Engine{
+		rules:   make(map[string][]*ruleState),
+		dedup:   time.Duration(cfg.Dedup),
+		raise:   raise,
+		onError: onError,
+		seen:    make(map[string]time.Time),
+		done:    make(chan struct{}),
+	}
+	if e.dedup == 0 {
+		e.dedup = time.Minute
+	}
+	size := cfg.QueueSize
+	if size <= 0 {
+		size = 1024
+	}
+
+	for _, r := range cfg.Rules {
+		s, err := compileRule(r)
+		if err != nil {
+			return nil, err
+		}
+		e.rules[s.rule.Source] = append(e.rules[s.rule.Source], s)
+	}
+
+	for _, nc := range cfg.Notifiers {
+		n, err := newNotifier(nc)
+		if err != nil {
+			e.closeNotifiers()
+			return nil, err
+		}
+		e.notifiers = append(e.notifiers, &notifierEntry{
+			n:           n,
+			minSeverity: nc.MinSeverity.Rank(),
+			queue:       make(chan alert.Alert, size),
+		})
+	}
+	return e, nil
+}
+
+// Wants reports whether any rule looks at records of source, so callers
+// can skip building them.
+func (e *Engine) Wants(source string) bool {
+	return len(e.rules[source]) > 0
+}
+
+// Observe evaluates the rules of source against r.
+func (e *Engine) Observe(source string, r Record, now time.Time) {
+	for _, s := range e.rules[source] {
+		if a, ok := s.observe(r, now); ok {
+			e.raise(a)
+		}
+	}
+}
+
+// Notify runs the alert rules over a and queues it for each notifier that
+// takes its severity, unless the same alert was queued within the dedup
+// period.
+func (e *Engine) Notify(a alert.Alert) {
+	atomic.AddUint64(&e.stats.Raised, 1)
+
+	// Alerts raised by rules are not fed to the rules again
+	if _, fromRule := a.Fields["rule"]; !fromRule {
+		e.Observe(SourceAlert, alertRecord(a), a.Time)
+	}
+
+	key := fmt.Sprintf("%s|%s|%s:%d|%s:%d|%s", a.Type, a.Severity, a.SrcIP, a.SrcPort, a.DstIP, a.DstPort, a.Iface)
+	e.mu.Lock()
+	if last, ok := e.seen[key]; ok && a.Time.Sub(last) < e.dedup {
+		e.mu.Unlock()
+		atomic.AddUint64(&e.stats.Suppressed, 1)
+		return
+	}
+	e.seen[key] = a.Time
+	e.mu.Unlock()
+
+	rank := a.Severity.Rank()
+	for _, entry := range e.notifiers {
+		if rank < entry.minSeverity {
+			continue
+		}
+		select {
+		case entry.queue <- a:
+		default:
+			atomic.AddUint64(&e.stats.Dropped, 1)
+		}
+	}
+}
+
+// Run delivers queued alerts, one goroutine per notifier, until ctx is
+// done, then drains the queues.
+func (e *Engine) Run(ctx context.Context) {
+	defer close(e.done)
+	var wg sync.WaitGroup
+	for _, entry := range e.notifiers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			e.deliver(ctx, entry)
+		}()
+	}
+
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			wg.Wait()
+			return
+		case now := <-ticker.C:
+			e.expire(now)
+		}
+	}
+}
+
+// deliver sends the alerts queued for entry until ctx is done, then what
+// is left within a few seconds.
+func (e *Engine) deliver(ctx context.Context, entry *notifierEntry) {
+	for {
+		select {
+		case <-ctx.Done():
+			drain, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			for {
+				select {
+				case a := <-entry.queue:
+					e.send(drain, entry, a)
+				default:
+					return
+				}
+			}
+		case a := <-entry.queue:
+			e.send(ctx, entry, a)
+		}
+	}
+}
+
+func (e *Engine) send(ctx context.Context, entry *notifierEntry, a alert.Alert) {
+	if err := entry.n.Send(ctx, a); err != nil {
+		atomic.AddUint64(&e.stats.Failed, 1)
+		if e.onError != nil {
+			e.onError(fmt.Errorf("%s: %v", entry.n.Name(), err))
+		}
+		return
+	}
+	atomic.AddUint64(&e.stats.Delivered, 1)
+}
+
+func (e *Engine) expire(now time.Time) {
+	e.mu.Lock()
+	for key, last := range e.seen {
+		if now.Sub(last) >= e.dedup {
+			delete(e.seen, key)
+		}
+	}
+	e.mu.Unlock()
+
+	for _, rules := range e.rules {
+		for _, s := range rules {
+			s.expire(now)
+		}
+	}
+}
+
+func (e *Engine) Stats() Stats {
+	return Stats{
+		Raised:     atomic.LoadUint64(&e.stats.Raised),
+		Suppressed: atomic.LoadUint64(&e.stats.Suppressed),
+		Delivered:  atomic.LoadUint64(&e.stats.Delivered),
+		Failed:     atomic.LoadUint64(&e.stats.Failed),
+		Dropped:    atomic.LoadUint64(&e.stats.Dropped),
+	}
+}
+
+// Close waits for Run to drain the queues, if it was started, and closes
+// the notifiers.
+func (e *Engine) Close(timeout time.Duration) {
+	select {
+	case <-e.done:
+	case <-time.After(timeout):
+	}
+	e.closeNotifiers()
+}
+
+func (e *Engine) closeNotifiers() {
+	for _, entry := range e.notifiers {
+		if err := entry.n.Close(); err != nil && e.onError != nil {
+			e.onError(fmt.Errorf("%s: %v", entry.n.Name(), err))
+		}
+	}
+}
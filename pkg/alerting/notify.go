@@ -0,0 +1,230 @@
+package alerting
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"kernelKoala/pkg/alert"
+	"log/syslog"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// Notifier delivers alerts to one destination.
+type Notifier interface {
+	Name() string
+	Send(ctx context.Context, a alert.Alert) error
+	Close() error
+}
+
+// NotifierConfig configures one notifier, Type is webhook, file or syslog.
+// Alerts below MinSeverity are not sent to it.
+type NotifierConfig struct {
+	Type        string         `json:"type"`
+	MinSeverity alert.Severity `json:"min_severity"`
+
+	// webhook
+	URL     string            `json:"url"`
+	Headers map[string]string `json:"headers"`
+	Timeout Duration          `json:"timeout"`
+	Retries int               `json:"retries"`
+
+	// file
+	Path string `json:"path"`
+
+	// syslog, an empty address logs to the local daemon
+	Network string `json:"network"`
+	Address string `json:"address"`
+	Tag     string `json:"tag"`
+}
+
+func newNotifier(cfg NotifierConfig) (Notifier, error) {
+	switch cfg.Type {
+	case "webhook":
+		return newWebhookNotifier(cfg)
+	case "file":
+		return newFileNotifier(cfg)
+	case "syslog":
+		return newSyslogNotifier(cfg)
+	default:
+		return nil, fmt.Errorf("unknown notifier type %q", cfg.Type)
+	}
+}
+
+// webhookNotifier POSTs each alert as JSON, retrying failed deliveries and
+// 5xx answers with a growing delay. Any other answer is final: a rejected
+// alert isn't going to be accepted the next time.
+type webhookNotifier struct {
+	url     string
+	headers map[string]string
+	retries int
+	// backoff is the delay before the first retry, it grows by itself
+	// with every further one
+	backoff time.Duration
+	client  *http.Client
+}
+
+func newWebhookNotifier(cfg NotifierConfig) (*webhookNotifier, error) {
+	if cfg.URL == "" {
+		return nil, fmt.Errorf("webhook notifier without url")
+	}
+	timeout := time.Duration(cfg.Timeout)
+	if timeout <= 0 {
+		timeout = 5 * time.Second
+	}
+	retries := cfg.Retries
+	if retries <= 0 {
+		retries = 3
+	}
+	return &webhookNotifier{
+		url:     cfg.URL,
+		headers: cfg.Headers,
+		retries: retries,
+		backoff: time.Second,
+		client:  &http.Client{Timeout: timeout},
+	}, nil
+}
+
+func (n *webhookNotifier) Name() string { return "webhook " + n.url }
+
+func (n *webhookNotifier) Send(ctx context.Context, a alert.Alert) error {
+	body, err := json.Marshal(a)
+	if err != nil {
+		return err
+	}
+
+	for attempt := 0; ; attempt++ {
+		err = n.post(ctx, body)
+		if err == nil || !retryable(err) || attempt+1 >= n.retries {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(time.Duration(attempt+1) * n.backoff):
+		}
+	}
+}
+
+func (n *webhookNotifier) post(ctx context.Context, body []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, n.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range n.headers {
+		req.Header.Set(k, v)
+	}
+
+	resp, err := n.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return &statusError{code: resp.StatusCode, status: resp.Status}
+	}
+	return nil
+}
+
+// statusError is a webhook answer other than 2xx.
+type statusError struct {
+	code   int
+	status string
+}
+
+func (e *statusError) Error() string { return "webhook answered " + e.status }
+
+// retryable reports whether a failed POST may succeed later: the request
+// didn't get through or the server failed.
+func retryable(err error) bool {
+	var se *statusError
+	if errors.As(err, &se) {
+		return se.code >= 500
+	}
+	return true
+}
+
+func (n *webhookNotifier) Close() error {
+	n.client.CloseIdleConnections()
+	return nil
+}
+
+// fileNotifier appends one JSON alert per line.
+type fileNotifier struct {
+	mu   sync.Mutex
+	path string
+	f    *os.File
+}
+
+func newFileNotifier(cfg NotifierConfig) (*fileNotifier, error) {
+	if cfg.Path == "" {
+		return nil, fmt.Errorf("file notifier without path")
+	}
+	f, err := os.OpenFile(cfg.Path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o640)
+	if err != nil {
+		return nil, err
+	}
+	return &fileNotifier{path: cfg.Path, f: f}, nil
+}
+
+func (n *fileNotifier) Name() string { return "file " + n.path }
+
+func (n *fileNotifier) Send(_ context.Context, a alert.Alert) error {
+	line, err := json.Marshal(a)
+	if err != nil {
+		return err
+	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	_, err = n.f.Write(append(line, '\n'))
+	return err
+}
+
+func (n *fileNotifier) Close() error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.f.Close()
+}
+
+// syslogNotifier logs the text form of alerts at a priority matching their
+// severity.
+type syslogNotifier struct {
+	w *syslog.Writer
+}
+
+func newSyslogNotifier(cfg NotifierConfig) (*syslogNotifier, error) {
+	tag := cfg.Tag
+	if tag == "" {
+		tag = "kernelkoala"
+	}
+	w, err := syslog.Dial(cfg.Network, cfg.Address, syslog.LOG_WARNING|syslog.LOG_DAEMON, tag)
+	if err != nil {
+		return nil, err
+	}
+	return &syslogNotifier{w: w}, nil
+}
+
+func (n *syslogNotifier) Name() string { return "syslog" }
+
+func (n *syslogNotifier) Send(_ context.Context, a alert.Alert) error {
+	msg := a.String()
+	switch a.Severity {
+	case alert.SeverityCritical:
+		return n.w.Crit(msg)
+	case alert.SeverityHigh:
+		return n.w.Err(msg)
+	case alert.SeverityMedium:
+		return n.w.Warning(msg)
+	case alert.SeverityLow:
+		return n.w.Notice(msg)
+	default:
+		return n.w.Info(msg)
+	}
+}
+
+func (n *syslogNotifier) Close() error { return n.w.Close() }
@@ -0,0 +1,264 @@
+package alerting
+
+import (
+	"context"
+	"encoding/json"
+	"kernelKoala/pkg/alert"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// webhookServer answers with the given status codes in turn, the last one
+// from then on, and keeps the alerts it was sent.
+type webhookServer struct {
+	*httptest.Server
+	statuses []int
+
+	mu       sync.Mutex
+	requests int
+	alerts   []alert.Alert
+	headers  []http.Header
+}
+
+func newWebhookServer(t *testing.T, statuses ...int) *webhookServer {
+	w := &webhookServer{statuses: statuses}
+	w.Server = httptest.NewServer(http.HandlerFunc(w.handle))
+	t.Cleanup(w.Close)
+	return w
+}
+
+func (w *webhookServer) handle(rw http.ResponseWriter, r *http.Request) {
+	var a alert.Alert
+	err := json.NewDecoder(r.Body).Decode(&a)
+
+	w.mu.Lock()
+	status := w.statuses[min(w.requests, len(w.statuses)-1)]
+	w.requests++
+	if err == nil {
+		w.alerts = append(w.alerts, a)
+	}
+	w.headers = append(w.headers, r.Header.Clone())
+	w.mu.Unlock()
+
+	rw.WriteHeader(status)
+}
+
+func (w *webhookServer) count() int {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.requests
+}
+
+func testWebhook(t *testing.T, url string, retries int) *webhookNotifier {
+	n, err := newWebhookNotifier(NotifierConfig{
+		Type:    "webhook",
+		URL:     url,
+		Headers: map[string]string{"Authorization": "Bearer secret"},
+		Retries: retries,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	n.backoff = time.Millisecond
+	return n
+}
+
+var testAlert = alert.Alert{
+	Time:     time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC),
+	Type:     "port-scan",
+	Severity: alert.SeverityHigh,
+	Message:  "block scan from 203.0.113.7",
+	Protocol: "TCP",
+	SrcIP:    "203.0.113.7",
+	DstIP:    "10.0.0.1",
+	DstPort:  22,
+	Fields:   map[string]string{"kind": "block"},
+}
+
+func TestWebhookDelivers(t *testing.T) {
+	srv := newWebhookServer(t, http.StatusNoContent)
+	n := testWebhook(t, srv.URL, 3)
+
+	if err := n.Send(context.Background(), testAlert); err != nil {
+		t.Fatal(err)
+	}
+	if srv.count() != 1 {
+		t.Fatalf("%d requests, want 1", srv.count())
+	}
+	got := srv.alerts[0]
+	if got.Type != testAlert.Type || got.SrcIP != testAlert.SrcIP || got.DstPort != 22 ||
+		got.Fields["kind"] != "block" || !got.Time.Equal(testAlert.Time) {
+		t.Errorf("webhook got %+v", got)
+	}
+	h := srv.headers[0]
+	if h.Get("Content-Type") != "application/json" || h.Get("Authorization") != "Bearer secret" {
+		t.Errorf("unexpected headers %v", h)
+	}
+}
+
+func TestWebhookRetries(t *testing.T) {
+	srv := newWebhookServer(t, http.StatusServiceUnavailable, http.StatusBadGateway, http.StatusOK)
+	n := testWebhook(t, srv.URL, 3)
+
+	if err := n.Send(context.Background(), testAlert); err != nil {
+		t.Fatalf("delivery failed after retries: %v", err)
+	}
+	if srv.count() != 3 {
+		t.Errorf("%d requests, want 3", srv.count())
+	}
+	if len(srv.alerts) != 3 || srv.alerts[2].Message != testAlert.Message {
+		t.Errorf("retries didn't resend the alert: %+v", srv.alerts)
+	}
+}
+
+func TestWebhookGivesUp(t *testing.T) {
+	srv := newWebhookServer(t, http.StatusInternalServerError)
+	n := testWebhook(t, srv.URL, 2)
+
+	err := n.Send(context.Background(), testAlert)
+	if err == nil || err.Error() != "webhook answered 500 Internal Server Error" {
+		t.Fatalf("err = %v, want the last answer", err)
+	}
+	if srv.count() != 2 {
+		t.Errorf("%d requests, want 2", srv.count())
+	}
+}
+
+func TestWebhookRejectionIsFinal(t *testing.T) {
+	for _, status := range []int{http.StatusBadRequest, http.StatusUnauthorized, http.StatusNotFound, http.StatusTooManyRequests} {
+		srv := newWebhookServer(t, status, http.StatusOK)
+		err := testWebhook(t, srv.URL, 3).Send(context.Background(), testAlert)
+		if err == nil || retryable(err) {
+			t.Errorf("%d: err = %v, want a final error", status, err)
+		}
+		if srv.count() != 1 {
+			t.Errorf("%d: %d requests, want 1", status, srv.count())
+		}
+	}
+}
+
+func TestWebhookStopsRetryingOnCancel(t *testing.T) {
+	srv := newWebhookServer(t, http.StatusServiceUnavailable)
+	n := testWebhook(t, srv.URL, 5)
+	n.backoff = time.Hour
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if err := n.Send(ctx, testAlert); err == nil {
+		t.Fatal("Send succeeded against a failing webhook")
+	}
+	if time.Since(start) > 5*time.Second || srv.count() != 1 {
+		t.Errorf("took %s and %d requests after cancel", time.Since(start), srv.count())
+	}
+}
+
+func TestWebhookUnreachable(t *testing.T) {
+	srv := newWebhookServer(t, http.StatusOK)
+	url := srv.URL
+	srv.Close()
+
+	if err := testWebhook(t, url, 2).Send(context.Background(), testAlert); err == nil {
+		t.Fatal("Send succeeded against a closed server")
+	}
+}
+
+func TestEngineDelivery(t *testing.T) {
+	ok := newWebhookServer(t, http.StatusOK)
+	failing := newWebhookServer(t, http.StatusInternalServerError)
+
+	var errs atomic.Int32
+	e, err := New(Config{
+		Notifiers: []NotifierConfig{
+			{Type: "webhook", URL: ok.URL, MinSeverity: alert.SeverityMedium},
+			{Type: "webhook", URL: failing.URL, Retries: 1},
+		},
+	}, func(alert.Alert) {}, func(error) { errs.Add(1) })
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go e.Run(ctx)
+
+	low := testAlert
+	low.Severity = alert.SeverityLow
+	low.DstPort = 23
+	e.Notify(testAlert)
+	e.Notify(testAlert) // duplicate
+	e.Notify(low)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for e.Stats().Delivered+e.Stats().Failed < 3 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	cancel()
+	e.Close(5 * time.Second)
+
+	if ok.count() != 1 {
+		t.Errorf("medium webhook got %d alerts, want only the high one", ok.count())
+	}
+	if failing.count() != 2 {
+		t.Errorf("failing webhook got %d requests, want 2", failing.count())
+	}
+	stats := e.Stats()
+	want := Stats{Raised: 3, Suppressed: 1, Delivered: 1, Failed: 2}
+	if stats != want {
+		t.Errorf("stats = %+v, want %+v", stats, want)
+	}
+	if errs.Load() != 2 {
+		t.Errorf("%d errors reported, want 2", errs.Load())
+	}
+}
+
+// A webhook backing off doesn't hold up the other notifiers.
+func TestEngineNotifiersDontWait(t *testing.T) {
+	down := newWebhookServer(t, http.StatusServiceUnavailable)
+	path := filepath.Join(t.TempDir(), "alerts.jsonl")
+
+	e, err := New(Config{
+		Notifiers: []NotifierConfig{
+			{Type: "webhook", URL: down.URL, Retries: 10},
+			{Type: "file", Path: path},
+		},
+	}, func(alert.Alert) {}, func(error) {})
+	if err != nil {
+		t.Fatal(err)
+	}
+	e.notifiers[0].n.(*webhookNotifier).backoff = time.Hour
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go e.Run(ctx)
+	for port := range uint16(3) {
+		a := testAlert
+		a.DstPort = port
+		e.Notify(a)
+	}
+
+	lines := 0
+	deadline := time.Now().Add(5 * time.Second)
+	for lines < 3 && time.Now().Before(deadline) {
+		data, _ := os.ReadFile(path)
+		lines = strings.Count(string(data), "\n")
+		time.Sleep(10 * time.Millisecond)
+	}
+	cancel()
+	e.Close(10 * time.Second)
+
+	if lines != 3 {
+		t.Errorf("file got %d alerts while the webhook was retrying, want 3", lines)
+	}
+	if down.count() < 1 {
+		t.Error("webhook never tried")
+	}
+	if stats := e.Stats(); stats.Delivered != 3 || stats.Failed < 1 {
+		t.Errorf("stats = %+v", stats)
+	}
+}
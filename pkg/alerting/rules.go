@@ -0,0 +1,423 @@
+package alerting
+
+import (
+	"encoding/json"
+	"fmt"
+	"kernelKoala/pkg/alert"
+	"net/netip"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Sources a rule can be evaluated against.
+const (
+	SourcePacket = "packet"
+	SourceFlow   = "flow"
+	SourceAlert  = "alert"
+)
+
+// Record exposes the fields of a packet, flow or alert to the rules.
+type Record interface {
+	Field(name string) (string, bool)
+}
+
+// Fields is a Record backed by a map.
+type Fields map[string]string
+
+func (f Fields) Field(name string) (string, bool) {
+	v, ok := f[name]
+	return v, ok
+}
+
+// Duration is a time.Duration written as "30s" in the config.
+type Duration time.Duration
+
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return fmt.Errorf("duration must be a string like \"30s\"")
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(v)
+	return nil
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+// Condition compares one field of a record. Op is one of eq (default),
+// ne, in, not_in, gt, gte, lt, lte, cidr, contains and regex.
+type Condition struct {
+	Field  string   `json:"field"`
+	Op     string   `json:"op"`
+	Value  string   `json:"value"`
+	Values []string `json:"values"`
+}
+
+// Rule raises an alert when Threshold records matching all conditions are
+// seen within Window, counted separately per GroupBy key. A rule fires
+// again for the same group only after Cooldown.
+type Rule struct {
+	Name      string         `json:"name"`
+	Source    string         `json:"source"`
+	Severity  alert.Severity `json:"severity"`
+	Message   string         `json:"message"`
+	When      []Condition    `json:"when"`
+	Threshold int            `json:"threshold"`
+	Window    Duration       `json:"window"`
+	GroupBy   []string       `json:"group_by"`
+	Cooldown  Duration       `json:"cooldown"`
+}
+
+type matcher func(Record) bool
+
+func compileCondition(c Condition) (matcher, error) {
+	if c.Field == "" {
+		return nil, fmt.Errorf("condition without field")
+	}
+	field := c.Field
+	get := func(r Record) (string, bool) { return r.Field(field) }
+
+	switch c.Op {
+	case "", "eq":
+		return func(r Record) bool { v, ok := get(r); return ok && strings.EqualFold(v, c.Value) }, nil
+	case "ne":
+		return func(r Record) bool { v, _ := get(r); return !strings.EqualFold(v, c.Value) }, nil
+	case "in", "not_in":
+		set := make(map[string]bool, len(c.Values))
+		for _, v := range c.Values {
+			set[strings.ToLower(v)] = true
+		}
+		want := c.Op == "in"
+		return func(r Record) bool { v, _ := get(r); return set[strings.ToLower(v)] == want }, nil
+	case "gt", "gte", "lt", "lte":
+		limit, err := strconv.ParseFloat(c.Value, 64)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %q is not a number", c.Op, c.Value)
+		}
+		op := c.Op
+		return func(r Record) bool {
+			v, ok := get(r)
+			if !ok {
+				return false
+			}
+			n, err := strconv.ParseFloat(v, 64)
+			if err != nil {
+				return false
+			}
+			switch op {
+			case "gt":
+				return n > limit
+			case "gte":
+				return n >= limit
+			case "lt":
+				return n < limit
+			default:
+				return n <= limit
+			}
+		}, nil
+	case "cidr":
+		values := c.Values
+		if c.Value != "" {
+			values = append(values, c.Value)
+		}
+		var prefixes []netip.Prefix
+		for _, v := range values {
+			p, err := netip.ParsePrefix(v)
+			if err != nil {
+				return nil, fmt.Errorf("cidr: %v", err)
+			}
+			prefixes = append(prefixes, p)
+		}
+		return func(r Record) bool {
+			v, _ := get(r)
+			addr, err := netip.ParseAddr(v)
+			if err != nil {
+				return false
+			}
+			for _, p := range prefixes {
+				if p.Contains(addr) {
+					return true
+				}
+			}
+			return false
+		}, nil
+	case "contains":
+		return func(r Record) bool { v, _ := get(r); return strings.Contains(v, c.Value) }, nil
+	case "regex":
+		re, err := regexp.Compile(c.Value)
+		if err != nil {
+			return nil, fmt.Errorf("regex: %v", err)
+		}
+		return func(r Record) bool { v, ok := get(r); return ok && re.MatchString(v) }, nil
+	default:
+		return nil, fmt.Errorf("unknown op %q", c.Op)
+	}
+}
+
+// Filter matches records that satisfy all of its conditions, an empty
+// filter matches everything.
+type Filter []matcher
+
+func NewFilter(conds []Condition) (Filter, error) {
+	f := make(Filter, 0, len(conds))
+	for _, c := range conds {
+		m, err := compileCondition(c)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", c.Field, err)
+		}
+		f = append(f, m)
+	}
+	return f, nil
+}
+
+func (f Filter) Match(r Record) bool {
+	for _, m := range f {
+		if !m(r) {
+			return false
+		}
+	}
+	return true
+}
+
+// ParseCondition reads the short form field=value used on command lines
+// and in query strings. The value is compared for equality unless it
+// starts with >, >=, <, <=, ! or ~ (regex), lists separated by commas match
+// any of their items and *_ip fields accept CIDRs.
+func ParseCondition(field, value string) Condition {
+	for _, op := range []struct{ prefix, op string }{
+		{">=", "gte"}, {"<=", "lte"}, {">", "gt"}, {"<", "lt"}, {"!", "ne"}, {"~", "regex"},
+	} {
+		if strings.HasPrefix(value, op.prefix) {
+			return Condition{Field: field, Op: op.op, Value: strings.TrimPrefix(value, op.prefix)}
+		}
+	}
+	if strings.HasSuffix(field, "_ip") && strings.Contains(value, "/") {
+		return Condition{Field: field, Op: "cidr", Values: splitList(value)}
+	}
+	if strings.Contains(value, ",") {
+		return Condition{Field: field, Op: "in", Values: splitList(value)}
+	}
+	return Condition{Field: field, Value: value}
+}
+
+// Conditions collects repeated field=value flags such as -where, each
+// read with ParseCondition.
+type Conditions []Condition
+
+func (c *Conditions) String() string { return "" }
+
+func (c *Conditions) Set(v string) error {
+	field, value, ok := strings.Cut(v, "=")
+	if !ok || field == "" {
+		return fmt.Errorf("expected field=value, got %q", v)
+	}
+	*c = append(*c, ParseCondition(field, value))
+	return nil
+}
+
+func splitList(s string) []string {
+	var out []string
+	for _, v := range strings.Split(s, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			out = append(out, v)
+		}
+	}
+	return out
+}
+
+// AlertRecord exposes an alert with the fields rules with source "alert"
+// see.
+func AlertRecord(a alert.Alert) Record { return alertRecord(a) }
+
+type ruleGroup struct {
+	// times holds the last Threshold match times, oldest first
+	times    []time.Time
+	lastFire time.Time
+}
+
+// ruleState is a compiled rule with its per-group counters.
+type ruleState struct {
+	rule     Rule
+	matchers []matcher
+
+	mu     sync.Mutex
+	groups map[string]*ruleGroup
+}
+
+const maxRuleGroups = 10000
+
+func compileRule(r Rule) (*ruleState, error) {
+	if r.Name == "" {
+		return nil, fmt.Errorf("rule without name")
+	}
+	switch r.Source {
+	case SourcePacket, SourceFlow, SourceAlert:
+	case "":
+		r.Source = SourcePacket
+	default:
+		return nil, fmt.Errorf("rule %s: unknown source %q", r.Name, r.Source)
+	}
+	if r.Severity == "" {
+		r.Severity = alert.SeverityMedium
+	}
+	if r.Severity.Rank() == 0 {
+		return nil, fmt.Errorf("rule %s: unknown severity %q", r.Name, r.Severity)
+	}
+	if r.Threshold < 1 {
+		r.Threshold = 1
+	}
+	if r.Threshold > 1 && r.Window <= 0 {
+		return nil, fmt.Errorf("rule %s: a threshold needs a window", r.Name)
+	}
+
+	s := &ruleState{rule: r, groups: make(map[string]*ruleGroup)}
+	for _, c := range r.When {
+		m, err := compileCondition(c)
+		if err != nil {
+			return nil, fmt.Errorf("rule %s: %v", r.Name, err)
+		}
+		s.matchers = append(s.matchers, m)
+	}
+	return s, nil
+}
+
+// observe counts a matching record and returns the alert when the rule
+// fires.
+func (s *ruleState) observe(r Record, now time.Time) (alert.Alert, bool) {
+	for _, m := range s.matchers {
+		if !m(r) {
+			return alert.Alert{}, false
+		}
+	}
+
+	keyParts := make([]string, len(s.rule.GroupBy))
+	for i, f := range s.rule.GroupBy {
+		keyParts[i], _ = r.Field(f)
+	}
+	key := strings.Join(keyParts, "|")
+
+	s.mu.Lock()
+	g := s.groups[key]
+	if g == nil {
+		if len(s.groups) >= maxRuleGroups {
+			s.mu.Unlock()
+			return alert.Alert{}, false
+		}
+		g = &ruleGroup{}
+		s.groups[key] = g
+	}
+
+	if len(g.times) == s.rule.Threshold {
+		g.times = g.times[1:]
+	}
+	g.times = append(g.times, now)
+	window := time.Duration(s.rule.Window)
+	fire := len(g.times) == s.rule.Threshold &&
+		(s.rule.Threshold == 1 || now.Sub(g.times[0]) <= window) &&
+		(g.lastFire.IsZero() || now.Sub(g.lastFire) >= time.Duration(s.rule.Cooldown))
+	if fire {
+		g.lastFire = now
+		g.times = g.times[:0]
+	}
+	s.mu.Unlock()
+
+	if !fire {
+		return alert.Alert{}, false
+	}
+	return s.alert(r, keyParts, now), true
+}
+
+func (s *ruleState) alert(r Record, keyParts []string, now time.Time) alert.Alert {
+	fields := map[string]string{"rule": s.rule.Name}
+	for i, f := range s.rule.GroupBy {
+		fields[f] = keyParts[i]
+	}
+	message := s.rule.Message
+	if s.rule.Threshold > 1 {
+		fields["count"] = strconv.Itoa(s.rule.Threshold)
+		fields["window"] = time.Duration(s.rule.Window).String()
+		if message == "" {
+			message = fmt.Sprintf("rule %s matched %d times within %s", s.rule.Name, s.rule.Threshold, time.Duration(s.rule.Window))
+		}
+	}
+	if message == "" {
+		message = "rule " + s.rule.Name + " matched"
+	}
+
+	a := alert.Alert{
+		Time:     now,
+		Type:     s.rule.Name,
+		Severity: s.rule.Severity,
+		Message:  message,
+		Fields:   fields,
+	}
+	a.Protocol, _ = r.Field("protocol")
+	a.SrcIP, _ = r.Field("src_ip")
+	a.DstIP, _ = r.Field("dst_ip")
+	a.Iface, _ = r.Field("iface")
+	if v, ok := r.Field("src_port"); ok {
+		port, _ := strconv.ParseUint(v, 10, 16)
+		a.SrcPort = uint16(port)
+	}
+	if v, ok := r.Field("dst_port"); ok {
+		port, _ := strconv.ParseUint(v, 10, 16)
+		a.DstPort = uint16(port)
+	}
+	return a
+}
+
+// expire forgets groups that can neither fire nor are cooling down.
+func (s *ruleState) expire(now time.Time) {
+	keep := time.Duration(s.rule.Window)
+	if c := time.Duration(s.rule.Cooldown); c > keep {
+		keep = c
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for key, g := range s.groups {
+		last := g.lastFire
+		if n := len(g.times); n > 0 && g.times[n-1].After(last) {
+			last = g.times[n-1]
+		}
+		if now.Sub(last) > keep {
+			delete(s.groups, key)
+		}
+	}
+}
+
+// alertRecord exposes an alert to rules with source "alert".
+type alertRecord alert.Alert
+
+func (a alertRecord) Field(name string) (string, bool) {
+	switch name {
+	case "type":
+		return a.Type, true
+	case "severity":
+		return string(a.Severity), true
+	case "message":
+		return a.Message, true
+	case "protocol":
+		return a.Protocol, a.Protocol != ""
+	case "src_ip":
+		return a.SrcIP, a.SrcIP != ""
+	case "dst_ip":
+		return a.DstIP, a.DstIP != ""
+	case "src_port":
+		return strconv.Itoa(int(a.SrcPort)), a.SrcPort != 0
+	case "dst_port":
+		return strconv.Itoa(int(a.DstPort)), a.DstPort != 0
+	case "iface":
+		return a.Iface, a.Iface != ""
+	}
+	v, ok := a.Fields[name]
+	return v, ok
+}
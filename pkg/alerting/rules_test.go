@@ -0,0 +1,246 @@
+package alerting
+
+import (
+	"flag"
+	"io"
+	"kernelKoala/pkg/alert"
+	"reflect"
+	"testing"
+	"time"
+)
+
+var ruleT0 = time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+
+func mustCompile(t *testing.T, r Rule) *ruleState {
+	t.Helper()
+	s, err := compileRule(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+// feed observes the records at the given offsets from ruleT0 and returns
+// the alerts that fired.
+func feed(s *ruleState, records []Fields, offsets ...time.Duration) []alert.Alert {
+	var out []alert.Alert
+	for i, off := range offsets {
+		if a, ok := s.observe(records[i%len(records)], ruleT0.Add(off)); ok {
+			out = append(out, a)
+		}
+	}
+	return out
+}
+
+func sshAttempt(src string) Fields {
+	return Fields{"protocol": "TCP", "src_ip": src, "dst_ip": "10.0.0.1", "dst_port": "22", "tcp_flags": "SYN"}
+}
+
+func TestRuleWindow(t *testing.T) {
+	rule := Rule{
+		Name:      "ssh-bruteforce",
+		Severity:  alert.SeverityHigh,
+		When:      []Condition{{Field: "dst_port", Value: "22"}},
+		Threshold: 3,
+		Window:    Duration(10 * time.Second),
+	}
+	records := []Fields{sshAttempt("203.0.113.7")}
+
+	// Three matches spread over more than the window never fire
+	if alerts := feed(mustCompile(t, rule), records, 0, 6*time.Second, 12*time.Second, 18*time.Second); len(alerts) != 0 {
+		t.Fatalf("fired %d times for matches spread out", len(alerts))
+	}
+
+	// The oldest match slides out, the next three within the window fire
+	alerts := feed(mustCompile(t, rule), records, 0, 20*time.Second, 25*time.Second, 30*time.Second)
+	if len(alerts) != 1 {
+		t.Fatalf("fired %d times, want 1", len(alerts))
+	}
+	a := alerts[0]
+	if a.Type != "ssh-bruteforce" || a.Severity != alert.SeverityHigh || !a.Time.Equal(ruleT0.Add(30*time.Second)) {
+		t.Errorf("unexpected alert %+v", a)
+	}
+	if a.Fields["count"] != "3" || a.Fields["window"] != "10s" || a.Fields["rule"] != "ssh-bruteforce" {
+		t.Errorf("unexpected fields %v", a.Fields)
+	}
+	if a.SrcIP != "203.0.113.7" || a.DstPort != 22 || a.Protocol != "TCP" {
+		t.Errorf("endpoints not taken from the record: %+v", a)
+	}
+}
+
+func TestRuleConditionsMustAllMatch(t *testing.T) {
+	s := mustCompile(t, Rule{
+		Name: "telnet-from-outside",
+		When: []Condition{
+			{Field: "dst_port", Op: "in", Values: []string{"23", "2323"}},
+			{Field: "src_ip", Op: "cidr", Values: []string{"10.0.0.0/8"}},
+		},
+	})
+	if _, ok := s.observe(Fields{"dst_port": "2323", "src_ip": "203.0.113.7"}, ruleT0); ok {
+		t.Error("fired with one condition failing")
+	}
+	if _, ok := s.observe(Fields{"dst_port": "23", "src_ip": "10.1.2.3"}, ruleT0); !ok {
+		t.Error("didn't fire with all conditions matching")
+	}
+}
+
+func TestRuleGroupBy(t *testing.T) {
+	s := mustCompile(t, Rule{
+		Name:      "ssh-bruteforce",
+		When:      []Condition{{Field: "dst_port", Value: "22"}},
+		Threshold: 2,
+		Window:    Duration(time.Minute),
+		GroupBy:   []string{"src_ip"},
+	})
+
+	// Two sources interleaved, each on its own counter
+	records := []Fields{sshAttempt("203.0.113.7"), sshAttempt("198.51.100.9")}
+	alerts := feed(s, records, 0, time.Second, 2*time.Second, 3*time.Second)
+	if len(alerts) != 2 {
+		t.Fatalf("fired %d times, want once per source", len(alerts))
+	}
+	if alerts[0].Fields["src_ip"] != "203.0.113.7" || alerts[1].Fields["src_ip"] != "198.51.100.9" {
+		t.Errorf("group values missing from %v and %v", alerts[0].Fields, alerts[1].Fields)
+	}
+
+	// Without grouping the matches of both sources add up
+	s = mustCompile(t, Rule{
+		Name:      "ssh-bruteforce",
+		When:      []Condition{{Field: "dst_port", Value: "22"}},
+		Threshold: 3,
+		Window:    Duration(time.Minute),
+	})
+	if alerts := feed(s, records, 0, time.Second, 2*time.Second, 3*time.Second); len(alerts) != 1 {
+		t.Fatalf("ungrouped rule fired %d times, want 1", len(alerts))
+	}
+}
+
+func TestRuleCooldown(t *testing.T) {
+	s := mustCompile(t, Rule{
+		Name:     "ssh",
+		When:     []Condition{{Field: "dst_port", Value: "22"}},
+		Cooldown: Duration(time.Minute),
+		GroupBy:  []string{"src_ip"},
+	})
+	a, b := sshAttempt("203.0.113.7"), sshAttempt("198.51.100.9")
+
+	steps := []struct {
+		at   time.Duration
+		rec  Fields
+		fire bool
+	}{
+		{0, a, true},
+		{10 * time.Second, a, false},
+		{10 * time.Second, b, true}, // other group
+		{59 * time.Second, a, false},
+		{time.Minute, a, true},
+		{90 * time.Second, a, false},
+	}
+	for _, step := range steps {
+		if _, fired := s.observe(step.rec, ruleT0.Add(step.at)); fired != step.fire {
+			t.Errorf("at %s from %s: fired=%v, want %v", step.at, step.rec["src_ip"], fired, step.fire)
+		}
+	}
+}
+
+func TestRuleExpire(t *testing.T) {
+	s := mustCompile(t, Rule{
+		Name:      "ssh-bruteforce",
+		Threshold: 5,
+		Window:    Duration(10 * time.Second),
+		Cooldown:  Duration(time.Minute),
+		GroupBy:   []string{"src_ip"},
+	})
+	s.observe(sshAttempt("203.0.113.7"), ruleT0)
+
+	s.expire(ruleT0.Add(30 * time.Second))
+	if len(s.groups) != 1 {
+		t.Fatal("group dropped while within the cooldown")
+	}
+	s.expire(ruleT0.Add(2 * time.Minute))
+	if len(s.groups) != 0 {
+		t.Fatal("idle group kept")
+	}
+}
+
+func TestCompileRuleErrors(t *testing.T) {
+	for _, r := range []Rule{
+		{},
+		{Name: "x", Source: "dns"},
+		{Name: "x", Severity: "urgent"},
+		{Name: "x", Threshold: 2},
+		{Name: "x", When: []Condition{{Field: "dst_port", Op: "gt", Value: "many"}}},
+		{Name: "x", When: []Condition{{Field: "src_ip", Op: "cidr", Value: "10.0.0.0/33"}}},
+	} {
+		if _, err := compileRule(r); err == nil {
+			t.Errorf("rule %+v compiled", r)
+		}
+	}
+}
+
+func TestEngineRulesAndDedup(t *testing.T) {
+	var raised []alert.Alert
+	var e *Engine
+	e, err := New(Config{
+		Rules: []Rule{{
+			Name:   "critical-scan",
+			Source: SourceAlert,
+			When: []Condition{
+				{Field: "type", Value: "port-scan"},
+				{Field: "kind", Value: "block"},
+			},
+			Severity: alert.SeverityCritical,
+			GroupBy:  []string{"src_ip"},
+			Cooldown: Duration(time.Hour),
+		}},
+		Dedup: Duration(time.Minute),
+	}, func(a alert.Alert) {
+		raised = append(raised, a)
+		e.Notify(a)
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !e.Wants(SourceAlert) || e.Wants(SourcePacket) {
+		t.Error("Wants doesn't follow the rule sources")
+	}
+
+	e.Notify(testAlert)
+	e.Notify(testAlert)
+	later := testAlert
+	later.Time = later.Time.Add(2 * time.Minute)
+	e.Notify(later)
+
+	if len(raised) != 1 || raised[0].Severity != alert.SeverityCritical || raised[0].SrcIP != testAlert.SrcIP {
+		t.Fatalf("rule raised %+v, want one critical alert", raised)
+	}
+	// Three detector alerts, one a repeat, plus the rule alert
+	want := Stats{Raised: 4, Suppressed: 1}
+	if stats := e.Stats(); stats != want {
+		t.Errorf("stats = %+v, want %+v", stats, want)
+	}
+}
+
+func TestConditionsFlag(t *testing.T) {
+	var where Conditions
+	fs := flag.NewFlagSet("query", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	fs.Var(&where, "where", "")
+	if err := fs.Parse([]string{"-where", "dst_port=443", "-where", "bytes=>=1000", "-where", "src_ip=10.0.0.0/8,192.168.0.0/16"}); err != nil {
+		t.Fatal(err)
+	}
+	want := Conditions{
+		{Field: "dst_port", Value: "443"},
+		{Field: "bytes", Op: "gte", Value: "1000"},
+		{Field: "src_ip", Op: "cidr", Values: []string{"10.0.0.0/8", "192.168.0.0/16"}},
+	}
+	if !reflect.DeepEqual(where, want) {
+		t.Errorf("conditions %+v, want %+v", where, want)
+	}
+
+	for _, bad := range []string{"dst_port", "=443"} {
+		if err := where.Set(bad); err == nil {
+			t.Errorf("%q accepted", bad)
+		}
+	}
+}
@@ -0,0 +1,206 @@
+// Package auth secures the agent API and the streams to the Koala Server:
+// TLS certificates that are reloaded from disk while in use and bearer
+// tokens limited to scopes.
+package auth
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Certs holds a certificate with its key and an optional CA bundle. The
+// tls.Configs it hands out always use the files' current contents, so
+// renewed certificates are picked up without a restart.
+type Certs struct {
+	certFile, keyFile, caFile string
+
+	cert atomic.Pointer[tls.Certificate]
+	pool atomic.Pointer[x509.CertPool]
+	// modified holds the mtime and size of every file at the last load
+	modified string
+
+	errors func(error)
+	stop   chan struct{}
+	once   sync.Once
+}
+
+// LoadCerts reads certFile and keyFile, which may be empty for clients
+// without a certificate, and caFile, which may be empty to use the system
+// roots on clients and to not ask for client certificates on servers.
+//
+// The files are checked for changes every reloadInterval. Failed reloads
+// are passed to onError and the previous certificates stay in use.
+func LoadCerts(certFile, keyFile, caFile string, reloadInterval time.Duration, onError func(error)) (*Certs, error) {
+	if (certFile == "") != (keyFile == "") {
+		return nil, fmt.Errorf("a certificate needs both the certificate and the key file")
+	}
+	c := &Certs{
+		certFile: certFile,
+		keyFile:  keyFile,
+		caFile:   caFile,
+		errors:   onError,
+		stop:     make(chan struct{}),
+	}
+	if _, err := c.load(); err != nil {
+		return nil, err
+	}
+	if reloadInterval > 0 {
+		go c.watch(reloadInterval)
+	}
+	return c, nil
+}
+
+// load reads the files if any of them changed since the last load.
+func (c *Certs) load() (bool, error) {
+	modified := ""
+	for _, path := range []string{c.certFile, c.keyFile, c.caFile} {
+		if path == "" {
+			continue
+		}
+		st, err := os.Stat(path)
+		if err != nil {
+			return false, err
+		}
+		modified += fmt.Sprintf("%s:%d:%d;", path, st.ModTime().UnixNano(), st.Size())
+	}
+	if modified == c.modified {
+		return false, nil
+	}
+
+	var cert *tls.Certificate
+	if c.certFile != "" {
+		pair, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+		if err != nil {
+			return false, fmt.Errorf("loading %s: %v", c.certFile, err)
+		}
+		cert = &pair
+	}
+	var pool *x509.CertPool
+	if c.caFile != "" {
+		pem, err := os.ReadFile(c.caFile)
+		if err != nil {
+			return false, err
+		}
+		pool = x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return false, fmt.Errorf("%s: no certificates found", c.caFile)
+		}
+	}
+
+	c.cert.Store(cert)
+	c.pool.Store(pool)
+	c.modified = modified
+	return true, nil
+}
+
+func (c *Certs) watch(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-c.stop:
+			return
+		case <-ticker.C:
+			if _, err := c.load(); err != nil && c.errors != nil {
+				c.errors(err)
+			}
+		}
+	}
+}
+
+// Close stops watching the files.
+func (c *Certs) Close() {
+	c.once.Do(func() { close(c.stop) })
+}
+
+// ServerConfig presents the certificate and, when a CA bundle was given,
+// requires clients to present a certificate it signed.
+func (c *Certs) ServerConfig() *tls.Config {
+	cfg := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+			cert := c.cert.Load()
+			if cert == nil {
+				return nil, errors.New("no server certificate configured")
+			}
+			return cert, nil
+		},
+	}
+	if c.caFile != "" {
+		// The chain is verified by hand against the current bundle,
+		// ClientCAs would keep the bundle of the first load
+		cfg.ClientAuth = tls.RequireAnyClientCert
+		cfg.VerifyConnection = func(cs tls.ConnectionState) error {
+			return c.verify(cs.PeerCertificates, "", x509.ExtKeyUsageClientAuth)
+		}
+	}
+	return cfg
+}
+
+// ClientConfig presents the certificate, if any, and verifies the server
+// against the CA bundle, or the system roots without one. With a bundle
+// the connection must name the server, its certificate is checked against
+// that name.
+func (c *Certs) ClientConfig() *tls.Config {
+	cfg := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetClientCertificate: func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			if cert := c.cert.Load(); cert != nil {
+				return cert, nil
+			}
+			return &tls.Certificate{}, nil
+		},
+	}
+	if c.caFile != "" {
+		// Verification happens in VerifyConnection against the current
+		// bundle instead of a RootCAs fixed at creation
+		cfg.InsecureSkipVerify = true
+		cfg.VerifyConnection = func(cs tls.ConnectionState) error {
+			if cs.ServerName == "" {
+				return errors.New("no server name to verify the server certificate against")
+			}
+			return c.verify(cs.PeerCertificates, cs.ServerName, x509.ExtKeyUsageServerAuth)
+		}
+	}
+	return cfg
+}
+
+func (c *Certs) verify(chain []*x509.Certificate, name string, usage x509.ExtKeyUsage) error {
+	if len(chain) == 0 {
+		return errors.New("no certificate presented")
+	}
+	opts := x509.VerifyOptions{
+		Roots:         c.pool.Load(),
+		Intermediates: x509.NewCertPool(),
+		DNSName:       name,
+		KeyUsages:     []x509.ExtKeyUsage{usage},
+	}
+	for _, cert := range chain[1:] {
+		opts.Intermediates.AddCert(cert)
+	}
+	_, err := chain[0].Verify(opts)
+	return err
+}
+
+// PeerName identifies the other end of a connection by the common name of
+// its certificate, or its first DNS name, empty without a certificate.
+func PeerName(cs *tls.ConnectionState) string {
+	if cs == nil || len(cs.PeerCertificates) == 0 {
+		return ""
+	}
+	cert := cs.PeerCertificates[0]
+	if cert.Subject.CommonName != "" {
+		return cert.Subject.CommonName
+	}
+	if len(cert.DNSNames) > 0 {
+		return cert.DNSNames[0]
+	}
+	return ""
+}
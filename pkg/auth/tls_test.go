@@ -0,0 +1,145 @@
+package auth
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writePKI writes a CA and a certificate it signed for name, usable by
+// servers and clients, and returns the paths of the CA, certificate and key.
+func writePKI(t *testing.T, name string) (ca, cert, key string) {
+	dir := t.TempDir()
+	write := func(file, typ string, der []byte) string {
+		path := filepath.Join(dir, file)
+		if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: typ, Bytes: der}), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+
+	caKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	caTmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, caTmpl, caTmpl, &caKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caCert, _ := x509.ParseCertificate(caDER)
+
+	leafKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	leafDER, err := x509.CreateCertificate(rand.Reader, &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     []string{name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}, caCert, &leafKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, _ := x509.MarshalECPrivateKey(leafKey)
+	return write("ca.pem", "CERTIFICATE", caDER), write("cert.pem", "CERTIFICATE", leafDER), write("key.pem", "EC PRIVATE KEY", keyDER)
+}
+
+func loadTestCerts(t *testing.T, cert, key, ca string) *Certs {
+	c, err := LoadCerts(cert, key, ca, 0, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+// handshake connects a client with the given config to a server over
+// loopback and returns the errors of both ends.
+func handshake(t *testing.T, server, client *tls.Config) (serverErr, clientErr error) {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lis.Close()
+
+	errs := make(chan error, 1)
+	go func() {
+		conn, err := lis.Accept()
+		if err != nil {
+			errs <- err
+			return
+		}
+		defer conn.Close()
+		errs <- tls.Server(conn, server).Handshake()
+	}()
+
+	// Not tls.Dial, it would fill in a missing server name from the address
+	raw, err := net.Dial("tcp", lis.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn := tls.Client(raw, client)
+	defer conn.Close()
+	if clientErr = conn.Handshake(); clientErr == nil {
+		// With TLS 1.3 the client is done before the server checked its
+		// certificate, reading takes the server's verdict
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		conn.Read(make([]byte, 1))
+	}
+	return <-errs, clientErr
+}
+
+func TestClientVerifiesServerName(t *testing.T) {
+	ca, cert, key := writePKI(t, "koala.example")
+	server := loadTestCerts(t, cert, key, "").ServerConfig()
+	client := loadTestCerts(t, "", "", ca)
+
+	for _, tc := range []struct {
+		name string
+		ok   bool
+	}{
+		{"koala.example", true},
+		{"other.example", false},
+		{"", false}, // nothing to check the certificate against
+	} {
+		cfg := client.ClientConfig()
+		cfg.ServerName = tc.name
+		_, err := handshake(t, server, cfg)
+		if (err == nil) != tc.ok {
+			t.Errorf("server name %q: err = %v, want ok=%v", tc.name, err, tc.ok)
+		}
+	}
+}
+
+func TestServerRequiresClientCertificate(t *testing.T) {
+	ca, cert, key := writePKI(t, "node-a")
+	server := loadTestCerts(t, cert, key, ca).ServerConfig()
+
+	cfg := loadTestCerts(t, cert, key, ca).ClientConfig()
+	cfg.ServerName = "node-a"
+	if serverErr, clientErr := handshake(t, server, cfg); serverErr != nil || clientErr != nil {
+		t.Fatalf("client with a certificate: %v, %v", serverErr, clientErr)
+	}
+
+	cfg = loadTestCerts(t, "", "", ca).ClientConfig()
+	cfg.ServerName = "node-a"
+	if serverErr, _ := handshake(t, server, cfg); serverErr == nil {
+		t.Error("server accepted a client without a certificate")
+	}
+}
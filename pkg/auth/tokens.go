@@ -0,0 +1,175 @@
+package auth
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Scopes a token can be granted.
+const (
+	ScopeStatsRead    = "stats:read"
+	ScopeEventsStream = "events:stream"
+	ScopeFiltersWrite = "filters:write"
+	// ScopeAll grants every scope.
+	ScopeAll = "*"
+)
+
+var knownScopes = []string{ScopeStatsRead, ScopeEventsStream, ScopeFiltersWrite, ScopeAll}
+
+// Token is a named API client with the scopes it was granted.
+type Token struct {
+	Name   string
+	Scopes []string
+}
+
+// Allows reports whether the token was granted scope.
+func (t Token) Allows(scope string) bool {
+	return slices.Contains(t.Scopes, scope) || slices.Contains(t.Scopes, ScopeAll)
+}
+
+type tokenEntry struct {
+	Token
+	hash [sha256.Size]byte
+}
+
+// Tokens holds the bearer tokens of a token file.
+type Tokens struct {
+	path    string
+	modTime time.Time
+	size    int64
+	entries atomic.Pointer[[]tokenEntry]
+
+	errors func(error)
+	stop   chan struct{}
+	once   sync.Once
+}
+
+// LoadTokens reads a file of "name token scope[,scope...]" lines, # starts
+// a comment. Scopes are stats:read, events:stream, filters:write or * for
+// all of them.
+//
+// The file is checked for changes every reloadInterval. Failed reloads are
+// passed to onError and the previous tokens stay valid.
+func LoadTokens(path string, reloadInterval time.Duration, onError func(error)) (*Tokens, error) {
+	t := &Tokens{path: path, errors: onError, stop: make(chan struct{})}
+	if _, err := t.load(); err != nil {
+		return nil, err
+	}
+	if reloadInterval > 0 {
+		go t.watch(reloadInterval)
+	}
+	return t, nil
+}
+
+func (t *Tokens) load() (bool, error) {
+	st, err := os.Stat(t.path)
+	if err != nil {
+		return false, err
+	}
+	if st.ModTime().Equal(t.modTime) && st.Size() == t.size {
+		return false, nil
+	}
+
+	file, err := os.Open(t.path)
+	if err != nil {
+		return false, err
+	}
+	defer file.Close()
+
+	var entries []tokenEntry
+	names := make(map[string]bool)
+	scanner := bufio.NewScanner(file)
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		line, _, _ := strings.Cut(scanner.Text(), "#")
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) != 3 {
+			return false, fmt.Errorf("%s:%d: expected \"name token scopes\"", t.path, lineNo)
+		}
+		if names[fields[0]] {
+			return false, fmt.Errorf("%s:%d: duplicate token name %q", t.path, lineNo, fields[0])
+		}
+		names[fields[0]] = true
+
+		e := tokenEntry{Token: Token{Name: fields[0]}, hash: sha256.Sum256([]byte(fields[1]))}
+		for _, scope := range strings.Split(fields[2], ",") {
+			if !slices.Contains(knownScopes, scope) {
+				return false, fmt.Errorf("%s:%d: unknown scope %q", t.path, lineNo, scope)
+			}
+			e.Scopes = append(e.Scopes, scope)
+		}
+		entries = append(entries, e)
+	}
+	if err := scanner.Err(); err != nil {
+		return false, err
+	}
+
+	t.entries.Store(&entries)
+	t.modTime = st.ModTime()
+	t.size = st.Size()
+	return true, nil
+}
+
+func (t *Tokens) watch(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-t.stop:
+			return
+		case <-ticker.C:
+			if _, err := t.load(); err != nil && t.errors != nil {
+				t.errors(err)
+			}
+		}
+	}
+}
+
+// Len is the number of tokens loaded.
+func (t *Tokens) Len() int {
+	return len(*t.entries.Load())
+}
+
+// Lookup returns the token matching secret. Every token is compared in
+// constant time so the timing doesn't tell how close a guess was.
+func (t *Tokens) Lookup(secret string) (Token, bool) {
+	hash := sha256.Sum256([]byte(secret))
+	var found *tokenEntry
+	entries := *t.entries.Load()
+	for i := range entries {
+		if subtle.ConstantTimeCompare(hash[:], entries[i].hash[:]) == 1 {
+			found = &entries[i]
+		}
+	}
+	if found == nil {
+		return Token{}, false
+	}
+	return found.Token, true
+}
+
+// Close stops watching the file.
+func (t *Tokens) Close() {
+	t.once.Do(func() { close(t.stop) })
+}
+
+// BearerToken returns the token of an "Authorization: Bearer" header.
+func BearerToken(r *http.Request) (string, bool) {
+	scheme, token, ok := strings.Cut(r.Header.Get("Authorization"), " ")
+	if !ok || !strings.EqualFold(scheme, "Bearer") {
+		return "", false
+	}
+	token = strings.TrimSpace(token)
+	return token, token != ""
+}
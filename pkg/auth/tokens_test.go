@@ -0,0 +1,182 @@
+package auth
+
+import (
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func writeTokens(t *testing.T, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "tokens")
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadTokens(t *testing.T) {
+	tokens, err := LoadTokens(writeTokens(t, `
+# name  token   scopes
+grafana reader  stats:read   # dashboards
+siem    watcher stats:read,events:stream
+
+ops     admin   *
+`), 0, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tokens.Close()
+	if tokens.Len() != 3 {
+		t.Fatalf("%d tokens, want 3", tokens.Len())
+	}
+
+	for _, tc := range []struct {
+		secret, name string
+		scopes       []string
+	}{
+		{"reader", "grafana", []string{ScopeStatsRead}},
+		{"watcher", "siem", []string{ScopeStatsRead, ScopeEventsStream}},
+		{"admin", "ops", []string{ScopeAll}},
+	} {
+		tok, ok := tokens.Lookup(tc.secret)
+		if !ok || tok.Name != tc.name || !slices.Equal(tok.Scopes, tc.scopes) {
+			t.Errorf("Lookup(%q) = %+v, %v, want %s with %v", tc.secret, tok, ok, tc.name, tc.scopes)
+		}
+	}
+	for _, secret := range []string{"", "grafana", "reade", "readerx", "# name"} {
+		if tok, ok := tokens.Lookup(secret); ok {
+			t.Errorf("Lookup(%q) found %s", secret, tok.Name)
+		}
+	}
+}
+
+func TestLoadTokensErrors(t *testing.T) {
+	for _, tc := range []struct {
+		content, want string
+	}{
+		{"grafana reader\n", `:1: expected "name token scopes"`},
+		{"grafana reader stats:read extra\n", `:1: expected "name token scopes"`},
+		{"a one stats:read\n\n# b\na two stats:read\n", `:4: duplicate token name "a"`},
+		{"a one stats:write\n", `:1: unknown scope "stats:write"`},
+		{"a one stats:read,\n", `:1: unknown scope ""`},
+		{"a one Stats:Read\n", `:1: unknown scope "Stats:Read"`},
+	} {
+		_, err := LoadTokens(writeTokens(t, tc.content), 0, nil)
+		if err == nil || !strings.Contains(err.Error(), tc.want) {
+			t.Errorf("%q: got %v, want %s", tc.content, err, tc.want)
+		}
+	}
+	if _, err := LoadTokens(filepath.Join(t.TempDir(), "missing"), 0, nil); err == nil {
+		t.Error("missing file loaded")
+	}
+}
+
+// Two names sharing a secret both stay valid and the last one wins, the
+// lookup doesn't stop at the first match.
+func TestLoadTokensDuplicateSecret(t *testing.T) {
+	tokens, err := LoadTokens(writeTokens(t, "first same stats:read\nsecond same *\n"), 0, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tok, ok := tokens.Lookup("same"); !ok || tok.Name != "second" {
+		t.Errorf("Lookup = %+v, %v, want the last line", tok, ok)
+	}
+}
+
+func TestTokenAllows(t *testing.T) {
+	reader := Token{Name: "r", Scopes: []string{ScopeStatsRead}}
+	if !reader.Allows(ScopeStatsRead) || reader.Allows(ScopeEventsStream) || reader.Allows(ScopeFiltersWrite) {
+		t.Errorf("%+v allows the wrong scopes", reader)
+	}
+	all := Token{Name: "a", Scopes: []string{ScopeAll}}
+	for _, scope := range []string{ScopeStatsRead, ScopeEventsStream, ScopeFiltersWrite} {
+		if !all.Allows(scope) {
+			t.Errorf("* doesn't allow %s", scope)
+		}
+	}
+	if (Token{}).Allows(ScopeStatsRead) {
+		t.Error("a token without scopes allows stats:read")
+	}
+}
+
+// A bad reload keeps the previous tokens, a good one replaces them.
+func TestTokensReload(t *testing.T) {
+	path := writeTokens(t, "a one stats:read\n")
+	errs := make(chan error, 1)
+	tokens, err := LoadTokens(path, 10*time.Millisecond, func(err error) {
+		// A bad file is retried every tick
+		select {
+		case errs <- err:
+		default:
+		}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tokens.Close()
+
+	replace := func(content string) {
+		tmp := path + ".tmp"
+		if err := os.WriteFile(tmp, []byte(content), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Rename(tmp, path); err != nil {
+			t.Fatal(err)
+		}
+	}
+	replace("a one stats:read\nb two\n")
+	select {
+	case <-errs:
+	case <-time.After(5 * time.Second):
+		t.Fatal("bad reload not reported")
+	}
+	if _, ok := tokens.Lookup("one"); !ok {
+		t.Error("bad reload dropped the loaded tokens")
+	}
+
+	replace("b two events:stream\n")
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if _, ok := tokens.Lookup("two"); ok {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("good reload not picked up")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if _, ok := tokens.Lookup("one"); ok {
+		t.Error("removed token still valid")
+	}
+}
+
+func TestBearerToken(t *testing.T) {
+	for header, want := range map[string]string{
+		"Bearer abc":     "abc",
+		"bearer abc":     "abc",
+		"BEARER abc":     "abc",
+		"Bearer  abc ":   "abc",
+		"Bearer a b":     "a b",
+		"":               "",
+		"abc":            "",
+		"Bearer":         "",
+		"Bearer ":        "",
+		"Bearer    ":     "",
+		"Basic dXNlcjpw": "",
+		"Bearerabc":      "",
+	} {
+		r := httptest.NewRequest("GET", "/", nil)
+		if header != "" {
+			r.Header.Set("Authorization", header)
+		}
+		got, ok := BearerToken(r)
+		if got != want || ok != (want != "") {
+			t.Errorf("BearerToken(%q) = %q, %v, want %q", header, got, ok, want)
+		}
+	}
+}
@@ -0,0 +1,462 @@
+package detection
+
+import (
+	"encoding/json"
+	"fmt"
+	"kernelKoala/pkg/alert"
+	"math"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Metrics tracked by the anomaly detector.
+const (
+	MetricPackets  = "packets"
+	MetricBytes    = "bytes"
+	MetricNewFlows = "new_flows"
+)
+
+var anomalyMetrics = [...]string{MetricPackets, MetricBytes, MetricNewFlows}
+
+// Indexes of the metrics in anomalyMetrics.
+const (
+	countPackets = iota
+	countBytes
+	countNewFlows
+)
+
+// AnomalyConfig holds the settings of the volumetric anomaly detector.
+type AnomalyConfig struct {
+	// Interval is the length of one sample.
+	Interval time.Duration
+	// Alpha is the EWMA weight of a new sample.
+	Alpha float64
+	// Threshold is the deviation score, in standard deviations, that counts
+	// as anomalous, for Sustain consecutive intervals before an alert.
+	Threshold float64
+	Sustain   int
+	// MinSamples is the learning period, no alerts are raised for a
+	// baseline (or hour-of-day slot) with fewer samples.
+	MinSamples int
+	// MaxServices bounds the per-port series.
+	MaxServices int
+	// StatePath, if set, is where baselines are saved every SaveInterval
+	// and loaded from at startup.
+	StatePath    string
+	SaveInterval time.Duration
+	// Warn reports saved baselines that can't be used and are discarded.
+	Warn func(format string, args ...any) `json:"-"`
+}
+
+func DefaultAnomalyConfig() AnomalyConfig {
+	return AnomalyConfig{
+		Interval:     time.Minute,
+		Alpha:        0.05,
+		Threshold:    4,
+		Sustain:      3,
+		MinSamples:   60,
+		MaxServices:  256,
+		SaveInterval: 5 * time.Minute,
+	}
+}
+
+// ewma is an exponentially weighted mean and variance.
+type ewma struct {
+	Mean float64 `json:"mean"`
+	Var  float64 `json:"var"`
+	N    int     `json:"n"`
+}
+
+func (e *ewma) update(x, alpha float64) {
+	if e.N == 0 {
+		e.Mean, e.Var, e.N = x, 0, 1
+		return
+	}
+	diff := x - e.Mean
+	incr := alpha * diff
+	e.Mean += incr
+	e.Var = (1 - alpha) * (e.Var + diff*incr)
+	e.N++
+}
+
+// baseline is the overall EWMA of a metric plus one per hour of day, so a
+// quiet night is not compared with a busy afternoon.
+type baseline struct {
+	Overall ewma     `json:"overall"`
+	Hourly  [24]ewma `json:"hourly"`
+}
+
+// expected returns the mean and standard deviation to score against, the
+// hour slot once it has learned enough and the overall EWMA before that.
+func (b *baseline) expected(hour, minSamples int) (mean, std float64, ok bool) {
+	e := &b.Hourly[hour]
+	if e.N < minSamples {
+		e = &b.Overall
+	}
+	if e.N < minSamples {
+		return 0, 0, false
+	}
+	// Floor the deviation so near constant series don't alert on noise
+	std = math.Max(math.Sqrt(e.Var), math.Max(0.1*e.Mean, 1))
+	return e.Mean, std, true
+}
+
+// Series kinds.
+const (
+	seriesIface = iota
+	seriesProto
+	seriesService
+)
+
+// seriesKey identifies a series without formatting its name for every
+// packet. Only the fields of its kind are set.
+type seriesKey struct {
+	kind  uint8
+	proto uint8
+	port  uint16
+	iface string
+}
+
+// name is the key as it appears in alerts and the state file, e.g.
+// iface:eth0, proto:TCP or svc:UDP/53.
+func (k seriesKey) name() string {
+	switch k.kind {
+	case seriesIface:
+		return "iface:" + k.iface
+	case seriesProto:
+		return "proto:" + Packet{Protocol: k.proto}.protocolName()
+	default:
+		return "svc:" + Packet{Protocol: k.proto}.protocolName() + "/" + strconv.Itoa(int(k.port))
+	}
+}
+
+// parseSeriesKey reverses name.
+func parseSeriesKey(name string) (seriesKey, bool) {
+	kind, rest, ok := strings.Cut(name, ":")
+	if !ok {
+		return seriesKey{}, false
+	}
+	switch kind {
+	case "iface":
+		return seriesKey{kind: seriesIface, iface: rest}, true
+	case "proto":
+		proto, ok := parseProtocol(rest)
+		return seriesKey{kind: seriesProto, proto: proto}, ok
+	case "svc":
+		protoName, portStr, ok := strings.Cut(rest, "/")
+		if !ok {
+			return seriesKey{}, false
+		}
+		proto, ok := parseProtocol(protoName)
+		port, err := strconv.ParseUint(portStr, 10, 16)
+		if !ok || err != nil {
+			return seriesKey{}, false
+		}
+		return seriesKey{kind: seriesService, proto: proto, port: uint16(port)}, true
+	}
+	return seriesKey{}, false
+}
+
+// parseProtocol reverses Packet.protocolName.
+func parseProtocol(name string) (uint8, bool) {
+	switch name {
+	case "TCP":
+		return ProtoTCP, true
+	case "UDP":
+		return ProtoUDP, true
+	case "ICMP":
+		return ProtoICMP, true
+	}
+	var proto uint8
+	if _, err := fmt.Sscanf(name, "PROTO(%d)", &proto); err != nil {
+		return 0, false
+	}
+	return proto, true
+}
+
+type anomalySeries struct {
+	// counts of the current interval, indexed like anomalyMetrics
+	counts    [len(anomalyMetrics)]float64
+	baselines map[string]*baseline
+	streak    map[string]int
+	alerted   map[string]bool
+}
+
+func newAnomalySeries() *anomalySeries {
+	return &anomalySeries{
+		baselines: make(map[string]*baseline),
+		streak:    make(map[string]int),
+		alerted:   make(map[string]bool),
+	}
+}
+
+// anomalyState is the on-disk form of the baselines.
+type anomalyState struct {
+	Saved    time.Time                       `json:"saved"`
+	Interval string                          `json:"interval"`
+	Series   map[string]map[string]*baseline `json:"series"`
+}
+
+// AnomalyDetector learns rolling baselines of packets, bytes and new flows
+// per interface, per protocol and per service port, and alerts when a
+// series deviates from its baseline for several intervals in a row.
+type AnomalyDetector struct {
+	cfg AnomalyConfig
+
+	mu            sync.Mutex
+	series        map[seriesKey]*anomalySeries
+	services      int
+	intervalStart time.Time
+	lastSave      time.Time
+}
+
+// NewAnomalyDetector loads saved baselines from cfg.StatePath if it exists
+// and was written with the same interval.
+func NewAnomalyDetector(cfg AnomalyConfig) (*AnomalyDetector, error) {
+	d := &AnomalyDetector{
+		cfg:    cfg,
+		series: make(map[seriesKey]*anomalySeries),
+	}
+	if cfg.StatePath == "" {
+		return d, nil
+	}
+
+	data, err := os.ReadFile(cfg.StatePath)
+	if os.IsNotExist(err) {
+		return d, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var state anomalyState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return nil, fmt.Errorf("%s: %v", cfg.StatePath, err)
+	}
+	if state.Interval != cfg.Interval.String() {
+		// Samples of another length don't fit the baselines, learn anew
+		// rather than refuse to start
+		if cfg.Warn != nil {
+			cfg.Warn("%s: baselines were learned with a %s interval, not %s, starting without them",
+				cfg.StatePath, state.Interval, cfg.Interval)
+		}
+		return d, nil
+	}
+	for name, metrics := range state.Series {
+		key, ok := parseSeriesKey(name)
+		if !ok {
+			continue
+		}
+		s := d.seriesFor(key)
+		if s == nil {
+			continue
+		}
+		for metric, b := range metrics {
+			s.baselines[metric] = b
+		}
+	}
+	return d, nil
+}
+
+func (d *AnomalyDetector) Name() string { return "anomaly" }
+
+// Observe counts the packet into its interface, protocol and service series.
+func (d *AnomalyDetector) Observe(p Packet) []alert.Alert {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	keys := [3]seriesKey{
+		{kind: seriesIface, iface: p.Iface},
+		{kind: seriesProto, proto: p.Protocol},
+	}
+	n := 2
+	if port := servicePort(p); port != 0 {
+		keys[2] = seriesKey{kind: seriesService, proto: p.Protocol, port: port}
+		n = 3
+	}
+	for _, key := range keys[:n] {
+		s := d.seriesFor(key)
+		if s == nil {
+			continue
+		}
+		s.counts[countPackets]++
+		s.counts[countBytes] += float64(p.Bytes)
+		if p.NewFlow {
+			s.counts[countNewFlows]++
+		}
+	}
+	return nil
+}
+
+// servicePort guesses the server side port, the lower one when it is below
+// the ephemeral range.
+func servicePort(p Packet) uint16 {
+	if p.Protocol != ProtoTCP && p.Protocol != ProtoUDP {
+		return 0
+	}
+	port := p.SrcPort
+	if p.DstPort < port {
+		port = p.DstPort
+	}
+	if port == 0 || port >= 32768 {
+		return 0
+	}
+	return port
+}
+
+func (d *AnomalyDetector) seriesFor(key seriesKey) *anomalySeries {
+	s := d.series[key]
+	if s != nil {
+		return s
+	}
+	if key.kind == seriesService {
+		if d.services >= d.cfg.MaxServices {
+			return nil
+		}
+		d.services++
+	}
+	s = newAnomalySeries()
+	d.series[key] = s
+	return s
+}
+
+// Tick scores the finished interval against the baselines, then learns
+// from it.
+func (d *AnomalyDetector) Tick(now time.Time) []alert.Alert {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.intervalStart.IsZero() {
+		d.intervalStart, d.lastSave = now, now
+		return nil
+	}
+	if now.Sub(d.intervalStart) < d.cfg.Interval {
+		return nil
+	}
+	hour := d.intervalStart.Hour()
+	d.intervalStart = now
+
+	var alerts []alert.Alert
+	names := make(map[string]seriesKey, len(d.series))
+	sorted := make([]string, 0, len(d.series))
+	for key := range d.series {
+		name := key.name()
+		names[name] = key
+		sorted = append(sorted, name)
+	}
+	sort.Strings(sorted)
+
+	for _, name := range sorted {
+		s := d.series[names[name]]
+		for i, metric := range anomalyMetrics {
+			if a, ok := d.score(name, metric, s.counts[i], s, hour, now); ok {
+				alerts = append(alerts, a)
+			}
+		}
+		s.counts = [len(anomalyMetrics)]float64{}
+	}
+
+	if d.cfg.StatePath != "" && now.Sub(d.lastSave) >= d.cfg.SaveInterval {
+		d.lastSave = now
+		if err := d.save(now); err != nil {
+			alerts = append(alerts, alert.Alert{
+				Time:     now,
+				Type:     "anomaly",
+				Severity: alert.SeverityLow,
+				Message:  "failed to save baselines: " + err.Error(),
+			})
+		}
+	}
+	return alerts
+}
+
+func (d *AnomalyDetector) score(name, metric string, value float64, s *anomalySeries, hour int, now time.Time) (alert.Alert, bool) {
+	b := s.baselines[metric]
+	if b == nil {
+		b = &baseline{}
+		s.baselines[metric] = b
+	}
+
+	mean, std, ok := b.expected(hour, d.cfg.MinSamples)
+	score := 0.0
+	if ok {
+		score = (value - mean) / std
+	}
+	anomalous := math.Abs(score) >= d.cfg.Threshold
+
+	// Learn slowly from anomalous samples so an attack doesn't become the
+	// new normal within a few intervals
+	alpha := d.cfg.Alpha
+	if anomalous {
+		alpha /= 4
+	}
+	b.Overall.update(value, alpha)
+	b.Hourly[hour].update(value, alpha)
+
+	if !anomalous {
+		s.streak[metric] = 0
+		s.alerted[metric] = false
+		return alert.Alert{}, false
+	}
+	s.streak[metric]++
+	if s.streak[metric] < d.cfg.Sustain || s.alerted[metric] {
+		return alert.Alert{}, false
+	}
+	s.alerted[metric] = true
+
+	direction := "above"
+	if score < 0 {
+		direction = "below"
+	}
+	severity := alert.SeverityMedium
+	if math.Abs(score) >= 2*d.cfg.Threshold {
+		severity = alert.SeverityHigh
+	}
+	return alert.Alert{
+		Time:     now,
+		Type:     "anomaly",
+		Severity: severity,
+		Message: fmt.Sprintf("%s of %s %.1fσ %s baseline for %d intervals (%.0f, expected %.0f)",
+			metric, name, math.Abs(score), direction, s.streak[metric], value, mean),
+		Fields: map[string]string{
+			"series":    name,
+			"metric":    metric,
+			"value":     strconv.FormatFloat(value, 'f', 0, 64),
+			"expected":  strconv.FormatFloat(mean, 'f', 1, 64),
+			"stddev":    strconv.FormatFloat(std, 'f', 1, 64),
+			"score":     strconv.FormatFloat(score, 'f', 2, 64),
+			"intervals": strconv.Itoa(s.streak[metric]),
+		},
+	}, true
+}
+
+// save writes the baselines, the caller holds d.mu.
+func (d *AnomalyDetector) save(now time.Time) error {
+	state := anomalyState{
+		Saved:    now,
+		Interval: d.cfg.Interval.String(),
+		Series:   make(map[string]map[string]*baseline, len(d.series)),
+	}
+	for key, s := range d.series {
+		state.Series[key.name()] = s.baselines
+	}
+
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(d.cfg.StatePath, data)
+}
+
+// Close saves the baselines.
+func (d *AnomalyDetector) Close() error {
+	if d.cfg.StatePath == "" {
+		return nil
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.save(time.Now())
+}
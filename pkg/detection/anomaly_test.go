@@ -0,0 +1,152 @@
+package detection
+
+import (
+	"fmt"
+	"math"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestEWMA(t *testing.T) {
+	var e ewma
+	e.update(10, 0.5)
+	if e.Mean != 10 || e.Var != 0 || e.N != 1 {
+		t.Fatalf("first sample %+v", e)
+	}
+	// diff 10, incr 5: mean 15, var 0.5 * (0 + 10*5)
+	e.update(20, 0.5)
+	if e.Mean != 15 || e.Var != 25 || e.N != 2 {
+		t.Fatalf("second sample %+v", e)
+	}
+
+	var c ewma
+	for range 100 {
+		c.update(42, 0.05)
+	}
+	if c.Mean != 42 || c.Var != 0 {
+		t.Errorf("constant series %+v", c)
+	}
+
+	// A level shift is followed at the rate alpha
+	for range 100 {
+		c.update(142, 0.05)
+	}
+	if want := 142 - 100*math.Pow(0.95, 100); math.Abs(c.Mean-want) > 1e-9 {
+		t.Errorf("mean %v after the shift, want %v", c.Mean, want)
+	}
+}
+
+func TestBaselineExpected(t *testing.T) {
+	var b baseline
+	if _, _, ok := b.expected(3, 2); ok {
+		t.Fatal("empty baseline scored")
+	}
+
+	b.Overall = ewma{Mean: 1000, Var: 400, N: 10}
+	// Hour slots that are still learning fall back to the overall EWMA
+	b.Hourly[3] = ewma{Mean: 50, Var: 100, N: 1}
+	if mean, std, ok := b.expected(3, 2); !ok || mean != 1000 || std != 100 {
+		t.Errorf("fallback %v %v %v, want the overall mean with a 10%% floor", mean, std, ok)
+	}
+	b.Hourly[3].N = 2
+	if mean, std, ok := b.expected(3, 2); !ok || mean != 50 || std != 10 {
+		t.Errorf("hour slot %v %v %v", mean, std, ok)
+	}
+	// The deviation never drops below 1
+	b.Hourly[4] = ewma{Mean: 0.5, N: 5}
+	if _, std, _ := b.expected(4, 2); std != 1 {
+		t.Errorf("std %v, want the floor of 1", std)
+	}
+}
+
+func TestSeriesKeyNames(t *testing.T) {
+	for _, k := range []seriesKey{
+		{kind: seriesIface, iface: "eth0"},
+		{kind: seriesIface, iface: "veth:1/2"},
+		{kind: seriesProto, proto: ProtoTCP},
+		{kind: seriesProto, proto: 47},
+		{kind: seriesService, proto: ProtoUDP, port: 53},
+		{kind: seriesService, proto: 132, port: 38412},
+	} {
+		got, ok := parseSeriesKey(k.name())
+		if !ok || got != k {
+			t.Errorf("%s parsed as %+v, %v", k.name(), got, ok)
+		}
+	}
+	for _, name := range []string{"eth0", "proto:SCTP", "svc:TCP", "svc:TCP/http", "svc:TCP/70000", "host:10.0.0.1"} {
+		if k, ok := parseSeriesKey(name); ok {
+			t.Errorf("%q parsed as %+v", name, k)
+		}
+	}
+}
+
+func anomalyConfig(path string) AnomalyConfig {
+	cfg := DefaultAnomalyConfig()
+	cfg.StatePath = path
+	return cfg
+}
+
+func TestAnomalyStateRoundTrip(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "anomaly.json")
+	d, err := NewAnomalyDetector(anomalyConfig(path))
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.Tick(scanT0)
+	for i := range 5 {
+		p := syn(time.Duration(i)*time.Second, host(1), host(2), 443)
+		p.Iface, p.NewFlow, p.Bytes = "eth0", true, 100
+		d.Observe(p)
+	}
+	d.Tick(scanT0.Add(time.Minute))
+	if err := d.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	loaded, err := NewAnomalyDetector(anomalyConfig(path))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for key, s := range d.series {
+		ls := loaded.series[key]
+		if ls == nil {
+			t.Errorf("series %s not restored", key.name())
+			continue
+		}
+		for metric, b := range s.baselines {
+			if *ls.baselines[metric] != *b {
+				t.Errorf("%s %s restored as %+v, want %+v", key.name(), metric, ls.baselines[metric], b)
+			}
+		}
+	}
+	svc := loaded.series[seriesKey{kind: seriesService, proto: ProtoTCP, port: 443}]
+	if svc == nil || svc.baselines[MetricBytes].Overall.Mean != 500 {
+		t.Errorf("service baseline %+v", svc)
+	}
+}
+
+func TestAnomalyStateOtherInterval(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "anomaly.json")
+	d, _ := NewAnomalyDetector(anomalyConfig(path))
+	d.Tick(scanT0)
+	d.Observe(syn(0, host(1), host(2), 443))
+	d.Tick(scanT0.Add(time.Minute))
+	d.Close()
+
+	var warnings []string
+	cfg := anomalyConfig(path)
+	cfg.Interval = 5 * time.Minute
+	cfg.Warn = func(format string, args ...any) { warnings = append(warnings, fmt.Sprintf(format, args...)) }
+	d, err := NewAnomalyDetector(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(d.series) != 0 {
+		t.Errorf("%d series loaded from another interval", len(d.series))
+	}
+	if len(warnings) != 1 || !strings.Contains(warnings[0], "1m0s interval, not 5m0s") {
+		t.Errorf("warnings %q", warnings)
+	}
+}
@@ -0,0 +1,266 @@
+package detection
+
+import (
+	"fmt"
+	"kernelKoala/pkg/alert"
+	"math"
+	"net/netip"
+	"slices"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// BeaconConfig holds the settings of the beaconing detector.
+type BeaconConfig struct {
+	// Window is how far back connection starts are kept per channel.
+	Window time.Duration
+	// EvalInterval is how often the channels are scored.
+	EvalInterval time.Duration
+	// MinConnections is the number of starts within Window before a channel
+	// is scored.
+	MinConnections int
+	// MinInterval ignores cadences faster than this, e.g. busy pollers.
+	MinInterval time.Duration
+	// MaxJitter is the largest coefficient of variation of the intervals
+	// that still counts as periodic.
+	MaxJitter float64
+	// MinScore is the share of intervals within Tolerance of the median
+	// interval needed for an alert.
+	MinScore  float64
+	Tolerance float64
+	// Scopes limits the detector to traffic of these scopes.
+	Scopes []string
+	// TopN bounds the alerts raised per evaluation, the most periodic first.
+	TopN       int
+	MaxSamples int
+	MaxTracked int
+}
+
+func DefaultBeaconConfig() BeaconConfig {
+	return BeaconConfig{
+		Window:         time.Hour,
+		EvalInterval:   time.Minute,
+		MinConnections: 8,
+		MinInterval:    5 * time.Second,
+		MaxJitter:      0.2,
+		MinScore:       0.8,
+		Tolerance:      0.1,
+		Scopes:         []string{"outbound"},
+		TopN:           10,
+		MaxSamples:     512,
+		MaxTracked:     50000,
+	}
+}
+
+type beaconKey struct {
+	src, dst netip.Addr
+	port     uint16
+	protocol uint8
+}
+
+type beaconChannel struct {
+	starts   []time.Time
+	iface    string
+	lastSeen time.Time
+	alerted  time.Time
+}
+
+// BeaconStats describes the cadence of one channel.
+type BeaconStats struct {
+	Connections int
+	Median      time.Duration
+	Mean        time.Duration
+	// Jitter is the coefficient of variation of the intervals.
+	Jitter float64
+	// Score is the share of intervals within the tolerance of the median.
+	Score float64
+}
+
+// beaconStats computes the interval statistics of sorted start times.
+func beaconStats(starts []time.Time, tolerance float64) BeaconStats {
+	s := BeaconStats{Connections: len(starts)}
+	if len(starts) < 3 {
+		return s
+	}
+	intervals := make([]float64, 0, len(starts)-1)
+	sum := 0.0
+	for i := 1; i < len(starts); i++ {
+		d := starts[i].Sub(starts[i-1]).Seconds()
+		intervals = append(intervals, d)
+		sum += d
+	}
+	mean := sum / float64(len(intervals))
+	variance := 0.0
+	for _, d := range intervals {
+		variance += (d - mean) * (d - mean)
+	}
+	variance /= float64(len(intervals))
+
+	sorted := append([]float64(nil), intervals...)
+	sort.Float64s(sorted)
+	median := sorted[len(sorted)/2]
+	if len(sorted)%2 == 0 {
+		median = (sorted[len(sorted)/2-1] + sorted[len(sorted)/2]) / 2
+	}
+
+	within := 0
+	for _, d := range intervals {
+		if math.Abs(d-median) <= tolerance*median {
+			within++
+		}
+	}
+
+	s.Mean = time.Duration(mean * float64(time.Second))
+	s.Median = time.Duration(median * float64(time.Second))
+	if mean > 0 {
+		s.Jitter = math.Sqrt(variance) / mean
+	}
+	s.Score = float64(within) / float64(len(intervals))
+	return s
+}
+
+// BeaconDetector records connection starts per source, destination and
+// port and alerts on channels that connect at suspiciously regular
+// intervals, as malware checking in with its C2 server does.
+type BeaconDetector struct {
+	cfg    BeaconConfig
+	scopes map[string]bool
+
+	mu       sync.Mutex
+	channels map[beaconKey]*beaconChannel
+	lastEval time.Time
+}
+
+func NewBeaconDetector(cfg BeaconConfig) *BeaconDetector {
+	d := &BeaconDetector{
+		cfg:      cfg,
+		scopes:   make(map[string]bool),
+		channels: make(map[beaconKey]*beaconChannel),
+	}
+	for _, s := range cfg.Scopes {
+		d.scopes[s] = true
+	}
+	return d
+}
+
+func (d *BeaconDetector) Name() string { return "beacon" }
+
+// Observe records TCP SYNs and the first packet of UDP flows.
+func (d *BeaconDetector) Observe(p Packet) []alert.Alert {
+	if len(d.scopes) > 0 && !d.scopes[p.Scope] {
+		return nil
+	}
+	if !p.IsSYN() && !(p.Protocol == ProtoUDP && p.NewFlow) {
+		return nil
+	}
+
+	key := beaconKey{src: p.SrcIP, dst: p.DstIP, port: p.DstPort, protocol: p.Protocol}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	c := d.channels[key]
+	if c == nil {
+		if len(d.channels) >= d.cfg.MaxTracked {
+			return nil
+		}
+		c = &beaconChannel{}
+		d.channels[key] = c
+	}
+	// Packets come from several workers, a start may arrive after a later
+	// one and is put in its place
+	i := sort.Search(len(c.starts), func(i int) bool { return c.starts[i].After(p.Time) })
+	// Retransmitted SYNs arrive within a second or so, not a new start
+	if i > 0 && p.Time.Sub(c.starts[i-1]) < time.Second || i < len(c.starts) && c.starts[i].Sub(p.Time) < time.Second {
+		return nil
+	}
+	c.starts = slices.Insert(c.starts, i, p.Time)
+	if len(c.starts) > d.cfg.MaxSamples {
+		c.starts = c.starts[1:]
+	}
+	c.iface = p.Iface
+	if p.Time.After(c.lastSeen) {
+		c.lastSeen = p.Time
+	}
+	return nil
+}
+
+// Tick scores every channel once per EvalInterval and reports the most
+// periodic ones first.
+func (d *BeaconDetector) Tick(now time.Time) []alert.Alert {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if now.Sub(d.lastEval) < d.cfg.EvalInterval {
+		return nil
+	}
+	d.lastEval = now
+
+	type candidate struct {
+		key   beaconKey
+		c     *beaconChannel
+		stats BeaconStats
+	}
+	var found []candidate
+
+	cutoff := now.Add(-d.cfg.Window)
+	for key, c := range d.channels {
+		i := sort.Search(len(c.starts), func(i int) bool { return c.starts[i].After(cutoff) })
+		c.starts = c.starts[i:]
+		if len(c.starts) == 0 {
+			delete(d.channels, key)
+			continue
+		}
+		if len(c.starts) < d.cfg.MinConnections || now.Sub(c.alerted) < d.cfg.Window {
+			continue
+		}
+
+		stats := beaconStats(c.starts, d.cfg.Tolerance)
+		if stats.Median < d.cfg.MinInterval || stats.Jitter > d.cfg.MaxJitter || stats.Score < d.cfg.MinScore {
+			continue
+		}
+		found = append(found, candidate{key, c, stats})
+	}
+
+	sort.Slice(found, func(i, j int) bool {
+		if found[i].stats.Score != found[j].stats.Score {
+			return found[i].stats.Score > found[j].stats.Score
+		}
+		return found[i].stats.Jitter < found[j].stats.Jitter
+	})
+	if len(found) > d.cfg.TopN {
+		found = found[:d.cfg.TopN]
+	}
+
+	alerts := make([]alert.Alert, 0, len(found))
+	for rank, f := range found {
+		f.c.alerted = now
+		severity := alert.SeverityMedium
+		if f.stats.Score >= 0.95 && f.stats.Connections >= 2*d.cfg.MinConnections {
+			severity = alert.SeverityHigh
+		}
+		p := Packet{
+			Time:     now,
+			Iface:    f.c.iface,
+			Protocol: f.key.protocol,
+			SrcIP:    f.key.src,
+			DstIP:    f.key.dst,
+			DstPort:  f.key.port,
+		}
+		alerts = append(alerts, newAlert(p, "beacon", severity,
+			fmt.Sprintf("%s connects to %s:%d every %s (jitter %.1f%%, %d connections)",
+				f.key.src, f.key.dst, f.key.port, f.stats.Median.Round(time.Second), 100*f.stats.Jitter, f.stats.Connections),
+			map[string]string{
+				"rank":        strconv.Itoa(rank + 1),
+				"cadence":     f.stats.Median.Round(time.Millisecond).String(),
+				"mean":        f.stats.Mean.Round(time.Millisecond).String(),
+				"jitter":      strconv.FormatFloat(f.stats.Jitter, 'f', 3, 64),
+				"score":       strconv.FormatFloat(f.stats.Score, 'f', 2, 64),
+				"connections": strconv.Itoa(f.stats.Connections),
+				"window":      d.cfg.Window.String(),
+			}))
+	}
+	return alerts
+}
@@ -0,0 +1,130 @@
+package detection
+
+import (
+	"kernelKoala/pkg/alert"
+	"math"
+	"net/netip"
+	"slices"
+	"testing"
+	"time"
+)
+
+var c2 = netip.MustParseAddr("198.51.100.66")
+
+func startsAt(offsets ...time.Duration) []time.Time {
+	starts := make([]time.Time, len(offsets))
+	for i, o := range offsets {
+		starts[i] = scanT0.Add(o)
+	}
+	return starts
+}
+
+// every returns n offsets period apart, each shifted by the next jitter
+// value in turn.
+func every(period time.Duration, n int, jitter ...time.Duration) []time.Duration {
+	offsets := make([]time.Duration, n)
+	for i := range offsets {
+		offsets[i] = time.Duration(i) * period
+		if len(jitter) > 0 {
+			offsets[i] += jitter[i%len(jitter)]
+		}
+	}
+	return offsets
+}
+
+func TestBeaconStats(t *testing.T) {
+	s := beaconStats(startsAt(every(time.Minute, 10)...), 0.1)
+	if s.Connections != 10 || s.Median != time.Minute || s.Mean != time.Minute || s.Jitter != 0 || s.Score != 1 {
+		t.Errorf("regular starts: %+v", s)
+	}
+
+	// Intervals of 50s and 70s alternate: mean 60s, deviation 10s
+	s = beaconStats(startsAt(every(time.Minute, 9, 0, -10*time.Second)...), 0.1)
+	if s.Mean != time.Minute || math.Abs(s.Jitter-1.0/6) > 1e-9 || s.Score != 0 {
+		t.Errorf("alternating intervals: %+v", s)
+	}
+
+	// One late start out of nine intervals
+	offsets := every(time.Minute, 10)
+	offsets[9] += 3 * time.Minute
+	s = beaconStats(startsAt(offsets...), 0.1)
+	if s.Median != time.Minute || math.Abs(s.Score-8.0/9) > 1e-9 || s.Jitter < 0.5 {
+		t.Errorf("late start: %+v", s)
+	}
+
+	if s := beaconStats(startsAt(0, time.Minute), 0.1); s.Connections != 2 || s.Score != 0 || s.Median != 0 {
+		t.Errorf("two starts scored: %+v", s)
+	}
+}
+
+func beaconPacket(dst netip.Addr, at time.Duration) Packet {
+	p := syn(at, host(1), dst, 443)
+	p.Scope = "outbound"
+	return p
+}
+
+func TestBeaconOutOfOrder(t *testing.T) {
+	d := NewBeaconDetector(DefaultBeaconConfig())
+	offsets := every(time.Minute, 10)
+	// Workers deliver neighbouring starts swapped
+	for _, i := range []int{1, 0, 2, 4, 3, 5, 6, 8, 7, 9} {
+		d.Observe(beaconPacket(c2, offsets[i]))
+	}
+	// A retransmitted SYN of an earlier start
+	d.Observe(beaconPacket(c2, offsets[3]+500*time.Millisecond))
+
+	c := d.channels[beaconKey{src: host(1), dst: c2, port: 443, protocol: ProtoTCP}]
+	if !slices.IsSortedFunc(c.starts, func(a, b time.Time) int { return a.Compare(b) }) || len(c.starts) != 10 {
+		t.Fatalf("starts %v", c.starts)
+	}
+	if !c.lastSeen.Equal(scanT0.Add(offsets[9])) {
+		t.Errorf("last seen %v", c.lastSeen)
+	}
+
+	alerts := d.Tick(scanT0.Add(10 * time.Minute))
+	if len(alerts) != 1 || alerts[0].Fields["cadence"] != "1m0s" || alerts[0].Fields["score"] != "1.00" {
+		t.Errorf("alerts %v", alerts)
+	}
+}
+
+func TestBeaconRanking(t *testing.T) {
+	cfg := DefaultBeaconConfig()
+	cfg.TopN = 2
+	d := NewBeaconDetector(cfg)
+	dsts := []netip.Addr{host(10), host(11), host(12), host(13)}
+	for _, at := range every(time.Minute, 20) {
+		d.Observe(beaconPacket(dsts[0], at+time.Second)) // a second behind, so no retransmits
+	}
+	for _, at := range every(time.Minute, 20, 0, 3*time.Second) {
+		d.Observe(beaconPacket(dsts[1], at))
+	}
+	for _, at := range every(time.Minute, 20, 0, 2*time.Second) {
+		d.Observe(beaconPacket(dsts[2], at))
+	}
+	// Too fast to be a beacon
+	for _, at := range every(2*time.Second, 20) {
+		d.Observe(beaconPacket(dsts[3], at))
+	}
+
+	now := scanT0.Add(20 * time.Minute)
+	alerts := d.Tick(now)
+	if len(alerts) != 2 {
+		t.Fatalf("%d alerts, want the top 2: %v", len(alerts), alerts)
+	}
+	if alerts[0].DstIP != dsts[0].String() || alerts[0].Fields["rank"] != "1" ||
+		alerts[1].DstIP != dsts[2].String() || alerts[1].Fields["rank"] != "2" {
+		t.Errorf("ranking %s, %s", alerts[0].DstIP, alerts[1].DstIP)
+	}
+	if alerts[0].Severity != alert.SeverityHigh {
+		t.Errorf("perfect beacon with %s connections is %s", alerts[0].Fields["connections"], alerts[0].Severity)
+	}
+
+	// Alerted channels stay quiet for a window, the next evaluation is due
+	// after EvalInterval
+	if a := d.Tick(now.Add(time.Second)); len(a) != 0 {
+		t.Errorf("evaluated again before the interval: %v", a)
+	}
+	if a := d.Tick(now.Add(cfg.EvalInterval)); len(a) != 1 || a[0].DstIP != dsts[1].String() {
+		t.Errorf("next evaluation %v", a)
+	}
+}
@@ -0,0 +1,163 @@
+// Package detection holds detectors that look for attacks and unusual
+// behaviour in the packet stream and report them as alerts.
+//
+// Detectors never read the clock themselves, packets and ticks carry the
+// time, so a recorded event sequence replays the same way.
+package detection
+
+import (
+	"fmt"
+	"kernelKoala/pkg/alert"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// TCP flag bits as exported by the tc program.
+const (
+	FlagFIN = 0x01
+	FlagSYN = 0x02
+	FlagRST = 0x04
+	FlagPSH = 0x08
+	FlagACK = 0x10
+)
+
+// IP protocol numbers.
+const (
+	ProtoICMP = 1
+	ProtoTCP  = 6
+	ProtoUDP  = 17
+)
+
+// Packet is what the detectors know about one captured packet.
+type Packet struct {
+	Time     time.Time
+	Iface    string
+	Egress   bool
+	Protocol uint8
+	SrcIP    netip.Addr
+	DstIP    netip.Addr
+	SrcPort  uint16
+	DstPort  uint16
+	TcpFlags uint8
+	Bytes    uint32
+	// NewFlow marks the first packet seen of a connection.
+	NewFlow bool
+	// Scope is the traffic scope, e.g. "east-west", when known.
+	Scope string
+}
+
+// IsSYN reports a connection attempt, a SYN without ACK.
+func (p Packet) IsSYN() bool {
+	return p.Protocol == ProtoTCP && p.TcpFlags&(FlagSYN|FlagACK) == FlagSYN
+}
+
+// IsSYNACK reports the answer to a connection attempt.
+func (p Packet) IsSYNACK() bool {
+	return p.Protocol == ProtoTCP && p.TcpFlags&(FlagSYN|FlagACK) == FlagSYN|FlagACK
+}
+
+// IsRST reports a reset.
+func (p Packet) IsRST() bool {
+	return p.Protocol == ProtoTCP && p.TcpFlags&FlagRST != 0
+}
+
+func (p Packet) protocolName() string {
+	switch p.Protocol {
+	case ProtoTCP:
+		return "TCP"
+	case ProtoUDP:
+		return "UDP"
+	case ProtoICMP:
+		return "ICMP"
+	default:
+		return fmt.Sprintf("PROTO(%d)", p.Protocol)
+	}
+}
+
+// newAlert fills in the endpoint fields of an alert from p.
+func newAlert(p Packet, typ string, severity alert.Severity, message string, fields map[string]string) alert.Alert {
+	return alert.Alert{
+		Time:     p.Time,
+		Type:     typ,
+		Severity: severity,
+		Message:  message,
+		Protocol: p.protocolName(),
+		SrcIP:    addrString(p.SrcIP),
+		SrcPort:  p.SrcPort,
+		DstIP:    addrString(p.DstIP),
+		DstPort:  p.DstPort,
+		Iface:    p.Iface,
+		Fields:   fields,
+	}
+}
+
+func addrString(a netip.Addr) string {
+	if !a.IsValid() {
+		return ""
+	}
+	return a.String()
+}
+
+// Detector consumes packets and reports alerts. Observe is called from
+// several goroutines, Tick periodically with the current time so detectors
+// can close windows and forget idle state.
+type Detector interface {
+	Name() string
+	Observe(p Packet) []alert.Alert
+	Tick(now time.Time) []alert.Alert
+}
+
+// Closer is implemented by detectors with state to flush on shutdown.
+type Closer interface {
+	Close() error
+}
+
+// joinPorts renders up to max ports in ascending order.
+func joinPorts(ports map[uint16]struct{}, max int) string {
+	list := make([]int, 0, len(ports))
+	for p := range ports {
+		list = append(list, int(p))
+	}
+	sort.Ints(list)
+
+	var b strings.Builder
+	for i, p := range list {
+		if i == max {
+			fmt.Fprintf(&b, ",+%d", len(list)-max)
+			break
+		}
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		b.WriteString(strconv.Itoa(p))
+	}
+	return b.String()
+}
+
+// writeFileAtomic writes data to a temporary file next to path and renames
+// it over path, so readers and a crash see either the old or the new file.
+func writeFileAtomic(path string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+"-*")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,403 @@
+package detection
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"kernelKoala/pkg/alert"
+	"net/netip"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// GraphConfig holds the settings of the connection graph detector.
+type GraphConfig struct {
+	// LearnFor is how long edges are learned silently after the graph was
+	// first created, alerts start afterwards.
+	LearnFor time.Duration
+	// Scopes limits the graph to traffic of these scopes, e.g. "east-west".
+	Scopes []string
+	// Path, if set, is where the graph is saved every SaveInterval and
+	// loaded from at startup.
+	Path         string
+	SaveInterval time.Duration
+	// AllowlistPath lists edges that never alert.
+	AllowlistPath string
+	MaxEdges      int
+	// Namer names an address, e.g. after its workload. Addresses it
+	// doesn't know are used as they are.
+	Namer func(netip.Addr) (string, bool) `json:"-"`
+}
+
+func DefaultGraphConfig() GraphConfig {
+	return GraphConfig{
+		LearnFor:     24 * time.Hour,
+		Scopes:       []string{"east-west"},
+		SaveInterval: 5 * time.Minute,
+		MaxEdges:     100000,
+	}
+}
+
+// EdgeKey identifies a directed edge from a client to a server port.
+type EdgeKey struct {
+	Src      string `json:"src"`
+	Dst      string `json:"dst"`
+	Port     uint16 `json:"port"`
+	Protocol string `json:"protocol"`
+}
+
+func (k EdgeKey) String() string {
+	return fmt.Sprintf("%s -> %s %s/%d", k.Src, k.Dst, k.Protocol, k.Port)
+}
+
+// Edge is a learned or observed edge.
+type Edge struct {
+	EdgeKey
+	FirstSeen time.Time `json:"first_seen"`
+	LastSeen  time.Time `json:"last_seen"`
+	Flows     uint64    `json:"flows"`
+	// Learned is false for edges first seen after the learning period.
+	Learned bool `json:"learned"`
+}
+
+// Graph is the on-disk form of the connection graph.
+type Graph struct {
+	LearningStarted time.Time `json:"learning_started"`
+	LearningUntil   time.Time `json:"learning_until"`
+	Edges           []Edge    `json:"edges"`
+}
+
+// LoadGraph reads a graph saved by the detector.
+func LoadGraph(path string) (*Graph, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var g Graph
+	if err := json.Unmarshal(data, &g); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return &g, nil
+}
+
+// WriteText prints one edge per line, sorted.
+func (g *Graph) WriteText(w io.Writer) error {
+	fmt.Fprintf(w, "# learning %s - %s, %d edges\n",
+		g.LearningStarted.Format(time.RFC3339), g.LearningUntil.Format(time.RFC3339), len(g.Edges))
+	for _, e := range g.Edges {
+		state := "learned"
+		if !e.Learned {
+			state = "new"
+		}
+		if _, err := fmt.Fprintf(w, "%s flows=%d first=%s last=%s %s\n", e.EdgeKey, e.Flows,
+			e.FirstSeen.Format(time.RFC3339), e.LastSeen.Format(time.RFC3339), state); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// WriteDot prints the graph in Graphviz format.
+func (g *Graph) WriteDot(w io.Writer) error {
+	fmt.Fprintln(w, "digraph connections {")
+	for _, e := range g.Edges {
+		style := ""
+		if !e.Learned {
+			style = ", color=red"
+		}
+		fmt.Fprintf(w, "  %q -> %q [label=%q%s];\n", e.Src, e.Dst,
+			fmt.Sprintf("%s/%d", e.Protocol, e.Port), style)
+	}
+	_, err := fmt.Fprintln(w, "}")
+	return err
+}
+
+type allowRule struct {
+	src, dst string
+	port     int // -1 for any
+	protocol string
+}
+
+// parseAllowlist reads "src dst [port[/proto]]" lines. Endpoints are a
+// node name, an address, a CIDR or "*".
+func parseAllowlist(path string) ([]allowRule, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var rules []allowRule
+	scanner := bufio.NewScanner(f)
+	lineNo := 0
+	for scanner.Scan() {
+		lineNo++
+		line := scanner.Text()
+		if i := strings.IndexByte(line, '#'); i >= 0 {
+			line = line[:i]
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) < 2 || len(fields) > 3 {
+			return nil, fmt.Errorf("%s:%d: expected \"src dst [port[/proto]]\"", path, lineNo)
+		}
+
+		r := allowRule{src: fields[0], dst: fields[1], port: -1}
+		if len(fields) == 3 && fields[2] != "*" {
+			port, proto, _ := strings.Cut(fields[2], "/")
+			n, err := strconv.ParseUint(port, 10, 16)
+			if err != nil {
+				return nil, fmt.Errorf("%s:%d: invalid port %q", path, lineNo, port)
+			}
+			r.port, r.protocol = int(n), strings.ToUpper(proto)
+		}
+		rules = append(rules, r)
+	}
+	return rules, scanner.Err()
+}
+
+func matchEndpoint(pattern, name string, addr netip.Addr) bool {
+	if pattern == "*" || pattern == name || pattern == addr.String() {
+		return true
+	}
+	if prefix, err := netip.ParsePrefix(pattern); err == nil {
+		return prefix.Contains(addr)
+	}
+	return false
+}
+
+func (r allowRule) matches(k EdgeKey, src, dst netip.Addr) bool {
+	return matchEndpoint(r.src, k.Src, src) && matchEndpoint(r.dst, k.Dst, dst) &&
+		(r.port < 0 || uint16(r.port) == k.Port) &&
+		(r.protocol == "" || r.protocol == k.Protocol)
+}
+
+// GraphDetector learns which nodes talk to which server ports and, once
+// the learning period is over, alerts on edges it has not seen before.
+type GraphDetector struct {
+	cfg       GraphConfig
+	scopes    map[string]bool
+	allowlist []allowRule
+
+	mu       sync.Mutex
+	started  time.Time
+	until    time.Time
+	edges    map[EdgeKey]*Edge
+	pairs    map[[2]string]bool
+	dirty    bool
+	lastSave time.Time
+	// full is set once MaxEdges was reached and reported
+	full bool
+}
+
+// NewGraphDetector loads the saved graph and the allowlist, if configured.
+func NewGraphDetector(cfg GraphConfig) (*GraphDetector, error) {
+	d := &GraphDetector{
+		cfg:    cfg,
+		scopes: make(map[string]bool),
+		edges:  make(map[EdgeKey]*Edge),
+		pairs:  make(map[[2]string]bool),
+	}
+	for _, s := range cfg.Scopes {
+		d.scopes[s] = true
+	}
+
+	if cfg.AllowlistPath != "" {
+		rules, err := parseAllowlist(cfg.AllowlistPath)
+		if err != nil {
+			return nil, err
+		}
+		d.allowlist = rules
+	}
+
+	if cfg.Path != "" {
+		g, err := LoadGraph(cfg.Path)
+		switch {
+		case os.IsNotExist(err):
+		case err != nil:
+			return nil, err
+		default:
+			d.started, d.until = g.LearningStarted, g.LearningUntil
+			for i := range g.Edges {
+				e := g.Edges[i]
+				d.edges[e.EdgeKey] = &e
+				d.pairs[[2]string{e.Src, e.Dst}] = true
+			}
+		}
+	}
+	return d, nil
+}
+
+func (d *GraphDetector) Name() string { return "graph" }
+
+func (d *GraphDetector) Observe(p Packet) []alert.Alert {
+	if !p.NewFlow || (len(d.scopes) > 0 && !d.scopes[p.Scope]) {
+		return nil
+	}
+
+	// Orient the edge from client to server
+	client, server, port := p.SrcIP, p.DstIP, p.DstPort
+	switch {
+	case p.IsSYN():
+	case p.IsSYNACK():
+		client, server, port = p.DstIP, p.SrcIP, p.SrcPort
+	case p.Protocol == ProtoUDP:
+		if servicePort(p) == p.SrcPort && p.SrcPort != p.DstPort {
+			client, server, port = p.DstIP, p.SrcIP, p.SrcPort
+		}
+	default:
+		return nil
+	}
+
+	key := EdgeKey{
+		Src:      d.nodeName(client),
+		Dst:      d.nodeName(server),
+		Port:     port,
+		Protocol: p.protocolName(),
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.started.IsZero() {
+		d.started, d.until = p.Time, p.Time.Add(d.cfg.LearnFor)
+	}
+
+	if e := d.edges[key]; e != nil {
+		e.LastSeen = p.Time
+		e.Flows++
+		d.dirty = true
+		return nil
+	}
+	if len(d.edges) >= d.cfg.MaxEdges {
+		// Edges beyond the cap are neither learned nor reported, say so
+		// once instead of going quiet
+		if d.full {
+			return nil
+		}
+		d.full = true
+		return []alert.Alert{newAlert(p, "graph", alert.SeverityMedium,
+			fmt.Sprintf("connection graph is full at %d edges, new edges such as %s are no longer learned or reported", len(d.edges), key),
+			map[string]string{
+				"kind":      "graph-full",
+				"edges":     strconv.Itoa(len(d.edges)),
+				"max_edges": strconv.Itoa(d.cfg.MaxEdges),
+			})}
+	}
+
+	learning := p.Time.Before(d.until)
+	pair := [2]string{key.Src, key.Dst}
+	knownPair := d.pairs[pair]
+	d.edges[key] = &Edge{EdgeKey: key, FirstSeen: p.Time, LastSeen: p.Time, Flows: 1, Learned: learning}
+	d.pairs[pair] = true
+	d.dirty = true
+
+	if learning {
+		return nil
+	}
+	for _, r := range d.allowlist {
+		if r.matches(key, client, server) {
+			return nil
+		}
+	}
+
+	kind, severity := "new-edge", alert.SeverityMedium
+	message := fmt.Sprintf("%s talked to %s for the first time on %s/%d", key.Src, key.Dst, key.Protocol, key.Port)
+	if knownPair {
+		kind, severity = "new-port", alert.SeverityLow
+		message = fmt.Sprintf("%s talked to %s on new port %s/%d", key.Src, key.Dst, key.Protocol, key.Port)
+	}
+	return []alert.Alert{newAlert(p, kind, severity, message, map[string]string{
+		"kind":     kind,
+		"src_node": key.Src,
+		"dst_node": key.Dst,
+		"port":     strconv.Itoa(int(key.Port)),
+	})}
+}
+
+func (d *GraphDetector) nodeName(addr netip.Addr) string {
+	if d.cfg.Namer != nil {
+		if name, ok := d.cfg.Namer(addr); ok {
+			return name
+		}
+	}
+	return addr.String()
+}
+
+// Tick saves the graph when it changed.
+func (d *GraphDetector) Tick(now time.Time) []alert.Alert {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.cfg.Path == "" || !d.dirty || now.Sub(d.lastSave) < d.cfg.SaveInterval {
+		return nil
+	}
+	d.lastSave = now
+	if err := d.save(); err != nil {
+		return []alert.Alert{{
+			Time:     now,
+			Type:     "graph",
+			Severity: alert.SeverityLow,
+			Message:  "failed to save connection graph: " + err.Error(),
+		}}
+	}
+	return nil
+}
+
+// Snapshot returns the graph with edges sorted.
+func (d *GraphDetector) Snapshot() *Graph {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.snapshot()
+}
+
+func (d *GraphDetector) snapshot() *Graph {
+	g := &Graph{LearningStarted: d.started, LearningUntil: d.until, Edges: make([]Edge, 0, len(d.edges))}
+	for _, e := range d.edges {
+		g.Edges = append(g.Edges, *e)
+	}
+	sort.Slice(g.Edges, func(i, j int) bool {
+		a, b := g.Edges[i], g.Edges[j]
+		if a.Src != b.Src {
+			return a.Src < b.Src
+		}
+		if a.Dst != b.Dst {
+			return a.Dst < b.Dst
+		}
+		if a.Protocol != b.Protocol {
+			return a.Protocol < b.Protocol
+		}
+		return a.Port < b.Port
+	})
+	return g
+}
+
+// save writes the graph, the caller holds d.mu.
+func (d *GraphDetector) save() error {
+	data, err := json.MarshalIndent(d.snapshot(), "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := writeFileAtomic(d.cfg.Path, data); err != nil {
+		return err
+	}
+	d.dirty = false
+	return nil
+}
+
+// Close saves the graph.
+func (d *GraphDetector) Close() error {
+	if d.cfg.Path == "" {
+		return nil
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.save()
+}
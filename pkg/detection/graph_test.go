@@ -0,0 +1,142 @@
+package detection
+
+import (
+	"kernelKoala/pkg/alert"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func writeFile(t *testing.T, name, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestParseAllowlist(t *testing.T) {
+	rules, err := parseAllowlist(writeFile(t, "allow", "# expected\nbilling 10.20.0.0/16 5432/tcp\n\n* dns 53 # any protocol\nweb api *\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []allowRule{
+		{src: "billing", dst: "10.20.0.0/16", port: 5432, protocol: "TCP"},
+		{src: "*", dst: "dns", port: 53},
+		{src: "web", dst: "api", port: -1},
+	}
+	if len(rules) != len(want) {
+		t.Fatalf("rules %+v", rules)
+	}
+	for i := range want {
+		if rules[i] != want[i] {
+			t.Errorf("rule %d = %+v, want %+v", i, rules[i], want[i])
+		}
+	}
+
+	for _, content := range []string{"web\n", "web api 80 tcp\n", "web api http\n", "web api 70000\n"} {
+		if _, err := parseAllowlist(writeFile(t, "allow", content)); err == nil || !strings.Contains(err.Error(), ":1:") {
+			t.Errorf("%q: err = %v", content, err)
+		}
+	}
+}
+
+func graphConfig() GraphConfig {
+	cfg := DefaultGraphConfig()
+	cfg.LearnFor = time.Hour
+	cfg.Scopes = nil
+	return cfg
+}
+
+func TestGraphLearning(t *testing.T) {
+	d, err := NewGraphDetector(graphConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Edges seen while learning never alert, not even later
+	if a := replay(d, newFlow(syn(0, host(1), host(2), 443)), newFlow(syn(59*time.Minute, host(1), host(3), 443))); len(a) != 0 {
+		t.Fatalf("alerts while learning: %v", a)
+	}
+	if a := d.Observe(newFlow(syn(2*time.Hour, host(1), host(2), 443))); len(a) != 0 {
+		t.Fatalf("learned edge alerted: %v", a)
+	}
+	// Packets of known flows are not new edges
+	if a := d.Observe(syn(2*time.Hour, host(4), host(2), 443)); len(a) != 0 {
+		t.Fatalf("packet of an old flow alerted: %v", a)
+	}
+
+	g := d.Snapshot()
+	if len(g.Edges) != 2 || !g.Edges[0].Learned || g.Edges[0].Flows != 2 || !g.LearningUntil.Equal(scanT0.Add(time.Hour)) {
+		t.Errorf("graph %+v", g)
+	}
+}
+
+func TestGraphNewEdgeAndPort(t *testing.T) {
+	cfg := graphConfig()
+	cfg.AllowlistPath = writeFile(t, "allow", "10.0.0.1 10.0.0.9 *\n")
+	d, err := NewGraphDetector(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.Observe(newFlow(syn(0, host(1), host(2), 443)))
+
+	after := 2 * time.Hour
+	edge := d.Observe(newFlow(syn(after, host(1), host(3), 443)))
+	if len(edge) != 1 || edge[0].Type != "new-edge" || edge[0].Fields["kind"] != "new-edge" {
+		t.Fatalf("new pair raised %v", edge)
+	}
+	port := d.Observe(newFlow(syn(after, host(1), host(2), 8443)))
+	if len(port) != 1 || port[0].Type != "new-port" || port[0].Severity != alert.SeverityLow {
+		t.Fatalf("new port raised %v", port)
+	}
+	// The answer to a connection is oriented back to the client
+	synAck := syn(after, host(3), host(1), 40000)
+	synAck.SrcPort, synAck.TcpFlags = 443, FlagSYN|FlagACK
+	if a := d.Observe(newFlow(synAck)); len(a) != 0 {
+		t.Errorf("SYN-ACK of a known edge alerted: %v", a)
+	}
+	if a := d.Observe(newFlow(syn(after, host(1), host(9), 22))); len(a) != 0 {
+		t.Errorf("allowlisted edge alerted: %v", a)
+	}
+}
+
+func TestGraphSave(t *testing.T) {
+	cfg := graphConfig()
+	cfg.Path = filepath.Join(t.TempDir(), "missing", "graph.json")
+	d, err := NewGraphDetector(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.Observe(newFlow(syn(0, host(1), host(2), 443)))
+
+	// A failed save keeps the changes for the next attempt
+	if a := d.Tick(scanT0.Add(time.Hour)); len(a) != 1 || !d.dirty {
+		t.Fatalf("failed save: %v, dirty %v", a, d.dirty)
+	}
+	if err := os.Mkdir(filepath.Dir(cfg.Path), 0o700); err != nil {
+		t.Fatal(err)
+	}
+	if a := d.Tick(scanT0.Add(2 * time.Hour)); len(a) != 0 || d.dirty {
+		t.Fatalf("save: %v, dirty %v", a, d.dirty)
+	}
+
+	// A restarted detector goes on with the saved graph
+	d, err = NewGraphDetector(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a := d.Observe(newFlow(syn(3*time.Hour, host(1), host(2), 443))); len(a) != 0 {
+		t.Errorf("saved edge alerted: %v", a)
+	}
+	if a := d.Observe(newFlow(syn(3*time.Hour, host(5), host(2), 443))); len(a) != 1 {
+		t.Errorf("learning started again after the restart: %v", a)
+	}
+}
+
+func newFlow(p Packet) Packet {
+	p.NewFlow = true
+	return p
+}
@@ -0,0 +1,285 @@
+package detection
+
+import (
+	"container/list"
+	"encoding/binary"
+	"fmt"
+	"kernelKoala/pkg/alert"
+	"net/netip"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Port scan kinds.
+const (
+	ScanVertical   = "vertical"   // many ports on one host
+	ScanHorizontal = "horizontal" // one port on many hosts
+	ScanBlock      = "block"      // many ports on many hosts
+)
+
+// PortScanConfig holds the thresholds of the port scan detector. Counts are
+// of distinct targets within Window.
+type PortScanConfig struct {
+	Window          time.Duration
+	VerticalPorts   int
+	HorizontalHosts int
+	BlockHosts      int
+	BlockPorts      int
+	// MaxSources bounds the tracked sources, new sources are ignored until
+	// idle ones expire. The bound is spread over the source shards.
+	MaxSources int
+	// MaxProbes bounds the distinct targets remembered per source.
+	MaxProbes int
+}
+
+func DefaultPortScanConfig() PortScanConfig {
+	return PortScanConfig{
+		Window:          time.Minute,
+		VerticalPorts:   25,
+		HorizontalHosts: 25,
+		BlockHosts:      10,
+		BlockPorts:      10,
+		MaxSources:      10000,
+		MaxProbes:       4096,
+	}
+}
+
+// portScanShards spreads the sources over locks, a source always lands in
+// the same shard.
+const portScanShards = 16
+
+type probeKey struct {
+	dst  netip.Addr
+	port uint16
+}
+
+type probe struct {
+	key probeKey
+	at  time.Time
+}
+
+// scanSource keeps the distinct targets of one source in the order they
+// were last probed, along with how many ports each host and how many hosts
+// each port was probed on. The counts follow every probe that is added or
+// ages out, so checking the thresholds doesn't walk the probes.
+type scanSource struct {
+	probes    map[probeKey]*list.Element
+	order     *list.List // front is the latest probe
+	hostPorts map[netip.Addr]int
+	portHosts map[uint16]int
+	first     time.Time
+	last      time.Time
+	tcp       int
+	udp       int
+	open      int // SYN-ACK answers
+	closed    int // RST answers
+	reported  map[string]time.Time
+}
+
+type scanShard struct {
+	mu      sync.Mutex
+	sources map[netip.Addr]*scanSource
+}
+
+// PortScanDetector tracks the distinct hosts and ports each source tries to
+// reach. TCP probes are bare SYNs, UDP probes go to ports below the
+// ephemeral range so that replies to clients don't count. SYN-ACK and RST
+// answers from the targets are kept as evidence of open and closed ports.
+type PortScanDetector struct {
+	cfg PortScanConfig
+
+	shards      [portScanShards]scanShard
+	maxPerShard int
+}
+
+func NewPortScanDetector(cfg PortScanConfig) *PortScanDetector {
+	d := &PortScanDetector{
+		cfg:         cfg,
+		maxPerShard: max(cfg.MaxSources/portScanShards, 1),
+	}
+	for i := range d.shards {
+		d.shards[i].sources = make(map[netip.Addr]*scanSource)
+	}
+	return d
+}
+
+func (d *PortScanDetector) Name() string { return "port-scan" }
+
+func (d *PortScanDetector) shard(addr netip.Addr) *scanShard {
+	b := addr.As16()
+	h := binary.BigEndian.Uint32(b[0:]) ^ binary.BigEndian.Uint32(b[4:]) ^
+		binary.BigEndian.Uint32(b[8:]) ^ binary.BigEndian.Uint32(b[12:])
+	return &d.shards[(h*2654435761)>>28%portScanShards]
+}
+
+func (d *PortScanDetector) Observe(p Packet) []alert.Alert {
+	switch {
+	case p.IsSYN():
+	case p.Protocol == ProtoUDP && p.DstPort < 32768:
+	case p.IsSYNACK():
+		d.answer(p.DstIP, true)
+		return nil
+	case p.IsRST():
+		d.answer(p.DstIP, false)
+		return nil
+	default:
+		return nil
+	}
+
+	shard := d.shard(p.SrcIP)
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+
+	src := shard.sources[p.SrcIP]
+	if src == nil {
+		if len(shard.sources) >= d.maxPerShard {
+			return nil
+		}
+		src = &scanSource{
+			probes:    make(map[probeKey]*list.Element),
+			order:     list.New(),
+			hostPorts: make(map[netip.Addr]int),
+			portHosts: make(map[uint16]int),
+			first:     p.Time,
+			reported:  make(map[string]time.Time),
+		}
+		shard.sources[p.SrcIP] = src
+	}
+	src.last = p.Time
+	if p.Protocol == ProtoTCP {
+		src.tcp++
+	} else {
+		src.udp++
+	}
+
+	key := probeKey{dst: p.DstIP, port: p.DstPort}
+	if elem, ok := src.probes[key]; ok {
+		elem.Value.(*probe).at = p.Time
+		src.order.MoveToFront(elem)
+		return nil
+	}
+
+	d.prune(src, p.Time)
+	if len(src.probes) >= d.cfg.MaxProbes {
+		return nil
+	}
+	src.probes[key] = src.order.PushFront(&probe{key: key, at: p.Time})
+	src.hostPorts[key.dst]++
+	src.portHosts[key.port]++
+	return d.evaluate(p, src)
+}
+
+// answer records a target's reply to a probe, addressed to the prober.
+func (d *PortScanDetector) answer(prober netip.Addr, open bool) {
+	shard := d.shard(prober)
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+
+	if src := shard.sources[prober]; src != nil {
+		if open {
+			src.open++
+		} else {
+			src.closed++
+		}
+	}
+}
+
+// prune drops the probes older than the window, oldest first.
+func (d *PortScanDetector) prune(src *scanSource, now time.Time) {
+	cutoff := now.Add(-d.cfg.Window)
+	for elem := src.order.Back(); elem != nil; elem = src.order.Back() {
+		pr := elem.Value.(*probe)
+		if !pr.at.Before(cutoff) {
+			break
+		}
+		src.order.Remove(elem)
+		delete(src.probes, pr.key)
+		if src.hostPorts[pr.key.dst]--; src.hostPorts[pr.key.dst] == 0 {
+			delete(src.hostPorts, pr.key.dst)
+		}
+		if src.portHosts[pr.key.port]--; src.portHosts[pr.key.port] == 0 {
+			delete(src.portHosts, pr.key.port)
+		}
+	}
+	if src.first.Before(cutoff) {
+		src.first = cutoff
+	}
+}
+
+// evaluate checks the thresholds after p added a new target. Only the host
+// and port of p can have crossed the vertical and horizontal ones.
+func (d *PortScanDetector) evaluate(p Packet, src *scanSource) []alert.Alert {
+	hosts, ports := len(src.hostPorts), len(src.portHosts)
+
+	// A block scan also looks vertical and horizontal, report the wider one
+	if hosts >= d.cfg.BlockHosts && ports >= d.cfg.BlockPorts {
+		return d.report(p, src, ScanBlock, alert.SeverityHigh,
+			fmt.Sprintf("block scan from %s: %d ports on %d hosts", p.SrcIP, ports, hosts),
+			func() map[uint16]struct{} { return src.ports(nil) }, hosts)
+	}
+	if n := src.hostPorts[p.DstIP]; n >= d.cfg.VerticalPorts {
+		return d.report(p, src, ScanVertical, alert.SeverityMedium,
+			fmt.Sprintf("vertical scan from %s: %d ports on %s", p.SrcIP, n, p.DstIP),
+			func() map[uint16]struct{} { return src.ports(&p.DstIP) }, 1)
+	}
+	if n := src.portHosts[p.DstPort]; n >= d.cfg.HorizontalHosts {
+		return d.report(p, src, ScanHorizontal, alert.SeverityMedium,
+			fmt.Sprintf("horizontal scan from %s: port %d on %d hosts", p.SrcIP, p.DstPort, n),
+			func() map[uint16]struct{} { return map[uint16]struct{}{p.DstPort: {}} }, n)
+	}
+	return nil
+}
+
+// ports returns the probed ports, of one host if dst is set.
+func (src *scanSource) ports(dst *netip.Addr) map[uint16]struct{} {
+	ports := make(map[uint16]struct{})
+	if dst == nil {
+		for port := range src.portHosts {
+			ports[port] = struct{}{}
+		}
+		return ports
+	}
+	for k := range src.probes {
+		if k.dst == *dst {
+			ports[k.port] = struct{}{}
+		}
+	}
+	return ports
+}
+
+// report raises an alert unless the same kind was reported for this source
+// within the window. The port list is only built for alerts that go out.
+func (d *PortScanDetector) report(p Packet, src *scanSource, kind string, severity alert.Severity, message string, ports func() map[uint16]struct{}, hosts int) []alert.Alert {
+	if last, ok := src.reported[kind]; ok && p.Time.Sub(last) < d.cfg.Window {
+		return nil
+	}
+	src.reported[kind] = p.Time
+
+	return []alert.Alert{newAlert(p, "port-scan", severity, message, map[string]string{
+		"kind":     kind,
+		"ports":    joinPorts(ports(), 32),
+		"hosts":    strconv.Itoa(hosts),
+		"probes":   strconv.Itoa(len(src.probes)),
+		"timespan": p.Time.Sub(src.first).Round(time.Millisecond).String(),
+		"tcp_syn":  strconv.Itoa(src.tcp),
+		"udp":      strconv.Itoa(src.udp),
+		"open":     strconv.Itoa(src.open),
+		"closed":   strconv.Itoa(src.closed),
+	})}
+}
+
+// Tick forgets sources that sent no probe for a whole window.
+func (d *PortScanDetector) Tick(now time.Time) []alert.Alert {
+	for i := range d.shards {
+		shard := &d.shards[i]
+		shard.mu.Lock()
+		for addr, src := range shard.sources {
+			if now.Sub(src.last) > d.cfg.Window {
+				delete(shard.sources, addr)
+			}
+		}
+		shard.mu.Unlock()
+	}
+	return nil
+}
@@ -0,0 +1,262 @@
+package detection
+
+import (
+	"kernelKoala/pkg/alert"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+var (
+	scanner = netip.MustParseAddr("203.0.113.7")
+	scanT0  = time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+)
+
+func syn(at time.Duration, src, dst netip.Addr, port uint16) Packet {
+	return Packet{
+		Time:     scanT0.Add(at),
+		Protocol: ProtoTCP,
+		SrcIP:    src,
+		DstIP:    dst,
+		SrcPort:  40000,
+		DstPort:  port,
+		TcpFlags: FlagSYN,
+	}
+}
+
+func host(i int) netip.Addr {
+	return netip.AddrFrom4([4]byte{10, 0, byte(i >> 8), byte(i)})
+}
+
+func testPortScanConfig() PortScanConfig {
+	cfg := DefaultPortScanConfig()
+	cfg.VerticalPorts = 5
+	cfg.HorizontalHosts = 5
+	cfg.BlockHosts = 3
+	cfg.BlockPorts = 3
+	return cfg
+}
+
+// replay feeds the packets in order and collects the alerts.
+func replay(d Detector, packets ...Packet) []alert.Alert {
+	var out []alert.Alert
+	for _, p := range packets {
+		out = append(out, d.Observe(p)...)
+	}
+	return out
+}
+
+func TestPortScanVertical(t *testing.T) {
+	d := NewPortScanDetector(testPortScanConfig())
+	target := host(1)
+
+	var packets []Packet
+	for port := uint16(1); port <= 8; port++ {
+		packets = append(packets, syn(time.Duration(port)*time.Second, scanner, target, port))
+	}
+	alerts := replay(d, packets...)
+	if len(alerts) != 1 {
+		t.Fatalf("got %d alerts, want 1: %v", len(alerts), alerts)
+	}
+	a := alerts[0]
+	if a.Fields["kind"] != ScanVertical || a.Fields["ports"] != "1,2,3,4,5" || a.Fields["hosts"] != "1" {
+		t.Errorf("unexpected alert fields %v", a.Fields)
+	}
+	if a.Fields["timespan"] != "4s" {
+		t.Errorf("timespan = %s, want 4s", a.Fields["timespan"])
+	}
+}
+
+func TestPortScanHorizontal(t *testing.T) {
+	d := NewPortScanDetector(testPortScanConfig())
+
+	var packets []Packet
+	for i := range 5 {
+		packets = append(packets, syn(time.Duration(i)*time.Second, scanner, host(i), 22))
+	}
+	alerts := replay(d, packets...)
+	if len(alerts) != 1 {
+		t.Fatalf("got %d alerts, want 1: %v", len(alerts), alerts)
+	}
+	if f := alerts[0].Fields; f["kind"] != ScanHorizontal || f["ports"] != "22" || f["hosts"] != "5" {
+		t.Errorf("unexpected alert fields %v", f)
+	}
+}
+
+func TestPortScanBlock(t *testing.T) {
+	d := NewPortScanDetector(testPortScanConfig())
+
+	// The third host's first port completes the block
+	var packets []Packet
+	for i := range 3 {
+		for port := uint16(80); port < 83; port++ {
+			packets = append(packets, syn(time.Second, scanner, host(i), port))
+		}
+	}
+	alerts := replay(d, packets...)
+	if len(alerts) != 1 {
+		t.Fatalf("got %d alerts, want 1: %v", len(alerts), alerts)
+	}
+	if f := alerts[0].Fields; f["kind"] != ScanBlock || f["ports"] != "80,81,82" || f["hosts"] != "3" || f["probes"] != "7" {
+		t.Errorf("unexpected alert fields %v", f)
+	}
+	if alerts[0].Severity != alert.SeverityHigh {
+		t.Errorf("severity = %s, want high", alerts[0].Severity)
+	}
+}
+
+func TestPortScanCooldown(t *testing.T) {
+	d := NewPortScanDetector(testPortScanConfig())
+	target := host(1)
+
+	var alerts []alert.Alert
+	for port := uint16(1); port <= 20; port++ {
+		alerts = append(alerts, d.Observe(syn(time.Duration(port)*time.Second, scanner, target, port))...)
+	}
+	if len(alerts) != 1 {
+		t.Fatalf("got %d alerts within the window, want 1", len(alerts))
+	}
+
+	// Keep scanning past the window, the kind is reported again
+	for port := uint16(21); port <= 80; port++ {
+		alerts = append(alerts, d.Observe(syn(time.Duration(port)*time.Second, scanner, target, port))...)
+	}
+	if len(alerts) != 2 {
+		t.Fatalf("got %d alerts after the window, want 2", len(alerts))
+	}
+}
+
+func TestPortScanAgesOutProbes(t *testing.T) {
+	d := NewPortScanDetector(testPortScanConfig())
+	target := host(1)
+
+	// Four ports a window apart never add up to five
+	var packets []Packet
+	for round := range 3 {
+		at := time.Duration(round) * 2 * time.Minute
+		for port := uint16(1); port <= 4; port++ {
+			packets = append(packets, syn(at, scanner, target, port+uint16(round)*10))
+		}
+	}
+	if alerts := replay(d, packets...); len(alerts) != 0 {
+		t.Fatalf("got %d alerts, want none: %v", len(alerts), alerts)
+	}
+
+	src := d.shard(scanner).sources[scanner]
+	if len(src.probes) != 4 || src.order.Len() != 4 {
+		t.Errorf("kept %d probes, %d in order, want 4", len(src.probes), src.order.Len())
+	}
+	if len(src.hostPorts) != 1 || src.hostPorts[target] != 4 {
+		t.Errorf("host counts = %v, want 4 ports on %s", src.hostPorts, target)
+	}
+	for port := range src.portHosts {
+		if port < 21 {
+			t.Errorf("port %d of an earlier round is still counted", port)
+		}
+	}
+}
+
+func TestPortScanRepeatedProbeStaysFresh(t *testing.T) {
+	cfg := testPortScanConfig()
+	d := NewPortScanDetector(cfg)
+	target := host(1)
+
+	// Port 1 is probed again just before it would age out
+	replay(d,
+		syn(0, scanner, target, 1),
+		syn(50*time.Second, scanner, target, 1),
+		syn(90*time.Second, scanner, target, 2),
+	)
+	src := d.shard(scanner).sources[scanner]
+	if src.hostPorts[target] != 2 {
+		t.Errorf("%d ports counted on %s, want 2", src.hostPorts[target], target)
+	}
+}
+
+func TestPortScanIgnoresReplies(t *testing.T) {
+	d := NewPortScanDetector(testPortScanConfig())
+	target := host(1)
+
+	var packets []Packet
+	for port := uint16(0); port < 10; port++ {
+		// Replies to a client land on ephemeral ports
+		packets = append(packets, Packet{
+			Time: scanT0, Protocol: ProtoUDP, SrcIP: scanner, DstIP: target, SrcPort: 53, DstPort: 40000 + port,
+		})
+		p := syn(0, scanner, target, 1000+port)
+		p.TcpFlags = FlagSYN | FlagACK
+		packets = append(packets, p)
+	}
+	if alerts := replay(d, packets...); len(alerts) != 0 {
+		t.Fatalf("got %d alerts, want none", len(alerts))
+	}
+}
+
+func TestPortScanCountsAnswers(t *testing.T) {
+	d := NewPortScanDetector(testPortScanConfig())
+	target := host(1)
+
+	var alerts []alert.Alert
+	for port := uint16(1); port <= 5; port++ {
+		alerts = append(alerts, d.Observe(syn(0, scanner, target, port))...)
+		answer := Packet{Time: scanT0, Protocol: ProtoTCP, SrcIP: target, DstIP: scanner, SrcPort: port, DstPort: 40000}
+		if port == 3 {
+			answer.TcpFlags = FlagSYN | FlagACK
+		} else {
+			answer.TcpFlags = FlagRST | FlagACK
+		}
+		if port < 5 {
+			d.Observe(answer)
+		}
+	}
+	if len(alerts) != 1 {
+		t.Fatalf("got %d alerts, want 1", len(alerts))
+	}
+	if f := alerts[0].Fields; f["open"] != "1" || f["closed"] != "3" || f["tcp_syn"] != "5" {
+		t.Errorf("unexpected answer counts %v", f)
+	}
+}
+
+func TestPortScanMaxProbes(t *testing.T) {
+	cfg := testPortScanConfig()
+	cfg.MaxProbes = 3
+	d := NewPortScanDetector(cfg)
+	target := host(1)
+
+	var packets []Packet
+	for port := uint16(1); port <= 10; port++ {
+		packets = append(packets, syn(0, scanner, target, port))
+	}
+	if alerts := replay(d, packets...); len(alerts) != 0 {
+		t.Fatalf("got %d alerts, want none", len(alerts))
+	}
+	if n := len(d.shard(scanner).sources[scanner].probes); n != 3 {
+		t.Errorf("remembered %d probes, want 3", n)
+	}
+
+	// Once the first probes age out there is room again
+	alerts := replay(d,
+		syn(2*time.Minute, scanner, target, 20),
+		syn(2*time.Minute, scanner, target, 21),
+	)
+	if len(alerts) != 0 {
+		t.Fatalf("got %d alerts, want none", len(alerts))
+	}
+	if n := len(d.shard(scanner).sources[scanner].probes); n != 2 {
+		t.Errorf("remembered %d probes, want 2", n)
+	}
+}
+
+func TestPortScanTickForgetsIdleSources(t *testing.T) {
+	d := NewPortScanDetector(testPortScanConfig())
+	replay(d, syn(0, scanner, host(1), 1))
+
+	d.Tick(scanT0.Add(30 * time.Second))
+	if d.shard(scanner).sources[scanner] == nil {
+		t.Fatal("source forgotten within the window")
+	}
+	d.Tick(scanT0.Add(2 * time.Minute))
+	if d.shard(scanner).sources[scanner] != nil {
+		t.Fatal("idle source still tracked")
+	}
+}
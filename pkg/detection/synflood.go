@@ -0,0 +1,297 @@
+package detection
+
+import (
+	"fmt"
+	"kernelKoala/pkg/alert"
+	"net/netip"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// SYNFloodConfig holds the thresholds of the SYN flood detector. A
+// destination enters the flood state when it receives at least MinSYNs in an
+// interval and fewer than EnterRatio of them complete the handshake. It
+// leaves it after ExitIntervals intervals with a completion ratio above
+// ExitRatio or too few SYNs, so a flood hovering at the threshold raises one
+// alert instead of many.
+type SYNFloodConfig struct {
+	Interval      time.Duration
+	MinSYNs       int
+	EnterRatio    float64
+	ExitRatio     float64
+	ExitIntervals int
+	// SpoofedRatio is the share of sources sending a single SYN above which
+	// the sources are probably spoofed.
+	SpoofedRatio float64
+	TopSources   int
+
+	MaxDestinations int
+	MaxSources      int // per destination and interval
+	MaxPending      int // handshakes waiting for the final ACK
+}
+
+func DefaultSYNFloodConfig() SYNFloodConfig {
+	return SYNFloodConfig{
+		Interval:        5 * time.Second,
+		MinSYNs:         500,
+		EnterRatio:      0.2,
+		ExitRatio:       0.5,
+		ExitIntervals:   3,
+		SpoofedRatio:    0.8,
+		TopSources:      5,
+		MaxDestinations: 4096,
+		MaxSources:      10000,
+		MaxPending:      65536,
+	}
+}
+
+type service struct {
+	addr netip.Addr
+	port uint16
+}
+
+func (s service) String() string {
+	return netip.AddrPortFrom(s.addr, s.port).String()
+}
+
+type handshake struct {
+	client netip.AddrPort
+	server service
+}
+
+type synTarget struct {
+	syns        int
+	synacks     int
+	completions int
+	sources     map[netip.Addr]int
+	iface       string
+
+	flooding  bool
+	since     time.Time
+	calm      int
+	totalSYNs int
+	peakSYNs  int
+}
+
+// SYNFloodDetector counts SYNs, SYN-ACKs and completed handshakes per
+// destination service.
+type SYNFloodDetector struct {
+	cfg SYNFloodConfig
+
+	mu            sync.Mutex
+	targets       map[service]*synTarget
+	pending       map[handshake]time.Time
+	intervalStart time.Time
+}
+
+func NewSYNFloodDetector(cfg SYNFloodConfig) *SYNFloodDetector {
+	return &SYNFloodDetector{
+		cfg:     cfg,
+		targets: make(map[service]*synTarget),
+		pending: make(map[handshake]time.Time),
+	}
+}
+
+func (d *SYNFloodDetector) Name() string { return "syn-flood" }
+
+func (d *SYNFloodDetector) Observe(p Packet) []alert.Alert {
+	if p.Protocol != ProtoTCP {
+		return nil
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	switch {
+	case p.IsSYN():
+		t := d.target(service{p.DstIP, p.DstPort})
+		if t == nil {
+			return nil
+		}
+		t.syns++
+		t.iface = p.Iface
+		if _, ok := t.sources[p.SrcIP]; ok || len(t.sources) < d.cfg.MaxSources {
+			t.sources[p.SrcIP]++
+		}
+	case p.IsSYNACK():
+		srv := service{p.SrcIP, p.SrcPort}
+		if t := d.targets[srv]; t != nil {
+			t.synacks++
+		}
+		if len(d.pending) < d.cfg.MaxPending {
+			d.pending[handshake{netip.AddrPortFrom(p.DstIP, p.DstPort), srv}] = p.Time
+		}
+	case p.TcpFlags&(FlagSYN|FlagRST|FlagACK) == FlagACK:
+		hs := handshake{netip.AddrPortFrom(p.SrcIP, p.SrcPort), service{p.DstIP, p.DstPort}}
+		if _, ok := d.pending[hs]; ok {
+			delete(d.pending, hs)
+			if t := d.targets[hs.server]; t != nil {
+				t.completions++
+			}
+		}
+	}
+	return nil
+}
+
+func (d *SYNFloodDetector) target(s service) *synTarget {
+	t := d.targets[s]
+	if t == nil {
+		if len(d.targets) >= d.cfg.MaxDestinations {
+			return nil
+		}
+		t = &synTarget{sources: make(map[netip.Addr]int)}
+		d.targets[s] = t
+	}
+	return t
+}
+
+// Tick closes the interval once it has run its length.
+func (d *SYNFloodDetector) Tick(now time.Time) []alert.Alert {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.intervalStart.IsZero() {
+		d.intervalStart = now
+		return nil
+	}
+	if now.Sub(d.intervalStart) < d.cfg.Interval {
+		return nil
+	}
+	d.intervalStart = now
+
+	var alerts []alert.Alert
+	for srv, t := range d.targets {
+		if a, ok := d.evaluate(srv, t, now); ok {
+			alerts = append(alerts, a)
+		}
+		if !t.flooding && t.syns == 0 {
+			delete(d.targets, srv)
+			continue
+		}
+		t.syns, t.synacks, t.completions = 0, 0, 0
+		t.sources = make(map[netip.Addr]int)
+	}
+
+	// Handshakes still open after two intervals are not coming back
+	cutoff := now.Add(-2 * d.cfg.Interval)
+	for hs, t := range d.pending {
+		if t.Before(cutoff) {
+			delete(d.pending, hs)
+		}
+	}
+	return alerts
+}
+
+func (d *SYNFloodDetector) evaluate(srv service, t *synTarget, now time.Time) (alert.Alert, bool) {
+	ratio := 1.0
+	if t.syns > 0 {
+		ratio = float64(t.completions) / float64(t.syns)
+	}
+
+	if !t.flooding {
+		if t.syns < d.cfg.MinSYNs || ratio >= d.cfg.EnterRatio {
+			return alert.Alert{}, false
+		}
+		t.flooding, t.since, t.calm = true, now, 0
+		t.totalSYNs, t.peakSYNs = t.syns, t.syns
+		return d.floodAlert(srv, t, now, ratio), true
+	}
+
+	t.totalSYNs += t.syns
+	if t.syns > t.peakSYNs {
+		t.peakSYNs = t.syns
+	}
+	if t.syns >= d.cfg.MinSYNs/2 && ratio <= d.cfg.ExitRatio {
+		t.calm = 0
+		return alert.Alert{}, false
+	}
+	t.calm++
+	if t.calm < d.cfg.ExitIntervals {
+		return alert.Alert{}, false
+	}
+
+	t.flooding = false
+	return alert.Alert{
+		Time:     now,
+		Type:     "syn-flood",
+		Severity: alert.SeverityInfo,
+		Message:  fmt.Sprintf("SYN flood against %s ended after %s", srv, now.Sub(t.since).Round(time.Second)),
+		Protocol: "TCP",
+		DstIP:    srv.addr.String(),
+		DstPort:  srv.port,
+		Iface:    t.iface,
+		Fields: map[string]string{
+			"state":      "ended",
+			"total_syns": strconv.Itoa(t.totalSYNs),
+			"peak_syns":  strconv.Itoa(t.peakSYNs),
+		},
+	}, true
+}
+
+func (d *SYNFloodDetector) floodAlert(srv service, t *synTarget, now time.Time, ratio float64) alert.Alert {
+	single := 0
+	for _, n := range t.sources {
+		if n == 1 {
+			single++
+		}
+	}
+	spoofed := len(t.sources) > 0 && float64(single)/float64(len(t.sources)) >= d.cfg.SpoofedRatio
+
+	halfOpen := t.synacks - t.completions
+	if halfOpen < 0 {
+		halfOpen = 0
+	}
+
+	return alert.Alert{
+		Time:     now,
+		Type:     "syn-flood",
+		Severity: alert.SeverityHigh,
+		Message: fmt.Sprintf("SYN flood against %s: %d SYNs in %s, %.0f%% completed",
+			srv, t.syns, d.cfg.Interval, ratio*100),
+		Protocol: "TCP",
+		DstIP:    srv.addr.String(),
+		DstPort:  srv.port,
+		Iface:    t.iface,
+		Fields: map[string]string{
+			"state":          "started",
+			"syns":           strconv.Itoa(t.syns),
+			"synacks":        strconv.Itoa(t.synacks),
+			"completions":    strconv.Itoa(t.completions),
+			"half_open":      strconv.Itoa(halfOpen),
+			"sources":        strconv.Itoa(len(t.sources)),
+			"single_syn":     strconv.Itoa(single),
+			"spoofed_likely": strconv.FormatBool(spoofed),
+			"top_sources":    topSources(t.sources, d.cfg.TopSources),
+		},
+	}
+}
+
+// topSources lists the n sources that sent the most SYNs as "ip:count".
+func topSources(sources map[netip.Addr]int, n int) string {
+	type entry struct {
+		addr  netip.Addr
+		count int
+	}
+	list := make([]entry, 0, len(sources))
+	for a, c := range sources {
+		list = append(list, entry{a, c})
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].count != list[j].count {
+			return list[i].count > list[j].count
+		}
+		return list[i].addr.Less(list[j].addr)
+	})
+	if len(list) > n {
+		list = list[:n]
+	}
+
+	parts := make([]string, len(list))
+	for i, e := range list {
+		parts[i] = e.addr.String() + ":" + strconv.Itoa(e.count)
+	}
+	return strings.Join(parts, ",")
+}
@@ -0,0 +1,241 @@
+package detection
+
+import (
+	"kernelKoala/pkg/alert"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+var floodServer = netip.MustParseAddr("192.0.2.10")
+
+// floodReplay drives a SYN flood detector interval by interval on a fake
+// clock.
+type floodReplay struct {
+	t   *testing.T
+	d   *SYNFloodDetector
+	now time.Time
+}
+
+func newFloodReplay(t *testing.T) *floodReplay {
+	r := &floodReplay{t: t, d: NewSYNFloodDetector(DefaultSYNFloodConfig()), now: scanT0}
+	if alerts := r.d.Tick(r.now); len(alerts) != 0 {
+		t.Fatalf("first tick raised %d alerts", len(alerts))
+	}
+	return r
+}
+
+func (r *floodReplay) observe(p Packet) {
+	p.Time = r.now
+	if alerts := r.d.Observe(p); len(alerts) != 0 {
+		r.t.Fatalf("Observe raised %d alerts, detectors of this kind report on Tick", len(alerts))
+	}
+}
+
+func clientSYN(src netip.Addr, port uint16) Packet {
+	p := syn(0, src, floodServer, 80)
+	p.SrcPort = port
+	return p
+}
+
+// syns sends n bare SYNs from src to port 80 of the server.
+func (r *floodReplay) syns(src netip.Addr, n int) {
+	for i := range n {
+		r.observe(clientSYN(src, uint16(1024+i)))
+	}
+}
+
+// handshakes completes n connections from src.
+func (r *floodReplay) handshakes(src netip.Addr, n int) {
+	for i := range n {
+		port := uint16(20000 + i)
+		r.observe(clientSYN(src, port))
+		r.observe(Packet{Protocol: ProtoTCP, SrcIP: floodServer, SrcPort: 80, DstIP: src, DstPort: port, TcpFlags: FlagSYN | FlagACK})
+		r.observe(Packet{Protocol: ProtoTCP, SrcIP: src, SrcPort: port, DstIP: floodServer, DstPort: 80, TcpFlags: FlagACK})
+	}
+}
+
+// spoofed sends one SYN from each of n sources.
+func (r *floodReplay) spoofed(n int) {
+	for i := range n {
+		r.syns(host(i), 1)
+	}
+}
+
+// tick ends the interval.
+func (r *floodReplay) tick() []alert.Alert {
+	r.now = r.now.Add(r.d.cfg.Interval)
+	return r.d.Tick(r.now)
+}
+
+func (r *floodReplay) expect(alerts []alert.Alert, state string) alert.Alert {
+	r.t.Helper()
+	if state == "" {
+		if len(alerts) != 0 {
+			r.t.Fatalf("got %d alerts, want none: %v", len(alerts), alerts)
+		}
+		return alert.Alert{}
+	}
+	if len(alerts) != 1 {
+		r.t.Fatalf("got %d alerts, want one %s: %v", len(alerts), state, alerts)
+	}
+	if got := alerts[0].Fields["state"]; got != state {
+		r.t.Fatalf("alert state = %s, want %s", got, state)
+	}
+	return alerts[0]
+}
+
+func TestSYNFloodEnter(t *testing.T) {
+	r := newFloodReplay(t)
+	r.spoofed(600)
+	r.handshakes(host(1000), 50)
+
+	a := r.expect(r.tick(), "started")
+	if a.Severity != alert.SeverityHigh || a.DstIP != floodServer.String() || a.DstPort != 80 {
+		t.Errorf("unexpected alert %+v", a)
+	}
+	f := a.Fields
+	if f["syns"] != "650" || f["completions"] != "50" || f["synacks"] != "50" {
+		t.Errorf("unexpected counts %v", f)
+	}
+
+	// Still flooding, nothing new to report
+	r.spoofed(600)
+	r.expect(r.tick(), "")
+}
+
+func TestSYNFloodIgnoresHealthyTraffic(t *testing.T) {
+	r := newFloodReplay(t)
+
+	// Plenty of SYNs that all complete
+	for i := range 10 {
+		r.handshakes(host(i), 100)
+	}
+	r.expect(r.tick(), "")
+
+	// Unanswered SYNs, but too few of them
+	r.spoofed(499)
+	r.expect(r.tick(), "")
+}
+
+func TestSYNFloodHysteresisExit(t *testing.T) {
+	r := newFloodReplay(t)
+	r.spoofed(600)
+	r.expect(r.tick(), "started")
+
+	// Below MinSYNs but above half of it, with a ratio under ExitRatio,
+	// still counts as flooding
+	r.spoofed(300)
+	r.expect(r.tick(), "")
+
+	// Two calm intervals, then the flood flares up and resets the count
+	r.spoofed(10)
+	r.expect(r.tick(), "")
+	r.spoofed(10)
+	r.expect(r.tick(), "")
+	r.spoofed(400)
+	r.expect(r.tick(), "")
+
+	// A completion ratio above ExitRatio is calm even with many SYNs
+	r.handshakes(host(1), 600)
+	r.expect(r.tick(), "")
+	r.expect(r.tick(), "")
+	a := r.expect(r.tick(), "ended")
+
+	if a.Severity != alert.SeverityInfo {
+		t.Errorf("severity = %s, want info", a.Severity)
+	}
+	if f := a.Fields; f["total_syns"] != "1920" || f["peak_syns"] != "600" {
+		t.Errorf("unexpected totals %v", f)
+	}
+
+	// The target is forgotten once it is quiet and not flooding
+	r.expect(r.tick(), "")
+	if len(r.d.targets) != 0 {
+		t.Errorf("%d targets still tracked", len(r.d.targets))
+	}
+
+	// A new flood is reported again
+	r.spoofed(600)
+	r.expect(r.tick(), "started")
+}
+
+func TestSYNFloodSpoofedRatio(t *testing.T) {
+	cases := []struct {
+		name    string
+		send    func(r *floodReplay)
+		spoofed string
+		single  string
+	}{
+		{
+			name:    "one SYN per source",
+			send:    func(r *floodReplay) { r.spoofed(600) },
+			spoofed: "true",
+			single:  "600",
+		},
+		{
+			name: "few heavy sources",
+			send: func(r *floodReplay) {
+				for i := range 6 {
+					r.syns(host(i), 100)
+				}
+			},
+			spoofed: "false",
+			single:  "0",
+		},
+		{
+			// 80 of 100 sources sent a single SYN, right at SpoofedRatio
+			name: "at the ratio",
+			send: func(r *floodReplay) {
+				r.spoofed(80)
+				for i := range 20 {
+					r.syns(host(1000+i), 30)
+				}
+			},
+			spoofed: "true",
+			single:  "80",
+		},
+		{
+			name: "just below the ratio",
+			send: func(r *floodReplay) {
+				r.spoofed(79)
+				for i := range 21 {
+					r.syns(host(1000+i), 30)
+				}
+			},
+			spoofed: "false",
+			single:  "79",
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			r := newFloodReplay(t)
+			tc.send(r)
+			f := r.expect(r.tick(), "started").Fields
+			if f["spoofed_likely"] != tc.spoofed || f["single_syn"] != tc.single {
+				t.Errorf("spoofed_likely=%s single_syn=%s, want %s and %s",
+					f["spoofed_likely"], f["single_syn"], tc.spoofed, tc.single)
+			}
+		})
+	}
+}
+
+func TestSYNFloodTopSources(t *testing.T) {
+	r := newFloodReplay(t)
+	r.syns(host(3), 100)
+	r.syns(host(1), 300)
+	r.syns(host(2), 100)
+	r.syns(host(4), 50)
+	r.syns(host(5), 40)
+	r.syns(host(6), 40)
+
+	f := r.expect(r.tick(), "started").Fields
+	// Equal counts are ordered by address
+	want := "10.0.0.1:300,10.0.0.2:100,10.0.0.3:100,10.0.0.4:50,10.0.0.5:40"
+	if f["top_sources"] != want {
+		t.Errorf("top_sources = %s, want %s", f["top_sources"], want)
+	}
+	if f["sources"] != "6" {
+		t.Errorf("sources = %s, want 6", f["sources"])
+	}
+}
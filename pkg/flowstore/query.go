@@ -0,0 +1,350 @@
+package flowstore
+
+import (
+	"kernelKoala/pkg/alerting"
+	"kernelKoala/pkg/koala"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Query selects stored flows. A flow matches when it was active between
+// Since and Until, either end has an address in IP and the port Port,
+// it used Protocol and it satisfies every Where condition. Zero values
+// match everything.
+type Query struct {
+	Since    time.Time
+	Until    time.Time
+	IP       netip.Prefix
+	Port     uint16
+	Protocol string
+	Where    []alerting.Condition
+}
+
+// QueryStats tells how much of the store the indexes let a query skip.
+type QueryStats struct {
+	Segments        int `json:"segments"`
+	SegmentsSkipped int `json:"segments_skipped"`
+	Blocks          int `json:"blocks"`
+	BlocksSkipped   int `json:"blocks_skipped"`
+	Scanned         int `json:"scanned"`
+	Matched         int `json:"matched"`
+}
+
+// blockTest reports whether a block may hold a matching flow.
+type blockTest func(*blockIndex) bool
+
+// blockTests derives from the query what the block indexes can rule out:
+// addresses, ports and protocols compared for equality or by CIDR.
+func (q *Query) blockTests() []blockTest {
+	var tests []blockTest
+	if q.IP.IsValid() {
+		tests = append(tests, anyIPIn([]netip.Prefix{q.IP}))
+	}
+	if q.Port != 0 {
+		tests = append(tests, anyPort([]uint16{q.Port}))
+	}
+	if q.Protocol != "" {
+		tests = append(tests, anyProtocol([]string{q.Protocol}))
+	}
+
+	for _, c := range q.Where {
+		values := c.Values
+		if c.Value != "" {
+			values = append(slices.Clone(values), c.Value)
+		}
+		switch {
+		case c.Op == "cidr" && (c.Field == "src_ip" || c.Field == "dst_ip"):
+			var prefixes []netip.Prefix
+			for _, v := range values {
+				p, err := netip.ParsePrefix(v)
+				if err != nil {
+					return tests
+				}
+				prefixes = append(prefixes, p)
+			}
+			tests = append(tests, anyIPIn(prefixes))
+		case c.Op != "" && c.Op != "eq" && c.Op != "in":
+		case c.Field == "src_ip" || c.Field == "dst_ip":
+			var prefixes []netip.Prefix
+			for _, v := range values {
+				addr, err := netip.ParseAddr(v)
+				if err != nil {
+					return tests
+				}
+				prefixes = append(prefixes, netip.PrefixFrom(addr, addr.BitLen()))
+			}
+			tests = append(tests, anyIPIn(prefixes))
+		case c.Field == "src_port" || c.Field == "dst_port":
+			var ports []uint16
+			for _, v := range values {
+				port, err := strconv.ParseUint(v, 10, 16)
+				if err != nil {
+					return tests
+				}
+				ports = append(ports, uint16(port))
+			}
+			tests = append(tests, anyPort(ports))
+		case c.Field == "protocol":
+			tests = append(tests, anyProtocol(values))
+		}
+	}
+	return tests
+}
+
+func anyIPIn(prefixes []netip.Prefix) blockTest {
+	return func(b *blockIndex) bool {
+		for _, p := range prefixes {
+			if p.IsSingleIP() {
+				if _, ok := slices.BinarySearch(b.IPs, p.Addr().String()); ok {
+					return true
+				}
+				continue
+			}
+			for _, ip := range b.IPs {
+				if addr, err := netip.ParseAddr(ip); err == nil && p.Contains(addr) {
+					return true
+				}
+			}
+		}
+		return false
+	}
+}
+
+func anyPort(ports []uint16) blockTest {
+	return func(b *blockIndex) bool {
+		for _, port := range ports {
+			if _, ok := slices.BinarySearch(b.Ports, port); ok {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+func anyProtocol(protocols []string) blockTest {
+	return func(b *blockIndex) bool {
+		for _, proto := range protocols {
+			for _, have := range b.Protocols {
+				if strings.EqualFold(proto, have) {
+					return true
+				}
+			}
+		}
+		return false
+	}
+}
+
+// overlaps reports whether [from, to] meets the query's time range.
+func (q *Query) overlaps(from, to time.Time) bool {
+	return (q.Since.IsZero() || !to.Before(q.Since)) && (q.Until.IsZero() || !from.After(q.Until))
+}
+
+func (q *Query) match(f *koala.Flow, filter alerting.Filter) bool {
+	if !q.overlaps(f.FirstSeen, f.LastSeen) {
+		return false
+	}
+	if q.IP.IsValid() && !prefixHas(q.IP, f.SrcIP) && !prefixHas(q.IP, f.DstIP) {
+		return false
+	}
+	if q.Port != 0 && f.SrcPort != q.Port && f.DstPort != q.Port {
+		return false
+	}
+	if q.Protocol != "" && !strings.EqualFold(f.Protocol, q.Protocol) {
+		return false
+	}
+	return filter.Match(f)
+}
+
+func prefixHas(p netip.Prefix, ip string) bool {
+	addr, err := netip.ParseAddr(ip)
+	return err == nil && p.Contains(addr)
+}
+
+// Scan calls fn with every flow in dir matching q, oldest segment first,
+// until fn returns false. The segment a running agent is writing is read
+// up to its last complete block.
+func Scan(dir string, q Query, fn func(*koala.Flow) bool) (QueryStats, error) {
+	var stats QueryStats
+	filter, err := alerting.NewFilter(q.Where)
+	if err != nil {
+		return stats, err
+	}
+	tests := q.blockTests()
+
+	names, err := segmentNames(dir)
+	if err != nil {
+		return stats, err
+	}
+	for _, name := range names {
+		path := filepath.Join(dir, name)
+		idx, err := readIndex(strings.TrimSuffix(path, segmentExt) + indexExt)
+		if os.IsNotExist(err) {
+			idx, err = scanSegment(path)
+		}
+		if err != nil {
+			if os.IsNotExist(err) {
+				// Removed by retention meanwhile
+				continue
+			}
+			return stats, err
+		}
+
+		stats.Segments++
+		if idx.Records == 0 || !q.overlaps(idx.MinTime, idx.MaxTime) {
+			stats.SegmentsSkipped++
+			stats.Blocks += len(idx.Blocks)
+			stats.BlocksSkipped += len(idx.Blocks)
+			continue
+		}
+		more, err := scanBlocks(path, idx, q, tests, filter, &stats, fn)
+		if err != nil {
+			return stats, err
+		}
+		if !more {
+			break
+		}
+	}
+	return stats, nil
+}
+
+func scanBlocks(path string, idx *segmentIndex, q Query, tests []blockTest, filter alerting.Filter, stats *QueryStats, fn func(*koala.Flow) bool) (bool, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return true, nil
+		}
+		return false, err
+	}
+	defer file.Close()
+
+blocks:
+	for i := range idx.Blocks {
+		b := &idx.Blocks[i]
+		stats.Blocks++
+		if !q.overlaps(b.MinTime, b.MaxTime) {
+			stats.BlocksSkipped++
+			continue
+		}
+		for _, test := range tests {
+			if !test(b) {
+				stats.BlocksSkipped++
+				continue blocks
+			}
+		}
+
+		payload, err := readBlock(file, b.Offset)
+		if err != nil {
+			return false, err
+		}
+		flows, err := decodeBlock(payload)
+		if err != nil {
+			return false, err
+		}
+		for j := range flows {
+			stats.Scanned++
+			if !q.match(&flows[j], filter) {
+				continue
+			}
+			stats.Matched++
+			if !fn(&flows[j]) {
+				return false, nil
+			}
+		}
+	}
+	return true, nil
+}
+
+// Group sums the flows sharing the values of the group-by fields.
+type Group struct {
+	Key       []string  `json:"key"`
+	Flows     uint64    `json:"flows"`
+	Packets   uint64    `json:"packets"`
+	Bytes     uint64    `json:"bytes"`
+	FirstSeen time.Time `json:"first_seen"`
+	LastSeen  time.Time `json:"last_seen"`
+}
+
+// Aggregator groups flows by fields and, with an interval, by the time
+// bucket their first packet fell in.
+type Aggregator struct {
+	by       []string
+	interval time.Duration
+	groups   map[string]*Group
+}
+
+func NewAggregator(by []string, interval time.Duration) *Aggregator {
+	return &Aggregator{by: by, interval: interval, groups: make(map[string]*Group)}
+}
+
+// Columns names the parts of a group key.
+func (a *Aggregator) Columns() []string {
+	if a.interval > 0 {
+		return append([]string{"time"}, a.by...)
+	}
+	return a.by
+}
+
+func (a *Aggregator) Add(f *koala.Flow) {
+	key := make([]string, 0, len(a.by)+1)
+	if a.interval > 0 {
+		key = append(key, f.FirstSeen.Truncate(a.interval).UTC().Format(time.RFC3339))
+	}
+	for _, field := range a.by {
+		v, ok := f.Field(field)
+		if !ok || v == "" {
+			v = "-"
+		}
+		key = append(key, v)
+	}
+
+	id := strings.Join(key, "\x00")
+	g := a.groups[id]
+	if g == nil {
+		g = &Group{Key: key, FirstSeen: f.FirstSeen, LastSeen: f.LastSeen}
+		a.groups[id] = g
+	}
+	g.Flows++
+	g.Packets += f.Packets
+	g.Bytes += f.Bytes
+	if f.FirstSeen.Before(g.FirstSeen) {
+		g.FirstSeen = f.FirstSeen
+	}
+	if f.LastSeen.After(g.LastSeen) {
+		g.LastSeen = f.LastSeen
+	}
+}
+
+// Groups returns the groups largest first by sortBy, bytes (default),
+// packets or flows. With an interval they are ordered by time first.
+func (a *Aggregator) Groups(sortBy string) []*Group {
+	out := make([]*Group, 0, len(a.groups))
+	for _, g := range a.groups {
+		out = append(out, g)
+	}
+	value := func(g *Group) uint64 {
+		switch sortBy {
+		case "packets":
+			return g.Packets
+		case "flows":
+			return g.Flows
+		default:
+			return g.Bytes
+		}
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if a.interval > 0 && out[i].Key[0] != out[j].Key[0] {
+			return out[i].Key[0] < out[j].Key[0]
+		}
+		if vi, vj := value(out[i]), value(out[j]); vi != vj {
+			return vi > vj
+		}
+		return strings.Join(out[i].Key, " ") < strings.Join(out[j].Key, " ")
+	})
+	return out
+}
@@ -0,0 +1,270 @@
+package flowstore
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"kernelKoala/pkg/koala"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A segment file starts with segmentMagic followed by blocks. Every block
+// is a header holding the payload length and its CRC-32, both big endian,
+// and a payload of gzip compressed JSON lines, one flow per line.
+const (
+	segmentMagic    = "KKFLOWS1"
+	segmentExt      = ".seg"
+	indexExt        = ".idx"
+	indexVersion    = 1
+	blockHeaderSize = 8
+	maxBlockLength  = 64 << 20
+	partitionFormat = "20060102T150405Z"
+)
+
+// blockIndex describes one block so queries can skip it without reading
+// it: its time range and the distinct addresses, ports and protocols of
+// both ends of its flows.
+type blockIndex struct {
+	Offset    int64     `json:"offset"`
+	Length    int       `json:"length"`
+	Records   int       `json:"records"`
+	MinTime   time.Time `json:"min_time"`
+	MaxTime   time.Time `json:"max_time"`
+	IPs       []string  `json:"ips"`
+	Ports     []uint16  `json:"ports"`
+	Protocols []string  `json:"protocols"`
+}
+
+// segmentIndex is written next to a segment once it is sealed.
+type segmentIndex struct {
+	Version int          `json:"version"`
+	MinTime time.Time    `json:"min_time"`
+	MaxTime time.Time    `json:"max_time"`
+	Records int          `json:"records"`
+	Size    int64        `json:"size"`
+	Blocks  []blockIndex `json:"blocks"`
+}
+
+func (x *segmentIndex) add(b blockIndex) {
+	if x.MinTime.IsZero() || b.MinTime.Before(x.MinTime) {
+		x.MinTime = b.MinTime
+	}
+	if b.MaxTime.After(x.MaxTime) {
+		x.MaxTime = b.MaxTime
+	}
+	x.Records += b.Records
+	x.Size = b.Offset + blockHeaderSize + int64(b.Length)
+	x.Blocks = append(x.Blocks, b)
+}
+
+func newBlockIndex(flows []koala.Flow, offset int64, length int) blockIndex {
+	b := blockIndex{Offset: offset, Length: length, Records: len(flows)}
+	ips := make(map[string]bool)
+	ports := make(map[uint16]bool)
+	protocols := make(map[string]bool)
+	for i := range flows {
+		f := &flows[i]
+		if b.MinTime.IsZero() || f.FirstSeen.Before(b.MinTime) {
+			b.MinTime = f.FirstSeen
+		}
+		if f.LastSeen.After(b.MaxTime) {
+			b.MaxTime = f.LastSeen
+		}
+		ips[f.SrcIP], ips[f.DstIP] = true, true
+		ports[f.SrcPort], ports[f.DstPort] = true, true
+		protocols[f.Protocol] = true
+	}
+	for ip := range ips {
+		b.IPs = append(b.IPs, ip)
+	}
+	for port := range ports {
+		b.Ports = append(b.Ports, port)
+	}
+	for proto := range protocols {
+		b.Protocols = append(b.Protocols, proto)
+	}
+	slices.Sort(b.IPs)
+	slices.Sort(b.Ports)
+	slices.Sort(b.Protocols)
+	return b
+}
+
+// encodeBlock returns the framed block of flows.
+func encodeBlock(flows []koala.Flow) ([]byte, error) {
+	var buf bytes.Buffer
+	buf.Write(make([]byte, blockHeaderSize))
+	zw := gzip.NewWriter(&buf)
+	enc := json.NewEncoder(zw)
+	for i := range flows {
+		if err := enc.Encode(&flows[i]); err != nil {
+			return nil, err
+		}
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+
+	block := buf.Bytes()
+	payload := block[blockHeaderSize:]
+	binary.BigEndian.PutUint32(block[0:4], uint32(len(payload)))
+	binary.BigEndian.PutUint32(block[4:8], crc32.ChecksumIEEE(payload))
+	return block, nil
+}
+
+func decodeBlock(payload []byte) ([]koala.Flow, error) {
+	zr, err := gzip.NewReader(bytes.NewReader(payload))
+	if err != nil {
+		return nil, err
+	}
+	defer zr.Close()
+
+	var flows []koala.Flow
+	dec := json.NewDecoder(zr)
+	for {
+		var f koala.Flow
+		if err := dec.Decode(&f); err == io.EOF {
+			return flows, nil
+		} else if err != nil {
+			return nil, err
+		}
+		flows = append(flows, f)
+	}
+}
+
+// readBlock reads and checks the block at offset, err is io.EOF or
+// io.ErrUnexpectedEOF when the file ends before it does.
+func readBlock(r io.ReaderAt, offset int64) (payload []byte, err error) {
+	var header [blockHeaderSize]byte
+	if n, err := r.ReadAt(header[:], offset); err != nil {
+		if err == io.EOF && n > 0 {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	length := binary.BigEndian.Uint32(header[0:4])
+	if length == 0 || length > maxBlockLength {
+		return nil, fmt.Errorf("block at %d: bad length %d", offset, length)
+	}
+	payload = make([]byte, length)
+	if _, err := r.ReadAt(payload, offset+blockHeaderSize); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	if crc32.ChecksumIEEE(payload) != binary.BigEndian.Uint32(header[4:8]) {
+		return nil, fmt.Errorf("block at %d: checksum mismatch", offset)
+	}
+	return payload, nil
+}
+
+// scanSegment indexes a segment without an index file, the one being
+// written or one left behind by a crash. It stops at the first incomplete
+// or damaged block, the index covers the blocks before it.
+func scanSegment(path string) (*segmentIndex, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	magic := make([]byte, len(segmentMagic))
+	if _, err := io.ReadFull(f, magic); err != nil || string(magic) != segmentMagic {
+		return nil, fmt.Errorf("%s: not a flow segment", path)
+	}
+
+	idx := &segmentIndex{Version: indexVersion, Size: int64(len(segmentMagic))}
+	for offset := idx.Size; ; {
+		payload, err := readBlock(f, offset)
+		if err != nil {
+			break
+		}
+		flows, err := decodeBlock(payload)
+		if err != nil {
+			break
+		}
+		idx.add(newBlockIndex(flows, offset, len(payload)))
+		offset = idx.Size
+	}
+	return idx, nil
+}
+
+func readIndex(path string) (*segmentIndex, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	zr, err := gzip.NewReader(bufio.NewReader(f))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	var idx segmentIndex
+	if err := json.NewDecoder(zr).Decode(&idx); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	if idx.Version != indexVersion {
+		return nil, fmt.Errorf("%s: unsupported index version %d", path, idx.Version)
+	}
+	return &idx, nil
+}
+
+// writeIndex replaces the index file atomically, a reader sees either no
+// index or a complete one.
+func writeIndex(path string, idx *segmentIndex) error {
+	tmp := path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0640)
+	if err != nil {
+		return err
+	}
+	zw := gzip.NewWriter(f)
+	err = json.NewEncoder(zw).Encode(idx)
+	if cerr := zw.Close(); err == nil {
+		err = cerr
+	}
+	if serr := f.Sync(); err == nil {
+		err = serr
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// segmentName names the n-th segment of the partition starting at start,
+// names sort in time order.
+func segmentName(start time.Time, n int) string {
+	return fmt.Sprintf("%s-%04d%s", start.UTC().Format(partitionFormat), n, segmentExt)
+}
+
+// parseSegmentName returns the partition start and number of a segment
+// file name.
+func parseSegmentName(name string) (time.Time, int, bool) {
+	base, ok := strings.CutSuffix(name, segmentExt)
+	if !ok || len(base) != len(partitionFormat)+5 || base[len(partitionFormat)] != '-' {
+		return time.Time{}, 0, false
+	}
+	start, err := time.Parse(partitionFormat, base[:len(partitionFormat)])
+	if err != nil {
+		return time.Time{}, 0, false
+	}
+	n, err := strconv.Atoi(base[len(partitionFormat)+1:])
+	if err != nil {
+		return time.Time{}, 0, false
+	}
+	return start, n, true
+}
@@ -0,0 +1,412 @@
+// Package flowstore keeps exported flows on local disk so past traffic can
+// be queried without an external database.
+//
+// Flows are appended to segment files, one or more per time partition,
+// in compressed blocks. A sealed segment gets an index file recording the
+// time range, addresses, ports and protocols of each block, which lets
+// queries skip segments and blocks that can't match. Segments are removed
+// once they are older than the retention or the store outgrows its size
+// limit.
+//
+// Partitions follow the time a flow is written, that is when it was
+// exported, not when it started: a flow open for hours lands in the
+// partition it ended in. Queries therefore don't go by segment names but
+// by the index, which records each block's earliest FirstSeen and latest
+// LastSeen, so a long-lived flow is still found by any range it was
+// active in. Results come in export order.
+package flowstore
+
+import (
+	"context"
+	"fmt"
+	"kernelKoala/pkg/koala"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// DefaultDir is where the query command looks for flows by default.
+const DefaultDir = "/var/lib/kernelkoala/flows"
+
+// Config configures the writing side of a store.
+type Config struct {
+	Dir string
+	// Partition is the time span covered by one segment. A segment is also
+	// sealed early once it reaches SegmentSize bytes.
+	Partition   time.Duration
+	SegmentSize int64
+	// Segments whose newest flow is older than MaxAge are removed, and
+	// the oldest ones while the store holds more than MaxSize bytes.
+	// Zero disables either limit.
+	MaxAge  time.Duration
+	MaxSize int64
+	// Flows are written in blocks of up to BlockSize, at least every
+	// FlushInterval, flows beyond QueueSize are dropped.
+	BlockSize     int
+	FlushInterval time.Duration
+	QueueSize     int
+}
+
+func DefaultConfig() Config {
+	return Config{
+		Partition:     time.Hour,
+		SegmentSize:   64 << 20,
+		MaxAge:        7 * 24 * time.Hour,
+		MaxSize:       1 << 30,
+		BlockSize:     1000,
+		FlushInterval: 10 * time.Second,
+		QueueSize:     10000,
+	}
+}
+
+// Stats counts what the store wrote and removed.
+type Stats struct {
+	Written  uint64
+	Dropped  uint64
+	Blocks   uint64
+	Removed  uint64
+	Segments int
+	Size     int64
+	Queued   int
+}
+
+type segmentInfo struct {
+	name    string
+	size    int64
+	maxTime time.Time
+}
+
+type activeSegment struct {
+	name      string
+	file      *os.File
+	partition time.Time
+	index     segmentIndex
+}
+
+// Store appends flows to the segment files of one directory. Only one
+// process may write a directory, any number may query it.
+type Store struct {
+	cfg     Config
+	onError func(error)
+
+	queue chan koala.Flow
+	done  chan struct{}
+
+	// Owned by Run
+	active  *activeSegment
+	pending []koala.Flow
+
+	mu       sync.Mutex
+	segments []segmentInfo
+
+	written atomic.Uint64
+	dropped atomic.Uint64
+	blocks  atomic.Uint64
+	removed atomic.Uint64
+	// activeSize is the size of the segment being written
+	activeSize atomic.Int64
+}
+
+// Open prepares the directory for writing. Segments left without an
+// index by a crash are cut after their last complete block and sealed.
+// Write errors go to onError.
+func Open(cfg Config, onError func(error)) (*Store, error) {
+	if cfg.Dir == "" {
+		return nil, fmt.Errorf("store directory is required")
+	}
+	if cfg.Partition <= 0 {
+		return nil, fmt.Errorf("partition must be positive")
+	}
+	if err := os.MkdirAll(cfg.Dir, 0750); err != nil {
+		return nil, err
+	}
+
+	s := &Store{
+		cfg:     cfg,
+		onError: onError,
+		queue:   make(chan koala.Flow, cfg.QueueSize),
+		done:    make(chan struct{}),
+	}
+
+	names, err := segmentNames(cfg.Dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range names {
+		path := filepath.Join(cfg.Dir, name)
+		idx, err := readIndex(strings.TrimSuffix(path, segmentExt) + indexExt)
+		if os.IsNotExist(err) {
+			idx, err = recoverSegment(path)
+		}
+		if err != nil {
+			return nil, err
+		}
+		s.segments = append(s.segments, segmentInfo{name: name, size: idx.Size, maxTime: idx.MaxTime})
+	}
+	s.enforceRetention(time.Now())
+	return s, nil
+}
+
+// recoverSegment seals a segment that was being written when the agent
+// stopped without closing it.
+func recoverSegment(path string) (*segmentIndex, error) {
+	idx, err := scanSegment(path)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Truncate(path, idx.Size); err != nil {
+		return nil, err
+	}
+	return idx, writeIndex(strings.TrimSuffix(path, segmentExt)+indexExt, idx)
+}
+
+// segmentNames lists the segment files of dir, oldest first.
+func segmentNames(dir string) ([]string, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, e := range entries {
+		if _, _, ok := parseSegmentName(e.Name()); ok && e.Type().IsRegular() {
+			names = append(names, e.Name())
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// Add queues a flow without blocking.
+func (s *Store) Add(f koala.Flow) {
+	select {
+	case s.queue <- f:
+	default:
+		s.dropped.Add(1)
+	}
+}
+
+// Run writes queued flows until ctx is done, then writes what is left
+// and seals the current segment.
+func (s *Store) Run(ctx context.Context) {
+	defer close(s.done)
+	flush := time.NewTicker(s.cfg.FlushInterval)
+	defer flush.Stop()
+	retention := time.NewTicker(time.Minute)
+	defer retention.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			for drained := false; !drained; {
+				select {
+				case f := <-s.queue:
+					s.pending = append(s.pending, f)
+				default:
+					drained = true
+				}
+			}
+			s.writeBlock(time.Now())
+			s.seal()
+			return
+		case f := <-s.queue:
+			s.pending = append(s.pending, f)
+			if len(s.pending) >= s.cfg.BlockSize {
+				s.writeBlock(time.Now())
+			}
+		case now := <-flush.C:
+			s.writeBlock(now)
+			if s.active != nil && !now.Truncate(s.cfg.Partition).Equal(s.active.partition) {
+				s.seal()
+			}
+		case now := <-retention.C:
+			s.enforceRetention(now)
+		}
+	}
+}
+
+// writeBlock appends the pending flows as one block, starting a segment
+// when needed. On failure the flows are dropped.
+func (s *Store) writeBlock(now time.Time) {
+	if len(s.pending) == 0 {
+		return
+	}
+	defer func() { s.pending = s.pending[:0] }()
+
+	partition := now.Truncate(s.cfg.Partition)
+	if a := s.active; a != nil && (!partition.Equal(a.partition) || a.index.Size >= s.cfg.SegmentSize) {
+		s.seal()
+	}
+	if s.active == nil {
+		if err := s.create(partition); err != nil {
+			s.fail(len(s.pending), err)
+			return
+		}
+	}
+
+	block, err := encodeBlock(s.pending)
+	if err != nil {
+		s.fail(len(s.pending), err)
+		return
+	}
+	a := s.active
+	offset := a.index.Size
+	if _, err := a.file.WriteAt(block, offset); err != nil {
+		// Whatever part of the block made it to disk is overwritten by
+		// the next one or cut off when the segment is recovered
+		s.fail(len(s.pending), fmt.Errorf("writing %s: %v", a.name, err))
+		return
+	}
+	a.index.add(newBlockIndex(s.pending, offset, len(block)-blockHeaderSize))
+	s.activeSize.Store(a.index.Size)
+	s.written.Add(uint64(len(s.pending)))
+	s.blocks.Add(1)
+}
+
+func (s *Store) create(partition time.Time) error {
+	n := 0
+	s.mu.Lock()
+	for _, seg := range s.segments {
+		if start, i, ok := parseSegmentName(seg.name); ok && start.Equal(partition.UTC()) && i >= n {
+			n = i + 1
+		}
+	}
+	s.mu.Unlock()
+
+	name := segmentName(partition, n)
+	f, err := os.OpenFile(filepath.Join(s.cfg.Dir, name), os.O_CREATE|os.O_EXCL|os.O_RDWR, 0640)
+	if err != nil {
+		return err
+	}
+	if _, err := f.WriteString(segmentMagic); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+	s.active = &activeSegment{
+		name:      name,
+		file:      f,
+		partition: partition,
+		index:     segmentIndex{Version: indexVersion, Size: int64(len(segmentMagic))},
+	}
+	return nil
+}
+
+// seal syncs the current segment and writes its index.
+func (s *Store) seal() {
+	a := s.active
+	if a == nil {
+		return
+	}
+	s.active = nil
+
+	path := a.file.Name()
+	// Cut off what a failed write may have left after the last block
+	err := a.file.Truncate(a.index.Size)
+	if serr := a.file.Sync(); err == nil {
+		err = serr
+	}
+	if cerr := a.file.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = writeIndex(strings.TrimSuffix(path, segmentExt)+indexExt, &a.index)
+	}
+	if err != nil {
+		s.reportError(fmt.Errorf("sealing %s: %v", a.name, err))
+	}
+
+	s.mu.Lock()
+	s.segments = append(s.segments, segmentInfo{name: a.name, size: a.index.Size, maxTime: a.index.MaxTime})
+	s.activeSize.Store(0)
+	s.mu.Unlock()
+	s.enforceRetention(time.Now())
+}
+
+// enforceRetention removes sealed segments past MaxAge, then the oldest
+// ones until the store fits MaxSize. The segment being written counts
+// towards the size but is never removed.
+func (s *Store) enforceRetention(now time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	total := s.activeSize.Load()
+	for _, seg := range s.segments {
+		total += seg.size
+	}
+
+	kept := s.segments[:0]
+	for _, seg := range s.segments {
+		expired := s.cfg.MaxAge > 0 && now.Sub(seg.maxTime) > s.cfg.MaxAge
+		tooBig := s.cfg.MaxSize > 0 && total > s.cfg.MaxSize
+		if !expired && !tooBig {
+			kept = append(kept, seg)
+			continue
+		}
+		if err := s.remove(seg.name); err != nil {
+			s.reportError(err)
+			kept = append(kept, seg)
+			continue
+		}
+		total -= seg.size
+		s.removed.Add(1)
+	}
+	s.segments = kept
+}
+
+func (s *Store) remove(name string) error {
+	path := filepath.Join(s.cfg.Dir, name)
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	// An index left behind is ignored without its segment
+	if err := os.Remove(strings.TrimSuffix(path, segmentExt) + indexExt); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+func (s *Store) fail(flows int, err error) {
+	s.dropped.Add(uint64(flows))
+	s.reportError(err)
+}
+
+func (s *Store) reportError(err error) {
+	if s.onError != nil {
+		s.onError(err)
+	}
+}
+
+func (s *Store) Stats() Stats {
+	s.mu.Lock()
+	segments := len(s.segments)
+	size := s.activeSize.Load()
+	if size > 0 {
+		segments++
+	}
+	for _, seg := range s.segments {
+		size += seg.size
+	}
+	s.mu.Unlock()
+
+	return Stats{
+		Written:  s.written.Load(),
+		Dropped:  s.dropped.Load(),
+		Blocks:   s.blocks.Load(),
+		Removed:  s.removed.Load(),
+		Segments: segments,
+		Size:     size,
+		Queued:   len(s.queue),
+	}
+}
+
+// Close waits for Run to finish, if it was started.
+func (s *Store) Close(timeout time.Duration) {
+	select {
+	case <-s.done:
+	case <-time.After(timeout):
+	}
+}
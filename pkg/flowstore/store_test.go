@@ -0,0 +1,306 @@
+package flowstore
+
+import (
+	"kernelKoala/pkg/alerting"
+	"kernelKoala/pkg/koala"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+var storeT0 = time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+
+func flowAt(at time.Duration, src string, dstPort uint16, bytes uint64) koala.Flow {
+	return koala.Flow{
+		Protocol: "TCP", SrcIP: src, SrcPort: 40000, DstIP: "10.0.0.1", DstPort: dstPort,
+		FirstSeen: storeT0.Add(at), LastSeen: storeT0.Add(at + time.Second), Packets: bytes / 100, Bytes: bytes,
+	}
+}
+
+// openTestStore opens a store without limits: the flows are from the
+// past, Open would remove them right away.
+func openTestStore(t *testing.T, dir string) *Store {
+	t.Helper()
+	cfg := DefaultConfig()
+	cfg.Dir = dir
+	cfg.MaxAge, cfg.MaxSize = 0, 0
+	s, err := Open(cfg, func(err error) { t.Errorf("store error: %v", err) })
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+// write stores flows as one block, written at now.
+func write(s *Store, now time.Time, flows ...koala.Flow) {
+	s.pending = append(s.pending, flows...)
+	s.writeBlock(now)
+}
+
+func scanAll(t *testing.T, dir string, q Query) ([]koala.Flow, QueryStats) {
+	t.Helper()
+	var flows []koala.Flow
+	stats, err := Scan(dir, q, func(f *koala.Flow) bool {
+		flows = append(flows, *f)
+		return true
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return flows, stats
+}
+
+func TestBlockEncoding(t *testing.T) {
+	flows := []koala.Flow{flowAt(0, "10.0.0.2", 443, 1000), flowAt(time.Minute, "10.0.0.3", 22, 500)}
+	flows[0].TCPFlags = []string{"SYN", "ACK"}
+	block, err := encodeBlock(flows)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := strings.NewReader(string(block))
+	payload, err := readBlock(r, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := decodeBlock(payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, flows) {
+		t.Errorf("decoded %+v, want %+v", got, flows)
+	}
+
+	idx := newBlockIndex(flows, 8, len(payload))
+	if !idx.MinTime.Equal(flows[0].FirstSeen) || !idx.MaxTime.Equal(flows[1].LastSeen) || idx.Records != 2 ||
+		!reflect.DeepEqual(idx.IPs, []string{"10.0.0.1", "10.0.0.2", "10.0.0.3"}) ||
+		!reflect.DeepEqual(idx.Ports, []uint16{22, 443, 40000}) {
+		t.Errorf("index %+v", idx)
+	}
+
+	damaged := []byte(string(block))
+	damaged[len(damaged)-1] ^= 0xff
+	if _, err := readBlock(strings.NewReader(string(damaged)), 0); err == nil || !strings.Contains(err.Error(), "checksum") {
+		t.Errorf("damaged block: %v", err)
+	}
+	if _, err := readBlock(strings.NewReader(string(block[:len(block)-1])), 0); err == nil {
+		t.Error("cut block read")
+	}
+	if _, err := readBlock(strings.NewReader(string(make([]byte, 16))), 0); err == nil || !strings.Contains(err.Error(), "bad length") {
+		t.Errorf("zero length block: %v", err)
+	}
+}
+
+func TestSegmentNames(t *testing.T) {
+	name := segmentName(storeT0, 3)
+	if name != "20260101T120000Z-0003.seg" {
+		t.Errorf("name %s", name)
+	}
+	if start, n, ok := parseSegmentName(name); !ok || !start.Equal(storeT0) || n != 3 {
+		t.Errorf("parsed %v %d %v", start, n, ok)
+	}
+	for _, bad := range []string{"20260101T120000Z-0003.idx", "20260101T120000Z.seg", "notatimestamp-0001.seg"} {
+		if _, _, ok := parseSegmentName(bad); ok {
+			t.Errorf("%s parsed", bad)
+		}
+	}
+}
+
+func TestRecoverSegment(t *testing.T) {
+	dir := t.TempDir()
+	s := openTestStore(t, dir)
+	write(s, storeT0, flowAt(0, "10.0.0.2", 443, 1000))
+	write(s, storeT0, flowAt(time.Second, "10.0.0.3", 443, 1000))
+	// The agent dies halfway through the third block
+	block, _ := encodeBlock([]koala.Flow{flowAt(2*time.Second, "10.0.0.4", 443, 1000)})
+	path := s.active.file.Name()
+	size := s.active.index.Size
+	s.active.file.WriteAt(block[:len(block)/2], size)
+	s.active.file.Close()
+
+	// A query meanwhile reads the complete blocks
+	if flows, _ := scanAll(t, dir, Query{}); len(flows) != 2 {
+		t.Fatalf("%d flows in the unsealed segment, want 2", len(flows))
+	}
+
+	s = openTestStore(t, dir)
+	if fi, err := os.Stat(path); err != nil || fi.Size() != size {
+		t.Fatalf("segment of %d bytes after recovery, want %d", fi.Size(), size)
+	}
+	if _, err := readIndex(strings.TrimSuffix(path, segmentExt) + indexExt); err != nil {
+		t.Fatalf("no index after recovery: %v", err)
+	}
+	if st := s.Stats(); st.Segments != 1 || st.Size != size {
+		t.Errorf("stats %+v", st)
+	}
+
+	// New flows go to a segment of their own
+	write(s, storeT0, flowAt(3*time.Second, "10.0.0.5", 443, 1000))
+	s.seal()
+	flows, _ := scanAll(t, dir, Query{})
+	if len(flows) != 3 || flows[2].SrcIP != "10.0.0.5" {
+		t.Errorf("flows %+v", flows)
+	}
+}
+
+func TestRetentionByAge(t *testing.T) {
+	dir := t.TempDir()
+	s := openTestStore(t, dir)
+	for h := range 4 {
+		at := time.Duration(h) * time.Hour
+		write(s, storeT0.Add(at), flowAt(at, "10.0.0.2", 443, 1000))
+	}
+	s.seal()
+	s.cfg.MaxAge = 2 * time.Hour
+
+	// The segments hold flows ending just after 12:00, 13:00, 14:00 and 15:00
+	s.enforceRetention(storeT0.Add(4 * time.Hour))
+	flows, _ := scanAll(t, dir, Query{})
+	if len(flows) != 2 || !flows[0].FirstSeen.Equal(storeT0.Add(2*time.Hour)) {
+		t.Errorf("flows left %+v", flows)
+	}
+	if st := s.Stats(); st.Removed != 2 || st.Segments != 2 {
+		t.Errorf("stats %+v", st)
+	}
+	if names, _ := segmentNames(dir); len(names) != 2 {
+		t.Errorf("segments on disk %v", names)
+	}
+	if idx, _ := filepath.Glob(filepath.Join(dir, "*"+indexExt)); len(idx) != 2 {
+		t.Errorf("indexes on disk %v", idx)
+	}
+}
+
+func TestRetentionBySize(t *testing.T) {
+	dir := t.TempDir()
+	s := openTestStore(t, dir)
+	for h := range 3 {
+		at := time.Duration(h) * time.Hour
+		write(s, storeT0.Add(at), flowAt(at, "10.0.0.2", 443, 1000))
+	}
+	s.seal()
+	segment := s.Stats().Size / 3
+
+	// Room for two segments and a bit
+	s.cfg.MaxSize = 2*segment + segment/2
+	s.enforceRetention(storeT0.Add(3 * time.Hour))
+	flows, _ := scanAll(t, dir, Query{})
+	if len(flows) != 2 || flows[0].FirstSeen.Equal(storeT0) {
+		t.Errorf("flows left %+v, want the newest two", flows)
+	}
+
+	// The segment being written counts but is never removed
+	write(s, storeT0.Add(3*time.Hour), flowAt(3*time.Hour, "10.0.0.2", 443, 1000))
+	s.cfg.MaxSize = 1
+	s.enforceRetention(storeT0.Add(3 * time.Hour))
+	if flows, _ := scanAll(t, dir, Query{}); len(flows) != 1 || s.active == nil {
+		t.Errorf("flows left %+v", flows)
+	}
+}
+
+func TestBlockSkipping(t *testing.T) {
+	dir := t.TempDir()
+	s := openTestStore(t, dir)
+	write(s, storeT0, flowAt(0, "10.0.0.2", 443, 1000), flowAt(time.Second, "10.0.0.3", 443, 1000))
+	write(s, storeT0, flowAt(time.Minute, "192.168.1.9", 22, 500))
+	udp := flowAt(2*time.Minute, "10.0.0.4", 53, 100)
+	udp.Protocol = "UDP"
+	write(s, storeT0, udp)
+	s.seal()
+
+	for _, tc := range []struct {
+		name    string
+		q       Query
+		matched int
+		skipped int
+	}{
+		{"all", Query{}, 4, 0},
+		{"ip", Query{IP: netip.MustParsePrefix("192.168.1.9/32")}, 1, 2},
+		{"cidr", Query{IP: netip.MustParsePrefix("10.0.0.0/29")}, 4, 0},
+		{"port", Query{Port: 22}, 1, 2},
+		{"protocol", Query{Protocol: "udp"}, 1, 2},
+		{"since", Query{Since: storeT0.Add(90 * time.Second)}, 1, 2},
+		{"until", Query{Until: storeT0.Add(30 * time.Second)}, 2, 2},
+		{"where ip", Query{Where: []alerting.Condition{alerting.ParseCondition("src_ip", "10.0.0.3")}}, 1, 2},
+		{"where cidr", Query{Where: []alerting.Condition{alerting.ParseCondition("src_ip", "192.168.0.0/16")}}, 1, 2},
+		{"where ports", Query{Where: []alerting.Condition{alerting.ParseCondition("dst_port", "22,53")}}, 2, 1},
+		{"where protocol", Query{Where: []alerting.Condition{alerting.ParseCondition("protocol", "TCP")}}, 3, 1},
+		// Only equality narrows blocks down, the rest is checked per flow
+		{"where range", Query{Where: []alerting.Condition{alerting.ParseCondition("dst_port", ">100")}}, 2, 0},
+		{"where other field", Query{Where: []alerting.Condition{alerting.ParseCondition("bytes", "500")}}, 1, 0},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			flows, stats := scanAll(t, dir, tc.q)
+			if len(flows) != tc.matched || stats.Matched != tc.matched || stats.BlocksSkipped != tc.skipped || stats.Blocks != 3 {
+				t.Errorf("%d flows, stats %+v, want %d matched and %d blocks skipped", len(flows), stats, tc.matched, tc.skipped)
+			}
+		})
+	}
+
+	// Segments outside the time range aren't opened
+	_, stats := scanAll(t, dir, Query{Since: storeT0.Add(time.Hour)})
+	if stats.SegmentsSkipped != 1 || stats.Scanned != 0 {
+		t.Errorf("stats %+v", stats)
+	}
+}
+
+func TestLongFlowFoundByItsTimes(t *testing.T) {
+	dir := t.TempDir()
+	s := openTestStore(t, dir)
+	// Exported at 15:00, after three hours
+	long := flowAt(0, "10.0.0.2", 443, 1000)
+	long.LastSeen = storeT0.Add(3 * time.Hour)
+	write(s, storeT0.Add(3*time.Hour), long)
+	s.seal()
+
+	q := Query{Since: storeT0.Add(time.Hour), Until: storeT0.Add(2 * time.Hour)}
+	if flows, _ := scanAll(t, dir, q); len(flows) != 1 {
+		t.Errorf("flow active during the range not found")
+	}
+}
+
+func TestAggregator(t *testing.T) {
+	flows := []koala.Flow{
+		flowAt(0, "10.0.0.2", 443, 1000),
+		flowAt(time.Minute, "10.0.0.2", 443, 3000),
+		flowAt(2*time.Minute, "10.0.0.3", 443, 2500),
+		flowAt(6*time.Minute, "10.0.0.3", 22, 100),
+	}
+
+	a := NewAggregator([]string{"src_ip", "dst_port"}, 0)
+	for i := range flows {
+		a.Add(&flows[i])
+	}
+	groups := a.Groups("bytes")
+	if len(groups) != 3 {
+		t.Fatalf("%d groups", len(groups))
+	}
+	g := groups[0]
+	if !reflect.DeepEqual(g.Key, []string{"10.0.0.2", "443"}) || g.Flows != 2 || g.Bytes != 4000 || g.Packets != 40 ||
+		!g.FirstSeen.Equal(storeT0) || !g.LastSeen.Equal(storeT0.Add(time.Minute+time.Second)) {
+		t.Errorf("first group %+v", g)
+	}
+	if groups[1].Key[0] != "10.0.0.3" || groups[1].Bytes != 2500 {
+		t.Errorf("second group %+v", groups[1])
+	}
+	if byFlows := a.Groups("flows"); byFlows[0].Flows != 2 || byFlows[1].Flows != 1 || byFlows[1].Key[1] != "22" {
+		t.Errorf("by flows: ties go by key, got %+v then %+v", byFlows[0], byFlows[1])
+	}
+
+	// Time buckets come first, missing fields are "-"
+	a = NewAggregator([]string{"sni"}, 5*time.Minute)
+	for i := range flows {
+		a.Add(&flows[i])
+	}
+	if cols := a.Columns(); !reflect.DeepEqual(cols, []string{"time", "sni"}) {
+		t.Errorf("columns %v", cols)
+	}
+	groups = a.Groups("packets")
+	if len(groups) != 2 || groups[0].Key[0] != "2026-01-01T12:00:00Z" || groups[0].Key[1] != "-" || groups[0].Flows != 3 ||
+		groups[1].Key[0] != "2026-01-01T12:05:00Z" {
+		t.Errorf("groups %+v", groups)
+	}
+}
@@ -0,0 +1,241 @@
+// Package geoip enriches IP addresses with country, city and ASN data from
+// local MaxMind-format (MMDB) databases such as GeoLite2-City and
+// GeoLite2-ASN.
+package geoip
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/oschwald/maxminddb-golang"
+)
+
+// Info is what we know about an address.
+type Info struct {
+	Country string `json:"country,omitempty"`
+	City    string `json:"city,omitempty"`
+	ASN     uint   `json:"asn,omitempty"`
+	Org     string `json:"org,omitempty"`
+}
+
+func (i Info) String() string {
+	var parts []string
+	if i.Country != "" {
+		loc := i.Country
+		if i.City != "" {
+			loc += "/" + i.City
+		}
+		parts = append(parts, loc)
+	}
+	if i.ASN != 0 {
+		parts = append(parts, fmt.Sprintf("AS%d", i.ASN))
+	}
+	if i.Org != "" {
+		parts = append(parts, i.Org)
+	}
+	if len(parts) == 0 {
+		return "-"
+	}
+	return strings.Join(parts, " ")
+}
+
+type cityRecord struct {
+	Country struct {
+		IsoCode string `maxminddb:"iso_code"`
+	} `maxminddb:"country"`
+	City struct {
+		Names map[string]string `maxminddb:"names"`
+	} `maxminddb:"city"`
+}
+
+type asnRecord struct {
+	Number uint   `maxminddb:"autonomous_system_number"`
+	Org    string `maxminddb:"autonomous_system_organization"`
+}
+
+// database is one MMDB file, reloaded when its size or mtime changes.
+type database struct {
+	path    string
+	reader  atomic.Pointer[maxminddb.Reader]
+	modTime time.Time
+	size    int64
+}
+
+// load reads the whole file into memory so a replaced reader can simply be
+// dropped while lookups on it are still running.
+func (d *database) load() (bool, error) {
+	st, err := os.Stat(d.path)
+	if err != nil {
+		return false, err
+	}
+	if d.reader.Load() != nil && st.ModTime().Equal(d.modTime) && st.Size() == d.size {
+		return false, nil
+	}
+
+	data, err := os.ReadFile(d.path)
+	if err != nil {
+		return false, err
+	}
+	reader, err := maxminddb.FromBytes(data)
+	if err != nil {
+		return false, fmt.Errorf("%s: %v", d.path, err)
+	}
+
+	d.reader.Store(reader)
+	d.modTime, d.size = st.ModTime(), st.Size()
+	return true, nil
+}
+
+// cacheEvictSample is how many cached addresses are looked at to find one
+// that wasn't used for a while when the cache is full.
+const cacheEvictSample = 8
+
+type cacheEntry struct {
+	info Info
+	// used is when the entry was last looked up, in Unix nanoseconds
+	used atomic.Int64
+}
+
+// Enricher looks up addresses in the configured databases and caches the
+// results per IP.
+type Enricher struct {
+	city *database
+	asn  *database
+
+	mu        sync.RWMutex
+	cache     map[string]*cacheEntry
+	cacheSize int
+
+	errors func(error)
+	stop   chan struct{}
+	once   sync.Once
+}
+
+// New opens the databases, either path may be empty. The files are checked
+// for changes every reloadInterval, reload failures are passed to onError
+// and the previous data stays in use.
+func New(cityPath, asnPath string, cacheSize int, reloadInterval time.Duration, onError func(error)) (*Enricher, error) {
+	e := &Enricher{
+		cache:     make(map[string]*cacheEntry),
+		cacheSize: cacheSize,
+		errors:    onError,
+		stop:      make(chan struct{}),
+	}
+
+	if cityPath != "" {
+		e.city = &database{path: cityPath}
+		if _, err := e.city.load(); err != nil {
+			return nil, err
+		}
+	}
+	if asnPath != "" {
+		e.asn = &database{path: asnPath}
+		if _, err := e.asn.load(); err != nil {
+			return nil, err
+		}
+	}
+
+	if reloadInterval > 0 {
+		go e.watch(reloadInterval)
+	}
+
+	return e, nil
+}
+
+// Lookup returns the geo and ASN data for ip, ok is false when neither
+// database knows it.
+func (e *Enricher) Lookup(ip net.IP) (Info, bool) {
+	key := ip.String()
+
+	e.mu.RLock()
+	entry, ok := e.cache[key]
+	e.mu.RUnlock()
+	if ok {
+		entry.used.Store(time.Now().UnixNano())
+		return entry.info, entry.info != Info{}
+	}
+
+	var info Info
+
+	if e.city != nil {
+		var rec cityRecord
+		if err := e.city.reader.Load().Lookup(ip, &rec); err == nil {
+			info.Country = rec.Country.IsoCode
+			info.City = rec.City.Names["en"]
+		}
+	}
+	if e.asn != nil {
+		var rec asnRecord
+		if err := e.asn.reader.Load().Lookup(ip, &rec); err == nil {
+			info.ASN = rec.Number
+			info.Org = rec.Org
+		}
+	}
+
+	entry = &cacheEntry{info: info}
+	entry.used.Store(time.Now().UnixNano())
+	e.mu.Lock()
+	if _, ok := e.cache[key]; !ok && len(e.cache) >= e.cacheSize {
+		e.evictLocked()
+	}
+	e.cache[key] = entry
+	e.mu.Unlock()
+
+	return info, info != Info{}
+}
+
+// evictLocked forgets the least recently used of a few addresses picked
+// at random, map iteration order being random.
+func (e *Enricher) evictLocked() {
+	var oldest string
+	var oldestUsed int64
+	n := 0
+	for key, entry := range e.cache {
+		if used := entry.used.Load(); n == 0 || used < oldestUsed {
+			oldest, oldestUsed = key, used
+		}
+		if n++; n == cacheEvictSample {
+			break
+		}
+	}
+	delete(e.cache, oldest)
+}
+
+// Close stops watching the database files.
+func (e *Enricher) Close() {
+	e.once.Do(func() { close(e.stop) })
+}
+
+func (e *Enricher) watch(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-e.stop:
+			return
+		case <-ticker.C:
+			reloaded := false
+			for _, db := range []*database{e.city, e.asn} {
+				if db == nil {
+					continue
+				}
+				changed, err := db.load()
+				if err != nil && e.errors != nil {
+					e.errors(err)
+				}
+				reloaded = reloaded || changed
+			}
+			if reloaded {
+				e.mu.Lock()
+				e.cache = make(map[string]*cacheEntry, e.cacheSize)
+				e.mu.Unlock()
+			}
+		}
+	}
+}
@@ -0,0 +1,273 @@
+package geoip
+
+import (
+	"errors"
+	"net"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// Value types of the MMDB data section that the test databases use.
+type (
+	mmdbUint16 uint16
+	mmdbUint32 uint32
+	mmdbUint64 uint64
+)
+
+// mmdbControl encodes the control byte(s) of a value of typ and size.
+func mmdbControl(typ, size int) []byte {
+	var b []byte
+	switch {
+	case size < 29:
+		b = []byte{byte(size)}
+	case size < 285:
+		b = []byte{29, byte(size - 29)}
+	default:
+		b = []byte{30, byte((size - 285) >> 8), byte(size - 285)}
+	}
+	if typ <= 7 {
+		b[0] |= byte(typ << 5)
+		return b
+	}
+	// Extended types follow the control byte
+	return append([]byte{b[0], byte(typ - 7)}, b[1:]...)
+}
+
+func mmdbUint(typ int, v uint64) []byte {
+	var be []byte
+	for ; v > 0; v >>= 8 {
+		be = append([]byte{byte(v)}, be...)
+	}
+	return append(mmdbControl(typ, len(be)), be...)
+}
+
+func mmdbEncode(v any) []byte {
+	switch v := v.(type) {
+	case string:
+		return append(mmdbControl(2, len(v)), v...)
+	case mmdbUint16:
+		return mmdbUint(5, uint64(v))
+	case mmdbUint32:
+		return mmdbUint(6, uint64(v))
+	case mmdbUint64:
+		return mmdbUint(9, uint64(v))
+	case map[string]any:
+		b := mmdbControl(7, len(v))
+		for k, item := range v {
+			b = append(b, mmdbEncode(k)...)
+			b = append(b, mmdbEncode(item)...)
+		}
+		return b
+	case []any:
+		b := mmdbControl(11, len(v))
+		for _, item := range v {
+			b = append(b, mmdbEncode(item)...)
+		}
+		return b
+	default:
+		panic("unsupported MMDB value")
+	}
+}
+
+// writeMMDB writes an IPv4 database with 24 bit records that maps each
+// prefix, none containing another, to its record.
+func writeMMDB(t *testing.T, path string, records map[string]map[string]any) {
+	t.Helper()
+	const empty = -1
+	nodes := [][2]int{{empty, empty}}
+	var data []byte
+	var dataAt []int // data offset of the records pointing to data, by -2-i
+
+	for prefix, rec := range records {
+		p := netip.MustParsePrefix(prefix)
+		addr := p.Addr().As4()
+		n := 0
+		for i := 0; i < p.Bits(); i++ {
+			b := int(addr[i/8]>>(7-i%8)) & 1
+			if i == p.Bits()-1 {
+				nodes[n][b] = -2 - len(dataAt)
+				dataAt = append(dataAt, len(data))
+				data = append(data, mmdbEncode(rec)...)
+				break
+			}
+			if nodes[n][b] == empty {
+				nodes = append(nodes, [2]int{empty, empty})
+				nodes[n][b] = len(nodes) - 1
+			}
+			n = nodes[n][b]
+		}
+	}
+
+	var db []byte
+	count := len(nodes)
+	for _, node := range nodes {
+		for _, r := range node {
+			v := r
+			switch {
+			case r == empty:
+				v = count
+			case r < 0:
+				v = count + 16 + dataAt[-2-r]
+			}
+			db = append(db, byte(v>>16), byte(v>>8), byte(v))
+		}
+	}
+	db = append(db, make([]byte, 16)...)
+	db = append(db, data...)
+	db = append(db, "\xab\xcd\xefMaxMind.com"...)
+	db = append(db, mmdbEncode(map[string]any{
+		"node_count":                  mmdbUint32(count),
+		"record_size":                 mmdbUint16(24),
+		"ip_version":                  mmdbUint16(4),
+		"database_type":               "Test",
+		"languages":                   []any{"en"},
+		"binary_format_major_version": mmdbUint16(2),
+		"binary_format_minor_version": mmdbUint16(0),
+		"build_epoch":                 mmdbUint64(time.Now().Unix()),
+		"description":                 map[string]any{"en": "test"},
+	})...)
+	if err := os.WriteFile(path, db, 0o600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func city(country, name string) map[string]any {
+	return map[string]any{
+		"country": map[string]any{"iso_code": country},
+		"city":    map[string]any{"names": map[string]any{"en": name}},
+	}
+}
+
+func asn(number uint32, org string) map[string]any {
+	return map[string]any{
+		"autonomous_system_number":       mmdbUint32(number),
+		"autonomous_system_organization": org,
+	}
+}
+
+func testDatabases(t *testing.T) (cityPath, asnPath string) {
+	dir := t.TempDir()
+	cityPath, asnPath = filepath.Join(dir, "city.mmdb"), filepath.Join(dir, "asn.mmdb")
+	writeMMDB(t, cityPath, map[string]map[string]any{
+		"203.0.113.0/24":  city("DE", "Berlin"),
+		"198.51.100.0/25": city("US", ""),
+	})
+	writeMMDB(t, asnPath, map[string]map[string]any{
+		"203.0.113.0/24": asn(64500, "Example Net"),
+		"192.0.2.0/24":   asn(64501, "Docs"),
+	})
+	return cityPath, asnPath
+}
+
+func TestLookup(t *testing.T) {
+	cityPath, asnPath := testDatabases(t)
+	e, err := New(cityPath, asnPath, 16, 0, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer e.Close()
+
+	for ip, want := range map[string]Info{
+		"203.0.113.9":    {Country: "DE", City: "Berlin", ASN: 64500, Org: "Example Net"},
+		"198.51.100.1":   {Country: "US"},
+		"192.0.2.1":      {ASN: 64501, Org: "Docs"},
+		"198.51.100.200": {},
+		"10.0.0.1":       {},
+	} {
+		for range 2 { // looked up, then cached
+			got, ok := e.Lookup(net.ParseIP(ip))
+			if got != want || ok != (want != Info{}) {
+				t.Errorf("Lookup(%s) = %+v %v, want %+v", ip, got, ok, want)
+			}
+		}
+	}
+
+	// Either database alone will do
+	e, err = New("", asnPath, 16, 0, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := e.Lookup(net.ParseIP("203.0.113.9")); got != (Info{ASN: 64500, Org: "Example Net"}) {
+		t.Errorf("ASN only: %+v", got)
+	}
+}
+
+func TestInfoString(t *testing.T) {
+	for want, info := range map[string]Info{
+		"DE/Berlin AS64500 Example Net": {Country: "DE", City: "Berlin", ASN: 64500, Org: "Example Net"},
+		"US":                            {Country: "US"},
+		"AS64501":                       {ASN: 64501},
+		"-":                             {},
+	} {
+		if got := info.String(); got != want {
+			t.Errorf("%+v = %q, want %q", info, got, want)
+		}
+	}
+}
+
+func TestNewErrors(t *testing.T) {
+	if _, err := New(filepath.Join(t.TempDir(), "missing.mmdb"), "", 16, 0, nil); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("missing file: %v", err)
+	}
+	bad := filepath.Join(t.TempDir(), "bad.mmdb")
+	os.WriteFile(bad, []byte("not a database"), 0o600)
+	if _, err := New("", bad, 16, 0, nil); err == nil {
+		t.Error("bad file opened")
+	}
+}
+
+// A full cache forgets a few entries at a time, and not the ones in use.
+func TestCacheEviction(t *testing.T) {
+	e, err := New("", "", 64, 0, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hot := net.ParseIP("10.0.0.1")
+	e.Lookup(hot)
+	for i := range 1000 {
+		time.Sleep(time.Microsecond)
+		e.Lookup(hot)
+		e.Lookup(net.IPv4(10, 1, byte(i>>8), byte(i)))
+		if len(e.cache) > 64 {
+			t.Fatalf("cache grew to %d", len(e.cache))
+		}
+	}
+	if len(e.cache) != 64 {
+		t.Errorf("cache holds %d, want it full", len(e.cache))
+	}
+	if _, ok := e.cache[hot.String()]; !ok {
+		t.Error("address used all along was evicted")
+	}
+}
+
+func TestReload(t *testing.T) {
+	cityPath, _ := testDatabases(t)
+	// A half written file fails to load and is picked up on the next check
+	e, err := New(cityPath, "", 16, 10*time.Millisecond, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer e.Close()
+	ip := net.ParseIP("203.0.113.9")
+	if got, _ := e.Lookup(ip); got.City != "Berlin" {
+		t.Fatalf("before the reload %+v", got)
+	}
+
+	writeMMDB(t, cityPath, map[string]map[string]any{"203.0.113.0/24": city("FR", "Paris, Île-de-France")})
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if got, _ := e.Lookup(ip); got.City != "Berlin" {
+			if got.Country != "FR" {
+				t.Errorf("after the reload %+v", got)
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("database not reloaded")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,144 @@
+// Package iptrie implements a binary prefix trie for longest-prefix matching
+// of IPv4 and IPv6 addresses.
+package iptrie
+
+import (
+	"net"
+	"net/netip"
+)
+
+type node[V any] struct {
+	children [2]*node[V]
+	prefix   netip.Prefix
+	value    V
+	set      bool
+}
+
+// Trie maps prefixes to values. It is not safe for concurrent writes, build
+// it once and swap the pointer to update it.
+type Trie[V any] struct {
+	v4   *node[V]
+	v6   *node[V]
+	size int
+}
+
+func New[V any]() *Trie[V] {
+	return &Trie[V]{v4: &node[V]{}, v6: &node[V]{}}
+}
+
+func (t *Trie[V]) root(addr netip.Addr) *node[V] {
+	if addr.Is4() {
+		return t.v4
+	}
+	return t.v6
+}
+
+// Insert stores v for prefix, replacing any previous value for it.
+// IPv4-mapped IPv6 prefixes are stored as the IPv4 prefix they cover, the
+// way Lookup unmaps addresses.
+func (t *Trie[V]) Insert(prefix netip.Prefix, v V) {
+	prefix = unmapPrefix(prefix.Masked())
+	addr := prefix.Addr()
+	bytes := addr.AsSlice()
+
+	n := t.root(addr)
+	for i := 0; i < prefix.Bits(); i++ {
+		b := bit(bytes, i)
+		if n.children[b] == nil {
+			n.children[b] = &node[V]{}
+		}
+		n = n.children[b]
+	}
+
+	if !n.set {
+		t.size++
+	}
+	n.prefix, n.value, n.set = prefix, v, true
+}
+
+// Lookup returns the value of the most specific prefix containing addr.
+func (t *Trie[V]) Lookup(addr netip.Addr) (V, netip.Prefix, bool) {
+	addr = addr.Unmap()
+	bytes := addr.AsSlice()
+
+	var best *node[V]
+	n := t.root(addr)
+	for i := 0; n != nil; i++ {
+		if n.set {
+			best = n
+		}
+		if i == len(bytes)*8 {
+			break
+		}
+		n = n.children[bit(bytes, i)]
+	}
+
+	if best == nil {
+		var zero V
+		return zero, netip.Prefix{}, false
+	}
+	return best.value, best.prefix, true
+}
+
+// Contains reports whether any prefix in the trie contains addr.
+func (t *Trie[V]) Contains(addr netip.Addr) bool {
+	_, _, ok := t.Lookup(addr)
+	return ok
+}
+
+// Len returns the number of prefixes stored.
+func (t *Trie[V]) Len() int {
+	return t.size
+}
+
+// Walk calls fn for every stored prefix until fn returns false.
+func (t *Trie[V]) Walk(fn func(netip.Prefix, V) bool) {
+	for _, root := range []*node[V]{t.v4, t.v6} {
+		if !walk(root, fn) {
+			return
+		}
+	}
+}
+
+func walk[V any](n *node[V], fn func(netip.Prefix, V) bool) bool {
+	if n == nil {
+		return true
+	}
+	if n.set && !fn(n.prefix, n.value) {
+		return false
+	}
+	return walk(n.children[0], fn) && walk(n.children[1], fn)
+}
+
+// unmapPrefix turns ::ffff:a.b.c.d/n, n >= 96, into a.b.c.d/n-96. Shorter
+// prefixes reach beyond the mapped range and stay IPv6.
+func unmapPrefix(p netip.Prefix) netip.Prefix {
+	if addr := p.Addr(); addr.Is4In6() && p.Bits() >= 96 {
+		return netip.PrefixFrom(addr.Unmap(), p.Bits()-96)
+	}
+	return p
+}
+
+func bit(b []byte, i int) int {
+	return int(b[i/8]>>(7-uint(i%8))) & 1
+}
+
+// ParsePrefix accepts a CIDR or a bare address, which is taken as a host
+// prefix.
+func ParsePrefix(s string) (netip.Prefix, error) {
+	if p, err := netip.ParsePrefix(s); err == nil {
+		return unmapPrefix(p.Masked()), nil
+	}
+	addr, err := netip.ParseAddr(s)
+	if err != nil {
+		return netip.Prefix{}, err
+	}
+	addr = addr.Unmap()
+	return netip.PrefixFrom(addr, addr.BitLen()), nil
+}
+
+// AddrFromIP converts a net.IP, unmapping IPv4-in-IPv6 addresses.
+func AddrFromIP(ip net.IP) netip.Addr {
+	addr, _ := netip.AddrFromSlice(ip)
+	return addr.Unmap()
+}
@@ -0,0 +1,129 @@
+package iptrie
+
+import (
+	"net"
+	"net/netip"
+	"testing"
+)
+
+func testTrie(prefixes ...string) *Trie[string] {
+	t := New[string]()
+	for _, p := range prefixes {
+		t.Insert(netip.MustParsePrefix(p), p)
+	}
+	return t
+}
+
+func TestLookup(t *testing.T) {
+	trie := testTrie(
+		"10.0.0.0/8",
+		"10.1.0.0/16",
+		"10.1.2.3/32",
+		"0.0.0.0/0",
+		"2001:db8::/32",
+		"2001:db8:1::/48",
+		"::ffff:192.168.0.0/112", // mapped, stored as 192.168.0.0/16
+		"::ffff:0:0/95",          // wider than the mapped range, stays IPv6
+	)
+	for _, tc := range []struct {
+		addr string
+		want string
+	}{
+		{"10.2.3.4", "10.0.0.0/8"},
+		{"10.1.9.9", "10.1.0.0/16"},
+		{"10.1.2.3", "10.1.2.3/32"},
+		{"8.8.8.8", "0.0.0.0/0"},
+		{"::ffff:10.1.2.3", "10.1.2.3/32"},
+		{"192.168.7.1", "::ffff:192.168.0.0/112"},
+		{"::ffff:192.168.7.1", "::ffff:192.168.0.0/112"},
+		{"2001:db8::1", "2001:db8::/32"},
+		{"2001:db8:1::1", "2001:db8:1::/48"},
+		{"2001:db9::1", ""},
+		{"::1", ""},
+	} {
+		v, prefix, ok := trie.Lookup(netip.MustParseAddr(tc.addr))
+		if v != tc.want || ok != (tc.want != "") {
+			t.Errorf("Lookup(%s) = %q %v, want %q", tc.addr, v, ok, tc.want)
+		}
+		if ok && !prefix.Contains(netip.MustParseAddr(tc.addr).Unmap()) {
+			t.Errorf("Lookup(%s) returned prefix %s", tc.addr, prefix)
+		}
+	}
+}
+
+func TestInsertMapped(t *testing.T) {
+	trie := New[int]()
+	trie.Insert(netip.MustParsePrefix("::ffff:10.0.0.0/104"), 1)
+	trie.Insert(netip.MustParsePrefix("10.0.0.0/8"), 2)
+	if trie.Len() != 1 {
+		t.Errorf("Len = %d, the mapped and plain prefix are the same", trie.Len())
+	}
+	v, prefix, ok := trie.Lookup(netip.MustParseAddr("10.9.9.9"))
+	if !ok || v != 2 || prefix != netip.MustParsePrefix("10.0.0.0/8") {
+		t.Errorf("Lookup = %d %s %v", v, prefix, ok)
+	}
+	if !trie.Contains(netip.MustParseAddr("::ffff:10.9.9.9")) || trie.Contains(netip.MustParseAddr("11.0.0.1")) {
+		t.Error("Contains disagrees with the prefix")
+	}
+}
+
+func TestWalk(t *testing.T) {
+	trie := testTrie("10.0.0.0/8", "10.1.0.0/16", "2001:db8::/32")
+	trie.Insert(netip.MustParsePrefix("10.0.0.0/8"), "again")
+	var got []string
+	trie.Walk(func(p netip.Prefix, v string) bool {
+		got = append(got, p.String()+"="+v)
+		return true
+	})
+	want := []string{"10.0.0.0/8=again", "10.1.0.0/16=10.1.0.0/16", "2001:db8::/32=2001:db8::/32"}
+	if len(got) != len(want) || trie.Len() != 3 {
+		t.Fatalf("walked %v, Len %d", got, trie.Len())
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("walked %v, want %v", got, want)
+			break
+		}
+	}
+
+	n := 0
+	trie.Walk(func(netip.Prefix, string) bool { n++; return false })
+	if n != 1 {
+		t.Errorf("Walk went on after false, %d calls", n)
+	}
+}
+
+func TestParsePrefix(t *testing.T) {
+	for _, tc := range []struct {
+		in   string
+		want string
+	}{
+		{"10.1.2.3/8", "10.0.0.0/8"},
+		{"10.1.2.3", "10.1.2.3/32"},
+		{"2001:db8::1", "2001:db8::1/128"},
+		{"::ffff:10.1.2.3", "10.1.2.3/32"},
+		{"::ffff:10.1.2.3/120", "10.1.2.0/24"},
+		{"bogus", ""},
+		{"10.0.0.0/33", ""},
+	} {
+		p, err := ParsePrefix(tc.in)
+		if tc.want == "" {
+			if err == nil {
+				t.Errorf("ParsePrefix(%q) = %s, want an error", tc.in, p)
+			}
+			continue
+		}
+		if err != nil || p.String() != tc.want {
+			t.Errorf("ParsePrefix(%q) = %s, %v, want %s", tc.in, p, err, tc.want)
+		}
+	}
+}
+
+func TestAddrFromIP(t *testing.T) {
+	if a := AddrFromIP(net.ParseIP("10.0.0.1")); !a.Is4() || a.String() != "10.0.0.1" {
+		t.Errorf("AddrFromIP = %s", a)
+	}
+	if a := AddrFromIP(net.ParseIP("2001:db8::1")); a.String() != "2001:db8::1" {
+		t.Errorf("AddrFromIP = %s", a)
+	}
+}
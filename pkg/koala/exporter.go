@@ -0,0 +1,376 @@
+package koala
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/hex"
+	"fmt"
+	"kernelKoala/pkg/alert"
+	"sync/atomic"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+)
+
+// ExporterConfig configures the agent side of the Push stream.
+type ExporterConfig struct {
+	Addr     string
+	Node     string
+	Insecure bool
+	// TLS replaces the default client configuration, e.g. to present a
+	// client certificate. Ignored when Insecure is set.
+	TLS *tls.Config
+	// Records are sent in batches of up to BatchSize, at least every
+	// FlushInterval, records beyond QueueSize are dropped.
+	BatchSize     int
+	FlushInterval time.Duration
+	QueueSize     int
+	// MaxInFlight bounds the batches waiting for an ack. Once reached
+	// nothing more is sent and the queue takes the backlog.
+	MaxInFlight int
+	// Timeout bounds the wait for the last acks on shutdown.
+	Timeout time.Duration
+	// DialOptions are added to the defaults, e.g. a custom dialer.
+	DialOptions []grpc.DialOption
+}
+
+func DefaultExporterConfig() ExporterConfig {
+	return ExporterConfig{
+		BatchSize:     500,
+		FlushInterval: 2 * time.Second,
+		QueueSize:     20000,
+		MaxInFlight:   8,
+		Timeout:       10 * time.Second,
+	}
+}
+
+// ExporterStats counts what was shipped and lost.
+type ExporterStats struct {
+	FlowsSent  uint64
+	AlertsSent uint64
+	Batches    uint64
+	Dropped    uint64
+	Reconnects uint64
+	Queued     int
+	Connected  bool
+}
+
+type record struct {
+	flow  *Flow
+	alert *alert.Alert
+}
+
+// Exporter streams flows and alerts to a Koala Server. Batches stay
+// pending until the server acknowledges them and are sent again after a
+// reconnect.
+type Exporter struct {
+	cfg     ExporterConfig
+	conn    *grpc.ClientConn
+	session string
+	onError func(error)
+
+	queue chan record
+	done  chan struct{}
+
+	// Owned by Run
+	seq     uint64
+	pending []*Batch
+	current *Batch
+
+	flowsSent  atomic.Uint64
+	alertsSent atomic.Uint64
+	batches    atomic.Uint64
+	dropped    atomic.Uint64
+	reconnects atomic.Uint64
+	connected  atomic.Bool
+}
+
+// NewExporter prepares the connection, it is established by Run. Errors
+// of the stream go to onError.
+func NewExporter(cfg ExporterConfig, onError func(error)) (*Exporter, error) {
+	if cfg.Node == "" {
+		return nil, fmt.Errorf("node name is required")
+	}
+	tlsConfig := cfg.TLS
+	if tlsConfig == nil {
+		tlsConfig = &tls.Config{MinVersion: tls.VersionTLS12}
+	}
+	creds := credentials.NewTLS(tlsConfig)
+	if cfg.Insecure {
+		creds = insecure.NewCredentials()
+	}
+	opts := append(DialOptions(), grpc.WithTransportCredentials(creds))
+	conn, err := grpc.NewClient(cfg.Addr, append(opts, cfg.DialOptions...)...)
+	if err != nil {
+		return nil, err
+	}
+
+	id := make([]byte, 8)
+	rand.Read(id)
+	return &Exporter{
+		cfg:     cfg,
+		conn:    conn,
+		session: hex.EncodeToString(id),
+		onError: onError,
+		queue:   make(chan record, cfg.QueueSize),
+		done:    make(chan struct{}),
+	}, nil
+}
+
+// AddFlow queues a flow without blocking.
+func (e *Exporter) AddFlow(f Flow) {
+	e.enqueue(record{flow: &f})
+}
+
+// AddAlert queues an alert without blocking.
+func (e *Exporter) AddAlert(a alert.Alert) {
+	e.enqueue(record{alert: &a})
+}
+
+func (e *Exporter) enqueue(r record) {
+	select {
+	case e.queue <- r:
+	default:
+		e.dropped.Add(1)
+	}
+}
+
+// pushConn is one connected Push stream.
+type pushConn struct {
+	stream grpc.ClientStream
+	cancel context.CancelFunc
+	acks   chan uint64
+	errs   chan error
+}
+
+func (e *Exporter) open() (*pushConn, error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	stream, err := e.conn.NewStream(ctx, &pushStream, "/"+serviceName+"/Push")
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	pc := &pushConn{stream: stream, cancel: cancel, acks: make(chan uint64, e.cfg.MaxInFlight), errs: make(chan error, 1)}
+	go func() {
+		for {
+			var ack Ack
+			if err := stream.RecvMsg(&ack); err != nil {
+				pc.errs <- err
+				return
+			}
+			select {
+			case pc.acks <- ack.Seq:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return pc, nil
+}
+
+// Run keeps a stream to the server open until ctx is done, then sends what
+// is queued and waits up to Timeout for the acks.
+func (e *Exporter) Run(ctx context.Context) {
+	defer close(e.done)
+	flush := time.NewTicker(e.cfg.FlushInterval)
+	defer flush.Stop()
+
+	backoff := time.Second
+	for attempt := 0; ; attempt++ {
+		if attempt > 0 {
+			select {
+			case <-ctx.Done():
+				e.dropped.Add(uint64(e.unsent() + len(e.queue)))
+				return
+			case <-time.After(backoff):
+			}
+			backoff = min(backoff*2, 30*time.Second)
+			e.reconnects.Add(1)
+		}
+
+		pc, err := e.open()
+		if err != nil {
+			e.reportError(fmt.Errorf("connecting to %s: %v", e.cfg.Addr, err))
+			continue
+		}
+		e.connected.Store(true)
+		progressed, err := e.push(ctx, pc, flush.C)
+		pc.cancel()
+		e.connected.Store(false)
+		if err == nil {
+			return
+		}
+		e.reportError(fmt.Errorf("stream to %s: %v", e.cfg.Addr, err))
+		if progressed {
+			backoff = time.Second
+		}
+	}
+}
+
+// push announces the node, resends the pending batches and then ships new
+// records until ctx is done or the stream breaks. progressed reports
+// whether the server acknowledged anything.
+func (e *Exporter) push(ctx context.Context, pc *pushConn, flush <-chan time.Time) (progressed bool, err error) {
+	if err := pc.stream.SendMsg(e.newBatch()); err != nil {
+		return false, err
+	}
+	for _, b := range e.pending {
+		if err := pc.stream.SendMsg(b); err != nil {
+			return false, err
+		}
+	}
+	for {
+		queue := e.queue
+		if len(e.pending) >= e.cfg.MaxInFlight {
+			queue = nil
+		}
+		select {
+		case <-ctx.Done():
+			e.finish(pc)
+			return progressed, nil
+		case seq := <-pc.acks:
+			e.acked(seq)
+			progressed = true
+		case err := <-pc.errs:
+			return progressed, err
+		case r := <-queue:
+			e.add(r)
+			if len(e.current.Flows)+len(e.current.Alerts) >= e.cfg.BatchSize {
+				if err := e.send(pc); err != nil {
+					return progressed, err
+				}
+			}
+		case <-flush:
+			if len(e.pending) < e.cfg.MaxInFlight {
+				if err := e.send(pc); err != nil {
+					return progressed, err
+				}
+			}
+		}
+	}
+}
+
+// finish sends everything queued and waits for the acks.
+func (e *Exporter) finish(pc *pushConn) {
+	defer func() { e.dropped.Add(uint64(e.unsent())) }()
+	for drained := false; !drained; {
+		select {
+		case r := <-e.queue:
+			e.add(r)
+			if len(e.current.Flows)+len(e.current.Alerts) >= e.cfg.BatchSize {
+				if e.send(pc) != nil {
+					return
+				}
+			}
+		default:
+			drained = true
+		}
+	}
+	if e.send(pc) != nil {
+		return
+	}
+	pc.stream.CloseSend()
+
+	timeout := time.After(e.cfg.Timeout)
+	for len(e.pending) > 0 {
+		select {
+		case seq := <-pc.acks:
+			e.acked(seq)
+		case <-pc.errs:
+			// The stream ended, take the acks that came before
+			for {
+				select {
+				case seq := <-pc.acks:
+					e.acked(seq)
+				default:
+					return
+				}
+			}
+		case <-timeout:
+			return
+		}
+	}
+}
+
+func (e *Exporter) newBatch() *Batch {
+	return &Batch{Node: e.cfg.Node, Session: e.session}
+}
+
+func (e *Exporter) add(r record) {
+	if e.current == nil {
+		e.current = e.newBatch()
+	}
+	if r.flow != nil {
+		e.current.Flows = append(e.current.Flows, *r.flow)
+	} else {
+		e.current.Alerts = append(e.current.Alerts, *r.alert)
+	}
+}
+
+// send seals the current batch and puts it on the stream, it stays
+// pending until acknowledged.
+func (e *Exporter) send(pc *pushConn) error {
+	if e.current == nil {
+		return nil
+	}
+	e.seq++
+	e.current.Seq = e.seq
+	b := e.current
+	e.pending = append(e.pending, b)
+	e.current = nil
+	return pc.stream.SendMsg(b)
+}
+
+func (e *Exporter) acked(seq uint64) {
+	n := 0
+	for n < len(e.pending) && e.pending[n].Seq <= seq {
+		e.flowsSent.Add(uint64(len(e.pending[n].Flows)))
+		e.alertsSent.Add(uint64(len(e.pending[n].Alerts)))
+		e.batches.Add(1)
+		n++
+	}
+	e.pending = e.pending[n:]
+}
+
+// unsent counts the records not acknowledged yet.
+func (e *Exporter) unsent() int {
+	n := 0
+	for _, b := range e.pending {
+		n += len(b.Flows) + len(b.Alerts)
+	}
+	if e.current != nil {
+		n += len(e.current.Flows) + len(e.current.Alerts)
+	}
+	return n
+}
+
+func (e *Exporter) reportError(err error) {
+	if e.onError != nil {
+		e.onError(err)
+	}
+}
+
+func (e *Exporter) Stats() ExporterStats {
+	return ExporterStats{
+		FlowsSent:  e.flowsSent.Load(),
+		AlertsSent: e.alertsSent.Load(),
+		Batches:    e.batches.Load(),
+		Dropped:    e.dropped.Load(),
+		Reconnects: e.reconnects.Load(),
+		Queued:     len(e.queue),
+		Connected:  e.connected.Load(),
+	}
+}
+
+// Close waits for Run to finish, if it was started, and closes the
+// connection.
+func (e *Exporter) Close(timeout time.Duration) error {
+	select {
+	case <-e.done:
+	case <-time.After(timeout):
+	}
+	return e.conn.Close()
+}
@@ -0,0 +1,457 @@
+package koala
+
+import (
+	"container/list"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"kernelKoala/pkg/alerting"
+	"kernelKoala/pkg/auth"
+	"sort"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+// ServerConfig bounds what the server keeps in memory.
+type ServerConfig struct {
+	// Retention drops flows and alerts whose last packet is older.
+	Retention time.Duration
+	MaxFlows  int
+	MaxAlerts int
+	// MergeSlack is how far apart the time ranges two nodes report for
+	// the same 5-tuple may be to still count as one connection.
+	MergeSlack time.Duration
+	// MaxLimit caps the records a query returns.
+	MaxLimit int
+}
+
+func DefaultServerConfig() ServerConfig {
+	return ServerConfig{
+		Retention:  time.Hour,
+		MaxFlows:   500000,
+		MaxAlerts:  10000,
+		MergeSlack: 10 * time.Second,
+		MaxLimit:   10000,
+	}
+}
+
+// endpoint and mergeKey identify a connection regardless of which end
+// reported it.
+type endpoint struct {
+	ip   string
+	port uint16
+}
+
+type mergeKey struct {
+	protocol string
+	a, b     endpoint
+}
+
+func keyOf(f *Flow) mergeKey {
+	a := endpoint{f.SrcIP, f.SrcPort}
+	b := endpoint{f.DstIP, f.DstPort}
+	if b.ip < a.ip || (b.ip == a.ip && b.port < a.port) {
+		a, b = b, a
+	}
+	return mergeKey{protocol: f.Protocol, a: a, b: b}
+}
+
+type storedFlow struct {
+	key  mergeKey
+	flow *MergedFlow
+	elem *list.Element
+}
+
+// sessionState remembers the last batch of an agent session so batches
+// resent after a reconnect are acknowledged but not merged twice.
+type sessionState struct {
+	status  NodeStatus
+	lastSeq uint64
+	streams int
+}
+
+// Server is the Koala Server: it accepts Push streams from agents, merges
+// their flows and answers queries.
+type Server struct {
+	cfg     ServerConfig
+	onError func(error)
+
+	mu     sync.Mutex
+	flows  map[mergeKey][]*storedFlow
+	order  *list.List // *storedFlow, oldest report first
+	alerts []NodeAlert
+	nodes  map[string]*sessionState
+}
+
+func NewServer(cfg ServerConfig, onError func(error)) *Server {
+	return &Server{
+		cfg:     cfg,
+		onError: onError,
+		flows:   make(map[mergeKey][]*storedFlow),
+		order:   list.New(),
+		nodes:   make(map[string]*sessionState),
+	}
+}
+
+// Run expires old records until ctx is done.
+func (s *Server) Run(ctx context.Context) {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			s.expire(now)
+		}
+	}
+}
+
+// Push receives batches from one agent and acknowledges each of them. An
+// agent that presented a certificate may only report as the node its
+// certificate names, and a stream carries a single node.
+func (s *Server) Push(stream grpc.ServerStream) error {
+	peerAddr, identity := "", ""
+	if p, ok := peer.FromContext(stream.Context()); ok {
+		peerAddr = p.Addr.String()
+		if info, ok := p.AuthInfo.(credentials.TLSInfo); ok {
+			identity = auth.PeerName(&info.State)
+		}
+	}
+
+	var node *sessionState
+	defer func() {
+		if node != nil {
+			s.mu.Lock()
+			node.streams--
+			node.status.Connected = node.streams > 0
+			s.mu.Unlock()
+		}
+	}()
+
+	for {
+		var b Batch
+		if err := stream.RecvMsg(&b); err != nil {
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+			return err
+		}
+		if b.Node == "" {
+			return status.Error(codes.InvalidArgument, "batch without node name")
+		}
+		if identity != "" && b.Node != identity {
+			s.reportError(fmt.Errorf("%s (%s) tried to report as node %s", identity, peerAddr, b.Node))
+			return status.Errorf(codes.PermissionDenied, "certificate of %s doesn't allow reporting as node %s", identity, b.Node)
+		}
+		if node != nil && b.Node != node.status.Name {
+			return status.Errorf(codes.InvalidArgument, "node name changed from %s to %s within the stream", node.status.Name, b.Node)
+		}
+		node = s.ingest(&b, peerAddr, identity, node == nil)
+		if err := stream.SendMsg(&Ack{Seq: b.Seq}); err != nil {
+			s.reportError(fmt.Errorf("acknowledging %s: %v", b.Node, err))
+			return err
+		}
+	}
+}
+
+// ingest merges a batch unless it was seen before. The first batch of a
+// stream registers it, agents start with an empty one with Seq 0.
+func (s *Server) ingest(b *Batch, peerAddr, identity string, first bool) *sessionState {
+	now := time.Now()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	n := s.nodes[b.Node]
+	if n == nil || n.status.Session != b.Session {
+		n = &sessionState{status: NodeStatus{Name: b.Node, Session: b.Session, ConnectedAt: now}}
+		s.nodes[b.Node] = n
+	}
+	if first {
+		n.streams++
+		n.status.Connected = true
+		n.status.ConnectedAt = now
+		n.status.Peer = peerAddr
+		n.status.Identity = identity
+	}
+	if b.Seq == 0 {
+		return n
+	}
+	if b.Seq <= n.lastSeq {
+		n.status.Duplicates++
+		return n
+	}
+	n.lastSeq = b.Seq
+	n.status.Batches++
+	n.status.LastBatch = now
+	n.status.Flows += uint64(len(b.Flows))
+	n.status.Alerts += uint64(len(b.Alerts))
+
+	for i := range b.Flows {
+		s.mergeFlow(b.Node, &b.Flows[i])
+	}
+	for _, a := range b.Alerts {
+		s.alerts = append(s.alerts, NodeAlert{Node: b.Node, Alert: a})
+	}
+	if over := len(s.alerts) - s.cfg.MaxAlerts; over > 0 {
+		s.alerts = append(s.alerts[:0], s.alerts[over:]...)
+	}
+	return n
+}
+
+// mergeFlow adds one node's report to the connection it belongs to. The
+// same 5-tuple seen again later, after a port was reused, starts a new
+// connection.
+func (s *Server) mergeFlow(node string, f *Flow) {
+	key := keyOf(f)
+	var target *storedFlow
+	for _, sf := range s.flows[key] {
+		m := sf.flow
+		if !f.FirstSeen.After(m.LastSeen.Add(s.cfg.MergeSlack)) && !f.LastSeen.Before(m.FirstSeen.Add(-s.cfg.MergeSlack)) {
+			target = sf
+			break
+		}
+	}
+	if target == nil {
+		target = &storedFlow{key: key, flow: &MergedFlow{Flow: *f}}
+		target.flow.Iface, target.flow.Scope = "", ""
+		target.flow.Packets, target.flow.Bytes = 0, 0
+		target.elem = s.order.PushBack(target)
+		s.flows[key] = append(s.flows[key], target)
+		for s.order.Len() > s.cfg.MaxFlows {
+			s.remove(s.order.Front().Value.(*storedFlow))
+		}
+	} else {
+		s.order.MoveToBack(target.elem)
+	}
+
+	m := target.flow
+	var obs *Observation
+	for i := range m.Observations {
+		if m.Observations[i].Node == node {
+			obs = &m.Observations[i]
+			break
+		}
+	}
+	if obs == nil {
+		m.Observations = append(m.Observations, Observation{Node: node, Iface: f.Iface, Scope: f.Scope})
+		obs = &m.Observations[len(m.Observations)-1]
+	}
+	// A node reporting the connection again exported it in parts
+	obs.Packets += f.Packets
+	obs.Bytes += f.Bytes
+	m.Packets = max(m.Packets, obs.Packets)
+	m.Bytes = max(m.Bytes, obs.Bytes)
+
+	if f.FirstSeen.Before(m.FirstSeen) {
+		m.FirstSeen = f.FirstSeen
+	}
+	if f.LastSeen.After(m.LastSeen) {
+		m.LastSeen = f.LastSeen
+	}
+	m.Closed = m.Closed || f.Closed
+	m.TCPFlags = mergeFlags(m.TCPFlags, f.TCPFlags)
+	if m.SNI == "" {
+		m.SNI, m.JA3 = f.SNI, f.JA3
+	}
+
+	// Fill in what the other end knew, in the stored orientation
+	srcName, dstName, srcGeo, dstGeo := f.SrcName, f.DstName, f.SrcGeo, f.DstGeo
+	if f.SrcIP != m.SrcIP || f.SrcPort != m.SrcPort {
+		srcName, dstName, srcGeo, dstGeo = dstName, srcName, dstGeo, srcGeo
+	}
+	if m.SrcName == "" {
+		m.SrcName = srcName
+	}
+	if m.DstName == "" {
+		m.DstName = dstName
+	}
+	if m.SrcGeo == nil {
+		m.SrcGeo = srcGeo
+	}
+	if m.DstGeo == nil {
+		m.DstGeo = dstGeo
+	}
+}
+
+func mergeFlags(a, b []string) []string {
+	for _, flag := range b {
+		found := false
+		for _, have := range a {
+			if have == flag {
+				found = true
+				break
+			}
+		}
+		if !found {
+			a = append(a, flag)
+		}
+	}
+	return a
+}
+
+func (s *Server) remove(sf *storedFlow) {
+	s.order.Remove(sf.elem)
+	same := s.flows[sf.key]
+	for i, other := range same {
+		if other == sf {
+			same = append(same[:i], same[i+1:]...)
+			break
+		}
+	}
+	if len(same) == 0 {
+		delete(s.flows, sf.key)
+	} else {
+		s.flows[sf.key] = same
+	}
+}
+
+// expire drops flows and alerts older than the retention.
+func (s *Server) expire(now time.Time) {
+	cutoff := now.Add(-s.cfg.Retention)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for e := s.order.Front(); e != nil; {
+		next := e.Next()
+		if sf := e.Value.(*storedFlow); sf.flow.LastSeen.Before(cutoff) {
+			s.remove(sf)
+		}
+		e = next
+	}
+	keep := 0
+	for keep < len(s.alerts) && s.alerts[keep].Time.Before(cutoff) {
+		keep++
+	}
+	s.alerts = append(s.alerts[:0], s.alerts[keep:]...)
+	for name, n := range s.nodes {
+		if !n.status.Connected && n.status.LastBatch.Before(cutoff) {
+			delete(s.nodes, name)
+		}
+	}
+}
+
+func (s *Server) limit(q *Query) int {
+	if q.Limit <= 0 || q.Limit > s.cfg.MaxLimit {
+		return min(100, s.cfg.MaxLimit)
+	}
+	return q.Limit
+}
+
+func inRange(q *Query, first, last time.Time) bool {
+	if !q.Since.IsZero() && last.Before(q.Since) {
+		return false
+	}
+	return q.Until.IsZero() || !first.After(q.Until)
+}
+
+// Flows returns the merged flows matching q, largest first.
+func (s *Server) Flows(ctx context.Context, q *Query) (*FlowsResponse, error) {
+	filter, err := alerting.NewFilter(q.Where)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	value := func(f *MergedFlow) float64 {
+		switch q.Sort {
+		case "packets":
+			return float64(f.Packets)
+		case "duration":
+			return float64(f.LastSeen.Sub(f.FirstSeen))
+		case "last_seen":
+			return float64(f.LastSeen.UnixNano())
+		case "", "bytes":
+			return float64(f.Bytes)
+		}
+		return 0
+	}
+	switch q.Sort {
+	case "", "bytes", "packets", "duration", "last_seen":
+	default:
+		return nil, status.Errorf(codes.InvalidArgument, "unknown sort %q", q.Sort)
+	}
+
+	var out []*MergedFlow
+	s.mu.Lock()
+	for e := s.order.Front(); e != nil; e = e.Next() {
+		f := e.Value.(*storedFlow).flow
+		if !inRange(q, f.FirstSeen, f.LastSeen) || !observedBy(f, q.Node) || !filter.Match(f) {
+			continue
+		}
+		c := *f
+		c.Observations = append([]Observation(nil), f.Observations...)
+		c.TCPFlags = append([]string(nil), f.TCPFlags...)
+		out = append(out, &c)
+	}
+	s.mu.Unlock()
+
+	sort.Slice(out, func(i, j int) bool { return value(out[i]) > value(out[j]) })
+	resp := &FlowsResponse{Total: len(out), Flows: out}
+	if n := s.limit(q); len(resp.Flows) > n {
+		resp.Flows = resp.Flows[:n]
+	}
+	if resp.Flows == nil {
+		resp.Flows = []*MergedFlow{}
+	}
+	return resp, nil
+}
+
+func observedBy(f *MergedFlow, node string) bool {
+	if node == "" {
+		return true
+	}
+	for _, o := range f.Observations {
+		if o.Node == node {
+			return true
+		}
+	}
+	return false
+}
+
+// Alerts returns the alerts matching q, newest first.
+func (s *Server) Alerts(ctx context.Context, q *Query) (*AlertsResponse, error) {
+	filter, err := alerting.NewFilter(q.Where)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	resp := &AlertsResponse{Alerts: []NodeAlert{}}
+	limit := s.limit(q)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i := len(s.alerts) - 1; i >= 0; i-- {
+		a := s.alerts[i]
+		if (q.Node != "" && a.Node != q.Node) || !inRange(q, a.Time, a.Time) || !filter.Match(alerting.AlertRecord(a.Alert)) {
+			continue
+		}
+		resp.Total++
+		if len(resp.Alerts) < limit {
+			resp.Alerts = append(resp.Alerts, a)
+		}
+	}
+	return resp, nil
+}
+
+// Nodes lists the agents that reported within the retention.
+func (s *Server) Nodes(ctx context.Context, req *NodesRequest) (*NodesResponse, error) {
+	s.mu.Lock()
+	resp := &NodesResponse{Nodes: make([]NodeStatus, 0, len(s.nodes))}
+	for _, n := range s.nodes {
+		resp.Nodes = append(resp.Nodes, n.status)
+	}
+	s.mu.Unlock()
+	sort.Slice(resp.Nodes, func(i, j int) bool { return resp.Nodes[i].Name < resp.Nodes[j].Name })
+	return resp, nil
+}
+
+func (s *Server) reportError(err error) {
+	if s.onError != nil {
+		s.onError(err)
+	}
+}
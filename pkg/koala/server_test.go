@@ -0,0 +1,501 @@
+package koala
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"kernelKoala/pkg/alert"
+	"math/big"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+var flowT0 = time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+
+// collector runs a Server, or a wrapper of it, on an in-memory listener.
+type collector struct {
+	srv  *Server
+	lis  *bufconn.Listener
+	grpc *grpc.Server
+}
+
+func startCollector(t *testing.T, wrap func(*Server) CollectorServer, opts ...grpc.ServerOption) *collector {
+	c := &collector{
+		srv:  NewServer(DefaultServerConfig(), nil),
+		lis:  bufconn.Listen(1 << 20),
+		grpc: grpc.NewServer(opts...),
+	}
+	var impl CollectorServer = c.srv
+	if wrap != nil {
+		impl = wrap(c.srv)
+	}
+	RegisterCollector(c.grpc, impl)
+	go c.grpc.Serve(c.lis)
+	t.Cleanup(c.grpc.Stop)
+	return c
+}
+
+func (c *collector) dialer() grpc.DialOption {
+	return grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+		return c.lis.DialContext(ctx)
+	})
+}
+
+func (c *collector) node(t *testing.T, name string) NodeStatus {
+	t.Helper()
+	resp, _ := c.srv.Nodes(context.Background(), &NodesRequest{})
+	for _, n := range resp.Nodes {
+		if n.Name == name {
+			return n
+		}
+	}
+	t.Fatalf("node %s unknown to the server", name)
+	return NodeStatus{}
+}
+
+func (c *collector) flows(t *testing.T) []*MergedFlow {
+	t.Helper()
+	resp, err := c.srv.Flows(context.Background(), &Query{Limit: 1000})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp.Flows
+}
+
+// agent is a synthetic agent speaking the Push stream directly.
+type agent struct {
+	t      *testing.T
+	conn   *grpc.ClientConn
+	stream grpc.ClientStream
+	cancel context.CancelFunc
+}
+
+func newAgent(t *testing.T, c *collector, creds credentials.TransportCredentials) *agent {
+	if creds == nil {
+		creds = insecure.NewCredentials()
+	}
+	opts := append(DialOptions(), c.dialer(), grpc.WithTransportCredentials(creds))
+	conn, err := grpc.NewClient("passthrough:///koala", opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	a := &agent{t: t, conn: conn}
+	a.reconnect()
+	return a
+}
+
+// reconnect drops the stream and opens a new one.
+func (a *agent) reconnect() {
+	if a.cancel != nil {
+		a.cancel()
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	stream, err := a.conn.NewStream(ctx, &pushStream, "/"+serviceName+"/Push")
+	if err != nil {
+		cancel()
+		a.t.Fatal(err)
+	}
+	a.stream, a.cancel = stream, cancel
+	a.t.Cleanup(cancel)
+}
+
+// push sends a batch and returns its ack, or the error ending the stream.
+func (a *agent) push(b *Batch) (uint64, error) {
+	if err := a.stream.SendMsg(b); err != nil {
+		return 0, err
+	}
+	var ack Ack
+	if err := a.stream.RecvMsg(&ack); err != nil {
+		return 0, err
+	}
+	return ack.Seq, nil
+}
+
+func (a *agent) mustPush(b *Batch) {
+	a.t.Helper()
+	seq, err := a.push(b)
+	if err != nil {
+		a.t.Fatalf("pushing batch %d: %v", b.Seq, err)
+	}
+	if seq != b.Seq {
+		a.t.Fatalf("batch %d acknowledged as %d", b.Seq, seq)
+	}
+}
+
+func tcpFlow(src string, srcPort uint16, dst string, dstPort uint16, packets uint64, at time.Time) Flow {
+	return Flow{
+		Protocol: "TCP", SrcIP: src, SrcPort: srcPort, DstIP: dst, DstPort: dstPort,
+		FirstSeen: at, LastSeen: at.Add(time.Second), Packets: packets, Bytes: packets * 100,
+		TCPFlags: []string{"SYN", "ACK"},
+	}
+}
+
+func TestMergeFlowsOfBothEnds(t *testing.T) {
+	c := startCollector(t, nil)
+	client, server := newAgent(t, c, nil), newAgent(t, c, nil)
+
+	// The client end names the server, the server end knows the geo data
+	out := tcpFlow("10.0.0.1", 40000, "10.0.0.2", 5432, 10, flowT0)
+	out.DstName, out.Iface = "db", "eth0"
+	in := tcpFlow("10.0.0.2", 5432, "10.0.0.1", 40000, 12, flowT0.Add(2*time.Second))
+	in.TCPFlags, in.Closed, in.Iface = []string{"FIN"}, true, "ens5"
+
+	client.mustPush(&Batch{Node: "node-a", Session: "a1"})
+	client.mustPush(&Batch{Node: "node-a", Session: "a1", Seq: 1, Flows: []Flow{out}})
+	server.mustPush(&Batch{Node: "node-b", Session: "b1"})
+	server.mustPush(&Batch{Node: "node-b", Session: "b1", Seq: 1, Flows: []Flow{in}})
+
+	// The same 5-tuple an hour later is another connection
+	later := tcpFlow("10.0.0.1", 40000, "10.0.0.2", 5432, 3, flowT0.Add(time.Hour))
+	client.mustPush(&Batch{Node: "node-a", Session: "a1", Seq: 2, Flows: []Flow{later}})
+
+	flows := c.flows(t)
+	if len(flows) != 2 {
+		t.Fatalf("%d flows, want 2", len(flows))
+	}
+	m := flows[0]
+	if len(m.Observations) != 2 || m.Observations[0].Node != "node-a" || m.Observations[1].Node != "node-b" {
+		t.Fatalf("observations %+v", m.Observations)
+	}
+	if m.SrcIP != "10.0.0.1" || m.DstName != "db" || m.Packets != 12 || m.Bytes != 1200 {
+		t.Errorf("merged flow %+v", m.Flow)
+	}
+	if !m.FirstSeen.Equal(flowT0) || !m.LastSeen.Equal(flowT0.Add(3*time.Second)) || !m.Closed {
+		t.Errorf("merged times %s - %s closed=%v", m.FirstSeen, m.LastSeen, m.Closed)
+	}
+	if len(m.TCPFlags) != 3 {
+		t.Errorf("merged flags %v", m.TCPFlags)
+	}
+	if m.Observations[1].Iface != "ens5" || m.Observations[1].Packets != 12 {
+		t.Errorf("node-b observation %+v", m.Observations[1])
+	}
+
+	// Queries filter by the reporting node
+	resp, _ := c.srv.Flows(context.Background(), &Query{Node: "node-b"})
+	if resp.Total != 1 {
+		t.Errorf("node-b observed %d flows, want 1", resp.Total)
+	}
+}
+
+func TestDuplicateBatchesAreAcknowledged(t *testing.T) {
+	c := startCollector(t, nil)
+	a := newAgent(t, c, nil)
+
+	b := &Batch{Node: "node-a", Session: "s1", Seq: 1,
+		Flows: []Flow{tcpFlow("10.0.0.1", 40000, "10.0.0.2", 80, 5, flowT0)}}
+	a.mustPush(&Batch{Node: "node-a", Session: "s1"})
+	a.mustPush(b)
+	a.mustPush(b)
+
+	n := c.node(t, "node-a")
+	if n.Batches != 1 || n.Duplicates != 1 || n.Flows != 1 {
+		t.Errorf("node status %+v", n)
+	}
+	if f := c.flows(t); len(f) != 1 || f[0].Packets != 5 {
+		t.Errorf("duplicate merged again: %+v", f)
+	}
+}
+
+func TestResendAfterReconnect(t *testing.T) {
+	c := startCollector(t, nil)
+	a := newAgent(t, c, nil)
+
+	session := "s1"
+	batch := func(seq uint64, port uint16) *Batch {
+		return &Batch{Node: "node-a", Session: session, Seq: seq,
+			Flows: []Flow{tcpFlow("10.0.0.1", port, "10.0.0.2", 80, 1, flowT0)}}
+	}
+	a.mustPush(&Batch{Node: "node-a", Session: "s1"})
+	a.mustPush(batch(1, 40001))
+	a.mustPush(batch(2, 40002))
+
+	// The ack of batch 2 got lost, the agent resends it on a new stream
+	a.reconnect()
+	a.mustPush(&Batch{Node: "node-a", Session: "s1"})
+	a.mustPush(batch(2, 40002))
+	a.mustPush(batch(3, 40003))
+
+	n := c.node(t, "node-a")
+	if n.Batches != 3 || n.Duplicates != 1 || n.Flows != 3 || !n.Connected {
+		t.Errorf("node status %+v", n)
+	}
+	if f := c.flows(t); len(f) != 3 {
+		t.Errorf("%d flows, want 3", len(f))
+	}
+
+	// A restarted agent starts a new session from sequence 1
+	session = "s2"
+	a.reconnect()
+	a.mustPush(&Batch{Node: "node-a", Session: session})
+	a.mustPush(batch(1, 40004))
+	if n := c.node(t, "node-a"); n.Session != "s2" || n.Batches != 1 || n.Duplicates != 0 {
+		t.Errorf("node status after restart %+v", n)
+	}
+	if f := c.flows(t); len(f) != 4 {
+		t.Errorf("%d flows, want 4", len(f))
+	}
+}
+
+func TestStreamKeepsOneNode(t *testing.T) {
+	c := startCollector(t, nil)
+	a := newAgent(t, c, nil)
+
+	a.mustPush(&Batch{Node: "node-a", Session: "s1"})
+	_, err := a.push(&Batch{Node: "node-b", Session: "s1", Seq: 1})
+	if status.Code(err) != codes.InvalidArgument {
+		t.Fatalf("switching nodes gave %v, want InvalidArgument", err)
+	}
+
+	a.reconnect()
+	if _, err := a.push(&Batch{Session: "s1"}); status.Code(err) != codes.InvalidArgument {
+		t.Fatalf("batch without node gave %v, want InvalidArgument", err)
+	}
+}
+
+// lossyServer breaks the stream instead of acknowledging the first batch
+// with records, after it was merged.
+type lossyServer struct {
+	*Server
+	lost atomic.Bool
+}
+
+type lossyStream struct {
+	grpc.ServerStream
+	srv *lossyServer
+}
+
+func (s *lossyServer) Push(stream grpc.ServerStream) error {
+	return s.Server.Push(lossyStream{stream, s})
+}
+
+func (s lossyStream) SendMsg(m any) error {
+	if m.(*Ack).Seq > 0 && s.srv.lost.CompareAndSwap(false, true) {
+		return errors.New("connection lost")
+	}
+	return s.ServerStream.SendMsg(m)
+}
+
+func newTestExporter(t *testing.T, c *collector, node string, cfg ExporterConfig) (*Exporter, func()) {
+	cfg.Addr = "passthrough:///koala"
+	cfg.Node = node
+	cfg.Insecure = true
+	cfg.DialOptions = append(cfg.DialOptions, c.dialer())
+	e, err := NewExporter(cfg, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	go e.Run(ctx)
+	stop := sync.OnceFunc(func() {
+		cancel()
+		e.Close(10 * time.Second)
+	})
+	t.Cleanup(stop)
+	return e, stop
+}
+
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(10 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestExporterResendsUnacknowledged(t *testing.T) {
+	lossy := &lossyServer{}
+	c := startCollector(t, func(s *Server) CollectorServer { lossy.Server = s; return lossy })
+
+	cfg := DefaultExporterConfig()
+	cfg.BatchSize = 2
+	e, stop := newTestExporter(t, c, "node-a", cfg)
+	for i := range 4 {
+		e.AddFlow(tcpFlow("10.0.0.1", uint16(40000+i), "10.0.0.2", 80, 1, flowT0))
+	}
+	e.AddAlert(testAlert())
+
+	waitFor(t, "the resent batches", func() bool { return e.Stats().FlowsSent == 4 })
+	stop()
+
+	s := e.Stats()
+	if s.Reconnects != 1 || s.AlertsSent != 1 || s.Dropped != 0 {
+		t.Errorf("exporter stats %+v", s)
+	}
+	n := c.node(t, "node-a")
+	if n.Duplicates != 1 || n.Flows != 4 || n.Alerts != 1 {
+		t.Errorf("node status %+v", n)
+	}
+	for _, f := range c.flows(t) {
+		if f.Packets != 1 {
+			t.Errorf("flow %s:%d merged twice", f.SrcIP, f.SrcPort)
+		}
+	}
+}
+
+// gatedServer holds back the acks of batches with records until gate is
+// closed.
+type gatedServer struct {
+	*Server
+	gate chan struct{}
+}
+
+type gatedStream struct {
+	grpc.ServerStream
+	gate chan struct{}
+}
+
+func (s *gatedServer) Push(stream grpc.ServerStream) error {
+	return s.Server.Push(gatedStream{stream, s.gate})
+}
+
+func (s gatedStream) SendMsg(m any) error {
+	if m.(*Ack).Seq > 0 {
+		select {
+		case <-s.gate:
+		case <-s.Context().Done():
+			return s.Context().Err()
+		}
+	}
+	return s.ServerStream.SendMsg(m)
+}
+
+func TestExporterBackpressure(t *testing.T) {
+	gated := &gatedServer{gate: make(chan struct{})}
+	c := startCollector(t, func(s *Server) CollectorServer { gated.Server = s; return gated })
+
+	cfg := DefaultExporterConfig()
+	cfg.BatchSize = 1
+	cfg.MaxInFlight = 2
+	cfg.QueueSize = 5
+	e, stop := newTestExporter(t, c, "node-a", cfg)
+	waitFor(t, "the connection", func() bool { return e.Stats().Connected })
+
+	// Two batches in flight, then the exporter stops reading its queue
+	e.AddFlow(tcpFlow("10.0.0.1", 40000, "10.0.0.2", 80, 1, flowT0))
+	e.AddFlow(tcpFlow("10.0.0.1", 40001, "10.0.0.2", 80, 1, flowT0))
+	waitFor(t, "both batches sent", func() bool { return e.Stats().Queued == 0 })
+	for i := range 10 {
+		e.AddFlow(tcpFlow("10.0.0.1", uint16(41000+i), "10.0.0.2", 80, 1, flowT0))
+	}
+	time.Sleep(50 * time.Millisecond)
+	if s := e.Stats(); s.Queued != 5 || s.Dropped != 5 || s.FlowsSent != 0 {
+		t.Fatalf("stats while blocked %+v, want 5 queued and 5 dropped", s)
+	}
+
+	// Once acks arrive the backlog drains
+	close(gated.gate)
+	waitFor(t, "the backlog", func() bool { return e.Stats().FlowsSent == 7 })
+	stop()
+	if s := e.Stats(); s.Queued != 0 || s.Dropped != 5 || s.Reconnects != 0 {
+		t.Errorf("stats after draining %+v", s)
+	}
+	if n := c.node(t, "node-a"); n.Flows != 7 || n.Batches != 7 {
+		t.Errorf("node status %+v", n)
+	}
+}
+
+// testPKI is a CA with certificates it signed.
+type testPKI struct {
+	key  *ecdsa.PrivateKey
+	cert *x509.Certificate
+	pool *x509.CertPool
+}
+
+func newTestPKI(t *testing.T) *testPKI {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	return &testPKI{key: key, cert: cert, pool: pool}
+}
+
+func (p *testPKI) issue(t *testing.T, name string, usage x509.ExtKeyUsage) tls.Certificate {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     []string{name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{usage},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, p.cert, &key.PublicKey, p.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+func TestNodeBoundToCertificate(t *testing.T) {
+	pki := newTestPKI(t)
+	serverTLS := &tls.Config{
+		Certificates: []tls.Certificate{pki.issue(t, "koala", x509.ExtKeyUsageServerAuth)},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    pki.pool,
+	}
+	c := startCollector(t, nil, grpc.Creds(credentials.NewTLS(serverTLS)))
+	agentCreds := func(name string) credentials.TransportCredentials {
+		return credentials.NewTLS(&tls.Config{
+			Certificates: []tls.Certificate{pki.issue(t, name, x509.ExtKeyUsageClientAuth)},
+			RootCAs:      pki.pool,
+			ServerName:   "koala",
+		})
+	}
+
+	a := newAgent(t, c, agentCreds("node-a"))
+	a.mustPush(&Batch{Node: "node-a", Session: "s1"})
+	a.mustPush(&Batch{Node: "node-a", Session: "s1", Seq: 1, Flows: []Flow{tcpFlow("10.0.0.1", 40000, "10.0.0.2", 80, 1, flowT0)}})
+	if n := c.node(t, "node-a"); n.Identity != "node-a" || n.Batches != 1 {
+		t.Fatalf("node status %+v", n)
+	}
+
+	// node-b's certificate can't take over node-a's session
+	b := newAgent(t, c, agentCreds("node-b"))
+	_, err := b.push(&Batch{Node: "node-a", Session: "s1", Seq: 2, Flows: []Flow{tcpFlow("10.0.0.9", 1, "10.0.0.2", 80, 1, flowT0)}})
+	if status.Code(err) != codes.PermissionDenied {
+		t.Fatalf("impersonation gave %v, want PermissionDenied", err)
+	}
+	if n := c.node(t, "node-a"); n.Batches != 1 || n.Identity != "node-a" || n.Session != "s1" {
+		t.Errorf("node-a changed by another agent: %+v", n)
+	}
+	if f := c.flows(t); len(f) != 1 {
+		t.Errorf("%d flows, the impersonated batch was merged", len(f))
+	}
+}
+
+func testAlert() alert.Alert {
+	return alert.Alert{Time: flowT0, Type: "port-scan", Severity: alert.SeverityHigh, Message: "scan", SrcIP: "10.0.0.9"}
+}
@@ -0,0 +1,290 @@
+// Package koala ships flows and alerts from agents to the Koala Server,
+// which merges the flows of all nodes and answers cluster-wide queries.
+//
+// Agents and server speak gRPC with JSON messages, so there is no
+// generated code: the service is described by hand in collectorDesc.
+package koala
+
+import (
+	"context"
+	"encoding/json"
+	"kernelKoala/pkg/alert"
+	"kernelKoala/pkg/alerting"
+	"kernelKoala/pkg/geoip"
+	"strconv"
+	"strings"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/encoding"
+	"google.golang.org/grpc/encoding/gzip"
+)
+
+const (
+	serviceName = "kernelkoala.koala.v1.Collector"
+	codecName   = "json"
+)
+
+// Flow is a finished flow as one agent saw it.
+type Flow struct {
+	Protocol  string      `json:"protocol"`
+	SrcIP     string      `json:"src_ip"`
+	SrcName   string      `json:"src_name,omitempty"`
+	SrcPort   uint16      `json:"src_port,omitempty"`
+	DstIP     string      `json:"dst_ip"`
+	DstName   string      `json:"dst_name,omitempty"`
+	DstPort   uint16      `json:"dst_port,omitempty"`
+	Iface     string      `json:"iface,omitempty"`
+	Scope     string      `json:"scope,omitempty"`
+	FirstSeen time.Time   `json:"first_seen"`
+	LastSeen  time.Time   `json:"last_seen"`
+	Packets   uint64      `json:"packets"`
+	Bytes     uint64      `json:"bytes"`
+	TCPFlags  []string    `json:"tcp_flags,omitempty"`
+	Closed    bool        `json:"closed,omitempty"`
+	SNI       string      `json:"sni,omitempty"`
+	JA3       string      `json:"ja3,omitempty"`
+	SrcGeo    *geoip.Info `json:"src_geo,omitempty"`
+	DstGeo    *geoip.Info `json:"dst_geo,omitempty"`
+}
+
+// Field exposes the flow to query conditions, with the field names of
+// the agent's flow rules.
+func (f *Flow) Field(name string) (string, bool) {
+	switch name {
+	case "protocol":
+		return f.Protocol, true
+	case "src_ip":
+		return f.SrcIP, true
+	case "dst_ip":
+		return f.DstIP, true
+	case "src_port":
+		return strconv.Itoa(int(f.SrcPort)), true
+	case "dst_port":
+		return strconv.Itoa(int(f.DstPort)), true
+	case "src_name":
+		return f.SrcName, f.SrcName != ""
+	case "dst_name":
+		return f.DstName, f.DstName != ""
+	case "iface":
+		return f.Iface, f.Iface != ""
+	case "scope":
+		return f.Scope, f.Scope != ""
+	case "packets":
+		return strconv.FormatUint(f.Packets, 10), true
+	case "bytes":
+		return strconv.FormatUint(f.Bytes, 10), true
+	case "duration":
+		return strconv.FormatFloat(f.LastSeen.Sub(f.FirstSeen).Seconds(), 'f', 3, 64), true
+	case "tcp_flags":
+		return strings.Join(f.TCPFlags, "|"), f.Protocol == "TCP"
+	case "closed":
+		return strconv.FormatBool(f.Closed), true
+	case "tls_sni":
+		return f.SNI, f.SNI != ""
+	case "tls_ja3":
+		return f.JA3, f.JA3 != ""
+	case "src_country":
+		if f.SrcGeo == nil {
+			return "", false
+		}
+		return f.SrcGeo.Country, true
+	case "dst_country":
+		if f.DstGeo == nil {
+			return "", false
+		}
+		return f.DstGeo.Country, true
+	case "dst_asn":
+		if f.DstGeo == nil {
+			return "", false
+		}
+		return strconv.Itoa(int(f.DstGeo.ASN)), true
+	}
+	return "", false
+}
+
+// Batch is what an agent sends on the Push stream. Seq grows by one per
+// batch within a Session, batches resent after a reconnect keep theirs.
+type Batch struct {
+	Node    string        `json:"node"`
+	Session string        `json:"session"`
+	Seq     uint64        `json:"seq"`
+	Flows   []Flow        `json:"flows,omitempty"`
+	Alerts  []alert.Alert `json:"alerts,omitempty"`
+}
+
+// Ack confirms every batch up to Seq.
+type Ack struct {
+	Seq uint64 `json:"seq"`
+}
+
+// Query selects merged flows or alerts. Where uses the alerting rule
+// conditions, Node keeps records reported by that node.
+type Query struct {
+	Where []alerting.Condition `json:"where,omitempty"`
+	Node  string               `json:"node,omitempty"`
+	Since time.Time            `json:"since,omitzero"`
+	Until time.Time            `json:"until,omitzero"`
+	// Sort is bytes (default), packets, duration or last_seen, flows only.
+	Sort  string `json:"sort,omitempty"`
+	Limit int    `json:"limit,omitempty"`
+}
+
+// Observation is one node's view of a merged flow.
+type Observation struct {
+	Node    string `json:"node"`
+	Iface   string `json:"iface,omitempty"`
+	Scope   string `json:"scope,omitempty"`
+	Packets uint64 `json:"packets"`
+	Bytes   uint64 `json:"bytes"`
+}
+
+// MergedFlow is a connection with the reports of every node that saw it.
+// Packets and Bytes are the largest count any node reported, not the sum,
+// since both ends see the same packets.
+type MergedFlow struct {
+	Flow
+	Observations []Observation `json:"observations"`
+}
+
+// Field adds the number of observing nodes to the flow's fields.
+func (f *MergedFlow) Field(name string) (string, bool) {
+	if name == "observers" {
+		return strconv.Itoa(len(f.Observations)), true
+	}
+	return f.Flow.Field(name)
+}
+
+// NodeAlert is an alert with the node that raised it.
+type NodeAlert struct {
+	Node string `json:"node"`
+	alert.Alert
+}
+
+// NodeStatus describes an agent known to the server. Identity is the name
+// in its client certificate when mutual TLS is used.
+type NodeStatus struct {
+	Name        string    `json:"name"`
+	Session     string    `json:"session"`
+	Peer        string    `json:"peer"`
+	Identity    string    `json:"identity,omitempty"`
+	Connected   bool      `json:"connected"`
+	ConnectedAt time.Time `json:"connected_at"`
+	LastBatch   time.Time `json:"last_batch,omitzero"`
+	Batches     uint64    `json:"batches"`
+	Duplicates  uint64    `json:"duplicates"`
+	Flows       uint64    `json:"flows"`
+	Alerts      uint64    `json:"alerts"`
+}
+
+type FlowsResponse struct {
+	Total int           `json:"total"`
+	Flows []*MergedFlow `json:"flows"`
+}
+
+type AlertsResponse struct {
+	Total  int         `json:"total"`
+	Alerts []NodeAlert `json:"alerts"`
+}
+
+type NodesRequest struct{}
+
+type NodesResponse struct {
+	Nodes []NodeStatus `json:"nodes"`
+}
+
+// jsonCodec is the gRPC codec of the collector service.
+type jsonCodec struct{}
+
+func (jsonCodec) Marshal(v any) ([]byte, error)      { return json.Marshal(v) }
+func (jsonCodec) Unmarshal(data []byte, v any) error { return json.Unmarshal(data, v) }
+func (jsonCodec) Name() string                       { return codecName }
+
+func init() {
+	encoding.RegisterCodec(jsonCodec{})
+}
+
+// CollectorServer is implemented by Server.
+type CollectorServer interface {
+	Push(stream grpc.ServerStream) error
+	Flows(ctx context.Context, q *Query) (*FlowsResponse, error)
+	Alerts(ctx context.Context, q *Query) (*AlertsResponse, error)
+	Nodes(ctx context.Context, req *NodesRequest) (*NodesResponse, error)
+}
+
+func unaryHandler[Req any, Resp any](method string, call func(CollectorServer, context.Context, *Req) (*Resp, error)) grpc.MethodDesc {
+	return grpc.MethodDesc{
+		MethodName: method,
+		Handler: func(srv any, ctx context.Context, dec func(any) error, interceptor grpc.UnaryServerInterceptor) (any, error) {
+			req := new(Req)
+			if err := dec(req); err != nil {
+				return nil, err
+			}
+			if interceptor == nil {
+				return call(srv.(CollectorServer), ctx, req)
+			}
+			info := &grpc.UnaryServerInfo{Server: srv, FullMethod: "/" + serviceName + "/" + method}
+			return interceptor(ctx, req, info, func(ctx context.Context, req any) (any, error) {
+				return call(srv.(CollectorServer), ctx, req.(*Req))
+			})
+		},
+	}
+}
+
+var pushStream = grpc.StreamDesc{
+	StreamName:    "Push",
+	ServerStreams: true,
+	ClientStreams: true,
+	Handler: func(srv any, stream grpc.ServerStream) error {
+		return srv.(CollectorServer).Push(stream)
+	},
+}
+
+var collectorDesc = grpc.ServiceDesc{
+	ServiceName: serviceName,
+	HandlerType: (*CollectorServer)(nil),
+	Methods: []grpc.MethodDesc{
+		unaryHandler("Flows", CollectorServer.Flows),
+		unaryHandler("Alerts", CollectorServer.Alerts),
+		unaryHandler("Nodes", CollectorServer.Nodes),
+	},
+	Streams: []grpc.StreamDesc{pushStream},
+}
+
+// RegisterCollector adds the collector service to s.
+func RegisterCollector(s *grpc.Server, srv CollectorServer) {
+	s.RegisterService(&collectorDesc, srv)
+}
+
+// DialOptions selects the JSON codec and gzip compression, transport
+// credentials are up to the caller.
+func DialOptions() []grpc.DialOption {
+	return []grpc.DialOption{
+		grpc.WithDefaultCallOptions(grpc.CallContentSubtype(codecName), grpc.UseCompressor(gzip.Name)),
+	}
+}
+
+// Client queries a Koala Server.
+type Client struct {
+	conn *grpc.ClientConn
+}
+
+// NewClient uses conn, which should be dialed with DialOptions.
+func NewClient(conn *grpc.ClientConn) *Client {
+	return &Client{conn: conn}
+}
+
+func (c *Client) Flows(ctx context.Context, q *Query) (*FlowsResponse, error) {
+	resp := new(FlowsResponse)
+	return resp, c.conn.Invoke(ctx, "/"+serviceName+"/Flows", q, resp)
+}
+
+func (c *Client) Alerts(ctx context.Context, q *Query) (*AlertsResponse, error) {
+	resp := new(AlertsResponse)
+	return resp, c.conn.Invoke(ctx, "/"+serviceName+"/Alerts", q, resp)
+}
+
+func (c *Client) Nodes(ctx context.Context) (*NodesResponse, error) {
+	resp := new(NodesResponse)
+	return resp, c.conn.Invoke(ctx, "/"+serviceName+"/Nodes", &NodesRequest{}, resp)
+}
@@ -0,0 +1,124 @@
+package network
+
+import (
+	"kernelKoala/pkg/alerting"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// packetRecord exposes a packet and its flow to the alerting rules.
+type packetRecord struct {
+	event PayLoadTc
+	flow  FlowRecord
+}
+
+func (r packetRecord) Field(name string) (string, bool) {
+	e := r.event.Event
+	switch name {
+	case "protocol":
+		return protocolName(e.Protocol), true
+	case "src_ip":
+		return intToIP(e.SrcIP).String(), true
+	case "dst_ip":
+		return intToIP(e.DstIP).String(), true
+	case "src_port":
+		return strconv.Itoa(int(e.SrcPort)), true
+	case "dst_port":
+		return strconv.Itoa(int(e.DstPort)), true
+	case "direction":
+		return strings.ToLower(directionName(e.Direction)), true
+	case "iface":
+		return r.event.Iface, true
+	case "scope":
+		return r.event.Scope, r.event.Scope != ""
+	case "tcp_flags":
+		return strings.Join(tcpFlagNames(e.TcpFlags), "|"), e.Protocol == 6
+	case "bytes":
+		return strconv.Itoa(int(e.PktLen)), true
+	case "policy":
+		action := policyAction(e)
+		return action, action != ""
+	case "new_flow":
+		return strconv.FormatBool(r.flow.isNew()), true
+	case "flow_packets":
+		return strconv.FormatUint(r.flow.Packets, 10), true
+	case "flow_bytes":
+		return strconv.FormatUint(r.flow.Bytes, 10), true
+	case "tls_sni":
+		if r.flow.TLS == nil {
+			return "", false
+		}
+		return r.flow.TLS.SNI, true
+	}
+	return "", false
+}
+
+// flowRecord exposes an exported flow to the alerting rules.
+type flowRecord FlowRecord
+
+func (r flowRecord) Field(name string) (string, bool) {
+	switch name {
+	case "protocol":
+		return protocolName(r.Key.Protocol), true
+	case "src_ip":
+		return intToIP(r.Key.SrcIP).String(), true
+	case "dst_ip":
+		return intToIP(r.Key.DstIP).String(), true
+	case "src_port":
+		return strconv.Itoa(int(r.Key.SrcPort)), true
+	case "dst_port":
+		return strconv.Itoa(int(r.Key.DstPort)), true
+	case "src_name":
+		return r.SrcName, nameOrEmpty(r.SrcName) != ""
+	case "dst_name":
+		return r.DstName, nameOrEmpty(r.DstName) != ""
+	case "iface":
+		return r.Iface, true
+	case "scope":
+		return r.Scope, r.Scope != ""
+	case "packets":
+		return strconv.FormatUint(r.Packets, 10), true
+	case "bytes":
+		return strconv.FormatUint(r.Bytes, 10), true
+	case "duration":
+		return strconv.FormatFloat(r.LastSeen.Sub(r.FirstSeen).Seconds(), 'f', 3, 64), true
+	case "tcp_flags":
+		return strings.Join(tcpFlagNames(r.TcpFlags), "|"), r.Key.Protocol == 6
+	case "closed":
+		return strconv.FormatBool(r.Closed), true
+	case "tls_sni":
+		if r.TLS == nil {
+			return "", false
+		}
+		return r.TLS.SNI, true
+	case "tls_ja3":
+		if r.TLS == nil {
+			return "", false
+		}
+		return r.TLS.JA3, r.TLS.JA3 != ""
+	case "src_country":
+		if r.SrcGeo == nil {
+			return "", false
+		}
+		return r.SrcGeo.Country, true
+	case "dst_country":
+		if r.DstGeo == nil {
+			return "", false
+		}
+		return r.DstGeo.Country, true
+	case "dst_asn":
+		if r.DstGeo == nil {
+			return "", false
+		}
+		return strconv.Itoa(int(r.DstGeo.ASN)), true
+	}
+	return "", false
+}
+
+func (w *PacketWorker) evaluateRules(event PayLoadTc, flow FlowRecord) {
+	if w.alerting == nil || !w.alerting.Wants(alerting.SourcePacket) {
+		return
+	}
+	w.alerting.Observe(alerting.SourcePacket, packetRecord{event, flow}, time.Now())
+}
@@ -0,0 +1,600 @@
+package network
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"kernelKoala/pkg/alerting"
+	"kernelKoala/pkg/auth"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Event types of the live stream.
+const (
+	eventPacket = "packet"
+	eventFlow   = "flow"
+	eventAlert  = "alert"
+)
+
+const (
+	maxSubscribers    = 64
+	subscriberBuffer  = 1024
+	defaultFlowsLimit = 100
+	keepaliveInterval = 15 * time.Second
+)
+
+// sensitiveFlags are never shown by /api/v1/config.
+var sensitiveFlags = map[string]bool{
+	"otlp-headers": true,
+	"db-dsn":       true,
+}
+
+type streamEvent struct {
+	kind string
+	data []byte
+}
+
+type subscriber struct {
+	types   map[string]bool
+	filter  alerting.Filter
+	events  chan streamEvent
+	dropped atomic.Uint64
+}
+
+// eventHub fans live events out to the stream subscribers. A subscriber
+// that can't keep up loses events rather than slowing down the workers.
+type eventHub struct {
+	mu     sync.RWMutex
+	subs   map[*subscriber]struct{}
+	wanted [3]atomic.Int32
+}
+
+func newEventHub() *eventHub {
+	return &eventHub{subs: make(map[*subscriber]struct{})}
+}
+
+func eventIndex(kind string) int {
+	switch kind {
+	case eventPacket:
+		return 0
+	case eventFlow:
+		return 1
+	default:
+		return 2
+	}
+}
+
+// wants reports whether any subscriber asked for events of kind, so the
+// callers can skip building them.
+func (h *eventHub) wants(kind string) bool {
+	return h.wanted[eventIndex(kind)].Load() > 0
+}
+
+func (h *eventHub) subscribe(types map[string]bool, filter alerting.Filter) (*subscriber, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if len(h.subs) >= maxSubscribers {
+		return nil, fmt.Errorf("too many subscribers")
+	}
+	s := &subscriber{types: types, filter: filter, events: make(chan streamEvent, subscriberBuffer)}
+	h.subs[s] = struct{}{}
+	for kind := range types {
+		h.wanted[eventIndex(kind)].Add(1)
+	}
+	return s, nil
+}
+
+func (h *eventHub) unsubscribe(s *subscriber) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	delete(h.subs, s)
+	for kind := range s.types {
+		h.wanted[eventIndex(kind)].Add(-1)
+	}
+}
+
+// publish hands the event to every subscriber whose filter matches rec,
+// the JSON body is built once and only when someone takes it.
+func (h *eventHub) publish(kind string, rec alerting.Record, body func() any) {
+	if !h.wants(kind) {
+		return
+	}
+	var data []byte
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	for s := range h.subs {
+		if !s.types[kind] || !s.filter.Match(rec) {
+			continue
+		}
+		if data == nil {
+			var err error
+			if data, err = json.Marshal(body()); err != nil {
+				return
+			}
+		}
+		select {
+		case s.events <- streamEvent{kind: kind, data: data}:
+		default:
+			s.dropped.Add(1)
+		}
+	}
+}
+
+func (h *eventHub) subscribers() int {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return len(h.subs)
+}
+
+// publishPacket streams a processed packet.
+func (w *PacketWorker) publishPacket(event PayLoadTc, flow FlowRecord) {
+	if w.events == nil || !w.events.wants(eventPacket) {
+		return
+	}
+	w.events.publish(eventPacket, packetRecord{event, flow}, func() any {
+		srcName, dstName := "-", "-"
+		if w.dnsResolver.enabled {
+			srcName = w.names.Name(intToIP(event.Event.SrcIP))
+			dstName = w.names.Name(intToIP(event.Event.DstIP))
+		}
+		return newPacketJSON(event, flow, srcName, dstName)
+	})
+}
+
+// parseFilter turns query parameters other than reserved into conditions
+// on record fields.
+func parseFilter(q url.Values, reserved ...string) (alerting.Filter, error) {
+	skip := make(map[string]bool, len(reserved))
+	for _, k := range reserved {
+		skip[k] = true
+	}
+	var conds []alerting.Condition
+	for field, values := range q {
+		if skip[field] {
+			continue
+		}
+		for _, v := range values {
+			conds = append(conds, alerting.ParseCondition(field, v))
+		}
+	}
+	return alerting.NewFilter(conds)
+}
+
+// attachment records the tc hooks of one monitored interface.
+type attachment struct {
+	Name       string    `json:"name"`
+	Index      int       `json:"index,omitempty"`
+	Hooks      []string  `json:"hooks,omitempty"`
+	AttachedAt time.Time `json:"attached_at,omitzero"`
+	Error      string    `json:"error,omitempty"`
+}
+
+func (nc *NetworkCapture) setAttachment(a attachment) {
+	nc.attachMu.Lock()
+	defer nc.attachMu.Unlock()
+	if nc.attached == nil {
+		nc.attached = make(map[string]attachment)
+	}
+	nc.attached[a.Name] = a
+}
+
+func (nc *NetworkCapture) removeAttachment(name string) {
+	nc.attachMu.Lock()
+	defer nc.attachMu.Unlock()
+	delete(nc.attached, name)
+}
+
+type interfaceJSON struct {
+	attachment
+	RxPackets uint64 `json:"rx_packets"`
+	RxBytes   uint64 `json:"rx_bytes"`
+	TxPackets uint64 `json:"tx_packets"`
+	TxBytes   uint64 `json:"tx_bytes"`
+}
+
+type apiStats struct {
+	Started          time.Time         `json:"started"`
+	Uptime           string            `json:"uptime"`
+	PacketsProcessed uint64            `json:"packets_processed"`
+	PacketsDropped   uint64            `json:"packets_dropped"`
+	LostSamples      uint64            `json:"lost_samples"`
+	WorkerQueueFull  uint64            `json:"worker_queue_full"`
+	EventQueue       int               `json:"event_queue"`
+	WorkerQueues     []int             `json:"worker_queues"`
+	ActiveFlows      int               `json:"active_flows"`
+	UntrackedPackets uint64            `json:"untracked_packets"`
+	ThreatMatches    uint64            `json:"threat_matches"`
+	PolicyDropped    uint64            `json:"policy_dropped"`
+	PolicyWouldDrop  uint64            `json:"policy_would_drop"`
+	DNS              *apiDNSStats      `json:"dns,omitempty"`
+	RateLimit        *RateLimitStats   `json:"rate_limit,omitempty"`
+	Alerting         *apiAlertingStats `json:"alerting,omitempty"`
+	OTLP             *apiOTLPStats     `json:"otlp,omitempty"`
+	Koala            *apiKoalaStats    `json:"koala_server,omitempty"`
+	Store            *apiStoreStats    `json:"flow_store,omitempty"`
+	Database         *apiDBStats       `json:"database,omitempty"`
+	Subscribers      int               `json:"stream_subscribers"`
+}
+
+type apiDNSStats struct {
+	CacheSize    int     `json:"cache_size"`
+	CacheHits    uint64  `json:"cache_hits"`
+	CacheMisses  uint64  `json:"cache_misses"`
+	Evictions    uint64  `json:"evictions"`
+	HitRate      float64 `json:"hit_rate"`
+	Lookups      uint64  `json:"lookups"`
+	QueueDepth   int     `json:"queue_depth"`
+	LookupAvgMs  float64 `json:"lookup_avg_ms"`
+	LookupMaxMs  float64 `json:"lookup_max_ms"`
+	QueueDropped uint64  `json:"queue_dropped"`
+}
+
+type apiAlertingStats struct {
+	Raised     uint64 `json:"raised"`
+	Suppressed uint64 `json:"suppressed"`
+	Delivered  uint64 `json:"delivered"`
+	Failed     uint64 `json:"failed"`
+	Dropped    uint64 `json:"dropped"`
+}
+
+type apiOTLPStats struct {
+	LogsSent       uint64 `json:"logs_sent"`
+	LogsDropped    uint64 `json:"logs_dropped"`
+	MetricsSent    uint64 `json:"metrics_sent"`
+	ExportFailures uint64 `json:"export_failures"`
+}
+
+type apiKoalaStats struct {
+	Connected  bool   `json:"connected"`
+	FlowsSent  uint64 `json:"flows_sent"`
+	AlertsSent uint64 `json:"alerts_sent"`
+	Batches    uint64 `json:"batches"`
+	Queued     int    `json:"queued"`
+	Dropped    uint64 `json:"dropped"`
+	Reconnects uint64 `json:"reconnects"`
+}
+
+type apiStoreStats struct {
+	Written  uint64 `json:"written"`
+	Segments int    `json:"segments"`
+	Size     int64  `json:"size_bytes"`
+	Removed  uint64 `json:"segments_removed"`
+	Queued   int    `json:"queued"`
+	Dropped  uint64 `json:"dropped"`
+}
+
+type apiDBStats struct {
+	Connected     bool   `json:"connected"`
+	SchemaVersion int    `json:"schema_version"`
+	FlowsWritten  uint64 `json:"flows_written"`
+	AlertsWritten uint64 `json:"alerts_written"`
+	Batches       uint64 `json:"batches"`
+	Buffered      int    `json:"buffered"`
+	Queued        int    `json:"queued"`
+	Dropped       uint64 `json:"dropped"`
+	Rejected      uint64 `json:"rejected"`
+	Failures      uint64 `json:"failures"`
+}
+
+func (nc *NetworkCapture) apiStats() apiStats {
+	s := apiStats{
+		Started:          nc.started,
+		Uptime:           time.Since(nc.started).Round(time.Second).String(),
+		PacketsProcessed: atomic.LoadUint64(&nc.stats.PacketsProcessed),
+		PacketsDropped:   atomic.LoadUint64(&nc.stats.PacketsDropped),
+		LostSamples:      atomic.LoadUint64(&nc.stats.LostSamples),
+		WorkerQueueFull:  atomic.LoadUint64(&nc.stats.WorkerQueueFull),
+		EventQueue:       len(nc.eventChan),
+		WorkerQueues:     make([]int, 0, len(nc.workers)),
+		ActiveFlows:      nc.flows.Len(),
+		UntrackedPackets: nc.flows.Refused(),
+		ThreatMatches:    atomic.LoadUint64(&nc.stats.ThreatMatches),
+		PolicyDropped:    atomic.LoadUint64(&nc.stats.PolicyDropped),
+		PolicyWouldDrop:  atomic.LoadUint64(&nc.stats.PolicyWouldDrop),
+	}
+	for _, w := range nc.workers {
+		s.WorkerQueues = append(s.WorkerQueues, len(w.jobChan))
+	}
+	if nc.dnsResolver.enabled {
+		cs := nc.dnsResolver.CacheStats()
+		rs := nc.names.Stats()
+		s.DNS = &apiDNSStats{
+			CacheSize:    cs.Size,
+			CacheHits:    cs.Hits,
+			CacheMisses:  cs.Misses,
+			Evictions:    cs.Evictions,
+			HitRate:      rs.HitRate(),
+			Lookups:      rs.Lookups,
+			QueueDepth:   rs.QueueDepth,
+			LookupAvgMs:  float64(rs.LookupAverage) / float64(time.Millisecond),
+			LookupMaxMs:  float64(rs.LookupMax) / float64(time.Millisecond),
+			QueueDropped: rs.QueueFull,
+		}
+	}
+	if nc.ratelimit != nil {
+		rl := nc.ratelimit.Stats()
+		s.RateLimit = &rl
+	}
+	if nc.alerting != nil {
+		as := nc.alerting.Stats()
+		s.Alerting = &apiAlertingStats{as.Raised, as.Suppressed, as.Delivered, as.Failed, as.Dropped}
+	}
+	if nc.otlp != nil {
+		es := nc.otlp.Stats()
+		s.OTLP = &apiOTLPStats{es.LogsSent, es.LogsDropped, es.MetricsSent, es.ExportFailures}
+	}
+	if nc.koala != nil {
+		ks := nc.koala.Stats()
+		s.Koala = &apiKoalaStats{ks.Connected, ks.FlowsSent, ks.AlertsSent, ks.Batches, ks.Queued, ks.Dropped, ks.Reconnects}
+	}
+	if nc.store != nil {
+		ss := nc.store.Stats()
+		s.Store = &apiStoreStats{ss.Written, ss.Segments, ss.Size, ss.Removed, ss.Queued, ss.Dropped}
+	}
+	if nc.db != nil {
+		ds := nc.db.Stats()
+		s.Database = &apiDBStats{ds.Connected, ds.SchemaVersion, ds.FlowsWritten, ds.AlertsWritten, ds.Batches, ds.Buffered, ds.Queued, ds.Dropped, ds.Rejected, ds.Failures}
+	}
+	if nc.events != nil {
+		s.Subscribers = nc.events.subscribers()
+	}
+	return s
+}
+
+// namedFlowRecord looks the names of a flow up only when a filter asks
+// for them, a miss queues a PTR lookup.
+type namedFlowRecord struct {
+	flowRecord
+	names *AsyncResolver
+}
+
+func (r namedFlowRecord) Field(name string) (string, bool) {
+	switch name {
+	case "src_name":
+		r.SrcName = r.names.Name(intToIP(r.Key.SrcIP))
+	case "dst_name":
+		r.DstName = r.names.Name(intToIP(r.Key.DstIP))
+	}
+	return r.flowRecord.Field(name)
+}
+
+// activeFlows returns the tracked flows matching filter, sorted by key in
+// descending order and cut to limit. Names and locations are looked up for
+// the flows returned only.
+func (nc *NetworkCapture) activeFlows(filter alerting.Filter, key string, limit int) (flows []FlowRecord, total int) {
+	for _, rec := range nc.flows.Active() {
+		if filter.Match(namedFlowRecord{flowRecord(rec), nc.names}) {
+			flows = append(flows, rec)
+		}
+	}
+	total = len(flows)
+
+	value := func(r FlowRecord) float64 {
+		switch key {
+		case "packets":
+			return float64(r.Packets)
+		case "duration":
+			return float64(r.LastSeen.Sub(r.FirstSeen))
+		case "last_seen":
+			return float64(r.LastSeen.UnixNano())
+		default:
+			return float64(r.Bytes)
+		}
+	}
+	sort.Slice(flows, func(i, j int) bool { return value(flows[i]) > value(flows[j]) })
+	if len(flows) > limit {
+		flows = flows[:limit]
+	}
+	for i := range flows {
+		flows[i].SrcName = nc.names.Name(intToIP(flows[i].Key.SrcIP))
+		flows[i].DstName = nc.names.Name(intToIP(flows[i].Key.DstIP))
+		flows[i].SrcGeo = lookupGeo(nc.geo, nc.internal, flows[i].Key.SrcIP)
+		flows[i].DstGeo = lookupGeo(nc.geo, nc.internal, flows[i].Key.DstIP)
+	}
+	return flows, total
+}
+
+func (nc *NetworkCapture) interfaces() []interfaceJSON {
+	totals := nc.trafficTotals()
+	nc.attachMu.Lock()
+	out := make([]interfaceJSON, 0, len(nc.attached))
+	for _, a := range nc.attached {
+		out = append(out, interfaceJSON{attachment: a})
+	}
+	nc.attachMu.Unlock()
+
+	sort.Slice(out, func(i, j int) bool { return out[i].Name < out[j].Name })
+	for i := range out {
+		for _, k := range totals.trafficKeys {
+			if k.iface != out[i].Name {
+				continue
+			}
+			c := totals.traffic[k]
+			if k.direction == 1 {
+				out[i].TxPackets += c.packets
+				out[i].TxBytes += c.bytes
+			} else {
+				out[i].RxPackets += c.packets
+				out[i].RxBytes += c.bytes
+			}
+		}
+	}
+	return out
+}
+
+// configFlags returns every flag with its effective value, secrets are
+// redacted.
+func configFlags() (values map[string]string, set []string) {
+	values = make(map[string]string)
+	flag.VisitAll(func(f *flag.Flag) {
+		v := f.Value.String()
+		if sensitiveFlags[f.Name] && v != "" {
+			v = "<redacted>"
+		}
+		values[f.Name] = v
+	})
+	flag.Visit(func(f *flag.Flag) { set = append(set, f.Name) })
+	return values, set
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, map[string]string{"error": err.Error()})
+}
+
+// apiHandler routes the agent API.
+func (nc *NetworkCapture) apiHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /api/v1/stats", requireScope(auth.ScopeStatsRead, func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, nc.apiStats())
+	}))
+	mux.HandleFunc("GET /api/v1/flows", requireScope(auth.ScopeStatsRead, nc.handleFlows))
+	mux.HandleFunc("GET /api/v1/interfaces", requireScope(auth.ScopeStatsRead, func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, nc.interfaces())
+	}))
+	mux.HandleFunc("GET /api/v1/config", requireScope(auth.ScopeStatsRead, func(w http.ResponseWriter, r *http.Request) {
+		values, set := configFlags()
+		writeJSON(w, http.StatusOK, map[string]any{"flags": values, "set": set})
+	}))
+	mux.HandleFunc("GET /api/v1/events", requireScope(auth.ScopeEventsStream, nc.handleEvents))
+	mux.HandleFunc("GET /api/v1/policy", requireScope(auth.ScopeStatsRead, nc.handlePolicy))
+	return nc.authenticate(mux)
+}
+
+// handleFlows serves /api/v1/flows?dst_port=443&sort=bytes&top=20.
+func (nc *NetworkCapture) handleFlows(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	limit := defaultFlowsLimit
+	if v := q.Get("top"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("top must be a positive number"))
+			return
+		}
+		limit = n
+	}
+	key := q.Get("sort")
+	switch key {
+	case "", "bytes", "packets", "duration", "last_seen":
+	default:
+		writeError(w, http.StatusBadRequest, fmt.Errorf("sort must be bytes, packets, duration or last_seen"))
+		return
+	}
+	filter, err := parseFilter(q, "top", "sort")
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	flows, total := nc.activeFlows(filter, key, limit)
+	if flows == nil {
+		flows = []FlowRecord{}
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"total": total, "flows": flows})
+}
+
+// handleEvents streams matching packets, flows and alerts as server-sent
+// events, /api/v1/events?type=alert,flow&scope=outbound.
+func (nc *NetworkCapture) handleEvents(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeError(w, http.StatusInternalServerError, fmt.Errorf("streaming unsupported"))
+		return
+	}
+	q := r.URL.Query()
+	types := map[string]bool{eventFlow: true, eventAlert: true}
+	if v := q.Get("type"); v != "" {
+		types = make(map[string]bool)
+		for _, t := range splitString(v, ",") {
+			switch t = strings.TrimSpace(t); t {
+			case eventPacket, eventFlow, eventAlert:
+				types[t] = true
+			default:
+				writeError(w, http.StatusBadRequest, fmt.Errorf("unknown event type %q", t))
+				return
+			}
+		}
+	}
+	filter, err := parseFilter(q, "type")
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	sub, err := nc.events.subscribe(types, filter)
+	if err != nil {
+		writeError(w, http.StatusServiceUnavailable, err)
+		return
+	}
+	defer nc.events.unsubscribe(sub)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprint(w, ": kernelkoala event stream\n\n")
+	flusher.Flush()
+
+	keepalive := time.NewTicker(keepaliveInterval)
+	defer keepalive.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-keepalive.C:
+			fmt.Fprint(w, ": keepalive\n\n")
+		case ev := <-sub.events:
+			fmt.Fprintf(w, "event: %s\ndata: %s\n\n", ev.kind, ev.data)
+			if n := sub.dropped.Swap(0); n > 0 {
+				fmt.Fprintf(w, "event: dropped\ndata: {\"count\":%d}\n\n", n)
+			}
+		}
+		flusher.Flush()
+	}
+}
+
+// serveAPI serves the agent API on config.APIAddr until ctx is done.
+func (nc *NetworkCapture) serveAPI(ctx context.Context) {
+	srv := &http.Server{
+		Addr:              nc.config.APIAddr,
+		Handler:           nc.apiHandler(),
+		ReadHeaderTimeout: 5 * time.Second,
+		// Streams end with the agent, Shutdown doesn't wait for them
+		BaseContext: func(net.Listener) context.Context { return ctx },
+	}
+
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		srv.Shutdown(shutdownCtx)
+	}()
+
+	var err error
+	if nc.apiCerts != nil {
+		srv.TLSConfig = nc.apiCerts.ServerConfig()
+		nc.logger.Info("Serving API on %s with TLS", nc.config.APIAddr)
+		err = srv.ListenAndServeTLS("", "")
+	} else {
+		nc.logger.Info("Serving API on %s", nc.config.APIAddr)
+		err = srv.ListenAndServe()
+	}
+	if err != nil && err != http.ErrServerClosed {
+		nc.logger.Warn("API server failed: %v", err)
+	}
+}
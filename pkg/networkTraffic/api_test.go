@@ -0,0 +1,194 @@
+package network
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// apiCapture tracks flows from 10.0.0.2, 10.0.0.3 and 10.0.0.4 with one,
+// two and three packets. Only 10.0.0.2 has a name.
+func apiCapture() *NetworkCapture {
+	resolver := &DNSResolver{enabled: true, sources: []NameSource{
+		&staticSource{name: sourceStatic, names: map[string]string{"10.0.0.2": "web"}},
+	}}
+	nc := &NetworkCapture{
+		flows:  NewFlowTable(time.Minute, 0, nil),
+		names:  NewAsyncResolver(resolver, 0, 16),
+		events: newEventHub(),
+	}
+	for i, src := range []uint32{0x0200000a, 0x0300000a, 0x0400000a} {
+		for range i + 1 {
+			nc.flows.Update(tcpPacket(src, 40000, 0x10))
+		}
+	}
+	return nc
+}
+
+type flowsAnswer struct {
+	Total int `json:"total"`
+	Flows []struct {
+		SrcIP   string `json:"src_ip"`
+		SrcName string `json:"src_name"`
+		Packets uint64 `json:"packets"`
+	} `json:"flows"`
+}
+
+func getFlows(t *testing.T, nc *NetworkCapture, query string) (int, flowsAnswer) {
+	t.Helper()
+	w := httptest.NewRecorder()
+	nc.handleFlows(w, httptest.NewRequest(http.MethodGet, "/api/v1/flows?"+query, nil))
+	var answer flowsAnswer
+	if w.Code == http.StatusOK {
+		if err := json.Unmarshal(w.Body.Bytes(), &answer); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return w.Code, answer
+}
+
+func TestParseFilter(t *testing.T) {
+	q, _ := url.ParseQuery("dst_port=443&src_ip=10.0.0.0/24&scope=!outbound&top=5&sort=bytes")
+	filter, err := parseFilter(q, "top", "sort")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(filter) != 3 {
+		t.Errorf("%d conditions, want the reserved parameters left out", len(filter))
+	}
+	rec := FlowRecord{Key: FlowKey{SrcIP: 0x0200000a, DstPort: 443, Protocol: 6}, Scope: ScopeInbound}
+	if !filter.Match(flowRecord(rec)) {
+		t.Error("matching flow rejected")
+	}
+	rec.Scope = ScopeOutbound
+	if filter.Match(flowRecord(rec)) {
+		t.Error("excluded scope matched")
+	}
+
+	if _, err := parseFilter(url.Values{"src_name": {"~("}}); err == nil {
+		t.Error("bad regex accepted")
+	}
+	if f, err := parseFilter(url.Values{"type": {"flow"}}, "type"); err != nil || len(f) != 0 {
+		t.Errorf("reserved only: %v %v", f, err)
+	}
+}
+
+func TestHandleFlows(t *testing.T) {
+	nc := apiCapture()
+
+	code, answer := getFlows(t, nc, "")
+	if code != http.StatusOK || answer.Total != 3 || len(answer.Flows) != 3 || answer.Flows[0].Packets != 3 {
+		t.Fatalf("%d %+v", code, answer)
+	}
+	if answer.Flows[2].SrcName != "web" {
+		t.Errorf("flow of 10.0.0.2 named %q", answer.Flows[2].SrcName)
+	}
+
+	code, answer = getFlows(t, nc, "sort=packets&top=2&src_ip=!10.0.0.4")
+	if code != http.StatusOK || answer.Total != 2 || len(answer.Flows) != 2 || answer.Flows[0].SrcIP != "10.0.0.3" {
+		t.Errorf("%d %+v", code, answer)
+	}
+	code, answer = getFlows(t, nc, "top=1")
+	if answer.Total != 3 || len(answer.Flows) != 1 {
+		t.Errorf("top=1: %+v", answer)
+	}
+	if code, answer = getFlows(t, nc, "src_name=web"); code != http.StatusOK || answer.Total != 1 || answer.Flows[0].SrcIP != "10.0.0.2" {
+		t.Errorf("by name: %d %+v", code, answer)
+	}
+	if _, answer = getFlows(t, nc, "dst_port=22"); answer.Flows == nil || answer.Total != 0 {
+		t.Errorf("no match should be an empty list: %+v", answer)
+	}
+
+	for _, query := range []string{"top=0", "top=x", "sort=name", "bytes=%3Ex"} {
+		if code, _ := getFlows(t, nc, query); code != http.StatusBadRequest {
+			t.Errorf("%s got %d, want 400", query, code)
+		}
+	}
+}
+
+// Names are looked up for the flows returned, not every tracked flow.
+func TestHandleFlowsNamesAfterLimit(t *testing.T) {
+	nc := apiCapture()
+	lookups := func() uint64 { s := nc.names.Stats(); return s.Hits + s.Misses }
+
+	getFlows(t, nc, "top=1")
+	if n := lookups(); n != 2 {
+		t.Errorf("%d name lookups for one flow, want 2", n)
+	}
+	before := lookups()
+	getFlows(t, nc, "src_name=web")
+	if n := lookups() - before; n != 3+2 {
+		t.Errorf("%d name lookups, want one per flow for the filter and two for the answer", n)
+	}
+}
+
+func TestHandleEvents(t *testing.T) {
+	nc := apiCapture()
+	srv := httptest.NewServer(http.HandlerFunc(nc.handleEvents))
+	defer srv.Close()
+
+	for _, query := range []string{"type=flow,bogus", "bytes=%3Ex"} {
+		resp, err := http.Get(srv.URL + "?" + query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("%s got %d, want 400", query, resp.StatusCode)
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, srv.URL+"?type=flow&src_ip=10.0.0.3", nil)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if ct := resp.Header.Get("Content-Type"); resp.StatusCode != http.StatusOK || ct != "text/event-stream" {
+		t.Fatalf("%d %s", resp.StatusCode, ct)
+	}
+	for nc.events.subscribers() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	if !nc.events.wants(eventFlow) || nc.events.wants(eventPacket) {
+		t.Error("hub wants the wrong event types")
+	}
+
+	// Only the flow of 10.0.0.3 passes the filter, the alert isn't asked for
+	for _, rec := range nc.flows.Active() {
+		nc.events.publish(eventAlert, flowRecord(rec), func() any { return "alert" })
+		nc.events.publish(eventFlow, flowRecord(rec), func() any { return rec })
+	}
+
+	r := bufio.NewReader(resp.Body)
+	var events []string
+	for len(events) < 2 {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		if strings.HasPrefix(line, "event: ") || strings.HasPrefix(line, "data: ") {
+			events = append(events, strings.TrimSpace(line))
+		}
+	}
+	if events[0] != "event: flow" || !strings.Contains(events[1], `"src_ip":"10.0.0.3"`) {
+		t.Errorf("got %q", events)
+	}
+
+	cancel()
+	deadline := time.Now().Add(5 * time.Second)
+	for nc.events.subscribers() != 0 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if nc.events.subscribers() != 0 || nc.events.wants(eventFlow) {
+		t.Error("subscriber left behind after the client went away")
+	}
+}
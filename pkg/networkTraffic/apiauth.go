@@ -0,0 +1,193 @@
+package network
+
+import (
+	"context"
+	"fmt"
+	l "kernelKoala/internal/logger"
+	"kernelKoala/pkg/auth"
+	"kernelKoala/pkg/policy"
+	"net/http"
+	"time"
+)
+
+// setupAPIAuth loads the API certificates and tokens and opens the audit
+// log.
+func (nc *NetworkCapture) setupAPIAuth() {
+	cfg := nc.config
+	if cfg.APICert != "" || cfg.APIClientCA != "" {
+		if cfg.APICert == "" {
+			nc.logger.Fatal("-api-client-ca needs -api-tls-cert and -api-tls-key")
+		}
+		certs, err := auth.LoadCerts(cfg.APICert, cfg.APIKey, cfg.APIClientCA, cfg.TLSReload, func(err error) {
+			nc.logger.Warn("API certificate reload failed: %v", err)
+		})
+		if err != nil {
+			nc.logger.Fatal("failed to load API certificates: %v", err)
+		}
+		nc.apiCerts = certs
+	}
+
+	if cfg.APITokens != "" {
+		tokens, err := auth.LoadTokens(cfg.APITokens, cfg.TLSReload, func(err error) {
+			nc.logger.Warn("API token reload failed: %v", err)
+		})
+		if err != nil {
+			nc.logger.Fatal("failed to load API tokens: %v", err)
+		}
+		nc.apiTokens = tokens
+		nc.logger.Info("Loaded %d API tokens", tokens.Len())
+	}
+
+	if cfg.AuditLog != "" {
+		path := cfg.AuditLog
+		if path == "-" {
+			path = ""
+		}
+		audit, err := l.NewLogger(&l.Config{Level: l.INFO, AddTime: true, FilePath: path})
+		if err != nil {
+			nc.logger.Fatal("failed to open audit log: %v", err)
+		}
+		nc.audit = audit
+	}
+}
+
+// apiClient is who made an API request, as far as the certificate and
+// the bearer token tell.
+type apiClient struct {
+	cert  string
+	token *auth.Token
+}
+
+type apiClientKey struct{}
+
+func (c *apiClient) name() string {
+	switch {
+	case c.token != nil && c.cert != "":
+		return c.token.Name + "@" + c.cert
+	case c.token != nil:
+		return c.token.Name
+	case c.cert != "":
+		return c.cert
+	default:
+		return "-"
+	}
+}
+
+// statusRecorder keeps the response status for the audit log.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *statusRecorder) Flush() {
+	if f, ok := r.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (r *statusRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
+
+// authenticate identifies the client of every request and writes the
+// audit log. With a token file, requests without a valid bearer token
+// are rejected here, the scopes are checked per route by requireScope.
+func (nc *NetworkCapture) authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		client := &apiClient{cert: auth.PeerName(r.TLS)}
+		if nc.audit != nil {
+			defer func() { nc.auditAccess(r, client, rec.status, time.Since(start)) }()
+		}
+
+		if nc.apiTokens != nil {
+			secret, ok := auth.BearerToken(r)
+			token, found := nc.apiTokens.Lookup(secret)
+			if !ok || !found {
+				rec.Header().Set("WWW-Authenticate", `Bearer realm="kernelkoala"`)
+				writeError(rec, http.StatusUnauthorized, fmt.Errorf("missing or invalid bearer token"))
+				return
+			}
+			client.token = &token
+		}
+		next.ServeHTTP(rec, r.WithContext(context.WithValue(r.Context(), apiClientKey{}, client)))
+	})
+}
+
+// requireScope rejects tokens that were not granted scope. Without a
+// token file every client may read, but filters:write routes still need
+// a client certificate, so an open API can't be used to block traffic.
+func requireScope(scope string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		client, _ := r.Context().Value(apiClientKey{}).(*apiClient)
+		if client == nil {
+			client = &apiClient{}
+		}
+		if client.token != nil && !client.token.Allows(scope) {
+			writeError(w, http.StatusForbidden, fmt.Errorf("token %s lacks scope %s", client.token.Name, scope))
+			return
+		}
+		if scope == auth.ScopeFiltersWrite && client.token == nil && client.cert == "" {
+			writeError(w, http.StatusForbidden, fmt.Errorf("changes need --api-tokens or --api-client-ca"))
+			return
+		}
+		next(w, r)
+	}
+}
+
+// auditAccess logs one API request. Streams are logged when they end, so
+// the duration is how long the client listened.
+func (nc *NetworkCapture) auditAccess(r *http.Request, client *apiClient, status int, took time.Duration) {
+	path := r.URL.Path
+	if r.URL.RawQuery != "" {
+		path += "?" + r.URL.RawQuery
+	}
+	msg := fmt.Sprintf("api client=%s remote=%s method=%s path=%q status=%d duration=%s",
+		client.name(), r.RemoteAddr, r.Method, path, status, took.Round(time.Millisecond))
+	if status == http.StatusUnauthorized || status == http.StatusForbidden {
+		nc.audit.Warn("%s", msg)
+		return
+	}
+	nc.audit.Info("%s", msg)
+}
+
+type policyJSON struct {
+	Mode  string        `json:"mode"`
+	Rules []policy.Rule `json:"rules"`
+}
+
+func (nc *NetworkCapture) policyState() (policyJSON, error) {
+	mode, err := nc.policy.Mode()
+	if err != nil {
+		return policyJSON{}, err
+	}
+	rules, err := nc.policy.List()
+	if err != nil {
+		return policyJSON{}, err
+	}
+	if rules == nil {
+		rules = []policy.Rule{}
+	}
+	return policyJSON{Mode: mode.String(), Rules: rules}, nil
+}
+
+// handlePolicy serves the deny policy mode and rules, GET /api/v1/policy.
+func (nc *NetworkCapture) handlePolicy(w http.ResponseWriter, r *http.Request) {
+	if nc.policy == nil {
+		writeError(w, http.StatusServiceUnavailable, fmt.Errorf("policy not set up"))
+		return
+	}
+
+	state, err := nc.policyState()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, state)
+}
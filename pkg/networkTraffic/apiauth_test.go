@@ -0,0 +1,77 @@
+package network
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"kernelKoala/pkg/auth"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// scopedAPI serves an empty response on a read and a write route behind
+// the API authentication.
+func scopedAPI(nc *NetworkCapture) http.Handler {
+	ok := func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(http.StatusNoContent) }
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /api/v1/policy", requireScope(auth.ScopeStatsRead, ok))
+	mux.HandleFunc("PUT /api/v1/policy/mode", requireScope(auth.ScopeFiltersWrite, ok))
+	return nc.authenticate(mux)
+}
+
+func apiRequest(h http.Handler, method, token string, cert bool) int {
+	r := httptest.NewRequest(method, "/api/v1/policy", nil)
+	if method == http.MethodPut {
+		r = httptest.NewRequest(method, "/api/v1/policy/mode", nil)
+	}
+	if token != "" {
+		r.Header.Set("Authorization", "Bearer "+token)
+	}
+	if cert {
+		r.TLS = &tls.ConnectionState{PeerCertificates: []*x509.Certificate{{Subject: pkix.Name{CommonName: "ops"}}}}
+	}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	return w.Code
+}
+
+func TestPolicyWritesNeedAuthentication(t *testing.T) {
+	// Without tokens or client certificates the API is read-only
+	open := scopedAPI(&NetworkCapture{})
+	if code := apiRequest(open, http.MethodGet, "", false); code != http.StatusNoContent {
+		t.Errorf("open read got %d", code)
+	}
+	if code := apiRequest(open, http.MethodPut, "", false); code != http.StatusForbidden {
+		t.Errorf("open write got %d, want 403", code)
+	}
+	// A verified client certificate is enough
+	if code := apiRequest(open, http.MethodPut, "", true); code != http.StatusNoContent {
+		t.Errorf("write with a client certificate got %d", code)
+	}
+
+	path := filepath.Join(t.TempDir(), "tokens")
+	if err := os.WriteFile(path, []byte("grafana reader stats:read\nops writer *\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	tokens, err := auth.LoadTokens(path, 0, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	secured := scopedAPI(&NetworkCapture{apiTokens: tokens})
+	for _, tc := range []struct {
+		method, token string
+		want          int
+	}{
+		{http.MethodGet, "", http.StatusUnauthorized},
+		{http.MethodGet, "reader", http.StatusNoContent},
+		{http.MethodPut, "reader", http.StatusForbidden},
+		{http.MethodPut, "writer", http.StatusNoContent},
+	} {
+		if code := apiRequest(secured, tc.method, tc.token, false); code != tc.want {
+			t.Errorf("%s with token %q got %d, want %d", tc.method, tc.token, code, tc.want)
+		}
+	}
+}
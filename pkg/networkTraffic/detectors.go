@@ -0,0 +1,117 @@
+package network
+
+import (
+	"context"
+	"fmt"
+	"kernelKoala/pkg/detection"
+	"net/netip"
+	"time"
+)
+
+// Names accepted by -detectors.
+const (
+	detectorPortScan = "portscan"
+	detectorSYNFlood = "synflood"
+	detectorAnomaly  = "anomaly"
+	detectorGraph    = "graph"
+	detectorBeacon   = "beacon"
+)
+
+// buildDetectors creates the detectors listed in config.Detectors.
+func (nc *NetworkCapture) buildDetectors() error {
+	for _, name := range nc.config.Detectors {
+		switch name {
+		case detectorPortScan:
+			nc.detectors = append(nc.detectors, detection.NewPortScanDetector(nc.config.PortScan))
+		case detectorSYNFlood:
+			nc.detectors = append(nc.detectors, detection.NewSYNFloodDetector(nc.config.SYNFlood))
+		case detectorAnomaly:
+			cfg := nc.config.Anomaly
+			cfg.Warn = nc.logger.Warn
+			d, err := detection.NewAnomalyDetector(cfg)
+			if err != nil {
+				return err
+			}
+			nc.detectors = append(nc.detectors, d)
+		case detectorGraph:
+			cfg := nc.config.Graph
+			cfg.Namer = func(a netip.Addr) (string, bool) { return nc.dnsResolver.WorkloadName(a.AsSlice()) }
+			d, err := detection.NewGraphDetector(cfg)
+			if err != nil {
+				return err
+			}
+			nc.detectors = append(nc.detectors, d)
+		case detectorBeacon:
+			nc.detectors = append(nc.detectors, detection.NewBeaconDetector(nc.config.Beacon))
+		default:
+			return fmt.Errorf("unknown detector %q", name)
+		}
+	}
+	return nil
+}
+
+// detectionPacket converts an event for the detectors.
+func detectionPacket(event PayLoadTc, flow FlowRecord) detection.Packet {
+	e := event.Event
+	return detection.Packet{
+		Time:     time.Now(),
+		Iface:    event.Iface,
+		Egress:   e.Direction == 1,
+		Protocol: e.Protocol,
+		SrcIP:    v4Addr(e.SrcIP),
+		DstIP:    v4Addr(e.DstIP),
+		SrcPort:  e.SrcPort,
+		DstPort:  e.DstPort,
+		TcpFlags: e.TcpFlags,
+		Bytes:    e.PktLen,
+		NewFlow:  flow.isNew(),
+		Scope:    event.Scope,
+	}
+}
+
+// v4Addr converts an address in the byte order the kernel reports it.
+func v4Addr(ip uint32) netip.Addr {
+	return netip.AddrFrom4([4]byte{byte(ip), byte(ip >> 8), byte(ip >> 16), byte(ip >> 24)})
+}
+
+func (w *PacketWorker) runDetectors(event PayLoadTc, flow FlowRecord) {
+	if len(w.detectors) == 0 {
+		return
+	}
+	p := detectionPacket(event, flow)
+	for _, d := range w.detectors {
+		for _, a := range d.Observe(p) {
+			w.alert(a)
+		}
+	}
+}
+
+// tickDetectors lets the detectors close their windows once a second.
+func (nc *NetworkCapture) tickDetectors(ctx context.Context) {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			for _, d := range nc.detectors {
+				for _, a := range d.Tick(now) {
+					nc.emitAlert(a)
+				}
+			}
+		}
+	}
+}
+
+// closeDetectors flushes detector state, e.g. learned baselines.
+func (nc *NetworkCapture) closeDetectors() {
+	for _, d := range nc.detectors {
+		if c, ok := d.(detection.Closer); ok {
+			if err := c.Close(); err != nil {
+				nc.logger.Warn("failed to close %s detector: %v", d.Name(), err)
+			}
+		}
+	}
+}
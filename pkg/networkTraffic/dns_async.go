@@ -0,0 +1,151 @@
+package network
+
+import (
+	"context"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ResolverStats describes the asynchronous name lookup pipeline.
+type ResolverStats struct {
+	QueueDepth    int
+	Hits          uint64
+	Misses        uint64
+	Enqueued      uint64
+	Deduplicated  uint64
+	QueueFull     uint64
+	Lookups       uint64
+	LookupTotal   time.Duration
+	LookupMax     time.Duration
+	LookupAverage time.Duration
+}
+
+// AsyncResolver keeps PTR lookups off the packet path: callers get whatever
+// name is known right now and misses are queued to a small bounded pool, with
+// concurrent requests for the same IP collapsed into one lookup.
+type AsyncResolver struct {
+	resolver *DNSResolver
+	queue    chan string
+	workers  int
+
+	mu       sync.Mutex
+	inflight map[string]struct{}
+
+	hits         uint64
+	misses       uint64
+	enqueued     uint64
+	deduplicated uint64
+	queueFull    uint64
+	lookups      uint64
+	lookupNs     uint64
+	lookupMaxNs  uint64
+}
+
+func NewAsyncResolver(resolver *DNSResolver, workers, queueSize int) *AsyncResolver {
+	return &AsyncResolver{
+		resolver: resolver,
+		queue:    make(chan string, queueSize),
+		workers:  workers,
+		inflight: make(map[string]struct{}),
+	}
+}
+
+// Start launches the lookup workers, they exit when ctx is cancelled.
+func (a *AsyncResolver) Start(ctx context.Context) {
+	for i := 0; i < a.workers; i++ {
+		go a.worker(ctx)
+	}
+}
+
+// Name returns the known name for ip without blocking, or "-" while a lookup
+// is pending.
+func (a *AsyncResolver) Name(ip net.IP) string {
+	if name, ok := a.resolver.Cached(ip); ok {
+		atomic.AddUint64(&a.hits, 1)
+		return name
+	}
+	atomic.AddUint64(&a.misses, 1)
+	a.enqueue(ip.String())
+	return "-"
+}
+
+func (a *AsyncResolver) enqueue(ip string) {
+	a.mu.Lock()
+	if _, ok := a.inflight[ip]; ok {
+		a.mu.Unlock()
+		atomic.AddUint64(&a.deduplicated, 1)
+		return
+	}
+	a.inflight[ip] = struct{}{}
+	a.mu.Unlock()
+
+	select {
+	case a.queue <- ip:
+		atomic.AddUint64(&a.enqueued, 1)
+	default:
+		atomic.AddUint64(&a.queueFull, 1)
+		a.done(ip)
+	}
+}
+
+func (a *AsyncResolver) done(ip string) {
+	a.mu.Lock()
+	delete(a.inflight, ip)
+	a.mu.Unlock()
+}
+
+func (a *AsyncResolver) worker(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case ip := <-a.queue:
+			start := time.Now()
+			a.resolver.ResolveIP(net.ParseIP(ip))
+			a.observeLatency(time.Since(start))
+			a.done(ip)
+		}
+	}
+}
+
+func (a *AsyncResolver) observeLatency(d time.Duration) {
+	ns := uint64(d)
+	atomic.AddUint64(&a.lookups, 1)
+	atomic.AddUint64(&a.lookupNs, ns)
+	for {
+		max := atomic.LoadUint64(&a.lookupMaxNs)
+		if ns <= max || atomic.CompareAndSwapUint64(&a.lookupMaxNs, max, ns) {
+			return
+		}
+	}
+}
+
+// Stats returns a snapshot of the resolver counters.
+func (a *AsyncResolver) Stats() ResolverStats {
+	s := ResolverStats{
+		QueueDepth:   len(a.queue),
+		Hits:         atomic.LoadUint64(&a.hits),
+		Misses:       atomic.LoadUint64(&a.misses),
+		Enqueued:     atomic.LoadUint64(&a.enqueued),
+		Deduplicated: atomic.LoadUint64(&a.deduplicated),
+		QueueFull:    atomic.LoadUint64(&a.queueFull),
+		Lookups:      atomic.LoadUint64(&a.lookups),
+		LookupTotal:  time.Duration(atomic.LoadUint64(&a.lookupNs)),
+		LookupMax:    time.Duration(atomic.LoadUint64(&a.lookupMaxNs)),
+	}
+	if s.Lookups > 0 {
+		s.LookupAverage = s.LookupTotal / time.Duration(s.Lookups)
+	}
+	return s
+}
+
+// HitRate is the fraction of Name calls answered without queueing a lookup.
+func (s ResolverStats) HitRate() float64 {
+	total := s.Hits + s.Misses
+	if total == 0 {
+		return 0
+	}
+	return float64(s.Hits) / float64(total)
+}
@@ -0,0 +1,206 @@
+package network
+
+import (
+	"container/list"
+	"hash/fnv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const dnsCacheShards = 16
+
+// DNSCacheStats are the counters of a DNSCache.
+type DNSCacheStats struct {
+	Size        int
+	Hits        uint64
+	Misses      uint64
+	Evictions   uint64
+	Expirations uint64
+}
+
+type dnsCacheEntry struct {
+	key      string
+	domain   string
+	expires  time.Time
+	negative bool
+}
+
+type dnsCacheShard struct {
+	mu       sync.Mutex
+	items    map[string]*list.Element
+	order    *list.List // front is most recently used
+	capacity int
+}
+
+// DNSCache is a size-bounded LRU of PTR answers, split into shards so
+// workers don't contend on a single lock. Positive answers live for their
+// record TTL clamped to [minTTL, maxTTL], "no name" answers for negativeTTL.
+type DNSCache struct {
+	shards      [dnsCacheShards]dnsCacheShard
+	minTTL      time.Duration
+	maxTTL      time.Duration
+	negativeTTL time.Duration
+
+	hits        uint64
+	misses      uint64
+	evictions   uint64
+	expirations uint64
+
+	stop chan struct{}
+	once sync.Once
+}
+
+func NewDNSCache(size int, minTTL, maxTTL, negativeTTL time.Duration) *DNSCache {
+	perShard := size / dnsCacheShards
+	if perShard < 1 {
+		perShard = 1
+	}
+
+	c := &DNSCache{
+		minTTL:      minTTL,
+		maxTTL:      maxTTL,
+		negativeTTL: negativeTTL,
+		stop:        make(chan struct{}),
+	}
+	for i := range c.shards {
+		c.shards[i] = dnsCacheShard{
+			items:    make(map[string]*list.Element),
+			order:    list.New(),
+			capacity: perShard,
+		}
+	}
+
+	go c.cleanup(time.Minute)
+
+	return c
+}
+
+func (c *DNSCache) shard(key string) *dnsCacheShard {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return &c.shards[h.Sum32()%dnsCacheShards]
+}
+
+// Get returns the cached name for key. A cached failure is reported as "-".
+func (c *DNSCache) Get(key string) (string, bool) {
+	s := c.shard(key)
+	now := time.Now()
+
+	s.mu.Lock()
+	elem, ok := s.items[key]
+	if !ok {
+		s.mu.Unlock()
+		atomic.AddUint64(&c.misses, 1)
+		return "", false
+	}
+
+	entry := elem.Value.(*dnsCacheEntry)
+	if now.After(entry.expires) {
+		s.order.Remove(elem)
+		delete(s.items, key)
+		s.mu.Unlock()
+		atomic.AddUint64(&c.expirations, 1)
+		atomic.AddUint64(&c.misses, 1)
+		return "", false
+	}
+
+	s.order.MoveToFront(elem)
+	domain := entry.domain
+	if entry.negative {
+		domain = "-"
+	}
+	s.mu.Unlock()
+
+	atomic.AddUint64(&c.hits, 1)
+	return domain, true
+}
+
+// Set caches a successful answer for its record TTL.
+func (c *DNSCache) Set(key, domain string, ttl time.Duration) {
+	if ttl < c.minTTL {
+		ttl = c.minTTL
+	}
+	if ttl > c.maxTTL {
+		ttl = c.maxTTL
+	}
+	c.put(&dnsCacheEntry{key: key, domain: domain, expires: time.Now().Add(ttl)})
+}
+
+// SetNegative caches an answer without a name so it isn't retried for
+// negativeTTL.
+func (c *DNSCache) SetNegative(key string) {
+	c.put(&dnsCacheEntry{key: key, negative: true, expires: time.Now().Add(c.negativeTTL)})
+}
+
+func (c *DNSCache) put(entry *dnsCacheEntry) {
+	s := c.shard(entry.key)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if elem, ok := s.items[entry.key]; ok {
+		elem.Value = entry
+		s.order.MoveToFront(elem)
+		return
+	}
+
+	for s.order.Len() >= s.capacity {
+		oldest := s.order.Back()
+		s.order.Remove(oldest)
+		delete(s.items, oldest.Value.(*dnsCacheEntry).key)
+		atomic.AddUint64(&c.evictions, 1)
+	}
+	s.items[entry.key] = s.order.PushFront(entry)
+}
+
+// Stats returns a snapshot of the cache counters.
+func (c *DNSCache) Stats() DNSCacheStats {
+	stats := DNSCacheStats{
+		Hits:        atomic.LoadUint64(&c.hits),
+		Misses:      atomic.LoadUint64(&c.misses),
+		Evictions:   atomic.LoadUint64(&c.evictions),
+		Expirations: atomic.LoadUint64(&c.expirations),
+	}
+	for i := range c.shards {
+		s := &c.shards[i]
+		s.mu.Lock()
+		stats.Size += s.order.Len()
+		s.mu.Unlock()
+	}
+	return stats
+}
+
+// Close stops the cleanup goroutine.
+func (c *DNSCache) Close() {
+	c.once.Do(func() { close(c.stop) })
+}
+
+func (c *DNSCache) cleanup(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-c.stop:
+			return
+		case now := <-ticker.C:
+			for i := range c.shards {
+				c.sweep(&c.shards[i], now)
+			}
+		}
+	}
+}
+
+func (c *DNSCache) sweep(s *dnsCacheShard, now time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for key, elem := range s.items {
+		if now.After(elem.Value.(*dnsCacheEntry).expires) {
+			s.order.Remove(elem)
+			delete(s.items, key)
+			atomic.AddUint64(&c.expirations, 1)
+		}
+	}
+}
@@ -0,0 +1,278 @@
+package network
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const benchCacheSize = 4096
+
+// sameShardKeys returns n keys that land in one shard of c.
+func sameShardKeys(c *DNSCache, n int) []string {
+	var keys []string
+	for _, k := range benchKeys(1024) {
+		if c.shard(k) == c.shard("10.0.0.0") {
+			keys = append(keys, k)
+		}
+		if len(keys) == n {
+			break
+		}
+	}
+	return keys
+}
+
+func TestDNSCacheEvictsLeastRecentlyUsed(t *testing.T) {
+	// Two entries per shard
+	c := NewDNSCache(2*dnsCacheShards, time.Minute, time.Hour, time.Minute)
+	defer c.Close()
+	keys := sameShardKeys(c, 3)
+
+	c.Set(keys[0], "a", time.Hour)
+	c.Set(keys[1], "b", time.Hour)
+	c.Get(keys[0]) // b is now the oldest
+	c.SetNegative(keys[2])
+
+	if _, ok := c.Get(keys[1]); ok {
+		t.Error("least recently used entry kept")
+	}
+	if name, ok := c.Get(keys[0]); !ok || name != "a" {
+		t.Errorf("recently read entry = %q %v", name, ok)
+	}
+	if name, ok := c.Get(keys[2]); !ok || name != "-" {
+		t.Errorf("negative entry = %q %v", name, ok)
+	}
+
+	// Replacing an entry doesn't evict
+	c.Set(keys[0], "a2", time.Hour)
+	if name, _ := c.Get(keys[0]); name != "a2" {
+		t.Errorf("replaced entry = %q", name)
+	}
+	if s := c.Stats(); s.Evictions != 1 || s.Size != 2 {
+		t.Errorf("stats %+v", s)
+	}
+}
+
+func TestDNSCacheExpiry(t *testing.T) {
+	c := NewDNSCache(64, 20*time.Millisecond, time.Hour, 20*time.Millisecond)
+	defer c.Close()
+
+	c.Set("10.0.0.1", "short", time.Millisecond) // raised to the minimum
+	c.Set("10.0.0.2", "long", 48*time.Hour)      // cut to the maximum
+	c.SetNegative("10.0.0.3")
+
+	entry := func(key string) *dnsCacheEntry {
+		s := c.shard(key)
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		return s.items[key].Value.(*dnsCacheEntry)
+	}
+	if ttl := time.Until(entry("10.0.0.2").expires); ttl > time.Hour || ttl < 59*time.Minute {
+		t.Errorf("TTL %s, want the maximum", ttl)
+	}
+	if _, ok := c.Get("10.0.0.1"); !ok {
+		t.Fatal("entry expired before the minimum TTL")
+	}
+
+	time.Sleep(30 * time.Millisecond)
+	for _, key := range []string{"10.0.0.1", "10.0.0.3"} {
+		if name, ok := c.Get(key); ok {
+			t.Errorf("%s still cached as %q", key, name)
+		}
+	}
+	if _, ok := c.Get("10.0.0.2"); !ok {
+		t.Error("long entry expired")
+	}
+
+	// The sweep drops what nobody asks for
+	c.sweep(c.shard("10.0.0.2"), time.Now().Add(2*time.Hour))
+	if s := c.Stats(); s.Size != 0 || s.Expirations != 3 {
+		t.Errorf("stats %+v", s)
+	}
+}
+
+// ptrServer answers PTR queries with rcode, and a name for NOERROR. It
+// returns the address to query.
+func ptrServer(t *testing.T, rcode int) string {
+	t.Helper()
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &dns.Server{PacketConn: pc, Handler: dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+		m := new(dns.Msg)
+		m.SetRcode(req, rcode)
+		if rcode == dns.RcodeSuccess {
+			m.Answer = append(m.Answer, &dns.PTR{
+				Hdr: dns.RR_Header{Name: req.Question[0].Name, Rrtype: dns.TypePTR, Class: dns.ClassINET, Ttl: 600},
+				Ptr: "web.example.",
+			})
+		}
+		w.WriteMsg(m)
+	})}
+	started := make(chan struct{})
+	srv.NotifyStartedFunc = func() { close(started) }
+	go srv.ActivateAndServe()
+	<-started
+	t.Cleanup(func() { srv.Shutdown() })
+	return pc.LocalAddr().String()
+}
+
+func ptrResolver(t *testing.T, timeout time.Duration, servers ...string) *DNSResolver {
+	r := &DNSResolver{
+		client:     &dns.Client{Timeout: timeout},
+		servers:    servers,
+		enabled:    true,
+		ptrEnabled: true,
+		timeout:    timeout,
+		maxTTL:     time.Hour,
+		cache:      NewDNSCache(64, time.Minute, time.Hour, time.Minute),
+	}
+	t.Cleanup(r.cache.Close)
+	r.sources = []NameSource{ptrSource{r.cache}}
+	return r
+}
+
+func TestPTRLookupOutcomes(t *testing.T) {
+	r := ptrResolver(t, time.Second)
+	ctx := context.Background()
+
+	name, ttl, err := r.queryDNSServer(ctx, ptrServer(t, dns.RcodeSuccess), "203.0.113.5")
+	if err != nil || name != "web.example." || ttl != 10*time.Minute {
+		t.Errorf("answer %q %s %v", name, ttl, err)
+	}
+	if _, _, err := r.queryDNSServer(ctx, ptrServer(t, dns.RcodeNameError), "203.0.113.5"); !errors.Is(err, errNoPTR) {
+		t.Errorf("NXDOMAIN: %v", err)
+	}
+	if _, _, err := r.queryDNSServer(ctx, ptrServer(t, dns.RcodeServerFailure), "203.0.113.5"); err == nil || errors.Is(err, errNoPTR) {
+		t.Errorf("SERVFAIL: %v, want a failure", err)
+	}
+
+	// One server knowing there is no name is enough to remember it
+	r.servers = []string{ptrServer(t, dns.RcodeServerFailure), ptrServer(t, dns.RcodeNameError)}
+	if got := r.ResolveIP(net.ParseIP("203.0.113.5")); got != "-" {
+		t.Errorf("resolved %q", got)
+	}
+	if name, ok := r.cache.Get("203.0.113.5"); !ok || name != "-" {
+		t.Errorf("no negative entry: %q %v", name, ok)
+	}
+}
+
+func TestPTRTimeoutNotCached(t *testing.T) {
+	// A server that never answers
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+
+	r := ptrResolver(t, 50*time.Millisecond, pc.LocalAddr().String())
+	if got := r.ResolveIP(net.ParseIP("203.0.113.5")); got != "-" {
+		t.Errorf("resolved %q", got)
+	}
+	if name, ok := r.cache.Get("203.0.113.5"); ok {
+		t.Errorf("timeout cached as %q", name)
+	}
+}
+
+func newBenchCache(b *testing.B) *DNSCache {
+	c := NewDNSCache(benchCacheSize, time.Minute, time.Hour, time.Minute)
+	b.Cleanup(c.Close)
+	return c
+}
+
+func benchKeys(n int) []string {
+	keys := make([]string, n)
+	for i := range keys {
+		keys[i] = "10.0." + strconv.Itoa(i/256%256) + "." + strconv.Itoa(i%256)
+	}
+	return keys
+}
+
+// BenchmarkDNSCacheHit reads names that are all cached.
+func BenchmarkDNSCacheHit(b *testing.B) {
+	c := newBenchCache(b)
+	keys := benchKeys(benchCacheSize / 2)
+	for _, k := range keys {
+		c.Set(k, "host-"+k, time.Hour)
+	}
+
+	var seq atomic.Uint64
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		i := int(seq.Add(1)) * 7919
+		for pb.Next() {
+			c.Get(keys[i%len(keys)])
+			i++
+		}
+	})
+}
+
+// BenchmarkDNSCacheMiss reads names that were never cached.
+func BenchmarkDNSCacheMiss(b *testing.B) {
+	c := newBenchCache(b)
+	keys := benchKeys(benchCacheSize)
+
+	var seq atomic.Uint64
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		i := int(seq.Add(1)) * 7919
+		for pb.Next() {
+			c.Get(keys[i%len(keys)])
+			i++
+		}
+	})
+}
+
+// BenchmarkDNSCacheEviction works on four times as many names as fit, so
+// most reads miss and every write evicts.
+func BenchmarkDNSCacheEviction(b *testing.B) {
+	c := newBenchCache(b)
+	keys := benchKeys(benchCacheSize * 4)
+
+	var seq atomic.Uint64
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		i := int(seq.Add(1)) * 7919
+		for pb.Next() {
+			k := keys[i%len(keys)]
+			if _, ok := c.Get(k); !ok {
+				c.Set(k, "host", time.Hour)
+			}
+			i++
+		}
+	})
+}
+
+// BenchmarkDNSCacheMixed is mostly hits with some misses and negative
+// answers, roughly what the packet workers see.
+func BenchmarkDNSCacheMixed(b *testing.B) {
+	c := newBenchCache(b)
+	keys := benchKeys(benchCacheSize + benchCacheSize/4)
+	for _, k := range keys[:benchCacheSize*3/4] {
+		c.Set(k, "host-"+k, time.Hour)
+	}
+
+	var seq atomic.Uint64
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		i := int(seq.Add(1)) * 7919
+		for pb.Next() {
+			k := keys[i%len(keys)]
+			if _, ok := c.Get(k); !ok {
+				if i%3 == 0 {
+					c.SetNegative(k)
+				} else {
+					c.Set(k, "host", time.Hour)
+				}
+			}
+			i++
+		}
+	})
+}
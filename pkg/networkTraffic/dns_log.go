@@ -0,0 +1,335 @@
+package network
+
+import (
+	"container/list"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// DNSLogRecord is one line of the DNS observability stream. Type is "query",
+// "response", "timeout" for queries that never got an answer, or "summary"
+// for the periodic per-client counters.
+type DNSLogRecord struct {
+	Time      time.Time `json:"time"`
+	Type      string    `json:"type"`
+	Iface     string    `json:"iface,omitempty"`
+	Protocol  string    `json:"protocol,omitempty"`
+	Client    string    `json:"client"`
+	Server    string    `json:"server,omitempty"`
+	ID        uint16    `json:"id,omitempty"`
+	QName     string    `json:"qname,omitempty"`
+	QType     string    `json:"qtype,omitempty"`
+	RCode     string    `json:"rcode,omitempty"`
+	Answers   []string  `json:"answers,omitempty"`
+	LatencyMs float64   `json:"latency_ms,omitempty"`
+
+	Stats *DNSClientStats `json:"stats,omitempty"`
+}
+
+// DNSClientStats are the aggregate counters kept per client IP.
+type DNSClientStats struct {
+	Queries   uint64 `json:"queries"`
+	Responses uint64 `json:"responses"`
+	NXDomain  uint64 `json:"nxdomain"`
+	ServFail  uint64 `json:"servfail"`
+	Timeouts  uint64 `json:"timeouts"`
+}
+
+// dnsTxKey identifies a transaction by its 5-tuple and DNS id, seen from the
+// client side.
+type dnsTxKey struct {
+	clientIP   uint32
+	serverIP   uint32
+	clientPort uint16
+	serverPort uint16
+	protocol   uint8
+	id         uint16
+}
+
+// Bounds of the DNS logger state. Past dnsLogMaxPending the oldest
+// unanswered query is forgotten, past dnsLogMaxClients the client seen
+// longest ago. Clients are also forgotten after dnsLogClientIdle without
+// DNS traffic.
+const (
+	dnsLogMaxPending = 65536
+	dnsLogMaxClients = 16384
+	dnsLogClientIdle = 15 * time.Minute
+)
+
+type pendingQuery struct {
+	key   dnsTxKey
+	tsNs  uint64
+	seen  time.Time
+	iface string
+	qname string
+	qtype string
+}
+
+type dnsClient struct {
+	ip       uint32
+	lastSeen time.Time
+	stats    DNSClientStats
+}
+
+// DNSLogger matches DNS queries with their responses and writes both, with
+// the measured latency, as JSON lines to a dedicated output stream. Records
+// are encoded outside mu, outMu only keeps the lines whole.
+type DNSLogger struct {
+	outMu sync.Mutex
+	out   io.Writer
+
+	mu sync.Mutex
+	// Both lists hold the most recent entry at the front, so the oldest
+	// query and the longest idle client are at the back.
+	pending      map[dnsTxKey]*list.Element
+	pendingOrder *list.List
+	clients      map[uint32]*list.Element
+	clientOrder  *list.List
+	lastSummary  time.Time
+	timeout      time.Duration
+	interval     time.Duration
+}
+
+func NewDNSLogger(out io.Writer, timeout, interval time.Duration) *DNSLogger {
+	return &DNSLogger{
+		out:          out,
+		pending:      make(map[dnsTxKey]*list.Element),
+		pendingOrder: list.New(),
+		clients:      make(map[uint32]*list.Element),
+		clientOrder:  list.New(),
+		lastSummary:  time.Now(),
+		timeout:      timeout,
+		interval:     interval,
+	}
+}
+
+// Observe records a parsed DNS message seen on the wire.
+func (d *DNSLogger) Observe(event PayLoadTc, msg *dns.Msg) {
+	e := event.Event
+	rec := DNSLogRecord{
+		Time:     time.Now(),
+		Iface:    event.Iface,
+		Protocol: strings.ToLower(protocolName(e.Protocol)),
+		ID:       msg.Id,
+	}
+	if len(msg.Question) > 0 {
+		rec.QName = strings.TrimSuffix(msg.Question[0].Name, ".")
+		rec.QType = dns.TypeToString[msg.Question[0].Qtype]
+	}
+
+	d.mu.Lock()
+	if !msg.Response {
+		key := dnsTxKey{e.SrcIP, e.DstIP, e.SrcPort, e.DstPort, e.Protocol, msg.Id}
+		if elem, ok := d.pending[key]; ok {
+			d.pendingOrder.Remove(elem)
+		}
+		for d.pendingOrder.Len() >= dnsLogMaxPending {
+			d.removePending(d.pendingOrder.Back())
+		}
+		d.pending[key] = d.pendingOrder.PushFront(&pendingQuery{
+			key:   key,
+			tsNs:  e.Timestamp,
+			seen:  rec.Time,
+			iface: event.Iface,
+			qname: rec.QName,
+			qtype: rec.QType,
+		})
+		d.client(e.SrcIP, rec.Time).Queries++
+
+		d.mu.Unlock()
+
+		rec.Type = "query"
+		rec.Client = fmt.Sprintf("%s:%d", intToIP(e.SrcIP), e.SrcPort)
+		rec.Server = fmt.Sprintf("%s:%d", intToIP(e.DstIP), e.DstPort)
+		d.write(rec)
+		return
+	}
+
+	key := dnsTxKey{e.DstIP, e.SrcIP, e.DstPort, e.SrcPort, e.Protocol, msg.Id}
+	if elem, ok := d.pending[key]; ok {
+		query := elem.Value.(*pendingQuery)
+		d.removePending(elem)
+		if e.Timestamp > query.tsNs {
+			rec.LatencyMs = float64(e.Timestamp-query.tsNs) / float64(time.Millisecond)
+		}
+	}
+
+	stats := d.client(e.DstIP, rec.Time)
+	stats.Responses++
+	switch msg.Rcode {
+	case dns.RcodeNameError:
+		stats.NXDomain++
+	case dns.RcodeServerFailure:
+		stats.ServFail++
+	}
+	d.mu.Unlock()
+
+	rec.Type = "response"
+	rec.Client = fmt.Sprintf("%s:%d", intToIP(e.DstIP), e.DstPort)
+	rec.Server = fmt.Sprintf("%s:%d", intToIP(e.SrcIP), e.SrcPort)
+	rec.RCode = dns.RcodeToString[msg.Rcode]
+	for _, rr := range msg.Answer {
+		rec.Answers = append(rec.Answers, answerString(rr))
+	}
+	d.write(rec)
+}
+
+// Run expires unanswered queries and periodically writes the per-client
+// counters until ctx is cancelled. Queries are checked four times per
+// timeout, so a timeout is logged at most a quarter of it late.
+func (d *DNSLogger) Run(ctx context.Context) {
+	expiry := time.NewTicker(max(d.timeout/4, 100*time.Millisecond))
+	defer expiry.Stop()
+	summary := time.NewTicker(d.interval)
+	defer summary.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-expiry.C:
+			d.expire(now)
+		case now := <-summary.C:
+			d.summarize(now)
+		}
+	}
+}
+
+func (d *DNSLogger) expire(now time.Time) {
+	var timeouts []DNSLogRecord
+	d.mu.Lock()
+	for elem := d.pendingOrder.Back(); elem != nil; elem = d.pendingOrder.Back() {
+		query := elem.Value.(*pendingQuery)
+		if now.Sub(query.seen) < d.timeout {
+			break
+		}
+		d.removePending(elem)
+		key := query.key
+		d.client(key.clientIP, now).Timeouts++
+		timeouts = append(timeouts, DNSLogRecord{
+			Time:     now,
+			Type:     "timeout",
+			Iface:    query.iface,
+			Protocol: strings.ToLower(protocolName(key.protocol)),
+			Client:   fmt.Sprintf("%s:%d", intToIP(key.clientIP), key.clientPort),
+			Server:   fmt.Sprintf("%s:%d", intToIP(key.serverIP), key.serverPort),
+			ID:       key.id,
+			QName:    query.qname,
+			QType:    query.qtype,
+		})
+	}
+	d.mu.Unlock()
+
+	for _, rec := range timeouts {
+		d.write(rec)
+	}
+}
+
+// summarize writes the counters of the clients seen since the last
+// summary and forgets the ones idle for dnsLogClientIdle.
+func (d *DNSLogger) summarize(now time.Time) {
+	d.mu.Lock()
+
+	for elem := d.clientOrder.Back(); elem != nil; elem = d.clientOrder.Back() {
+		if now.Sub(elem.Value.(*dnsClient).lastSeen) < dnsLogClientIdle {
+			break
+		}
+		d.removeClient(elem)
+	}
+
+	var active []dnsClient
+	for elem := d.clientOrder.Front(); elem != nil; elem = elem.Next() {
+		c := elem.Value.(*dnsClient)
+		if c.lastSeen.Before(d.lastSummary) {
+			break
+		}
+		active = append(active, *c)
+	}
+	d.lastSummary = now
+	d.mu.Unlock()
+
+	sort.Slice(active, func(i, j int) bool { return active[i].ip < active[j].ip })
+	for _, c := range active {
+		d.write(DNSLogRecord{
+			Time:   now,
+			Type:   "summary",
+			Client: intToIP(c.ip).String(),
+			Stats:  &c.stats,
+		})
+	}
+}
+
+// Snapshot returns a copy of the per-client counters keyed by client IP.
+func (d *DNSLogger) Snapshot() map[string]DNSClientStats {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	out := make(map[string]DNSClientStats, len(d.clients))
+	for ip, elem := range d.clients {
+		out[intToIP(ip).String()] = elem.Value.(*dnsClient).stats
+	}
+	return out
+}
+
+// client returns the counters of ip, marking it as seen at now.
+func (d *DNSLogger) client(ip uint32, now time.Time) *DNSClientStats {
+	if elem, ok := d.clients[ip]; ok {
+		c := elem.Value.(*dnsClient)
+		c.lastSeen = now
+		d.clientOrder.MoveToFront(elem)
+		return &c.stats
+	}
+	for d.clientOrder.Len() >= dnsLogMaxClients {
+		d.removeClient(d.clientOrder.Back())
+	}
+	c := &dnsClient{ip: ip, lastSeen: now}
+	d.clients[ip] = d.clientOrder.PushFront(c)
+	return &c.stats
+}
+
+func (d *DNSLogger) removePending(elem *list.Element) {
+	d.pendingOrder.Remove(elem)
+	delete(d.pending, elem.Value.(*pendingQuery).key)
+}
+
+func (d *DNSLogger) removeClient(elem *list.Element) {
+	d.clientOrder.Remove(elem)
+	delete(d.clients, elem.Value.(*dnsClient).ip)
+}
+
+// write must be called without mu held.
+func (d *DNSLogger) write(rec DNSLogRecord) {
+	line, err := json.Marshal(rec)
+	if err != nil {
+		return
+	}
+	line = append(line, '\n')
+	// Write errors only happen on a broken writer, there is nothing useful
+	// to do with them on the hot path.
+	d.outMu.Lock()
+	d.out.Write(line)
+	d.outMu.Unlock()
+}
+
+func answerString(rr dns.RR) string {
+	switch a := rr.(type) {
+	case *dns.A:
+		return a.A.String()
+	case *dns.AAAA:
+		return a.AAAA.String()
+	case *dns.CNAME:
+		return "CNAME " + strings.TrimSuffix(a.Target, ".")
+	case *dns.PTR:
+		return "PTR " + strings.TrimSuffix(a.Ptr, ".")
+	default:
+		return strings.TrimPrefix(rr.String(), rr.Header().String())
+	}
+}
@@ -0,0 +1,147 @@
+package network
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func dnsLogRecords(t *testing.T, out *bytes.Buffer) []DNSLogRecord {
+	t.Helper()
+	var recs []DNSLogRecord
+	for _, line := range strings.Split(strings.TrimSpace(out.String()), "\n") {
+		var rec DNSLogRecord
+		if err := json.Unmarshal([]byte(line), &rec); err != nil {
+			t.Fatalf("bad line %q: %v", line, err)
+		}
+		recs = append(recs, rec)
+	}
+	out.Reset()
+	return recs
+}
+
+// dnsQueryPacket is the query dnsPacket answers, 10.0.0.2:40000 to
+// 10.0.0.53:53 at 1ms.
+func dnsQueryPacket(id uint16) (PayLoadTc, *dns.Msg) {
+	q := new(dns.Msg)
+	q.SetQuestion("api.example.com.", dns.TypeA)
+	q.Id = id
+	return PayLoadTc{
+		Event: Event{
+			SrcIP: 0x0200000a, DstIP: 0x3500000a, SrcPort: 40000, DstPort: 53,
+			Protocol: 17, Timestamp: uint64(time.Millisecond),
+		},
+		Iface: "eth0",
+	}, q
+}
+
+func TestDNSLogMatchesResponses(t *testing.T) {
+	var out bytes.Buffer
+	d := NewDNSLogger(&out, time.Second, time.Minute)
+
+	query, q := dnsQueryPacket(7)
+	d.Observe(query, q)
+	resp := dnsResponse(t, "api.example.com", "api.example.com. 60 IN A 203.0.113.10")
+	resp.Id = 7
+	d.Observe(dnsPacket(17, nil), resp)
+
+	recs := dnsLogRecords(t, &out)
+	if len(recs) != 2 {
+		t.Fatalf("%d records", len(recs))
+	}
+	if r := recs[0]; r.Type != "query" || r.Client != "10.0.0.2:40000" || r.Server != "10.0.0.53:53" ||
+		r.QName != "api.example.com" || r.QType != "A" || r.Protocol != "udp" {
+		t.Errorf("query %+v", r)
+	}
+	if r := recs[1]; r.Type != "response" || r.Client != "10.0.0.2:40000" || r.RCode != "NOERROR" ||
+		r.LatencyMs != 1 || len(r.Answers) != 1 || r.Answers[0] != "203.0.113.10" {
+		t.Errorf("response %+v", r)
+	}
+	if len(d.pending) != 0 {
+		t.Errorf("%d queries pending after the answer", len(d.pending))
+	}
+
+	// An answer to another id has no latency
+	resp.Id = 8
+	resp.Rcode = dns.RcodeNameError
+	d.Observe(dnsPacket(17, nil), resp)
+	if r := dnsLogRecords(t, &out)[0]; r.LatencyMs != 0 || r.RCode != "NXDOMAIN" {
+		t.Errorf("unmatched response %+v", r)
+	}
+	if s := d.Snapshot()["10.0.0.2"]; s.Queries != 1 || s.Responses != 2 || s.NXDomain != 1 {
+		t.Errorf("client stats %+v", s)
+	}
+}
+
+func TestDNSLogTimeoutsAndSummary(t *testing.T) {
+	var out bytes.Buffer
+	d := NewDNSLogger(&out, time.Second, time.Minute)
+	query, q := dnsQueryPacket(9)
+	d.Observe(query, q)
+	out.Reset()
+
+	d.expire(time.Now())
+	if out.Len() != 0 {
+		t.Errorf("query timed out early: %s", out.String())
+	}
+	d.expire(time.Now().Add(2 * time.Second))
+	if r := dnsLogRecords(t, &out); len(r) != 1 || r[0].Type != "timeout" || r[0].QName != "api.example.com" || r[0].ID != 9 {
+		t.Errorf("timeout %+v", r)
+	}
+
+	d.summarize(time.Now().Add(3 * time.Second))
+	recs := dnsLogRecords(t, &out)
+	if len(recs) != 1 || recs[0].Type != "summary" || recs[0].Client != "10.0.0.2" ||
+		recs[0].Stats.Queries != 1 || recs[0].Stats.Timeouts != 1 {
+		t.Errorf("summary %+v", recs)
+	}
+
+	// Quiet clients are left out, then forgotten
+	d.summarize(time.Now().Add(4 * time.Second))
+	if out.Len() != 0 {
+		t.Errorf("summary of a quiet client: %s", out.String())
+	}
+	d.summarize(time.Now().Add(dnsLogClientIdle + time.Minute))
+	if len(d.Snapshot()) != 0 {
+		t.Error("idle client kept")
+	}
+}
+
+// blockingWriter holds every write until released.
+type blockingWriter struct {
+	writing chan struct{}
+	release chan struct{}
+}
+
+func (w *blockingWriter) Write(p []byte) (int, error) {
+	w.writing <- struct{}{}
+	<-w.release
+	return len(p), nil
+}
+
+// A slow output doesn't hold the state lock.
+func TestDNSLogWritesOutsideLock(t *testing.T) {
+	w := &blockingWriter{writing: make(chan struct{}), release: make(chan struct{})}
+	d := NewDNSLogger(w, time.Second, time.Minute)
+
+	query, q := dnsQueryPacket(1)
+	go d.Observe(query, q)
+	<-w.writing
+
+	done := make(chan struct{})
+	go func() {
+		d.Snapshot()
+		d.expire(time.Now())
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Error("state locked while the record was written")
+	}
+	close(w.release)
+}
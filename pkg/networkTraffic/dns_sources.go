@@ -0,0 +1,185 @@
+package network
+
+import (
+	"bufio"
+	"fmt"
+	"kernelKoala/pkg/iptrie"
+	"net"
+	"os"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// Names accepted by -dns-sources.
+const (
+	sourcePassive = "passive"
+	sourceHosts   = "hosts"
+	sourceStatic  = "static"
+	sourceCIDR    = "cidr"
+	sourcePTR     = "ptr"
+)
+
+// NameSource is one step of the resolver chain. Lookup must not block on
+// the network.
+type NameSource interface {
+	Name() string
+	Lookup(ip net.IP) (string, bool)
+}
+
+type passiveSource struct{ p *PassiveDNS }
+
+func (s passiveSource) Name() string                    { return sourcePassive }
+func (s passiveSource) Lookup(ip net.IP) (string, bool) { return s.p.Lookup(ip) }
+
+// staticSource answers from IP→name files in /etc/hosts format.
+type staticSource struct {
+	name  string
+	names map[string]string
+}
+
+func (s *staticSource) Name() string { return s.name }
+
+func (s *staticSource) Lookup(ip net.IP) (string, bool) {
+	name, ok := s.names[ip.String()]
+	return name, ok
+}
+
+// loadHostsFiles reads "ip name [aliases...]" lines, the first file that
+// names an IP wins. Lines that don't parse are passed to warn and skipped.
+func loadHostsFiles(name string, paths []string, warn func(format string, args ...any)) (*staticSource, error) {
+	src := &staticSource{name: name, names: make(map[string]string)}
+
+	for _, path := range paths {
+		err := readConfigLinesSkipping(path, warn, func(fields []string) error {
+			if len(fields) < 2 {
+				return fmt.Errorf("expected \"ip name\", got %q", strings.Join(fields, " "))
+			}
+			ip := net.ParseIP(fields[0])
+			if ip == nil {
+				return fmt.Errorf("invalid IP %q", fields[0])
+			}
+			if _, ok := src.names[ip.String()]; !ok {
+				src.names[ip.String()] = fields[1]
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return src, nil
+}
+
+// cidrSource labels addresses by the most specific configured network,
+// e.g. "10.20.0.0/16 = payments-vpc".
+type cidrSource struct {
+	labels *iptrie.Trie[string]
+}
+
+func (s *cidrSource) Name() string { return sourceCIDR }
+
+func (s *cidrSource) Lookup(ip net.IP) (string, bool) {
+	label, _, ok := s.labels.Lookup(iptrie.AddrFromIP(ip))
+	return label, ok
+}
+
+func loadCIDRLabels(path string, warn func(format string, args ...any)) (*cidrSource, error) {
+	src := &cidrSource{labels: iptrie.New[string]()}
+
+	err := readConfigLinesSkipping(path, warn, func(fields []string) error {
+		line := strings.Join(fields, " ")
+		cidr, label, ok := strings.Cut(line, "=")
+		if !ok {
+			return fmt.Errorf("expected \"cidr = label\", got %q", line)
+		}
+		prefix, err := iptrie.ParsePrefix(strings.TrimSpace(cidr))
+		if err != nil {
+			return err
+		}
+		src.labels.Insert(prefix, strings.TrimSpace(label))
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return src, nil
+}
+
+// readConfigLines calls fn with the whitespace separated fields of every
+// non-empty line, ignoring '#' comments.
+func readConfigLines(path string, fn func(fields []string) error) error {
+	return readConfigLinesSkipping(path, nil, fn)
+}
+
+// readConfigLinesSkipping is readConfigLines that passes the lines fn
+// fails on to warn and goes on, for files the agent shares with the rest
+// of the system. A nil warn stops at the first bad line.
+func readConfigLinesSkipping(path string, warn func(format string, args ...any), fn func(fields []string) error) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	lineNo := 0
+	for scanner.Scan() {
+		lineNo++
+		line := scanner.Text()
+		if i := strings.IndexByte(line, '#'); i >= 0 {
+			line = line[:i]
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		if err := fn(fields); err != nil {
+			if warn == nil {
+				return fmt.Errorf("%s:%d: %v", path, lineNo, err)
+			}
+			warn("%s:%d: %v, line skipped", path, lineNo, err)
+		}
+	}
+	return scanner.Err()
+}
+
+// loadResolvConf returns the nameservers of a resolv.conf with ports, and
+// the search list used to shorten names.
+func loadResolvConf(path string) (*dns.ClientConfig, []string, error) {
+	cfg, err := dns.ClientConfigFromFile(path)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	servers := make([]string, 0, len(cfg.Servers))
+	for _, s := range cfg.Servers {
+		servers = append(servers, net.JoinHostPort(s, cfg.Port))
+	}
+	return cfg, servers, nil
+}
+
+// shortenName strips a resolv.conf search domain from name, provided what is
+// left has fewer dots than ndots, so that it would resolve back the same way.
+func shortenName(name string, cfg *dns.ClientConfig) string {
+	if cfg == nil {
+		return name
+	}
+	name = strings.TrimSuffix(name, ".")
+	for _, domain := range cfg.Search {
+		domain = strings.TrimSuffix(domain, ".")
+		if short, ok := strings.CutSuffix(name, "."+domain); ok && strings.Count(short, ".") < cfg.Ndots {
+			return short
+		}
+	}
+	return name
+}
+
+// ptrSource answers from the cache of earlier reverse lookups, the lookups
+// themselves run in the background.
+type ptrSource struct{ cache *DNSCache }
+
+func (s ptrSource) Name() string { return sourcePTR }
+
+func (s ptrSource) Lookup(ip net.IP) (string, bool) { return s.cache.Get(ip.String()) }
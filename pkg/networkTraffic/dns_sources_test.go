@@ -0,0 +1,142 @@
+package network
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+// warnings collects what a loader skipped.
+type warnings []string
+
+func (w *warnings) warn(format string, args ...any) {
+	*w = append(*w, fmt.Sprintf(format, args...))
+}
+
+func lookup(src NameSource, ip string) string {
+	name, ok := src.Lookup(net.ParseIP(ip))
+	if !ok {
+		return ""
+	}
+	return name
+}
+
+func TestLoadHostsFiles(t *testing.T) {
+	first := writeTestFile(t, `
+# comment
+10.0.0.1   db db.internal   # trailing comment
+::1        localhost
+10.0.0.2
+not-an-ip  broken
+10.0.0.1   other
+`)
+	second := writeTestFile(t, "10.0.0.1 later\n10.0.0.3 cache\n")
+
+	var w warnings
+	src, err := loadHostsFiles(sourceStatic, []string{first, second}, w.warn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for ip, want := range map[string]string{
+		"10.0.0.1": "db", // the first name of the first file wins
+		"::1":      "localhost",
+		"10.0.0.3": "cache",
+		"10.0.0.2": "",
+	} {
+		if got := lookup(src, ip); got != want {
+			t.Errorf("%s named %q, want %q", ip, got, want)
+		}
+	}
+	if src.Name() != sourceStatic {
+		t.Errorf("source named %s", src.Name())
+	}
+
+	if len(w) != 2 || !strings.Contains(w[0], first+":5:") || !strings.Contains(w[1], `invalid IP "not-an-ip"`) {
+		t.Errorf("warnings %q", w)
+	}
+
+	if _, err := loadHostsFiles(sourceHosts, []string{first + ".missing"}, w.warn); err == nil {
+		t.Error("missing file loaded")
+	}
+}
+
+func TestLoadCIDRLabels(t *testing.T) {
+	path := writeTestFile(t, `
+10.20.0.0/16 = payments-vpc
+10.20.5.0/24 = payments-db
+2001:db8::/32 = lab v6
+10.30.0.0/16 payments
+bogus/8 = nothing
+`)
+	var w warnings
+	src, err := loadCIDRLabels(path, w.warn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for ip, want := range map[string]string{
+		"10.20.1.1":   "payments-vpc",
+		"10.20.5.9":   "payments-db",
+		"2001:db8::7": "lab v6",
+		"10.30.0.1":   "",
+	} {
+		if got := lookup(src, ip); got != want {
+			t.Errorf("%s labelled %q, want %q", ip, got, want)
+		}
+	}
+	if len(w) != 2 {
+		t.Errorf("warnings %q", w)
+	}
+}
+
+func TestReadConfigLinesStopsAtBadLine(t *testing.T) {
+	path := writeTestFile(t, "a\n\n  # only a comment\nb c\nd\n")
+	var lines []string
+	err := readConfigLines(path, func(fields []string) error {
+		if fields[0] == "d" {
+			return fmt.Errorf("no d")
+		}
+		lines = append(lines, strings.Join(fields, " "))
+		return nil
+	})
+	if err == nil || err.Error() != path+":5: no d" {
+		t.Errorf("err = %v", err)
+	}
+	if strings.Join(lines, ",") != "a,b c" {
+		t.Errorf("lines %q", lines)
+	}
+}
+
+func TestShortenName(t *testing.T) {
+	cfg := &dns.ClientConfig{Search: []string{"svc.cluster.local.", "corp.example."}, Ndots: 2}
+	for name, want := range map[string]string{
+		"db.svc.cluster.local.":       "db",
+		"db.payments.corp.example":    "db.payments",
+		"a.b.c.corp.example":          "a.b.c.corp.example", // as many dots as ndots
+		"example.org":                 "example.org",
+		"svc.cluster.local.other.com": "svc.cluster.local.other.com",
+	} {
+		if got := shortenName(name, cfg); got != want {
+			t.Errorf("shortenName(%q) = %q, want %q", name, got, want)
+		}
+	}
+	if got := shortenName("db.corp.example.", nil); got != "db.corp.example." {
+		t.Errorf("without a resolv.conf the name changed to %q", got)
+	}
+}
+
+func TestLoadResolvConf(t *testing.T) {
+	path := writeTestFile(t, "nameserver 10.0.0.53\nnameserver fd00::53\nsearch corp.example\noptions ndots:3\n")
+	cfg, servers, err := loadResolvConf(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(servers, ",") != "10.0.0.53:53,[fd00::53]:53" {
+		t.Errorf("servers %v", servers)
+	}
+	if cfg.Ndots != 3 || len(cfg.Search) != 1 {
+		t.Errorf("config %+v", cfg)
+	}
+}
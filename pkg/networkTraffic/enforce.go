@@ -0,0 +1,100 @@
+package network
+
+import (
+	"fmt"
+	"kernelKoala/pkg/alert"
+	"kernelKoala/pkg/policy"
+	"sync/atomic"
+	"time"
+)
+
+// Event flags set by the deny policy, RuleID names the matching rule.
+const (
+	EventFlagDropped   = 0x02
+	EventFlagWouldDrop = 0x04
+)
+
+// policyAction describes what the policy did to a packet, "" if nothing.
+func policyAction(e Event) string {
+	switch {
+	case e.Flags&EventFlagDropped != 0:
+		return "dropped"
+	case e.Flags&EventFlagWouldDrop != 0:
+		return "would-drop"
+	default:
+		return ""
+	}
+}
+
+// setupPolicy installs the rules from -policy-file, if any, and applies
+// -policy-mode if it was given. Otherwise the rules and the mode already in
+// the pinned maps stay, so changes made through the CLI or the API survive
+// restarts.
+func (nc *NetworkCapture) setupPolicy(objs *EBPFObjects) error {
+	nc.policy = policy.New(objs.PolicyRules, objs.PolicyConfig)
+
+	if nc.config.PolicyFile != "" {
+		rules, err := policy.LoadFile(nc.config.PolicyFile)
+		if err != nil {
+			return err
+		}
+		if _, err := nc.policy.Replace(rules); err != nil {
+			return err
+		}
+	}
+
+	if nc.config.PolicyModeSet {
+		if err := nc.policy.SetMode(nc.config.PolicyMode); err != nil {
+			return err
+		}
+	}
+
+	mode, err := nc.policy.Mode()
+	if err != nil {
+		return err
+	}
+	rules, err := nc.policy.List()
+	if err != nil {
+		return err
+	}
+	nc.logger.Info("Policy mode %s with %d rules", mode, len(rules))
+	return nil
+}
+
+// checkPolicy counts dropped and would-drop packets and raises an alert for
+// the first one of each flow.
+func (w *PacketWorker) checkPolicy(event PayLoadTc, flow FlowRecord) {
+	e := event.Event
+	action := policyAction(e)
+	if action == "" {
+		return
+	}
+
+	severity := alert.SeverityMedium
+	if action == "dropped" {
+		atomic.AddUint64(&w.stats.PolicyDropped, 1)
+	} else {
+		atomic.AddUint64(&w.stats.PolicyWouldDrop, 1)
+		severity = alert.SeverityLow
+	}
+
+	if !flow.isNew() {
+		return
+	}
+	w.alert(alert.Alert{
+		Time:     time.Now(),
+		Type:     "policy",
+		Severity: severity,
+		Message:  fmt.Sprintf("%s by policy rule %d", action, e.RuleID),
+		Protocol: protocolName(e.Protocol),
+		SrcIP:    intToIP(e.SrcIP).String(),
+		SrcPort:  e.SrcPort,
+		DstIP:    intToIP(e.DstIP).String(),
+		DstPort:  e.DstPort,
+		Iface:    event.Iface,
+		Fields: map[string]string{
+			"action":  action,
+			"rule_id": fmt.Sprint(e.RuleID),
+		},
+	})
+}
@@ -0,0 +1,273 @@
+package network
+
+import (
+	"context"
+	"fmt"
+	"kernelKoala/pkg/geoip"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const flowShards = 64
+
+// FlowKey identifies a connection, oriented from the side that initiated it
+// when that is known.
+type FlowKey struct {
+	SrcIP    uint32
+	DstIP    uint32
+	SrcPort  uint16
+	DstPort  uint16
+	Protocol uint8
+}
+
+func flowKeyFromEvent(e Event) FlowKey {
+	return FlowKey{
+		SrcIP:    e.SrcIP,
+		DstIP:    e.DstIP,
+		SrcPort:  e.SrcPort,
+		DstPort:  e.DstPort,
+		Protocol: e.Protocol,
+	}
+}
+
+func (k FlowKey) reverse() FlowKey {
+	return FlowKey{
+		SrcIP:    k.DstIP,
+		DstIP:    k.SrcIP,
+		SrcPort:  k.DstPort,
+		DstPort:  k.SrcPort,
+		Protocol: k.Protocol,
+	}
+}
+
+// canonical returns the same key for both directions of a connection.
+func (k FlowKey) canonical() FlowKey {
+	if k.SrcIP > k.DstIP || (k.SrcIP == k.DstIP && k.SrcPort > k.DstPort) {
+		return k.reverse()
+	}
+	return k
+}
+
+func (k FlowKey) shard() int {
+	c := k.canonical()
+	h := c.SrcIP*2654435761 ^ c.DstIP*2246822519 ^ uint32(c.SrcPort)<<16 ^ uint32(c.DstPort) ^ uint32(c.Protocol)
+	return int(h % flowShards)
+}
+
+func (k FlowKey) String() string {
+	return fmt.Sprintf("%s %s:%d -> %s:%d", protocolName(k.Protocol),
+		intToIP(k.SrcIP), k.SrcPort, intToIP(k.DstIP), k.DstPort)
+}
+
+// FlowRecord aggregates the packets of one connection in both directions.
+type FlowRecord struct {
+	Key       FlowKey
+	Iface     string
+	Scope     string
+	FirstSeen time.Time
+	LastSeen  time.Time
+	Packets   uint64
+	Bytes     uint64
+	TcpFlags  uint8
+	Closed    bool
+	TLS       *TLSInfo
+	// Refused marks the record of a packet the full table didn't track,
+	// it only counts that packet.
+	Refused bool
+
+	// Names are filled in when the flow is exported.
+	SrcName string
+	DstName string
+	// Geo data of external endpoints, also filled in on export.
+	SrcGeo *geoip.Info
+	DstGeo *geoip.Info
+}
+
+type flowShard struct {
+	mu    sync.Mutex
+	flows map[FlowKey]*FlowRecord
+}
+
+// FlowTable tracks active connections and hands finished ones to an export
+// callback when they close or go idle. Once maxFlows are tracked, packets
+// of new connections are no longer tracked, so a flood of new 5-tuples
+// can't exhaust memory or push out the established connections.
+type FlowTable struct {
+	shards      [flowShards]flowShard
+	idleTimeout time.Duration
+	export      func(FlowRecord)
+	// maxPerShard is maxFlows spread over the shards, 0 is unlimited.
+	maxPerShard int
+	refused     atomic.Uint64
+}
+
+func NewFlowTable(idleTimeout time.Duration, maxFlows int, export func(FlowRecord)) *FlowTable {
+	t := &FlowTable{
+		idleTimeout: idleTimeout,
+		export:      export,
+	}
+	if maxFlows > 0 {
+		t.maxPerShard = max(maxFlows/flowShards, 1)
+	}
+	for i := range t.shards {
+		t.shards[i].flows = make(map[FlowKey]*FlowRecord)
+	}
+	return t
+}
+
+// Update accounts a packet to its flow and returns a copy of the record.
+// When the table is full the packet of a new connection gets a record of
+// its own that is not tracked and marked Refused.
+func (t *FlowTable) Update(event PayLoadTc) FlowRecord {
+	e := event.Event
+	key := flowKeyFromEvent(e)
+	now := time.Now()
+
+	shard := &t.shards[key.shard()]
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+
+	rec, ok := shard.flows[key.canonical()]
+	if !ok {
+		// A SYN-ACK means we missed the SYN and are looking at the server
+		if e.Protocol == 6 && e.TcpFlags&0x12 == 0x12 {
+			key = key.reverse()
+			event.Scope = reverseScope(event.Scope)
+		}
+		rec = &FlowRecord{
+			Key:       key,
+			Iface:     event.Iface,
+			Scope:     event.Scope,
+			FirstSeen: now,
+		}
+		if t.maxPerShard > 0 && len(shard.flows) >= t.maxPerShard {
+			t.refused.Add(1)
+			rec.Refused = true
+		} else {
+			shard.flows[key.canonical()] = rec
+		}
+	}
+
+	rec.LastSeen = now
+	rec.Packets++
+	rec.Bytes += uint64(e.PktLen)
+	rec.TcpFlags |= e.TcpFlags
+	if e.TcpFlags&0x05 != 0 { // FIN or RST
+		rec.Closed = true
+	}
+
+	return *rec
+}
+
+// isNew reports whether the record is that of the first packet of a
+// tracked connection. Every packet of a connection the full table refused
+// has a record of one packet, none of them starts a flow.
+func (r FlowRecord) isNew() bool {
+	return r.Packets == 1 && !r.Refused
+}
+
+// SetTLS attaches ClientHello details to the flow the event belongs to.
+func (t *FlowTable) SetTLS(e Event, info *TLSInfo) {
+	key := flowKeyFromEvent(e)
+	shard := &t.shards[key.shard()]
+	shard.mu.Lock()
+	if rec, ok := shard.flows[key.canonical()]; ok {
+		rec.TLS = info
+	}
+	shard.mu.Unlock()
+}
+
+// Active returns a copy of every flow currently tracked.
+func (t *FlowTable) Active() []FlowRecord {
+	var out []FlowRecord
+	for i := range t.shards {
+		shard := &t.shards[i]
+		shard.mu.Lock()
+		for _, rec := range shard.flows {
+			out = append(out, *rec)
+		}
+		shard.mu.Unlock()
+	}
+	return out
+}
+
+// Len returns the number of flows currently tracked.
+func (t *FlowTable) Len() int {
+	n := 0
+	for i := range t.shards {
+		shard := &t.shards[i]
+		shard.mu.Lock()
+		n += len(shard.flows)
+		shard.mu.Unlock()
+	}
+	return n
+}
+
+// Refused returns how many packets of new connections were not tracked
+// because the table was full.
+func (t *FlowTable) Refused() uint64 {
+	return t.refused.Load()
+}
+
+// Run exports closed and idle flows until ctx is cancelled, then flushes the
+// rest.
+func (t *FlowTable) Run(ctx context.Context) {
+	ticker := time.NewTicker(5 * time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			t.sweep(time.Time{})
+			return
+		case now := <-ticker.C:
+			t.sweep(now)
+		}
+	}
+}
+
+// sweep exports finished flows, a zero now exports everything.
+func (t *FlowTable) sweep(now time.Time) {
+	var done []FlowRecord
+
+	for i := range t.shards {
+		shard := &t.shards[i]
+		shard.mu.Lock()
+		for key, rec := range shard.flows {
+			idle := now.Sub(rec.LastSeen)
+			if now.IsZero() || idle > t.idleTimeout || (rec.Closed && idle > time.Second) {
+				done = append(done, *rec)
+				delete(shard.flows, key)
+			}
+		}
+		shard.mu.Unlock()
+	}
+
+	if t.export == nil {
+		return
+	}
+	for _, rec := range done {
+		t.export(rec)
+	}
+}
+
+func (r FlowRecord) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "FLOW %s | names=%s -> %s | packets=%d bytes=%d duration=%s | flags=%s | iface=%s | scope=%s",
+		r.Key, orDash(r.SrcName), orDash(r.DstName), r.Packets, r.Bytes,
+		r.LastSeen.Sub(r.FirstSeen).Round(time.Millisecond), tcpFlagsToString(r.TcpFlags), r.Iface, r.Scope)
+	if r.TLS != nil {
+		b.WriteString(" | " + r.TLS.String())
+	}
+	b.WriteString(geoSuffix(r.SrcGeo, r.DstGeo))
+	return b.String()
+}
+
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
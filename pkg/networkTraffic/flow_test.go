@@ -0,0 +1,118 @@
+package network
+
+import (
+	"testing"
+	"time"
+)
+
+func tcpPacket(src uint32, srcPort uint16, flags uint8) PayLoadTc {
+	return PayLoadTc{
+		Event: Event{
+			SrcIP: src, DstIP: 0x0100000a, // 10.0.0.1
+			SrcPort: srcPort, DstPort: 443, Protocol: 6, TcpFlags: flags, PktLen: 60,
+		},
+		Iface: "eth0",
+		Scope: ScopeInbound,
+	}
+}
+
+func TestFlowTableAccounting(t *testing.T) {
+	table := NewFlowTable(time.Minute, 0, nil)
+
+	syn := table.Update(tcpPacket(0x0200000a, 40000, 0x02))
+	if !syn.isNew() || syn.Refused {
+		t.Fatalf("first packet %+v, want a new tracked flow", syn)
+	}
+
+	// The reply belongs to the same flow
+	reply := tcpPacket(0x0100000a, 443, 0x12)
+	reply.Event.DstIP, reply.Event.DstPort = 0x0200000a, 40000
+	rec := table.Update(reply)
+	if rec.isNew() || rec.Packets != 2 || rec.Bytes != 120 || rec.TcpFlags != 0x12 {
+		t.Errorf("reply %+v, want the second packet of the flow", rec)
+	}
+	if rec.Key.SrcPort != 40000 {
+		t.Errorf("flow oriented %s, want from the client", rec.Key)
+	}
+
+	rec = table.Update(tcpPacket(0x0200000a, 40000, 0x01))
+	if !rec.Closed || table.Len() != 1 {
+		t.Errorf("FIN didn't close the flow: %+v", rec)
+	}
+}
+
+func TestFlowTableMissedSYN(t *testing.T) {
+	table := NewFlowTable(time.Minute, 0, nil)
+
+	// A SYN-ACK from the server is the first packet seen
+	synAck := tcpPacket(0x0100000a, 443, 0x12)
+	synAck.Event.DstIP, synAck.Event.DstPort = 0x0200000a, 40000
+	rec := table.Update(synAck)
+	if rec.Key.SrcPort != 40000 || rec.Key.DstPort != 443 || rec.Scope != ScopeOutbound {
+		t.Errorf("flow %s scope %s, want it turned around", rec.Key, rec.Scope)
+	}
+}
+
+func TestFlowTableFull(t *testing.T) {
+	// One flow per shard
+	table := NewFlowTable(time.Minute, flowShards, nil)
+
+	tracked, refused := 0, []PayLoadTc{}
+	for i := range 1000 {
+		p := tcpPacket(0x0200000a, uint16(20000+i), 0x02)
+		rec := table.Update(p)
+		if rec.Refused {
+			if rec.isNew() {
+				t.Fatalf("refused record %+v counts as a new flow", rec)
+			}
+			refused = append(refused, p)
+			continue
+		}
+		if !rec.isNew() {
+			t.Fatalf("first packet of a tracked flow %+v isn't new", rec)
+		}
+		tracked++
+	}
+	if tracked != flowShards || table.Len() != flowShards {
+		t.Fatalf("%d flows tracked, table holds %d, want %d", tracked, table.Len(), flowShards)
+	}
+	if table.Refused() != uint64(len(refused)) {
+		t.Errorf("Refused() = %d, want %d", table.Refused(), len(refused))
+	}
+
+	// Later packets of a refused connection never look like a new flow
+	for range 3 {
+		rec := table.Update(refused[0])
+		if !rec.Refused || rec.Packets != 1 || rec.isNew() {
+			t.Fatalf("repeated refused packet %+v", rec)
+		}
+	}
+
+	// Established flows keep being accounted
+	var established PayLoadTc
+	for _, f := range table.Active() {
+		established = tcpPacket(f.Key.SrcIP, f.Key.SrcPort, 0x10)
+		break
+	}
+	if rec := table.Update(established); rec.Refused || rec.Packets != 2 {
+		t.Errorf("tracked flow refused once the table was full: %+v", rec)
+	}
+}
+
+func TestFlowTableSweep(t *testing.T) {
+	var exported []FlowRecord
+	table := NewFlowTable(time.Minute, 0, func(r FlowRecord) { exported = append(exported, r) })
+	table.Update(tcpPacket(0x0200000a, 40000, 0x02))
+	table.Update(tcpPacket(0x0200000a, 40001, 0x02))
+	table.Update(tcpPacket(0x0200000a, 40001, 0x04)) // RST
+
+	now := time.Now()
+	table.sweep(now.Add(2 * time.Second))
+	if len(exported) != 1 || exported[0].Key.SrcPort != 40001 {
+		t.Fatalf("exported %v, want the closed flow only", exported)
+	}
+	table.sweep(now.Add(2 * time.Minute))
+	if len(exported) != 2 || table.Len() != 0 {
+		t.Errorf("idle flow not exported: %v", exported)
+	}
+}
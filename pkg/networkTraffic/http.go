@@ -0,0 +1,312 @@
+package network
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// maxPendingHTTP bounds the pipelined requests remembered per connection.
+	maxPendingHTTP = 16
+	// maxHTTPConnections bounds the connections with requests waiting for
+	// a response.
+	maxHTTPConnections = 65536
+	// httpEvictSample is how many connections are looked at to find an old
+	// one to make room.
+	httpEvictSample = 8
+	// l7Snaplen is L7_SNAPLEN in tc.c, the payload bytes captured per
+	// packet.
+	l7Snaplen = 512
+)
+
+var httpMethods = [][]byte{
+	[]byte("GET "), []byte("POST "), []byte("PUT "), []byte("DELETE "),
+	[]byte("HEAD "), []byte("OPTIONS "), []byte("PATCH "), []byte("CONNECT "),
+	[]byte("TRACE "),
+}
+
+// HTTPEvent describes one HTTP/1.x exchange on a connection. Status is 0 when
+// no response was seen before the request timed out.
+type HTTPEvent struct {
+	Time      time.Time `json:"time"`
+	Iface     string    `json:"iface"`
+	Client    string    `json:"client"`
+	Server    string    `json:"server"`
+	Method    string    `json:"method"`
+	Host      string    `json:"host,omitempty"`
+	Path      string    `json:"path"`
+	Status    int       `json:"status"`
+	LatencyMs float64   `json:"latency_ms,omitempty"`
+}
+
+func (h HTTPEvent) String() string {
+	status, latency := "-", "-"
+	if h.Status != 0 {
+		status = strconv.Itoa(h.Status)
+		latency = fmt.Sprintf("%.3fms", h.LatencyMs)
+	}
+	return fmt.Sprintf("HTTP %s %s%s -> %s (%s) | client=%s server=%s | iface=%s",
+		h.Method, h.Host, h.Path, status, latency, h.Client, h.Server, h.Iface)
+}
+
+// HTTPStats counts the requests the tracker couldn't follow.
+type HTTPStats struct {
+	Pending int
+	// Evicted requests were forgotten to make room for newer connections.
+	Evicted uint64
+	// Truncated request lines were cut off by the capture before the HTTP
+	// version, their path is incomplete.
+	Truncated uint64
+}
+
+type pendingRequest struct {
+	event HTTPEvent
+	tsNs  uint64
+	seen  time.Time
+}
+
+// HTTPTracker parses HTTP/1.x request and status lines from captured payload
+// prefixes and pairs responses with requests on the same connection.
+type HTTPTracker struct {
+	mu          sync.Mutex
+	pending     map[FlowKey][]pendingRequest
+	maxConns    int
+	maxPath     int
+	redactQuery bool
+	timeout     time.Duration
+	emit        func(HTTPEvent)
+
+	evicted   atomic.Uint64
+	truncated atomic.Uint64
+}
+
+func NewHTTPTracker(maxPath int, redactQuery bool, timeout time.Duration, emit func(HTTPEvent)) *HTTPTracker {
+	return &HTTPTracker{
+		pending:     make(map[FlowKey][]pendingRequest),
+		maxConns:    maxHTTPConnections,
+		maxPath:     maxPath,
+		redactQuery: redactQuery,
+		timeout:     timeout,
+		emit:        emit,
+	}
+}
+
+// Observe inspects a TCP payload prefix for a request or a status line.
+func (h *HTTPTracker) Observe(event PayLoadTc) {
+	payload := event.Payload
+	if len(payload) == 0 {
+		return
+	}
+
+	if bytes.HasPrefix(payload, []byte("HTTP/1.")) {
+		h.observeResponse(event)
+		return
+	}
+	for _, m := range httpMethods {
+		if bytes.HasPrefix(payload, m) {
+			h.observeRequest(event)
+			return
+		}
+	}
+}
+
+func (h *HTTPTracker) observeRequest(event PayLoadTc) {
+	e := event.Event
+	line, rest := splitLine(event.Payload)
+
+	// METHOD SP request-target SP HTTP-version
+	parts := bytes.Split(line, []byte(" "))
+	switch {
+	case len(parts) == 3 && bytes.HasPrefix(parts[2], []byte("HTTP/1.")):
+	case len(parts) == 2 && rest == nil && len(event.Payload) >= l7Snaplen:
+		// A long target filled the capture before the version
+		h.truncated.Add(1)
+	default:
+		return
+	}
+
+	req := pendingRequest{
+		tsNs: e.Timestamp,
+		seen: time.Now(),
+		event: HTTPEvent{
+			Iface:  event.Iface,
+			Client: fmt.Sprintf("%s:%d", intToIP(e.SrcIP), e.SrcPort),
+			Server: fmt.Sprintf("%s:%d", intToIP(e.DstIP), e.DstPort),
+			Method: string(parts[0]),
+			Host:   headerValue(rest, "host"),
+			Path:   h.cleanPath(string(parts[1])),
+		},
+	}
+
+	key := flowKeyFromEvent(e)
+	h.mu.Lock()
+	queue, ok := h.pending[key]
+	if !ok && len(h.pending) >= h.maxConns {
+		h.evictLocked()
+	}
+	if len(queue) >= maxPendingHTTP {
+		queue = queue[1:]
+		h.evicted.Add(1)
+	}
+	h.pending[key] = append(queue, req)
+	h.mu.Unlock()
+}
+
+// evictLocked forgets the connection with the oldest request among a few
+// picked at random, map iteration order being random.
+func (h *HTTPTracker) evictLocked() {
+	var oldest FlowKey
+	var oldestSeen time.Time
+	n := 0
+	for key, queue := range h.pending {
+		if n == 0 || queue[0].seen.Before(oldestSeen) {
+			oldest, oldestSeen = key, queue[0].seen
+		}
+		if n++; n == httpEvictSample {
+			break
+		}
+	}
+	h.evicted.Add(uint64(len(h.pending[oldest])))
+	delete(h.pending, oldest)
+}
+
+func (h *HTTPTracker) Stats() HTTPStats {
+	h.mu.Lock()
+	pending := 0
+	for _, queue := range h.pending {
+		pending += len(queue)
+	}
+	h.mu.Unlock()
+	return HTTPStats{Pending: pending, Evicted: h.evicted.Load(), Truncated: h.truncated.Load()}
+}
+
+func (h *HTTPTracker) observeResponse(event PayLoadTc) {
+	e := event.Event
+	line, _ := splitLine(event.Payload)
+
+	// HTTP-version SP status-code SP reason-phrase
+	parts := bytes.SplitN(line, []byte(" "), 3)
+	if len(parts) < 2 {
+		return
+	}
+	status, err := strconv.Atoi(string(parts[1]))
+	// 1xx responses are followed by the final one, keep waiting for it
+	if err != nil || status < 200 || status > 999 {
+		return
+	}
+
+	key := flowKeyFromEvent(e).reverse()
+	h.mu.Lock()
+	queue := h.pending[key]
+	if len(queue) == 0 {
+		h.mu.Unlock()
+		return
+	}
+	req := queue[0]
+	if len(queue) == 1 {
+		delete(h.pending, key)
+	} else {
+		h.pending[key] = queue[1:]
+	}
+	h.mu.Unlock()
+
+	out := req.event
+	out.Time = time.Now()
+	out.Status = status
+	if e.Timestamp > req.tsNs {
+		out.LatencyMs = float64(e.Timestamp-req.tsNs) / float64(time.Millisecond)
+	}
+	h.emit(out)
+}
+
+// Run emits requests that never got a response until ctx is cancelled.
+func (h *HTTPTracker) Run(ctx context.Context) {
+	ticker := time.NewTicker(h.timeout)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			h.expire()
+		}
+	}
+}
+
+func (h *HTTPTracker) expire() {
+	now := time.Now()
+	var stale []HTTPEvent
+
+	h.mu.Lock()
+	for key, queue := range h.pending {
+		keep := queue[:0]
+		for _, req := range queue {
+			if now.Sub(req.seen) < h.timeout {
+				keep = append(keep, req)
+				continue
+			}
+			ev := req.event
+			ev.Time = now
+			stale = append(stale, ev)
+		}
+		if len(keep) == 0 {
+			delete(h.pending, key)
+		} else {
+			h.pending[key] = keep
+		}
+	}
+	h.mu.Unlock()
+
+	for _, ev := range stale {
+		h.emit(ev)
+	}
+}
+
+// cleanPath redacts the query string and bounds the length of a request
+// target.
+func (h *HTTPTracker) cleanPath(path string) string {
+	if h.redactQuery {
+		if i := strings.IndexByte(path, '?'); i >= 0 {
+			path = path[:i] + "?REDACTED"
+		}
+	}
+	if h.maxPath > 0 && len(path) > h.maxPath {
+		path = path[:h.maxPath]
+	}
+	return path
+}
+
+func splitLine(b []byte) (line, rest []byte) {
+	i := bytes.Index(b, []byte("\r\n"))
+	if i < 0 {
+		return b, nil
+	}
+	return b[:i], b[i+2:]
+}
+
+// headerValue returns the value of the named header from the captured part
+// of a header block.
+func headerValue(headers []byte, name string) string {
+	for len(headers) > 0 {
+		var line []byte
+		line, headers = splitLine(headers)
+		if len(line) == 0 {
+			break
+		}
+		colon := bytes.IndexByte(line, ':')
+		if colon < 0 {
+			continue
+		}
+		if bytes.EqualFold(bytes.TrimSpace(line[:colon]), []byte(name)) {
+			return string(bytes.TrimSpace(line[colon+1:]))
+		}
+	}
+	return ""
+}
@@ -0,0 +1,133 @@
+package network
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+// httpPacket is a packet of the connection from 10.0.0.2:port to
+// 10.0.0.1:80, or back when response is set.
+func httpPacket(port uint16, response bool, tsNs uint64, payload string) PayLoadTc {
+	e := Event{SrcIP: 0x0200000a, DstIP: 0x0100000a, SrcPort: port, DstPort: 80, Protocol: 6, Timestamp: tsNs}
+	if response {
+		e.SrcIP, e.DstIP, e.SrcPort, e.DstPort = e.DstIP, e.SrcIP, e.DstPort, e.SrcPort
+	}
+	return PayLoadTc{Event: e, Iface: "eth0", Payload: []byte(payload)}
+}
+
+func newTestHTTPTracker(redact bool) (*HTTPTracker, *[]HTTPEvent) {
+	var events []HTTPEvent
+	return NewHTTPTracker(32, redact, time.Minute, func(e HTTPEvent) { events = append(events, e) }), &events
+}
+
+func TestHTTPExchange(t *testing.T) {
+	h, events := newTestHTTPTracker(true)
+	h.Observe(httpPacket(40000, false, 1e9, "GET /search?q=secret HTTP/1.1\r\nAccept: */*\r\nhost:  example.com \r\n\r\n"))
+	h.Observe(httpPacket(40000, true, 1e9+2.5e6, "HTTP/1.1 200 OK\r\nContent-Length: 0\r\n\r\n"))
+
+	if len(*events) != 1 {
+		t.Fatalf("%d events, want 1", len(*events))
+	}
+	e := (*events)[0]
+	if e.Method != "GET" || e.Host != "example.com" || e.Path != "/search?REDACTED" || e.Status != 200 ||
+		e.LatencyMs != 2.5 || e.Client != "10.0.0.2:40000" || e.Server != "10.0.0.1:80" {
+		t.Errorf("event %+v", e)
+	}
+	if h.Stats().Pending != 0 {
+		t.Errorf("answered request still pending")
+	}
+}
+
+func TestHTTPPipelining(t *testing.T) {
+	h, events := newTestHTTPTracker(false)
+	h.Observe(httpPacket(40000, false, 1, "GET /a HTTP/1.1\r\n\r\n"))
+	h.Observe(httpPacket(40000, false, 2, "POST /b HTTP/1.1\r\n\r\n"))
+	// An interim response doesn't answer a request
+	h.Observe(httpPacket(40000, true, 3, "HTTP/1.1 100 Continue\r\n\r\n"))
+	h.Observe(httpPacket(40000, true, 4, "HTTP/1.1 404 Not Found\r\n\r\n"))
+	h.Observe(httpPacket(40000, true, 5, "HTTP/1.0 500\r\n\r\n"))
+	// Nothing left to answer
+	h.Observe(httpPacket(40000, true, 6, "HTTP/1.1 200 OK\r\n\r\n"))
+
+	if len(*events) != 2 || (*events)[0].Path != "/a" || (*events)[0].Status != 404 ||
+		(*events)[1].Method != "POST" || (*events)[1].Status != 500 {
+		t.Errorf("events %+v", *events)
+	}
+}
+
+func TestHTTPNotParsed(t *testing.T) {
+	h, events := newTestHTTPTracker(false)
+	for _, payload := range []string{
+		"",
+		"GETTING / HTTP/1.1\r\n",
+		"GET / HTTP/2.0\r\n",
+		"GET /a b HTTP/1.1\r\n",
+		"GET /\r\n",
+		"\x16\x03\x01\x00\x05hello",
+	} {
+		h.Observe(httpPacket(40000, false, 1, payload))
+	}
+	for _, payload := range []string{"HTTP/1.1\r\n", "HTTP/1.1 OK\r\n", "HTTP/1.1 1000 Huge\r\n"} {
+		h.Observe(httpPacket(40000, true, 2, payload))
+	}
+	if st := h.Stats(); st.Pending != 0 || len(*events) != 0 {
+		t.Errorf("garbage parsed: %+v %+v", st, *events)
+	}
+}
+
+func TestHTTPLongPath(t *testing.T) {
+	h, events := newTestHTTPTracker(false)
+	// The request line fills the whole capture, the version is lost
+	long := "GET /" + strings.Repeat("x", l7Snaplen)
+	h.Observe(httpPacket(40000, false, 1, long[:l7Snaplen]))
+	// A short packet without the version is not a request line
+	h.Observe(httpPacket(40001, false, 1, "GET /partial"))
+
+	st := h.Stats()
+	if st.Truncated != 1 || st.Pending != 1 {
+		t.Fatalf("stats %+v", st)
+	}
+	h.Observe(httpPacket(40000, true, 2, "HTTP/1.1 414 URI Too Long\r\n\r\n"))
+	if len(*events) != 1 || len((*events)[0].Path) != 32 || (*events)[0].Status != 414 {
+		t.Errorf("events %+v", *events)
+	}
+}
+
+func TestHTTPBounds(t *testing.T) {
+	h, _ := newTestHTTPTracker(false)
+	h.maxConns = 4
+
+	// Pipelined requests beyond the per connection limit push out the oldest
+	for i := range maxPendingHTTP + 2 {
+		h.Observe(httpPacket(40000, false, uint64(i), "GET / HTTP/1.1\r\n\r\n"))
+	}
+	if st := h.Stats(); st.Pending != maxPendingHTTP || st.Evicted != 2 {
+		t.Fatalf("stats %+v", st)
+	}
+
+	// New connections beyond the limit evict whole connections
+	for port := range uint16(10) {
+		h.Observe(httpPacket(50000+port, false, 1, "GET / HTTP/1.1\r\n\r\n"))
+	}
+	h.mu.Lock()
+	conns := len(h.pending)
+	h.mu.Unlock()
+	st := h.Stats()
+	if conns != 4 {
+		t.Errorf("%d connections tracked, want 4", conns)
+	}
+	if st.Pending+int(st.Evicted) != maxPendingHTTP+2+10 {
+		t.Errorf("stats %+v, requests lost without being counted", st)
+	}
+}
+
+func TestHTTPExpire(t *testing.T) {
+	h, events := newTestHTTPTracker(false)
+	h.timeout = 0
+	h.Observe(httpPacket(40000, false, 1, "DELETE /item/7 HTTP/1.1\r\n\r\n"))
+	h.expire()
+	if len(*events) != 1 || (*events)[0].Status != 0 || h.Stats().Pending != 0 {
+		t.Errorf("unanswered request not emitted: %+v", *events)
+	}
+}
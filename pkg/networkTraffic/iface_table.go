@@ -3,6 +3,7 @@ package network
 import (
 	"fmt"
 	"kernelKoala/internal/logger"
+	"kernelKoala/pkg/geoip"
 	"os"
 	"sync"
 
@@ -14,7 +15,7 @@ type ifaceTablePrinter struct {
 	chEvent   chan PayLoadTc
 	app       *tview.Application
 	table     *tview.Table
-	tableData map[string][]Event
+	tableData map[string][]PayLoadTc
 	mapLock   sync.RWMutex
 	layout    *tview.Flex
 	header    *tview.TextView
@@ -24,7 +25,7 @@ type ifaceTablePrinter struct {
 func (i *ifaceTablePrinter) InitUI() {
 	i.chEvent = make(chan PayLoadTc, 100)
 	i.app = tview.NewApplication()
-	i.tableData = make(map[string][]Event)
+	i.tableData = make(map[string][]PayLoadTc)
 
 	_, _ = os.Hostname()
 	i.header = tview.NewTextView()
@@ -47,7 +48,7 @@ func (i *ifaceTablePrinter) forward() {
 	for ev := range i.chEvent {
 		i.mapLock.Lock()
 		logger.Info("%s", ev.Iface)
-		i.tableData[ev.Iface] = append(i.tableData[ev.Iface], ev.Event)
+		i.tableData[ev.Iface] = append(i.tableData[ev.Iface], ev)
 		if len(i.tableData[ev.Iface]) > 10 {
 			i.tableData[ev.Iface] = i.tableData[ev.Iface][len(i.tableData[ev.Iface])-10:]
 		}
@@ -61,7 +62,7 @@ func (i *ifaceTablePrinter) updateTable() {
 	i.table.Clear()
 
 	// Table Header
-	headers := []string{"Iface", "Protocol", "Direction", "Source", "Src Port", "Destination", "Dst Port", "Flags"}
+	headers := []string{"Iface", "Protocol", "Direction", "Source", "Src Port", "Destination", "Dst Port", "Flags", "Src Geo", "Dst Geo"}
 	for j, h := range headers {
 		i.table.SetCell(0, j, tview.NewTableCell(fmt.Sprintf("[::b]%s", h)).
 			SetTextColor(tcell.ColorLightCyan).
@@ -72,7 +73,8 @@ func (i *ifaceTablePrinter) updateTable() {
 	// Fill rows
 	row := 1
 	for iface, events := range i.tableData {
-		for _, e := range events {
+		for _, ev := range events {
+			e := ev.Event
 			dir := "Ingress"
 			if e.Direction == 1 {
 				dir = "Egress"
@@ -90,11 +92,20 @@ func (i *ifaceTablePrinter) updateTable() {
 			i.table.SetCell(row, 5, tview.NewTableCell(dst))
 			i.table.SetCell(row, 6, tview.NewTableCell(fmt.Sprintf("%d", e.DstPort)))
 			i.table.SetCell(row, 7, tview.NewTableCell(flags))
+			i.table.SetCell(row, 8, tview.NewTableCell(geoCell(ev.SrcGeo)))
+			i.table.SetCell(row, 9, tview.NewTableCell(geoCell(ev.DstGeo)))
 			row++
 		}
 	}
 }
 
+func geoCell(info *geoip.Info) string {
+	if info == nil {
+		return "-"
+	}
+	return info.String()
+}
+
 func protocolName(proto uint8) string {
 	switch proto {
 	case 6:
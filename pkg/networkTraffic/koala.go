@@ -0,0 +1,31 @@
+package network
+
+import "kernelKoala/pkg/koala"
+
+// koalaFlow is the form an exported flow is shipped to the Koala Server in.
+func koalaFlow(rec FlowRecord) koala.Flow {
+	f := koala.Flow{
+		Protocol:  protocolName(rec.Key.Protocol),
+		SrcIP:     intToIP(rec.Key.SrcIP).String(),
+		SrcName:   nameOrEmpty(rec.SrcName),
+		SrcPort:   rec.Key.SrcPort,
+		DstIP:     intToIP(rec.Key.DstIP).String(),
+		DstName:   nameOrEmpty(rec.DstName),
+		DstPort:   rec.Key.DstPort,
+		Iface:     rec.Iface,
+		Scope:     rec.Scope,
+		FirstSeen: rec.FirstSeen,
+		LastSeen:  rec.LastSeen,
+		Packets:   rec.Packets,
+		Bytes:     rec.Bytes,
+		TCPFlags:  tcpFlagNames(rec.TcpFlags),
+		Closed:    rec.Closed,
+		SrcGeo:    rec.SrcGeo,
+		DstGeo:    rec.DstGeo,
+	}
+	if rec.TLS != nil {
+		f.SNI = rec.TLS.SNI
+		f.JA3 = rec.TLS.JA3
+	}
+	return f
+}
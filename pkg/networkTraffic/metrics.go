@@ -0,0 +1,355 @@
+package network
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// maxTrackedPorts bounds the per-port counters of one worker, ports seen
+// after it is full are counted as "other".
+const maxTrackedPorts = 1024
+
+type trafficKey struct {
+	iface     string
+	direction uint8
+	protocol  uint8
+}
+
+type portKey struct {
+	protocol uint8
+	port     uint16
+}
+
+type counter struct {
+	packets uint64
+	bytes   uint64
+}
+
+// value returns the packets or bytes count by metric name.
+func (c *counter) value(metric string) float64 {
+	if metric == "bytes" {
+		return float64(c.bytes)
+	}
+	return float64(c.packets)
+}
+
+// trafficCounters is owned by one worker, the mutex is only contended by
+// scrapes.
+type trafficCounters struct {
+	mu      sync.Mutex
+	traffic map[trafficKey]*counter
+	ports   map[portKey]*counter
+	other   map[uint8]*counter
+}
+
+func newTrafficCounters() *trafficCounters {
+	return &trafficCounters{
+		traffic: make(map[trafficKey]*counter),
+		ports:   make(map[portKey]*counter),
+		other:   make(map[uint8]*counter),
+	}
+}
+
+func (t *trafficCounters) add(event PayLoadTc) {
+	e := event.Event
+	size := uint64(e.PktLen)
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	key := trafficKey{iface: event.Iface, direction: e.Direction, protocol: e.Protocol}
+	c := t.traffic[key]
+	if c == nil {
+		c = &counter{}
+		t.traffic[key] = c
+	}
+	c.packets++
+	c.bytes += size
+
+	if e.Protocol != 6 && e.Protocol != 17 {
+		return
+	}
+	port := e.DstPort
+	if e.SrcPort < port {
+		port = e.SrcPort
+	}
+	pk := portKey{protocol: e.Protocol, port: port}
+	c = t.ports[pk]
+	if c == nil {
+		if len(t.ports) >= maxTrackedPorts {
+			if c = t.other[e.Protocol]; c == nil {
+				c = &counter{}
+				t.other[e.Protocol] = c
+			}
+		} else {
+			c = &counter{}
+			t.ports[pk] = c
+		}
+	}
+	c.packets++
+	c.bytes += size
+}
+
+// mergeInto adds the counters to the totals of all workers.
+func (t *trafficCounters) mergeInto(traffic map[trafficKey]*counter, ports map[portKey]*counter, other map[uint8]*counter) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for k, c := range t.traffic {
+		addCounter(traffic, k, c)
+	}
+	for k, c := range t.ports {
+		addCounter(ports, k, c)
+	}
+	for k, c := range t.other {
+		addCounter(other, k, c)
+	}
+}
+
+func addCounter[K comparable](m map[K]*counter, k K, c *counter) {
+	sum := m[k]
+	if sum == nil {
+		sum = &counter{}
+		m[k] = sum
+	}
+	sum.packets += c.packets
+	sum.bytes += c.bytes
+}
+
+// metricsWriter writes the Prometheus text exposition format.
+type metricsWriter struct {
+	w *bufio.Writer
+}
+
+func (m metricsWriter) header(name, typ, help string) {
+	fmt.Fprintf(m.w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+}
+
+// sample writes one value, labels are name/value pairs.
+func (m metricsWriter) sample(name string, value float64, labels ...string) {
+	m.w.WriteString(name)
+	if len(labels) > 0 {
+		m.w.WriteByte('{')
+		for i := 0; i+1 < len(labels); i += 2 {
+			if i > 0 {
+				m.w.WriteByte(',')
+			}
+			fmt.Fprintf(m.w, "%s=\"%s\"", labels[i], escapeLabel(labels[i+1]))
+		}
+		m.w.WriteByte('}')
+	}
+	m.w.WriteByte(' ')
+	m.w.WriteString(strconv.FormatFloat(value, 'g', -1, 64))
+	m.w.WriteByte('\n')
+}
+
+func (m metricsWriter) single(name, typ, help string, value float64) {
+	m.header(name, typ, help)
+	m.sample(name, value)
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func escapeLabel(s string) string { return labelEscaper.Replace(s) }
+
+// writeMetrics renders the agent health and traffic metrics.
+func (nc *NetworkCapture) writeMetrics(out io.Writer) error {
+	m := metricsWriter{bufio.NewWriter(out)}
+
+	m.single("kernelkoala_packets_processed_total", "counter", "Packets decoded by the workers.",
+		float64(atomic.LoadUint64(&nc.stats.PacketsProcessed)))
+	m.single("kernelkoala_packets_dropped_total", "counter", "Packets lost in the kernel buffers or dropped in user space.",
+		float64(atomic.LoadUint64(&nc.stats.PacketsDropped)))
+	m.single("kernelkoala_lost_samples_total", "counter", "Samples the kernel could not write to the perf buffers.",
+		float64(atomic.LoadUint64(&nc.stats.LostSamples)))
+	m.single("kernelkoala_worker_queue_full_total", "counter", "Packets dropped because a worker queue was full.",
+		float64(atomic.LoadUint64(&nc.stats.WorkerQueueFull)))
+	m.single("kernelkoala_event_queue_depth", "gauge", "Packets waiting for the dispatcher.", float64(len(nc.eventChan)))
+
+	m.header("kernelkoala_worker_queue_depth", "gauge", "Packets queued per worker.")
+	for _, w := range nc.workers {
+		m.sample("kernelkoala_worker_queue_depth", float64(len(w.jobChan)), "worker", strconv.Itoa(w.id))
+	}
+
+	if nc.dnsResolver.enabled {
+		cs := nc.dnsResolver.CacheStats()
+		rs := nc.names.Stats()
+		m.single("kernelkoala_dns_cache_entries", "gauge", "Names held in the DNS cache.", float64(cs.Size))
+		m.single("kernelkoala_dns_cache_hits_total", "counter", "DNS cache hits.", float64(cs.Hits))
+		m.single("kernelkoala_dns_cache_misses_total", "counter", "DNS cache misses.", float64(cs.Misses))
+		m.single("kernelkoala_dns_cache_evictions_total", "counter", "DNS cache evictions.", float64(cs.Evictions))
+		m.single("kernelkoala_dns_lookups_total", "counter", "Reverse DNS lookups performed.", float64(rs.Lookups))
+		m.single("kernelkoala_dns_lookup_queue_depth", "gauge", "Reverse DNS lookups waiting.", float64(rs.QueueDepth))
+	}
+	if nc.http != nil {
+		hs := nc.http.Stats()
+		m.single("kernelkoala_http_pending_requests", "gauge", "HTTP requests waiting for a response.", float64(hs.Pending))
+		m.single("kernelkoala_http_evicted_total", "counter", "HTTP requests forgotten to bound the tracker.", float64(hs.Evicted))
+		m.single("kernelkoala_http_truncated_total", "counter", "HTTP request lines cut off by the capture.", float64(hs.Truncated))
+	}
+	if nc.intel != nil {
+		m.single("kernelkoala_threat_matches_total", "counter", "Flows touching threat intel indicators.",
+			float64(atomic.LoadUint64(&nc.stats.ThreatMatches)))
+	}
+	if nc.policy != nil {
+		m.single("kernelkoala_policy_dropped_total", "counter", "Packets dropped by the deny policy.",
+			float64(atomic.LoadUint64(&nc.stats.PolicyDropped)))
+		m.single("kernelkoala_policy_would_drop_total", "counter", "Packets the deny policy would drop in dry-run mode.",
+			float64(atomic.LoadUint64(&nc.stats.PolicyWouldDrop)))
+	}
+	if nc.alerting != nil {
+		as := nc.alerting.Stats()
+		m.single("kernelkoala_alerts_raised_total", "counter", "Alerts raised.", float64(as.Raised))
+		m.single("kernelkoala_alerts_suppressed_total", "counter", "Alerts suppressed as duplicates.", float64(as.Suppressed))
+		m.single("kernelkoala_alert_deliveries_failed_total", "counter", "Failed alert deliveries.", float64(as.Failed))
+	}
+
+	t := nc.trafficTotals()
+	for _, metric := range []string{"packets", "bytes"} {
+		name := "kernelkoala_traffic_" + metric + "_total"
+		m.header(name, "counter", "Captured "+metric+" by interface, direction and protocol.")
+		for _, k := range t.trafficKeys {
+			m.sample(name, t.traffic[k].value(metric), "iface", k.iface,
+				"direction", strings.ToLower(directionName(k.direction)), "protocol", protocolName(k.protocol))
+		}
+	}
+
+	for _, metric := range []string{"packets", "bytes"} {
+		name := "kernelkoala_port_" + metric + "_total"
+		m.header(name, "counter", fmt.Sprintf("Captured %s of the first %d service ports seen, the rest as port \"other\".",
+			metric, nc.config.MetricsTopN))
+		for _, k := range t.portKeys {
+			m.sample(name, t.ports[k].value(metric), "protocol", protocolName(k.protocol), "port", strconv.Itoa(int(k.port)))
+		}
+		for _, p := range t.protocols {
+			m.sample(name, t.other[p].value(metric), "protocol", protocolName(p), "port", "other")
+		}
+	}
+	return m.w.Flush()
+}
+
+// trafficTotals is the sum of the traffic counters of all workers, with
+// sorted keys.
+type trafficTotals struct {
+	traffic     map[trafficKey]*counter
+	trafficKeys []trafficKey
+	ports       map[portKey]*counter
+	portKeys    []portKey
+	other       map[uint8]*counter
+	protocols   []uint8
+}
+
+// trafficTotals merges the worker counters. Only MetricsTopN ports keep
+// their own series, the rest are summed up per protocol, so the series
+// count stays bounded.
+func (nc *NetworkCapture) trafficTotals() trafficTotals {
+	t := trafficTotals{
+		traffic: make(map[trafficKey]*counter),
+		ports:   make(map[portKey]*counter),
+		other:   make(map[uint8]*counter),
+	}
+	for _, w := range nc.workers {
+		w.traffic.mergeInto(t.traffic, t.ports, t.other)
+	}
+
+	for k := range t.traffic {
+		t.trafficKeys = append(t.trafficKeys, k)
+	}
+	sort.Slice(t.trafficKeys, func(i, j int) bool {
+		a, b := t.trafficKeys[i], t.trafficKeys[j]
+		if a.iface != b.iface {
+			return a.iface < b.iface
+		}
+		if a.direction != b.direction {
+			return a.direction < b.direction
+		}
+		return a.protocol < b.protocol
+	})
+
+	exported := nc.exportedPorts(t.ports)
+	keys := make([]portKey, 0, len(exported))
+	for k, c := range t.ports {
+		if exported[k] {
+			keys = append(keys, k)
+		} else {
+			addCounter(t.other, k.protocol, c)
+		}
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].protocol != keys[j].protocol {
+			return keys[i].protocol < keys[j].protocol
+		}
+		return keys[i].port < keys[j].port
+	})
+	t.portKeys = keys
+
+	for p := range t.other {
+		t.protocols = append(t.protocols, p)
+	}
+	sort.Slice(t.protocols, func(i, j int) bool { return t.protocols[i] < t.protocols[j] })
+	return t
+}
+
+// exportedPorts returns the ports with series of their own. Ports join
+// while there is room, the busiest first, and never leave, so a port is
+// either always summed up as "other" or never, and no counter goes down.
+func (nc *NetworkCapture) exportedPorts(ports map[portKey]*counter) map[portKey]bool {
+	nc.portsMu.Lock()
+	defer nc.portsMu.Unlock()
+	if nc.metricPorts == nil {
+		nc.metricPorts = make(map[portKey]bool)
+	}
+	if len(nc.metricPorts) >= nc.config.MetricsTopN {
+		return nc.metricPorts
+	}
+
+	var candidates []portKey
+	for k := range ports {
+		if !nc.metricPorts[k] {
+			candidates = append(candidates, k)
+		}
+	}
+	sort.Slice(candidates, func(i, j int) bool {
+		a, b := ports[candidates[i]], ports[candidates[j]]
+		if a.bytes != b.bytes {
+			return a.bytes > b.bytes
+		}
+		return candidates[i].port < candidates[j].port
+	})
+	for _, k := range candidates[:min(nc.config.MetricsTopN-len(nc.metricPorts), len(candidates))] {
+		nc.metricPorts[k] = true
+	}
+	return nc.metricPorts
+}
+
+// serveMetrics serves /metrics on config.MetricsAddr until ctx is done.
+func (nc *NetworkCapture) serveMetrics(ctx context.Context) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		if err := nc.writeMetrics(w); err != nil {
+			nc.logger.Warn("failed to write metrics: %v", err)
+		}
+	})
+	srv := &http.Server{Addr: nc.config.MetricsAddr, Handler: mux, ReadHeaderTimeout: 5 * time.Second}
+
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		srv.Shutdown(shutdownCtx)
+	}()
+
+	nc.logger.Info("Serving metrics on %s/metrics", nc.config.MetricsAddr)
+	if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		nc.logger.Warn("metrics server failed: %v", err)
+	}
+}
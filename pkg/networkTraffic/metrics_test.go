@@ -0,0 +1,181 @@
+package network
+
+import (
+	"bufio"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// metricsCapture is a capture with one worker and nothing else set up.
+func metricsCapture(topN int) (*NetworkCapture, *PacketWorker) {
+	w := &PacketWorker{jobChan: make(chan PayLoadTc, 1), traffic: newTrafficCounters()}
+	nc := &NetworkCapture{
+		config:      &CaptureConfig{MetricsTopN: topN},
+		stats:       &Stats{PacketsProcessed: 42},
+		eventChan:   make(chan PayLoadTc, 1),
+		dnsResolver: &DNSResolver{},
+		workers:     []*PacketWorker{w},
+	}
+	return nc, w
+}
+
+func trafficPacket(iface string, direction uint8, dstPort uint16, size uint32) PayLoadTc {
+	return PayLoadTc{
+		Event: Event{
+			SrcIP: 0x0200000a, DstIP: 0x0100000a, SrcPort: 50000, DstPort: dstPort,
+			Protocol: 6, Direction: direction, PktLen: size,
+		},
+		Iface: iface,
+	}
+}
+
+// scrape renders the metrics and returns the samples by their line name,
+// labels included.
+func scrape(t *testing.T, nc *NetworkCapture) map[string]float64 {
+	t.Helper()
+	var b strings.Builder
+	if err := nc.writeMetrics(&b); err != nil {
+		t.Fatal(err)
+	}
+	samples := make(map[string]float64)
+	for _, line := range strings.Split(strings.TrimSpace(b.String()), "\n") {
+		if strings.HasPrefix(line, "#") {
+			continue
+		}
+		i := strings.LastIndexByte(line, ' ')
+		v, err := strconv.ParseFloat(line[i+1:], 64)
+		if err != nil {
+			t.Fatalf("bad sample line %q", line)
+		}
+		samples[line[:i]] = v
+	}
+	return samples
+}
+
+func TestWriteMetrics(t *testing.T) {
+	nc, w := metricsCapture(10)
+	w.traffic.add(trafficPacket("eth0", 0, 443, 100))
+	w.traffic.add(trafficPacket("eth0", 0, 443, 50))
+	w.traffic.add(trafficPacket("eth0", 1, 22, 60))
+
+	s := scrape(t, nc)
+	for name, want := range map[string]float64{
+		`kernelkoala_packets_processed_total`:                                                42,
+		`kernelkoala_worker_queue_depth{worker="0"}`:                                         0,
+		`kernelkoala_traffic_packets_total{iface="eth0",direction="ingress",protocol="TCP"}`: 2,
+		`kernelkoala_traffic_bytes_total{iface="eth0",direction="ingress",protocol="TCP"}`:   150,
+		`kernelkoala_traffic_bytes_total{iface="eth0",direction="egress",protocol="TCP"}`:    60,
+		`kernelkoala_port_bytes_total{protocol="TCP",port="443"}`:                            150,
+		`kernelkoala_port_packets_total{protocol="TCP",port="22"}`:                           1,
+	} {
+		if got, ok := s[name]; !ok || got != want {
+			t.Errorf("%s = %v (present %v), want %v", name, got, ok, want)
+		}
+	}
+	// Disabled subsystems export nothing
+	if _, ok := s["kernelkoala_dns_cache_entries"]; ok {
+		t.Error("DNS metrics without the resolver")
+	}
+}
+
+func TestMetricsFormat(t *testing.T) {
+	nc, w := metricsCapture(10)
+	w.traffic.add(trafficPacket("eth0", 0, 443, 100))
+	var b strings.Builder
+	nc.writeMetrics(&b)
+
+	// Every family has its HELP and TYPE before the samples
+	declared := make(map[string]bool)
+	for _, line := range strings.Split(strings.TrimSpace(b.String()), "\n") {
+		if f := strings.Fields(line); f[0] == "#" {
+			if f[1] == "TYPE" {
+				declared[f[2]] = true
+			}
+			continue
+		}
+		name, _, _ := strings.Cut(strings.Fields(line)[0], "{")
+		if !declared[name] {
+			t.Errorf("sample before its TYPE: %q", line)
+		}
+	}
+}
+
+func TestEscapeLabel(t *testing.T) {
+	for in, want := range map[string]string{
+		"eth0":        "eth0",
+		`C:\dev`:      `C:\\dev`,
+		`say "hi"`:    `say \"hi\"`,
+		"line\nbreak": `line\nbreak`,
+		"\\\"\n":      `\\\"\n`,
+	} {
+		if got := escapeLabel(in); got != want {
+			t.Errorf("escapeLabel(%q) = %s, want %s", in, got, want)
+		}
+	}
+
+	var b strings.Builder
+	m := metricsWriter{bufio.NewWriter(&b)}
+	m.sample("x", 1.5, "iface", `we"ird`, "n", "a\nb")
+	m.w.Flush()
+	if got := b.String(); got != "x{iface=\"we\\\"ird\",n=\"a\\nb\"} 1.5\n" {
+		t.Errorf("sample line %q", got)
+	}
+}
+
+// Port series are picked once: a port that falls out of the busiest never
+// loses its series and "other" never shrinks.
+func TestPortSeriesAreSticky(t *testing.T) {
+	nc, w := metricsCapture(2)
+	w.traffic.add(trafficPacket("eth0", 0, 443, 1000))
+	w.traffic.add(trafficPacket("eth0", 0, 80, 500))
+	w.traffic.add(trafficPacket("eth0", 0, 22, 100))
+
+	port := func(s map[string]float64, p string) float64 {
+		return s[`kernelkoala_port_bytes_total{protocol="TCP",port="`+p+`"}`]
+	}
+	first := scrape(t, nc)
+	if port(first, "443") != 1000 || port(first, "80") != 500 || port(first, "other") != 100 {
+		t.Fatalf("first scrape %v", first)
+	}
+
+	// 22 becomes the busiest port and 8080 shows up
+	for range 20 {
+		w.traffic.add(trafficPacket("eth0", 0, 22, 1000))
+	}
+	w.traffic.add(trafficPacket("eth0", 0, 8080, 10))
+	second := scrape(t, nc)
+	if _, ok := second[`kernelkoala_port_bytes_total{protocol="TCP",port="22"}`]; ok {
+		t.Error("port 22 got a series after it was summed up as other")
+	}
+	if port(second, "443") != 1000 || port(second, "80") != 500 {
+		t.Errorf("exported ports changed: %v", second)
+	}
+	if port(second, "other") != 100+20000+10 {
+		t.Errorf("other = %v, want every later byte of 22 and 8080", port(second, "other"))
+	}
+	for name, v := range first {
+		if second[name] < v {
+			t.Errorf("%s went down from %v to %v", name, v, second[name])
+		}
+	}
+
+	// The OTLP metrics use the same ports
+	for _, m := range nc.otlpMetrics() {
+		if m.Name != "kernelkoala.port.bytes" {
+			continue
+		}
+		if len(m.Points) != 3 {
+			t.Errorf("%d OTLP port points, want 443, 80 and other", len(m.Points))
+		}
+	}
+}
+
+func TestNoPortSeries(t *testing.T) {
+	nc, w := metricsCapture(0)
+	w.traffic.add(trafficPacket("eth0", 0, 443, 100))
+	s := scrape(t, nc)
+	if s[`kernelkoala_port_bytes_total{protocol="TCP",port="other"}`] != 100 {
+		t.Errorf("without port series all bytes are other: %v", s)
+	}
+}
@@ -0,0 +1,156 @@
+package network
+
+import (
+	"kernelKoala/pkg/alert"
+	"kernelKoala/pkg/otlp"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	logspb "go.opentelemetry.io/proto/otlp/logs/v1"
+)
+
+// transportName is the OpenTelemetry network.transport value.
+func transportName(proto uint8) string {
+	switch proto {
+	case 6:
+		return "tcp"
+	case 17:
+		return "udp"
+	default:
+		return strings.ToLower(protocolName(proto))
+	}
+}
+
+// ioDirection is the OpenTelemetry network.io.direction value.
+func ioDirection(direction uint8) string {
+	if direction == 1 {
+		return "transmit"
+	}
+	return "receive"
+}
+
+// flowLog turns an exported flow into a log record with semantic
+// convention attributes.
+func flowLog(rec FlowRecord) otlp.LogRecord {
+	attrs := []otlp.Attr{
+		otlp.String("event.name", "kernelkoala.flow"),
+		otlp.String("network.transport", transportName(rec.Key.Protocol)),
+		otlp.String("network.type", "ipv4"),
+		otlp.String("source.address", intToIP(rec.Key.SrcIP).String()),
+		otlp.Int("source.port", int64(rec.Key.SrcPort)),
+		otlp.String("destination.address", intToIP(rec.Key.DstIP).String()),
+		otlp.Int("destination.port", int64(rec.Key.DstPort)),
+		otlp.String("network.interface.name", rec.Iface),
+		otlp.String("kernelkoala.scope", rec.Scope),
+		otlp.String("kernelkoala.source.name", nameOrEmpty(rec.SrcName)),
+		otlp.String("kernelkoala.destination.name", nameOrEmpty(rec.DstName)),
+		otlp.Int("kernelkoala.flow.packets", int64(rec.Packets)),
+		otlp.Int("kernelkoala.flow.bytes", int64(rec.Bytes)),
+		otlp.Int("kernelkoala.flow.duration_ms", rec.LastSeen.Sub(rec.FirstSeen).Milliseconds()),
+		otlp.Bool("kernelkoala.flow.closed", rec.Closed),
+	}
+	if rec.Key.Protocol == 6 {
+		attrs = append(attrs, otlp.String("kernelkoala.flow.tcp_flags", strings.Join(tcpFlagNames(rec.TcpFlags), "|")))
+	}
+	if rec.TLS != nil {
+		attrs = append(attrs,
+			otlp.String("tls.client.server_name", rec.TLS.SNI),
+			otlp.String("tls.protocol.version", rec.TLS.Version))
+		if rec.TLS.JA3 != "" {
+			attrs = append(attrs, otlp.String("tls.client.ja3", rec.TLS.JA3))
+		}
+	}
+	if rec.SrcGeo != nil {
+		attrs = append(attrs, otlp.String("kernelkoala.source.country", rec.SrcGeo.Country))
+	}
+	if rec.DstGeo != nil {
+		attrs = append(attrs, otlp.String("kernelkoala.destination.country", rec.DstGeo.Country))
+	}
+	return otlp.LogRecord{
+		Time:     rec.LastSeen,
+		Severity: logspb.SeverityNumber_SEVERITY_NUMBER_INFO,
+		Body:     rec.String(),
+		Attrs:    attrs,
+	}
+}
+
+// alertLog turns an alert into a log record, detector fields become
+// kernelkoala.alert.* attributes.
+func alertLog(a alert.Alert) otlp.LogRecord {
+	attrs := []otlp.Attr{
+		otlp.String("event.name", "kernelkoala.alert"),
+		otlp.String("kernelkoala.alert.type", a.Type),
+		otlp.String("kernelkoala.alert.severity", string(a.Severity)),
+		otlp.String("network.transport", strings.ToLower(a.Protocol)),
+		otlp.String("source.address", a.SrcIP),
+		otlp.String("destination.address", a.DstIP),
+		otlp.String("network.interface.name", a.Iface),
+	}
+	if a.SrcPort != 0 {
+		attrs = append(attrs, otlp.Int("source.port", int64(a.SrcPort)))
+	}
+	if a.DstPort != 0 {
+		attrs = append(attrs, otlp.Int("destination.port", int64(a.DstPort)))
+	}
+	for k, v := range a.Fields {
+		attrs = append(attrs, otlp.String("kernelkoala.alert."+k, v))
+	}
+
+	severity := logspb.SeverityNumber_SEVERITY_NUMBER_INFO
+	switch a.Severity {
+	case alert.SeverityLow, alert.SeverityMedium:
+		severity = logspb.SeverityNumber_SEVERITY_NUMBER_WARN
+	case alert.SeverityHigh:
+		severity = logspb.SeverityNumber_SEVERITY_NUMBER_ERROR
+	case alert.SeverityCritical:
+		severity = logspb.SeverityNumber_SEVERITY_NUMBER_FATAL
+	}
+	return otlp.LogRecord{Time: a.Time, Severity: severity, Body: a.Message, Attrs: attrs}
+}
+
+// otlpMetrics collects the agent and traffic counters for the exporter.
+func (nc *NetworkCapture) otlpMetrics() []otlp.Metric {
+	counter := func(name, desc, unit string, value uint64) otlp.Metric {
+		return otlp.Metric{Name: name, Description: desc, Unit: unit, Monotonic: true,
+			Points: []otlp.Point{{Value: int64(value)}}}
+	}
+	metrics := []otlp.Metric{
+		counter("kernelkoala.packets.processed", "Packets decoded by the workers.", "{packet}",
+			atomic.LoadUint64(&nc.stats.PacketsProcessed)),
+		counter("kernelkoala.packets.dropped", "Packets lost in the kernel buffers or dropped in user space.", "{packet}",
+			atomic.LoadUint64(&nc.stats.PacketsDropped)),
+		counter("kernelkoala.samples.lost", "Samples the kernel could not write to the perf buffers.", "{sample}",
+			atomic.LoadUint64(&nc.stats.LostSamples)),
+	}
+
+	t := nc.trafficTotals()
+	packets := otlp.Metric{Name: "kernelkoala.traffic.packets", Description: "Captured packets.", Unit: "{packet}", Monotonic: true}
+	bytes := otlp.Metric{Name: "kernelkoala.traffic.bytes", Description: "Captured bytes.", Unit: "By", Monotonic: true}
+	for _, k := range t.trafficKeys {
+		attrs := []otlp.Attr{
+			otlp.String("network.interface.name", k.iface),
+			otlp.String("network.io.direction", ioDirection(k.direction)),
+			otlp.String("network.transport", transportName(k.protocol)),
+		}
+		c := t.traffic[k]
+		packets.Points = append(packets.Points, otlp.Point{Attrs: attrs, Value: int64(c.packets)})
+		bytes.Points = append(bytes.Points, otlp.Point{Attrs: attrs, Value: int64(c.bytes)})
+	}
+
+	portBytes := otlp.Metric{Name: "kernelkoala.port.bytes", Description: "Captured bytes by service port, the first ports seen on their own, the rest as \"other\".",
+		Unit: "By", Monotonic: true}
+	for _, k := range t.portKeys {
+		portBytes.Points = append(portBytes.Points, otlp.Point{Value: int64(t.ports[k].bytes), Attrs: []otlp.Attr{
+			otlp.String("network.transport", transportName(k.protocol)),
+			otlp.String("kernelkoala.service.port", strconv.Itoa(int(k.port))),
+		}})
+	}
+	for _, p := range t.protocols {
+		portBytes.Points = append(portBytes.Points, otlp.Point{Value: int64(t.other[p].bytes), Attrs: []otlp.Attr{
+			otlp.String("network.transport", transportName(p)),
+			otlp.String("kernelkoala.service.port", "other"),
+		}})
+	}
+	return append(metrics, packets, bytes, portBytes)
+}
@@ -0,0 +1,149 @@
+package network
+
+import (
+	"kernelKoala/pkg/alert"
+	"kernelKoala/pkg/geoip"
+	"kernelKoala/pkg/otlp"
+	"testing"
+	"time"
+
+	logspb "go.opentelemetry.io/proto/otlp/logs/v1"
+)
+
+func attrValues(attrs []otlp.Attr) map[string]any {
+	m := make(map[string]any, len(attrs))
+	for _, a := range attrs {
+		m[a.Key] = a.Value
+	}
+	return m
+}
+
+func checkAttrs(t *testing.T, got []otlp.Attr, want map[string]any) {
+	t.Helper()
+	m := attrValues(got)
+	for k, v := range want {
+		if v == nil {
+			if _, ok := m[k]; ok {
+				t.Errorf("%s = %v, want it unset", k, m[k])
+			}
+			continue
+		}
+		if m[k] != v {
+			t.Errorf("%s = %v (%T), want %v (%T)", k, m[k], m[k], v, v)
+		}
+	}
+}
+
+func TestFlowLogAttributes(t *testing.T) {
+	first := time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+	rec := FlowRecord{
+		Key: FlowKey{
+			SrcIP: 0x0100000a, DstIP: 0x08080808, // 10.0.0.1, 8.8.8.8
+			SrcPort: 51234, DstPort: 443, Protocol: 6,
+		},
+		Iface:     "eth0",
+		Scope:     ScopeOutbound,
+		FirstSeen: first,
+		LastSeen:  first.Add(1500 * time.Millisecond),
+		Packets:   12,
+		Bytes:     4096,
+		TcpFlags:  0x02 | 0x10 | 0x01,
+		Closed:    true,
+		TLS:       &TLSInfo{SNI: "example.com", Version: "1.3", Truncated: true},
+		SrcName:   "-",
+		DstName:   "dns.google",
+		DstGeo:    &geoip.Info{Country: "US"},
+	}
+
+	l := flowLog(rec)
+	if !l.Time.Equal(rec.LastSeen) || l.Severity != logspb.SeverityNumber_SEVERITY_NUMBER_INFO || l.Body == "" {
+		t.Errorf("unexpected record %+v", l)
+	}
+	checkAttrs(t, l.Attrs, map[string]any{
+		"event.name":                      "kernelkoala.flow",
+		"network.transport":               "tcp",
+		"network.type":                    "ipv4",
+		"source.address":                  "10.0.0.1",
+		"source.port":                     int64(51234),
+		"destination.address":             "8.8.8.8",
+		"destination.port":                int64(443),
+		"network.interface.name":          "eth0",
+		"kernelkoala.scope":               "outbound",
+		"kernelkoala.source.name":         "",
+		"kernelkoala.destination.name":    "dns.google",
+		"kernelkoala.flow.packets":        int64(12),
+		"kernelkoala.flow.bytes":          int64(4096),
+		"kernelkoala.flow.duration_ms":    int64(1500),
+		"kernelkoala.flow.closed":         true,
+		"kernelkoala.flow.tcp_flags":      "FIN|SYN|ACK",
+		"tls.client.server_name":          "example.com",
+		"tls.protocol.version":            "1.3",
+		"tls.client.ja3":                  nil, // truncated hello, no fingerprint
+		"kernelkoala.destination.country": "US",
+		"kernelkoala.source.country":      nil,
+	})
+
+	// UDP flows carry no TCP flags
+	rec.Key.Protocol, rec.TLS = 17, nil
+	checkAttrs(t, flowLog(rec).Attrs, map[string]any{
+		"network.transport":          "udp",
+		"kernelkoala.flow.tcp_flags": nil,
+		"tls.client.server_name":     nil,
+	})
+}
+
+func TestAlertLogAttributes(t *testing.T) {
+	a := alert.Alert{
+		Time:     time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC),
+		Type:     "port-scan",
+		Severity: alert.SeverityHigh,
+		Message:  "block scan from 203.0.113.7",
+		Protocol: "TCP",
+		SrcIP:    "203.0.113.7",
+		DstIP:    "10.0.0.1",
+		DstPort:  22,
+		Iface:    "eth0",
+		Fields:   map[string]string{"kind": "block", "hosts": "12"},
+	}
+	l := alertLog(a)
+	if !l.Time.Equal(a.Time) || l.Body != a.Message {
+		t.Errorf("unexpected record %+v", l)
+	}
+	checkAttrs(t, l.Attrs, map[string]any{
+		"event.name":                 "kernelkoala.alert",
+		"kernelkoala.alert.type":     "port-scan",
+		"kernelkoala.alert.severity": "high",
+		"network.transport":          "tcp",
+		"source.address":             "203.0.113.7",
+		"source.port":                nil,
+		"destination.address":        "10.0.0.1",
+		"destination.port":           int64(22),
+		"network.interface.name":     "eth0",
+		"kernelkoala.alert.kind":     "block",
+		"kernelkoala.alert.hosts":    "12",
+	})
+
+	for severity, want := range map[alert.Severity]logspb.SeverityNumber{
+		alert.SeverityInfo:     logspb.SeverityNumber_SEVERITY_NUMBER_INFO,
+		alert.SeverityLow:      logspb.SeverityNumber_SEVERITY_NUMBER_WARN,
+		alert.SeverityMedium:   logspb.SeverityNumber_SEVERITY_NUMBER_WARN,
+		alert.SeverityHigh:     logspb.SeverityNumber_SEVERITY_NUMBER_ERROR,
+		alert.SeverityCritical: logspb.SeverityNumber_SEVERITY_NUMBER_FATAL,
+	} {
+		a.Severity = severity
+		if got := alertLog(a).Severity; got != want {
+			t.Errorf("%s alerts map to %v, want %v", severity, got, want)
+		}
+	}
+}
+
+func TestTransportAndDirectionNames(t *testing.T) {
+	for proto, want := range map[uint8]string{6: "tcp", 17: "udp", 1: "icmp"} {
+		if got := transportName(proto); got != want {
+			t.Errorf("transportName(%d) = %s, want %s", proto, got, want)
+		}
+	}
+	if ioDirection(0) != "receive" || ioDirection(1) != "transmit" {
+		t.Error("unexpected network.io.direction values")
+	}
+}
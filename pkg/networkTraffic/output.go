@@ -0,0 +1,146 @@
+package network
+
+import (
+	"encoding/json"
+	"fmt"
+	"kernelKoala/pkg/geoip"
+	"os"
+	"strings"
+	"time"
+)
+
+// Output formats accepted by -format.
+const (
+	formatText = "text"
+	formatJSON = "json"
+)
+
+// packetJSON is the JSON form of a packet line.
+type packetJSON struct {
+	Time      time.Time   `json:"time"`
+	Iface     string      `json:"iface"`
+	Direction string      `json:"direction"`
+	Protocol  string      `json:"protocol"`
+	SrcIP     string      `json:"src_ip"`
+	SrcName   string      `json:"src_name,omitempty"`
+	SrcPort   uint16      `json:"src_port,omitempty"`
+	DstIP     string      `json:"dst_ip"`
+	DstName   string      `json:"dst_name,omitempty"`
+	DstPort   uint16      `json:"dst_port,omitempty"`
+	Flags     []string    `json:"tcp_flags,omitempty"`
+	Bytes     uint32      `json:"bytes"`
+	Scope     string      `json:"scope"`
+	TLS       *TLSInfo    `json:"tls,omitempty"`
+	SrcGeo    *geoip.Info `json:"src_geo,omitempty"`
+	DstGeo    *geoip.Info `json:"dst_geo,omitempty"`
+	Policy    string      `json:"policy,omitempty"`
+	RuleID    uint32      `json:"rule_id,omitempty"`
+}
+
+func newPacketJSON(event PayLoadTc, flow FlowRecord, srcName, dstName string) packetJSON {
+	e := event.Event
+	return packetJSON{
+		Time:      time.Now(),
+		Iface:     event.Iface,
+		Direction: directionName(e.Direction),
+		Protocol:  protocolName(e.Protocol),
+		SrcIP:     intToIP(e.SrcIP).String(),
+		SrcName:   nameOrEmpty(srcName),
+		SrcPort:   e.SrcPort,
+		DstIP:     intToIP(e.DstIP).String(),
+		DstName:   nameOrEmpty(dstName),
+		DstPort:   e.DstPort,
+		Flags:     tcpFlagNames(e.TcpFlags),
+		Bytes:     e.PktLen,
+		Scope:     event.Scope,
+		TLS:       flow.TLS,
+		SrcGeo:    event.SrcGeo,
+		DstGeo:    event.DstGeo,
+		Policy:    policyAction(e),
+		RuleID:    e.RuleID,
+	}
+}
+
+// flowJSON is the JSON form of a FlowRecord.
+type flowJSON struct {
+	Protocol  string      `json:"protocol"`
+	SrcIP     string      `json:"src_ip"`
+	SrcName   string      `json:"src_name,omitempty"`
+	SrcPort   uint16      `json:"src_port,omitempty"`
+	DstIP     string      `json:"dst_ip"`
+	DstName   string      `json:"dst_name,omitempty"`
+	DstPort   uint16      `json:"dst_port,omitempty"`
+	Iface     string      `json:"iface"`
+	Scope     string      `json:"scope"`
+	FirstSeen time.Time   `json:"first_seen"`
+	LastSeen  time.Time   `json:"last_seen"`
+	Packets   uint64      `json:"packets"`
+	Bytes     uint64      `json:"bytes"`
+	Flags     []string    `json:"tcp_flags,omitempty"`
+	Closed    bool        `json:"closed"`
+	TLS       *TLSInfo    `json:"tls,omitempty"`
+	SrcGeo    *geoip.Info `json:"src_geo,omitempty"`
+	DstGeo    *geoip.Info `json:"dst_geo,omitempty"`
+}
+
+func (r FlowRecord) MarshalJSON() ([]byte, error) {
+	return json.Marshal(flowJSON{
+		Protocol:  protocolName(r.Key.Protocol),
+		SrcIP:     intToIP(r.Key.SrcIP).String(),
+		SrcName:   nameOrEmpty(r.SrcName),
+		SrcPort:   r.Key.SrcPort,
+		DstIP:     intToIP(r.Key.DstIP).String(),
+		DstName:   nameOrEmpty(r.DstName),
+		DstPort:   r.Key.DstPort,
+		Iface:     r.Iface,
+		Scope:     r.Scope,
+		FirstSeen: r.FirstSeen,
+		LastSeen:  r.LastSeen,
+		Packets:   r.Packets,
+		Bytes:     r.Bytes,
+		Flags:     tcpFlagNames(r.TcpFlags),
+		Closed:    r.Closed,
+		TLS:       r.TLS,
+		SrcGeo:    r.SrcGeo,
+		DstGeo:    r.DstGeo,
+	})
+}
+
+// printJSON writes v as a single line on stdout.
+func printJSON(v any) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "json encode failed: %v\n", err)
+		return
+	}
+	fmt.Println(string(data))
+}
+
+// geoSuffix renders the geo fields appended to text lines.
+func geoSuffix(src, dst *geoip.Info) string {
+	var parts []string
+	if src != nil {
+		parts = append(parts, "src_geo="+src.String())
+	}
+	if dst != nil {
+		parts = append(parts, "dst_geo="+dst.String())
+	}
+	if len(parts) == 0 {
+		return ""
+	}
+	return " | " + strings.Join(parts, " ")
+}
+
+func directionName(direction uint8) string {
+	if direction == 1 {
+		return "Egress"
+	}
+	return "Ingress"
+}
+
+func nameOrEmpty(name string) string {
+	if name == "-" {
+		return ""
+	}
+	return name
+}
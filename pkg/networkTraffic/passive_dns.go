@@ -0,0 +1,179 @@
+package network
+
+import (
+	"container/list"
+	"encoding/binary"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// Bounds applied to the TTL of learned answers so that zero-TTL records are
+// still usable for the connection that follows them and very long TTLs don't
+// pin stale names.
+const (
+	passiveMinTTL = 10 * time.Second
+	passiveMaxTTL = 24 * time.Hour
+)
+
+type passiveEntry struct {
+	ip      string
+	name    string
+	expires time.Time
+}
+
+// PassiveDNS learns IP→name mappings from DNS responses seen on the wire, so
+// names come from what the workload actually queried instead of PTR records.
+// When full, the address answered longest ago makes room for a new one.
+type PassiveDNS struct {
+	mu      sync.RWMutex
+	entries map[string]*list.Element
+	order   *list.List // front is most recently answered
+	maxSize int
+	stop    chan struct{}
+	once    sync.Once
+}
+
+func NewPassiveDNS(maxSize int) *PassiveDNS {
+	p := &PassiveDNS{
+		entries: make(map[string]*list.Element),
+		order:   list.New(),
+		maxSize: maxSize,
+		stop:    make(chan struct{}),
+	}
+
+	go p.cleanup()
+
+	return p
+}
+
+// Observe records the A/AAAA answers of a successful DNS response against the
+// name the client asked for.
+func (p *PassiveDNS) Observe(msg *dns.Msg) {
+	if !msg.Response || msg.Rcode != dns.RcodeSuccess || len(msg.Question) == 0 {
+		return
+	}
+
+	qname := strings.TrimSuffix(msg.Question[0].Name, ".")
+	now := time.Now()
+
+	for _, rr := range msg.Answer {
+		var ip net.IP
+		switch a := rr.(type) {
+		case *dns.A:
+			ip = a.A
+		case *dns.AAAA:
+			ip = a.AAAA
+		default:
+			continue
+		}
+		p.store(ip.String(), qname, now.Add(clampTTL(rr.Header().Ttl)))
+	}
+}
+
+// Lookup returns the last queried name that resolved to ip, if still valid.
+func (p *PassiveDNS) Lookup(ip net.IP) (string, bool) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	elem, ok := p.entries[ip.String()]
+	if !ok {
+		return "", false
+	}
+	entry := elem.Value.(*passiveEntry)
+	if time.Now().After(entry.expires) {
+		return "", false
+	}
+	return entry.name, true
+}
+
+// Close stops the cleanup goroutine.
+func (p *PassiveDNS) Close() {
+	p.once.Do(func() { close(p.stop) })
+}
+
+func (p *PassiveDNS) store(ip, name string, expires time.Time) {
+	if p.maxSize <= 0 {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	entry := &passiveEntry{ip: ip, name: name, expires: expires}
+	if elem, ok := p.entries[ip]; ok {
+		elem.Value = entry
+		p.order.MoveToFront(elem)
+		return
+	}
+
+	for p.order.Len() >= p.maxSize {
+		p.removeLocked(p.order.Back())
+	}
+	p.entries[ip] = p.order.PushFront(entry)
+}
+
+func (p *PassiveDNS) removeLocked(elem *list.Element) {
+	p.order.Remove(elem)
+	delete(p.entries, elem.Value.(*passiveEntry).ip)
+}
+
+func (p *PassiveDNS) cleanup() {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-p.stop:
+			return
+		case <-ticker.C:
+			now := time.Now()
+			p.mu.Lock()
+			for _, elem := range p.entries {
+				if now.After(elem.Value.(*passiveEntry).expires) {
+					p.removeLocked(elem)
+				}
+			}
+			p.mu.Unlock()
+		}
+	}
+}
+
+func clampTTL(ttl uint32) time.Duration {
+	d := time.Duration(ttl) * time.Second
+	if d < passiveMinTTL {
+		return passiveMinTTL
+	}
+	if d > passiveMaxTTL {
+		return passiveMaxTTL
+	}
+	return d
+}
+
+// parseDNSPayload unpacks a DNS message from a UDP datagram or the first TCP
+// segment of a connection (which carries a two byte length prefix).
+func parseDNSPayload(protocol uint8, payload []byte) *dns.Msg {
+	if protocol == 6 {
+		if len(payload) < 2 {
+			return nil
+		}
+		size := int(binary.BigEndian.Uint16(payload))
+		payload = payload[2:]
+		if size < len(payload) {
+			payload = payload[:size]
+		}
+	}
+
+	msg := new(dns.Msg)
+	if err := msg.Unpack(payload); err != nil {
+		return nil
+	}
+	return msg
+}
+
+func isDNSEvent(event Event) bool {
+	return (event.Protocol == 6 || event.Protocol == 17) &&
+		(event.SrcPort == 53 || event.DstPort == 53)
+}
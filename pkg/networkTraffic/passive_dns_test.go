@@ -0,0 +1,195 @@
+package network
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// dnsResponse answers a query for name with the given records.
+func dnsResponse(t *testing.T, name string, rrs ...string) *dns.Msg {
+	t.Helper()
+	q := new(dns.Msg)
+	q.SetQuestion(dns.Fqdn(name), dns.TypeA)
+	m := new(dns.Msg)
+	m.SetReply(q)
+	for _, s := range rrs {
+		rr, err := dns.NewRR(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		m.Answer = append(m.Answer, rr)
+	}
+	return m
+}
+
+func pack(t *testing.T, m *dns.Msg) []byte {
+	t.Helper()
+	data, err := m.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+// dnsPacket is a response from 10.0.0.53:53 to 10.0.0.2:40000.
+func dnsPacket(protocol uint8, payload []byte) PayLoadTc {
+	return PayLoadTc{
+		Event: Event{
+			SrcIP: 0x3500000a, DstIP: 0x0200000a, SrcPort: 53, DstPort: 40000,
+			Protocol: protocol, PktLen: uint32(len(payload)), Timestamp: uint64(2 * time.Millisecond),
+		},
+		Iface:   "eth0",
+		Payload: payload,
+	}
+}
+
+func TestParseDNSPayload(t *testing.T) {
+	data := pack(t, dnsResponse(t, "api.example.com", "api.example.com. 60 IN A 203.0.113.10"))
+	prefixed := binary.BigEndian.AppendUint16(nil, uint16(len(data)))
+
+	for _, tc := range []struct {
+		name     string
+		protocol uint8
+		payload  []byte
+		ok       bool
+	}{
+		{"udp", 17, data, true},
+		{"tcp", 6, append(prefixed, data...), true},
+		// Bytes after the message belong to the next one
+		{"tcp pipelined", 6, append(append(prefixed, data...), 0, 12, 1, 2), true},
+		{"tcp cut short", 6, append(prefixed, data[:len(data)-4]...), false},
+		{"tcp without prefix", 6, data, false},
+		{"tcp too short", 6, []byte{0}, false},
+		{"garbage", 17, []byte("GET / HTTP/1.1\r\n"), false},
+		{"empty", 17, nil, false},
+	} {
+		msg := parseDNSPayload(tc.protocol, tc.payload)
+		if (msg != nil) != tc.ok {
+			t.Errorf("%s: parsed %v, want %v", tc.name, msg != nil, tc.ok)
+			continue
+		}
+		if msg != nil && (msg.Question[0].Name != "api.example.com." || len(msg.Answer) != 1) {
+			t.Errorf("%s: parsed %v", tc.name, msg)
+		}
+	}
+}
+
+func TestCapturedPayload(t *testing.T) {
+	packet := []byte("ipv4+udp headers.payload")
+	event := Event{CapLen: uint16(len(packet)), PayloadOff: 17}
+	var b bytes.Buffer
+	binary.Write(&b, binary.LittleEndian, event)
+	sample := append(b.Bytes(), packet...)
+
+	if got := capturedPayload(event, sample); string(got) != "payload" {
+		t.Errorf("payload %q", got)
+	}
+	// The perf buffer pads samples, the padding isn't payload
+	if got := capturedPayload(event, append(sample, 0, 0, 0, 0)); string(got) != "payload" {
+		t.Errorf("payload with padding %q", got)
+	}
+	for name, tc := range map[string]struct {
+		event  Event
+		sample []byte
+	}{
+		"nothing captured":          {Event{PayloadOff: 17}, sample},
+		"sample shorter":            {event, sample[:len(sample)-1]},
+		"offset past capture":       {Event{CapLen: uint16(len(packet)), PayloadOff: uint16(len(packet))}, sample},
+		"offset past short capture": {Event{CapLen: 4, PayloadOff: 17}, sample},
+	} {
+		if got := capturedPayload(tc.event, tc.sample); got != nil {
+			t.Errorf("%s: payload %q", name, got)
+		}
+	}
+}
+
+func TestPassiveDNSObserve(t *testing.T) {
+	p := NewPassiveDNS(16)
+	defer p.Close()
+
+	p.Observe(dnsResponse(t, "api.example.com",
+		"api.example.com. 60 IN CNAME edge.cdn.example.",
+		"edge.cdn.example. 60 IN A 203.0.113.10",
+		"edge.cdn.example. 0 IN AAAA 2001:db8::10",
+	))
+	// Answers are learned under the name the client asked for
+	for _, ip := range []string{"203.0.113.10", "2001:db8::10"} {
+		if name, ok := p.Lookup(net.ParseIP(ip)); !ok || name != "api.example.com" {
+			t.Errorf("%s = %q %v", ip, name, ok)
+		}
+	}
+
+	// A zero TTL still covers the connection that follows
+	p.mu.RLock()
+	expires := p.entries["2001:db8::10"].Value.(*passiveEntry).expires
+	p.mu.RUnlock()
+	if ttl := time.Until(expires); ttl < passiveMinTTL-time.Second {
+		t.Errorf("zero TTL kept for %s", ttl)
+	}
+
+	// Failures and queries teach nothing
+	nx := dnsResponse(t, "gone.example.com", "gone.example.com. 60 IN A 203.0.113.20")
+	nx.Rcode = dns.RcodeNameError
+	p.Observe(nx)
+	query := dnsResponse(t, "q.example.com", "q.example.com. 60 IN A 203.0.113.21")
+	query.Response = false
+	p.Observe(query)
+	for _, ip := range []string{"203.0.113.20", "203.0.113.21"} {
+		if name, ok := p.Lookup(net.ParseIP(ip)); ok {
+			t.Errorf("%s learned as %q", ip, name)
+		}
+	}
+
+	// The latest answer for an address wins
+	p.Observe(dnsResponse(t, "www.example.com", "www.example.com. 60 IN A 203.0.113.10"))
+	if name, _ := p.Lookup(net.ParseIP("203.0.113.10")); name != "www.example.com" {
+		t.Errorf("renamed to %q", name)
+	}
+}
+
+func TestPassiveDNSEviction(t *testing.T) {
+	p := NewPassiveDNS(2)
+	defer p.Close()
+	p.Observe(dnsResponse(t, "a.example", "a.example. 60 IN A 192.0.2.1"))
+	p.Observe(dnsResponse(t, "b.example", "b.example. 60 IN A 192.0.2.2"))
+	p.Observe(dnsResponse(t, "a.example", "a.example. 60 IN A 192.0.2.1")) // answered again
+	p.Observe(dnsResponse(t, "c.example", "c.example. 60 IN A 192.0.2.3"))
+
+	if _, ok := p.Lookup(net.ParseIP("192.0.2.2")); ok {
+		t.Error("address answered longest ago kept")
+	}
+	for _, ip := range []string{"192.0.2.1", "192.0.2.3"} {
+		if _, ok := p.Lookup(net.ParseIP(ip)); !ok {
+			t.Errorf("%s evicted", ip)
+		}
+	}
+	if len(p.entries) != 2 || p.order.Len() != 2 {
+		t.Errorf("%d entries, %d in order", len(p.entries), p.order.Len())
+	}
+}
+
+// A captured response names the address for the resolver chain.
+func TestHandleDNSLearnsNames(t *testing.T) {
+	cfg := &CaptureConfig{EnableDNS: true, EnablePassive: true, DNSSources: []string{sourcePassive}, DNSCacheSize: 16}
+	resolver, err := NewDNSResolver(cfg, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resolver.Close()
+	w := &PacketWorker{dnsResolver: resolver}
+
+	msg := dnsResponse(t, "db.example.com", "db.example.com. 300 IN A 198.51.100.7")
+	data := pack(t, msg)
+	w.handleDNS(dnsPacket(6, append(binary.BigEndian.AppendUint16(nil, uint16(len(data))), data...)))
+
+	if name, ok := resolver.Cached(net.ParseIP("198.51.100.7")); !ok || name != "db.example.com" {
+		t.Errorf("Cached = %q %v", name, ok)
+	}
+	// Not a DNS message, nothing happens
+	w.handleDNS(dnsPacket(17, []byte("not dns")))
+}
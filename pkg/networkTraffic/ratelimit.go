@@ -0,0 +1,324 @@
+package network
+
+import (
+	"context"
+	"fmt"
+	"kernelKoala/pkg/alert"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cilium/ebpf"
+)
+
+// Event flags set by the ingress rate limiter.
+const (
+	EventFlagRateLimitStart = 0x08
+	EventFlagRateLimitStop  = 0x10
+)
+
+// RateLimitRule is a token bucket applied to every source sending to Port,
+// port 0 being the default for ports without a rule of their own.
+type RateLimitRule struct {
+	Port    uint16
+	Rate    uint32 // packets per second
+	Burst   uint32 // bucket size in packets
+	PerPort bool   // separate buckets per source and port
+	SYNOnly bool   // only TCP SYNs are counted
+}
+
+func (r RateLimitRule) String() string {
+	s := fmt.Sprintf("port=%d rate=%d burst=%d", r.Port, r.Rate, r.Burst)
+	if r.PerPort {
+		s += " per-port"
+	}
+	if r.SYNOnly {
+		s += " syn-only"
+	}
+	return s
+}
+
+// loadRateLimitRules reads lines like "port=443 rate=200 burst=400 syn-only".
+// Without a port the rule is the default, without a burst it is one
+// second's worth of packets.
+func loadRateLimitRules(path string) ([]RateLimitRule, error) {
+	var rules []RateLimitRule
+	err := readConfigLines(path, func(fields []string) error {
+		var r RateLimitRule
+		for _, field := range fields {
+			key, value, _ := strings.Cut(field, "=")
+			var err error
+			switch key {
+			case "port":
+				var port uint64
+				port, err = strconv.ParseUint(value, 10, 16)
+				r.Port = uint16(port)
+			case "rate":
+				var rate uint64
+				rate, err = strconv.ParseUint(value, 10, 32)
+				r.Rate = uint32(rate)
+			case "burst":
+				var burst uint64
+				burst, err = strconv.ParseUint(value, 10, 32)
+				r.Burst = uint32(burst)
+			case "per-port":
+				r.PerPort = true
+			case "syn-only":
+				r.SYNOnly = true
+			default:
+				return fmt.Errorf("unknown rate limit field %q", field)
+			}
+			if err != nil {
+				return fmt.Errorf("invalid %s %q", key, value)
+			}
+		}
+		if r.Rate == 0 {
+			return fmt.Errorf("rule needs a rate")
+		}
+		if r.Burst == 0 {
+			r.Burst = r.Rate
+		}
+		rules = append(rules, r)
+		return nil
+	})
+	return rules, err
+}
+
+// rlRule mirrors struct rl_rule in tc.c.
+type rlRule struct {
+	Rate    uint32
+	Burst   uint32
+	PerPort uint8
+	SYNOnly uint8
+	_       uint16
+}
+
+// rlKey mirrors struct rl_key in tc.c.
+type rlKey struct {
+	SrcIP uint32
+	Port  uint16
+	_     uint16
+}
+
+// rlBucket mirrors struct rl_bucket in tc.c.
+type rlBucket struct {
+	Tokens  uint64
+	LastNs  uint64
+	Passed  uint64
+	Dropped uint64
+}
+
+// RateLimitBucket is the state of one source's bucket.
+type RateLimitBucket struct {
+	SrcIP   net.IP
+	Port    uint16
+	Passed  uint64
+	Dropped uint64
+	Limited bool
+}
+
+// RateLimitStats sums up the buckets.
+type RateLimitStats struct {
+	Buckets int    `json:"buckets"`
+	Limited int    `json:"limited"`
+	Passed  uint64 `json:"passed"`
+	Dropped uint64 `json:"dropped"`
+}
+
+// RateLimiter configures the kernel token buckets and reports sources that
+// start or stop being limited.
+type RateLimiter struct {
+	rules   *ebpf.Map
+	buckets *ebpf.Map
+	limited *ebpf.Map
+	emit    func(alert.Alert)
+
+	mu          sync.Mutex
+	lastDropped map[rlKey]uint64
+	stats       RateLimitStats
+}
+
+func NewRateLimiter(rules, buckets, limited *ebpf.Map, emit func(alert.Alert)) *RateLimiter {
+	return &RateLimiter{
+		rules:       rules,
+		buckets:     buckets,
+		limited:     limited,
+		emit:        emit,
+		lastDropped: make(map[rlKey]uint64),
+	}
+}
+
+// SetRules replaces the configured rules.
+func (r *RateLimiter) SetRules(rules []RateLimitRule) error {
+	want := make(map[uint16]bool, len(rules))
+	for _, rule := range rules {
+		value := rlRule{Rate: rule.Rate, Burst: rule.Burst}
+		if rule.PerPort {
+			value.PerPort = 1
+		}
+		if rule.SYNOnly {
+			value.SYNOnly = 1
+		}
+		if err := r.rules.Put(rule.Port, value); err != nil {
+			return fmt.Errorf("rate limit rule %s: %v", rule, err)
+		}
+		want[rule.Port] = true
+	}
+
+	var port uint16
+	var value rlRule
+	var stale []uint16
+	iter := r.rules.Iterate()
+	for iter.Next(&port, &value) {
+		if !want[port] {
+			stale = append(stale, port)
+		}
+	}
+	for _, p := range stale {
+		r.rules.Delete(p)
+	}
+	return iter.Err()
+}
+
+// Buckets returns the per-source counters.
+func (r *RateLimiter) Buckets() ([]RateLimitBucket, error) {
+	limited, err := r.limitedKeys()
+	if err != nil {
+		return nil, err
+	}
+
+	var out []RateLimitBucket
+	var key rlKey
+	var b rlBucket
+	iter := r.buckets.Iterate()
+	for iter.Next(&key, &b) {
+		out = append(out, RateLimitBucket{
+			SrcIP:   intToIP(key.SrcIP),
+			Port:    key.Port,
+			Passed:  b.Passed,
+			Dropped: b.Dropped,
+			Limited: limited[key],
+		})
+	}
+	return out, iter.Err()
+}
+
+// limitedKeys returns the sources the kernel is dropping.
+func (r *RateLimiter) limitedKeys() (map[rlKey]bool, error) {
+	keys := make(map[rlKey]bool)
+	var key rlKey
+	var one uint8
+	iter := r.limited.Iterate()
+	for iter.Next(&key, &one) {
+		keys[key] = true
+	}
+	return keys, iter.Err()
+}
+
+// Stats returns the totals of the last poll.
+func (r *RateLimiter) Stats() RateLimitStats {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.stats
+}
+
+// Run polls the buckets. A limited source that stopped sending never gets a
+// passed packet to clear its state in the kernel, so it is cleared here
+// once its drop count stays flat for a whole interval.
+func (r *RateLimiter) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			r.poll()
+		}
+	}
+}
+
+func (r *RateLimiter) poll() {
+	var stats RateLimitStats
+	var quiet []rlKey
+	quietBuckets := make(map[rlKey]rlBucket)
+	seen := make(map[rlKey]uint64)
+
+	limited, err := r.limitedKeys()
+	if err != nil {
+		return
+	}
+	var key rlKey
+	var b rlBucket
+	iter := r.buckets.Iterate()
+	for iter.Next(&key, &b) {
+		stats.Buckets++
+		stats.Passed += b.Passed
+		stats.Dropped += b.Dropped
+		if !limited[key] {
+			continue
+		}
+		stats.Limited++
+		if last, ok := r.lastDropped[key]; ok && last == b.Dropped {
+			quiet = append(quiet, key)
+			quietBuckets[key] = b
+		}
+		seen[key] = b.Dropped
+	}
+
+	// Deleting the key only clears the flag, the bucket is left to the
+	// kernel. If the kernel cleared it first it also raised the stop.
+	for _, k := range quiet {
+		if err := r.limited.Delete(k); err != nil {
+			continue
+		}
+		delete(seen, k)
+		stats.Limited--
+		r.emit(r.stopAlert(k, quietBuckets[k]))
+	}
+
+	r.mu.Lock()
+	r.lastDropped = seen
+	r.stats = stats
+	r.mu.Unlock()
+}
+
+func (r *RateLimiter) stopAlert(key rlKey, b rlBucket) alert.Alert {
+	return alert.Alert{
+		Time:     time.Now(),
+		Type:     "rate-limit",
+		Severity: alert.SeverityInfo,
+		Message:  "source no longer rate limited",
+		SrcIP:    intToIP(key.SrcIP).String(),
+		DstPort:  key.Port,
+		Fields: map[string]string{
+			"passed":  strconv.FormatUint(b.Passed, 10),
+			"dropped": strconv.FormatUint(b.Dropped, 10),
+		},
+	}
+}
+
+// checkRateLimit turns the limiter transitions reported by the kernel into
+// alerts.
+func (w *PacketWorker) checkRateLimit(event PayLoadTc) {
+	e := event.Event
+	var a alert.Alert
+	switch {
+	case e.Flags&EventFlagRateLimitStart != 0:
+		a = alert.Alert{Type: "rate-limit", Severity: alert.SeverityMedium, Message: "source exceeded its rate limit, dropping"}
+	case e.Flags&EventFlagRateLimitStop != 0:
+		a = alert.Alert{Type: "rate-limit", Severity: alert.SeverityInfo, Message: "source no longer rate limited"}
+	default:
+		return
+	}
+
+	a.Time = time.Now()
+	a.Protocol = protocolName(e.Protocol)
+	a.SrcIP, a.SrcPort = intToIP(e.SrcIP).String(), e.SrcPort
+	a.DstIP, a.DstPort = intToIP(e.DstIP).String(), e.DstPort
+	a.Iface = event.Iface
+	w.alert(a)
+}
@@ -0,0 +1,68 @@
+package network
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func writeTestFile(t *testing.T, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "rules")
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadRateLimitRules(t *testing.T) {
+	for _, tc := range []struct {
+		name, content string
+		want          []RateLimitRule
+		err           string
+	}{
+		{
+			name:    "default burst",
+			content: "rate=100\n",
+			want:    []RateLimitRule{{Rate: 100, Burst: 100}},
+		},
+		{
+			name:    "full rule and comments",
+			content: "# SYN floods\nport=443 rate=200 burst=400 per-port syn-only # web\n\nport=22 rate=5\n",
+			want: []RateLimitRule{
+				{Port: 443, Rate: 200, Burst: 400, PerPort: true, SYNOnly: true},
+				{Port: 22, Rate: 5, Burst: 5},
+			},
+		},
+		{
+			name:    "largest values",
+			content: "port=65535 rate=4294967295 burst=4294967295\n",
+			want:    []RateLimitRule{{Port: 65535, Rate: 4294967295, Burst: 4294967295}},
+		},
+		{name: "no rate", content: "port=80 burst=10\n", err: "needs a rate"},
+		{name: "zero rate", content: "rate=0\n", err: "needs a rate"},
+		{name: "port too big", content: "port=65536 rate=1\n", err: `invalid port "65536"`},
+		{name: "negative rate", content: "rate=-1\n", err: `invalid rate "-1"`},
+		{name: "rate too big", content: "rate=4294967296\n", err: `invalid rate`},
+		{name: "bad burst", content: "rate=1 burst=lots\n", err: `invalid burst "lots"`},
+		{name: "unknown field", content: "rate=1\nrate=1 drop\n", err: `:2: unknown rate limit field "drop"`},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			rules, err := loadRateLimitRules(writeTestFile(t, tc.content))
+			if tc.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.err) {
+					t.Fatalf("err = %v, want %q", err, tc.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !slices.Equal(rules, tc.want) {
+				t.Errorf("rules %v, want %v", rules, tc.want)
+			}
+		})
+	}
+}
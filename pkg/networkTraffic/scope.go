@@ -0,0 +1,95 @@
+package network
+
+import (
+	"fmt"
+	"kernelKoala/pkg/iptrie"
+	"net"
+	"strings"
+)
+
+// Traffic scopes derived from which endpoints are internal.
+const (
+	ScopeEastWest = "east-west" // internal to internal
+	ScopeOutbound = "outbound"  // internal to external
+	ScopeInbound  = "inbound"   // external to internal
+	ScopeExternal = "external"  // neither endpoint is internal
+)
+
+// defaultInternalCIDRs covers RFC 1918, CGNAT, IPv6 ULA and link-local
+// ranges, loopback is always internal.
+var defaultInternalCIDRs = []string{
+	"10.0.0.0/8",
+	"172.16.0.0/12",
+	"192.168.0.0/16",
+	"100.64.0.0/10",
+	"169.254.0.0/16",
+	"fc00::/7",
+	"fe80::/10",
+}
+
+var loopbackCIDRs = []string{"127.0.0.0/8", "::1/128"}
+
+// NetworkSet is a set of prefixes answering membership by longest-prefix
+// match.
+type NetworkSet struct {
+	trie *iptrie.Trie[struct{}]
+}
+
+func NewNetworkSet(cidrs []string) (*NetworkSet, error) {
+	s := &NetworkSet{trie: iptrie.New[struct{}]()}
+	for _, cidr := range cidrs {
+		prefix, err := iptrie.ParsePrefix(strings.TrimSpace(cidr))
+		if err != nil {
+			return nil, fmt.Errorf("invalid network %q: %v", cidr, err)
+		}
+		s.trie.Insert(prefix, struct{}{})
+	}
+	return s, nil
+}
+
+// loadNetworkFile appends one CIDR per line from path to cidrs.
+func loadNetworkFile(path string, cidrs []string) ([]string, error) {
+	err := readConfigLines(path, func(fields []string) error {
+		cidrs = append(cidrs, fields[0])
+		return nil
+	})
+	return cidrs, err
+}
+
+func (s *NetworkSet) Contains(ip net.IP) bool {
+	return s.trie.Contains(iptrie.AddrFromIP(ip))
+}
+
+// ContainsV4 checks an address in the byte order the kernel reports it.
+func (s *NetworkSet) ContainsV4(ip uint32) bool {
+	return s.trie.Contains(v4Addr(ip))
+}
+
+// Classify returns the traffic scope of an event.
+func (s *NetworkSet) Classify(e Event) string {
+	src, dst := s.ContainsV4(e.SrcIP), s.ContainsV4(e.DstIP)
+	switch {
+	case src && dst:
+		return ScopeEastWest
+	case src:
+		return ScopeOutbound
+	case dst:
+		return ScopeInbound
+	default:
+		return ScopeExternal
+	}
+}
+
+// reverseScope returns the scope of the same traffic seen the other way.
+func reverseScope(scope string) string {
+	switch scope {
+	case ScopeOutbound:
+		return ScopeInbound
+	case ScopeInbound:
+		return ScopeOutbound
+	default:
+		return scope
+	}
+}
+
+var loopbackNetworks, _ = NewNetworkSet(loopbackCIDRs)
@@ -10,14 +10,28 @@ import (
 	"bytes"
 	"context"
 	"encoding/binary"
+	"errors"
 	"flag"
 	"fmt"
 	l "kernelKoala/internal/logger"
+	"kernelKoala/pkg/alert"
+	"kernelKoala/pkg/alerting"
+	"kernelKoala/pkg/auth"
+	"kernelKoala/pkg/detection"
+	"kernelKoala/pkg/flowstore"
+	"kernelKoala/pkg/geoip"
+	"kernelKoala/pkg/koala"
+	"kernelKoala/pkg/otlp"
+	"kernelKoala/pkg/policy"
+	"kernelKoala/pkg/sqlsink"
+	"kernelKoala/pkg/threatintel"
 	"net"
 	"os"
 	"os/signal"
 	"path/filepath"
 	"runtime"
+	"strconv"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"syscall"
@@ -38,11 +52,37 @@ type Event struct {
 	Protocol  uint8
 	Direction uint8
 	TcpFlags  uint8
+	// Flags holds EventFlag* bits set by the kernel.
+	Flags uint8
+	// PktLen is the length of the packet at the tc hook.
+	PktLen uint32
+	// PayloadOff is the offset of the L4 payload from the start of the packet.
+	PayloadOff uint16
+	// CapLen is the number of packet bytes appended to the sample.
+	CapLen uint16
+	// Timestamp is the kernel monotonic clock (ns) when the packet was seen.
+	Timestamp uint64
+	// RuleID is the policy rule behind EventFlagDropped/EventFlagWouldDrop.
+	RuleID uint32
+	_      uint32
 }
 
+// eventSize is the size of the fixed part of a perf sample, any captured
+// packet bytes follow it.
+var eventSize = binary.Size(Event{})
+
 type PayLoadTc struct {
 	Event Event
 	Iface string
+	// Payload holds the captured L4 payload prefix, if the kernel sent one.
+	Payload []byte
+	// Scope classifies the endpoints against the internal networks, see
+	// ScopeEastWest and friends.
+	Scope string
+	// SrcGeo and DstGeo are set for external endpoints when GeoIP
+	// databases are configured.
+	SrcGeo *geoip.Info
+	DstGeo *geoip.Info
 }
 
 // Statistics for monitoring performance
@@ -50,6 +90,10 @@ type Stats struct {
 	PacketsProcessed uint64
 	PacketsDropped   uint64
 	WorkerQueueFull  uint64
+	LostSamples      uint64
+	ThreatMatches    uint64
+	PolicyDropped    uint64
+	PolicyWouldDrop  uint64
 }
 
 // Configuration for the capture system
@@ -63,143 +107,303 @@ type CaptureConfig struct {
 	DNSTimeout     time.Duration
 	DNSCacheSize   int
 	DNSCacheTTL    time.Duration
+	DNSCacheMinTTL time.Duration
+	DNSNegativeTTL time.Duration
 	DNSServers     []string
-}
-
-// DNS Cache entry
-type DNSCacheEntry struct {
-	domain    string
-	timestamp time.Time
-	ttl       time.Duration
+	DNSSources     []string
+	ResolvConf     string
+	HostsFile      string
+	StaticFiles    []string
+	CIDRFile       string
+	DNSStripSearch bool
+	InternalCIDRs  []string
+	InternalFile   string
+	DNSWorkers     int
+	DNSQueueSize   int
+	EnablePassive  bool
+	EnablePTR      bool
+	DNSLogPath     string
+	DNSLogTimeout  time.Duration
+	FlowLog        bool
+	FlowTimeout    time.Duration
+	MaxFlows       int
+	HTTPPorts      []uint16
+	HTTPMaxPath    int
+	HTTPRedact     bool
+	Format         string
+	GeoIPCity      string
+	GeoIPASN       string
+	GeoIPCacheSize int
+	GeoIPReload    time.Duration
+	IOCFiles       []string
+	IOCReload      time.Duration
+	IOCKernel      bool
+	PolicyMode     policy.Mode
+	PolicyModeSet  bool // -policy-mode was given, otherwise the pinned mode stays
+	PolicyFile     string
+	PinPath        string
+	RateLimitFile  string
+	Detectors      []string
+	PortScan       detection.PortScanConfig
+	SYNFlood       detection.SYNFloodConfig
+	Anomaly        detection.AnomalyConfig
+	Graph          detection.GraphConfig
+	Beacon         detection.BeaconConfig
+	AlertConfig    string
+	MetricsAddr    string
+	MetricsTopN    int
+	OTLP           otlp.Config
+	APIAddr        string
+	APICert        string
+	APIKey         string
+	APIClientCA    string
+	APITokens      string
+	AuditLog       string
+	TLSReload      time.Duration
+	Koala          koala.ExporterConfig
+	ServerCA       string
+	ServerCert     string
+	ServerKey      string
+	Store          flowstore.Config
+	Database       sqlsink.Config
 }
 
 // High-performance DNS resolver with caching
 type DNSResolver struct {
-	client       *dns.Client
-	servers      []string
-	cache        sync.Map // map[string]*DNSCacheEntry
-	enabled      bool
-	timeout      time.Duration
-	cacheTTL     time.Duration
-	maxCacheSize int
-	cacheCount   int64
-	mu           sync.RWMutex
-}
-
-func NewDNSResolver(config *CaptureConfig) *DNSResolver {
+	client      *dns.Client
+	servers     []string
+	cache       *DNSCache
+	enabled     bool
+	timeout     time.Duration
+	maxTTL      time.Duration
+	passive     *PassiveDNS
+	ptrEnabled  bool
+	sources     []NameSource
+	resolvConf  *dns.ClientConfig
+	stripSearch bool
+	internal    *NetworkSet
+}
+
+// NewDNSResolver builds the resolver chain in the order given by
+// config.DNSSources, skipping sources that are not enabled. Bad lines in
+// hosts, static and CIDR files go to warn.
+func NewDNSResolver(config *CaptureConfig, internal *NetworkSet, warn func(format string, args ...any)) (*DNSResolver, error) {
 	if !config.EnableDNS {
-		return &DNSResolver{enabled: false}
+		return &DNSResolver{enabled: false}, nil
 	}
 
 	resolver := &DNSResolver{
 		client: &dns.Client{
 			Timeout: config.DNSTimeout,
 		},
-		servers:      config.DNSServers,
-		enabled:      true,
-		timeout:      config.DNSTimeout,
-		cacheTTL:     config.DNSCacheTTL,
-		maxCacheSize: config.DNSCacheSize,
+		servers:     config.DNSServers,
+		enabled:     true,
+		timeout:     config.DNSTimeout,
+		maxTTL:      config.DNSCacheTTL,
+		stripSearch: config.DNSStripSearch,
+		internal:    internal,
 	}
 
-	// Start cache cleanup goroutine
-	go resolver.cleanupCache()
+	if config.ResolvConf != "" {
+		cfg, servers, err := loadResolvConf(config.ResolvConf)
+		if err != nil && config.EnablePTR && len(resolver.servers) == 0 {
+			return nil, fmt.Errorf("no DNS servers configured and %v", err)
+		}
+		if err == nil {
+			resolver.resolvConf = cfg
+			if len(resolver.servers) == 0 {
+				resolver.servers = servers
+			}
+		}
+	}
 
-	return resolver
-}
+	for _, name := range config.DNSSources {
+		switch name {
+		case sourcePassive:
+			if config.EnablePassive {
+				resolver.passive = NewPassiveDNS(config.DNSCacheSize)
+				resolver.sources = append(resolver.sources, passiveSource{resolver.passive})
+			}
+		case sourceHosts:
+			if config.HostsFile != "" {
+				src, err := loadHostsFiles(sourceHosts, []string{config.HostsFile}, warn)
+				if err != nil {
+					return nil, err
+				}
+				resolver.sources = append(resolver.sources, src)
+			}
+		case sourceStatic:
+			if len(config.StaticFiles) > 0 {
+				src, err := loadHostsFiles(sourceStatic, config.StaticFiles, warn)
+				if err != nil {
+					return nil, err
+				}
+				resolver.sources = append(resolver.sources, src)
+			}
+		case sourceCIDR:
+			if config.CIDRFile != "" {
+				src, err := loadCIDRLabels(config.CIDRFile, warn)
+				if err != nil {
+					return nil, err
+				}
+				resolver.sources = append(resolver.sources, src)
+			}
+		case sourcePTR:
+			if config.EnablePTR {
+				resolver.ptrEnabled = true
+				resolver.cache = NewDNSCache(config.DNSCacheSize, config.DNSCacheMinTTL,
+					config.DNSCacheTTL, config.DNSNegativeTTL)
+				resolver.sources = append(resolver.sources, ptrSource{resolver.cache})
+			}
+		default:
+			return nil, fmt.Errorf("unknown DNS source %q", name)
+		}
+	}
 
-func (r *DNSResolver) cleanupCache() {
-	ticker := time.NewTicker(5 * time.Minute)
-	defer ticker.Stop()
+	return resolver, nil
+}
 
-	for range ticker.C {
-		if !r.enabled {
-			continue
-		}
+// Close stops the background cleanup of the caches.
+func (r *DNSResolver) Close() {
+	if r.passive != nil {
+		r.passive.Close()
+	}
+	if r.cache != nil {
+		r.cache.Close()
+	}
+}
 
-		now := time.Now()
-		r.cache.Range(func(key, value interface{}) bool {
-			entry := value.(*DNSCacheEntry)
-			if now.Sub(entry.timestamp) > entry.ttl {
-				r.cache.Delete(key)
-				atomic.AddInt64(&r.cacheCount, -1)
-			}
-			return true
-		})
+// CacheStats returns the PTR cache counters, zero when PTR lookups are off.
+func (r *DNSResolver) CacheStats() DNSCacheStats {
+	if r.cache == nil {
+		return DNSCacheStats{}
 	}
+	return r.cache.Stats()
 }
 
-func (r *DNSResolver) ResolveIP(ip net.IP) string {
+// Cached walks the resolver chain and returns the first name found without a
+// network round trip. ok is false only when a PTR lookup would be worth doing.
+func (r *DNSResolver) Cached(ip net.IP) (name string, ok bool) {
 	if !r.enabled {
-		return "-"
+		return "-", true
 	}
 
-	ipStr := ip.String()
-
-	// Check cache first
-	if cached, ok := r.cache.Load(ipStr); ok {
-		entry := cached.(*DNSCacheEntry)
-		if time.Since(entry.timestamp) < entry.ttl {
-			return entry.domain
+	known := false
+	for _, src := range r.sources {
+		name, ok := src.Lookup(ip)
+		if !ok {
+			continue
 		}
-		// Expired, remove from cache
-		r.cache.Delete(ipStr)
-		atomic.AddInt64(&r.cacheCount, -1)
+		if name == "-" {
+			// a cached PTR failure, later sources may still know better
+			known = true
+			continue
+		}
+		if r.stripSearch {
+			name = shortenName(name, r.resolvConf)
+		}
+		return name, true
 	}
 
 	// Don't resolve private/local IPs to reduce noise
-	if r.isPrivateIP(ip) {
-		return "-"
+	if !r.ptrEnabled || known || r.isPrivateIP(ip) {
+		return "-", true
 	}
 
+	return "", false
+}
+
+// WorkloadName names ip from the configured sources only, hosts files,
+// static names and CIDR labels, so the name doesn't change as passive DNS
+// and PTR answers come and go.
+func (r *DNSResolver) WorkloadName(ip net.IP) (string, bool) {
+	for _, src := range r.sources {
+		switch src.Name() {
+		case sourceHosts, sourceStatic, sourceCIDR:
+			if name, ok := src.Lookup(ip); ok && name != "-" {
+				return name, true
+			}
+		}
+	}
+	return "", false
+}
+
+// ResolveIP returns the name for ip, blocking on a PTR lookup if needed.
+func (r *DNSResolver) ResolveIP(ip net.IP) string {
+	if name, ok := r.Cached(ip); ok {
+		return name
+	}
+	ipStr := ip.String()
+
 	// Perform DNS lookup with timeout
 	ctx, cancel := context.WithTimeout(context.Background(), r.timeout)
 	defer cancel()
 
-	domain := r.performLookup(ctx, ipStr)
-
-	// Cache the result (even if it's "-" to avoid repeated failed lookups)
-	if atomic.LoadInt64(&r.cacheCount) < int64(r.maxCacheSize) {
-		entry := &DNSCacheEntry{
-			domain:    domain,
-			timestamp: time.Now(),
-			ttl:       r.cacheTTL,
-		}
-		if _, loaded := r.cache.LoadOrStore(ipStr, entry); !loaded {
-			atomic.AddInt64(&r.cacheCount, 1)
+	domain, ttl, err := r.performLookup(ctx, ipStr)
+	if err != nil {
+		// Remember that there is no name for a shorter time than a real
+		// answer. Timeouts and server failures aren't remembered, the next
+		// packet tries again.
+		if errors.Is(err, errNoPTR) {
+			r.cache.SetNegative(ipStr)
 		}
+		return "-"
 	}
 
+	r.cache.Set(ipStr, domain, ttl)
+	if r.stripSearch {
+		domain = shortenName(domain, r.resolvConf)
+	}
 	return domain
 }
 
-func (r *DNSResolver) performLookup(ctx context.Context, ip string) string {
+// ObserveMessage feeds a DNS message seen on the wire to the passive name
+// learner.
+func (r *DNSResolver) ObserveMessage(msg *dns.Msg) {
+	if r.passive == nil {
+		return
+	}
+	r.passive.Observe(msg)
+}
+
+// errNoPTR is a lookup answered with no name, as opposed to one that
+// failed.
+var errNoPTR = errors.New("no PTR record")
+
+// performLookup returns errNoPTR if any server answered that ip has no
+// name.
+func (r *DNSResolver) performLookup(ctx context.Context, ip string) (string, time.Duration, error) {
+	noName := false
 	// Use multiple DNS servers with fallback
 	for _, server := range r.servers {
-		select {
-		case <-ctx.Done():
-			return "-"
-		default:
+		if err := ctx.Err(); err != nil {
+			return "", 0, err
 		}
 
-		if domain := r.queryDNSServer(server, ip); domain != "-" {
-			return domain
+		domain, ttl, err := r.queryDNSServer(ctx, server, ip)
+		if err == nil {
+			return domain, ttl, nil
 		}
+		noName = noName || errors.Is(err, errNoPTR)
 	}
 
-	// Fallback to system resolver as last resort
-	names, err := net.LookupAddr(ip)
-	if err != nil || len(names) == 0 {
-		return "-"
+	// Fallback to system resolver as last resort, it doesn't tell us the TTL
+	names, err := net.DefaultResolver.LookupAddr(ctx, ip)
+	if err == nil && len(names) > 0 {
+		return names[0], r.maxTTL, nil
+	}
+	var dnsErr *net.DNSError
+	if noName || err == nil || (errors.As(err, &dnsErr) && dnsErr.IsNotFound) {
+		return "", 0, errNoPTR
 	}
-	return names[0]
+	return "", 0, err
 }
 
-func (r *DNSResolver) queryDNSServer(server, ip string) string {
+func (r *DNSResolver) queryDNSServer(ctx context.Context, server, ip string) (string, time.Duration, error) {
 	// Create reverse DNS query
 	arpa, err := dns.ReverseAddr(ip)
 	if err != nil {
-		return "-"
+		return "", 0, errNoPTR
 	}
 
 	msg := new(dns.Msg)
@@ -207,47 +411,33 @@ func (r *DNSResolver) queryDNSServer(server, ip string) string {
 	msg.RecursionDesired = true
 
 	// Query DNS server
-	resp, _, err := r.client.Exchange(msg, server)
-	if err != nil || resp == nil || len(resp.Answer) == 0 {
-		return "-"
+	resp, _, err := r.client.ExchangeContext(ctx, msg, server)
+	if err != nil {
+		return "", 0, err
+	}
+	switch resp.Rcode {
+	case dns.RcodeSuccess, dns.RcodeNameError:
+	default:
+		return "", 0, fmt.Errorf("%s answered %s", server, dns.RcodeToString[resp.Rcode])
 	}
 
 	// Extract PTR record
 	for _, ans := range resp.Answer {
 		if ptr, ok := ans.(*dns.PTR); ok {
-			return ptr.Ptr
+			return ptr.Ptr, time.Duration(ptr.Hdr.Ttl) * time.Second, nil
 		}
 	}
 
-	return "-"
+	return "", 0, errNoPTR
 }
 
+// isPrivateIP reports whether ip is loopback, link-local or in the
+// configured internal networks, which PTR lookups skip.
 func (r *DNSResolver) isPrivateIP(ip net.IP) bool {
 	if ip.IsLoopback() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() {
 		return true
 	}
-
-	// Check for private IP ranges
-	privateRanges := []struct {
-		network *net.IPNet
-	}{
-		{parseIPNet("10.0.0.0/8")},
-		{parseIPNet("172.16.0.0/12")},
-		{parseIPNet("192.168.0.0/16")},
-	}
-
-	for _, private := range privateRanges {
-		if private.network.Contains(ip) {
-			return true
-		}
-	}
-
-	return false
-}
-
-func parseIPNet(cidr string) *net.IPNet {
-	_, network, _ := net.ParseCIDR(cidr)
-	return network
+	return r.internal != nil && r.internal.Contains(ip)
 }
 
 type NetworkCapture struct {
@@ -260,21 +450,268 @@ type NetworkCapture struct {
 	workerPool  chan chan PayLoadTc
 	wg          sync.WaitGroup
 	dnsResolver *DNSResolver
+	names       *AsyncResolver
+	internal    *NetworkSet
+	dnsLog      *DNSLogger
+	dnsLogFile  *os.File
+	flows       *FlowTable
+	http        *HTTPTracker
+	geo         *geoip.Enricher
+	intel       *threatintel.List
+	iocMu       sync.Mutex
+	iocMap      *ebpf.Map
+	iocInKernel atomic.Bool
+	policy      *policy.Table
+	rateRules   []RateLimitRule
+	ratelimit   *RateLimiter
+	detectors   []detection.Detector
+	alerting    *alerting.Engine
+	workers     []*PacketWorker
+	otlp        *otlp.Exporter
+	koala       *koala.Exporter
+	store       *flowstore.Store
+	db          *sqlsink.Sink
+	serverCerts *auth.Certs
+	apiCerts    *auth.Certs
+	apiTokens   *auth.Tokens
+	audit       *l.Logger
+	started     time.Time
+	events      *eventHub
+	attachMu    sync.Mutex
+	attached    map[string]attachment
+	// metricPorts are the service ports with metric series of their own
+	portsMu     sync.Mutex
+	metricPorts map[portKey]bool
 }
 
 func NewNetworkCapture(config *CaptureConfig, logger *l.Logger) *NetworkCapture {
 	ctx, cancel := context.WithCancel(context.Background())
 
-	return &NetworkCapture{
-		config:      config,
-		logger:      logger,
-		stats:       &Stats{},
-		ctx:         ctx,
-		cancel:      cancel,
-		eventChan:   make(chan PayLoadTc, config.BufferSize),
-		workerPool:  make(chan chan PayLoadTc, config.WorkerCount),
-		dnsResolver: NewDNSResolver(config),
+	nc := &NetworkCapture{
+		config:     config,
+		logger:     logger,
+		stats:      &Stats{},
+		ctx:        ctx,
+		cancel:     cancel,
+		eventChan:  make(chan PayLoadTc, config.BufferSize),
+		workerPool: make(chan chan PayLoadTc, config.WorkerCount),
+		started:    time.Now(),
+	}
+
+	cidrs := append(append([]string{}, config.InternalCIDRs...), loopbackCIDRs...)
+	if config.InternalFile != "" {
+		var err error
+		if cidrs, err = loadNetworkFile(config.InternalFile, cidrs); err != nil {
+			logger.Fatal("failed to load internal networks: %v", err)
+		}
+	}
+	internal, err := NewNetworkSet(cidrs)
+	if err != nil {
+		logger.Fatal("failed to configure internal networks: %v", err)
+	}
+	nc.internal = internal
+
+	resolver, err := NewDNSResolver(config, internal, logger.Warn)
+	if err != nil {
+		logger.Fatal("failed to configure DNS resolver: %v", err)
+	}
+	nc.dnsResolver = resolver
+
+	nc.names = NewAsyncResolver(nc.dnsResolver, config.DNSWorkers, config.DNSQueueSize)
+	nc.flows = NewFlowTable(config.FlowTimeout, config.MaxFlows, nc.exportFlow)
+	if len(config.HTTPPorts) > 0 {
+		nc.http = NewHTTPTracker(config.HTTPMaxPath, config.HTTPRedact, 30*time.Second, nc.emitHTTP)
+	}
+
+	if config.GeoIPCity != "" || config.GeoIPASN != "" {
+		geo, err := geoip.New(config.GeoIPCity, config.GeoIPASN, config.GeoIPCacheSize, config.GeoIPReload, func(err error) {
+			logger.Warn("GeoIP reload failed: %v", err)
+		})
+		if err != nil {
+			logger.Fatal("failed to open GeoIP databases: %v", err)
+		}
+		nc.geo = geo
+	}
+
+	if len(config.IOCFiles) > 0 {
+		intel, err := threatintel.New(config.IOCFiles, config.IOCReload, nc.syncIOCMap, func(err error) {
+			logger.Warn("threat intel reload failed: %v", err)
+		})
+		if err != nil {
+			logger.Fatal("failed to load threat intel lists: %v", err)
+		}
+		nc.intel = intel
+		logger.Info("Loaded %d threat intel indicators", intel.Len())
 	}
+
+	if config.RateLimitFile != "" {
+		rules, err := loadRateLimitRules(config.RateLimitFile)
+		if err != nil {
+			logger.Fatal("failed to load rate limit rules: %v", err)
+		}
+		nc.rateRules = rules
+	}
+
+	if err := nc.buildDetectors(); err != nil {
+		logger.Fatal("failed to configure detectors: %v", err)
+	}
+
+	if config.AlertConfig != "" {
+		cfg, err := alerting.LoadConfig(config.AlertConfig)
+		if err != nil {
+			logger.Fatal("failed to load alerting config: %v", err)
+		}
+		engine, err := alerting.New(cfg, nc.emitAlert, func(err error) {
+			logger.Warn("alert delivery failed: %v", err)
+		})
+		if err != nil {
+			logger.Fatal("failed to configure alerting: %v", err)
+		}
+		nc.alerting = engine
+		logger.Info("Loaded %d alerting rules and %d notifiers", len(cfg.Rules), len(cfg.Notifiers))
+	}
+
+	if config.OTLP.Endpoint != "" {
+		exporter, err := otlp.New(config.OTLP, nc.otlpMetrics, func(err error) {
+			logger.Warn("OTLP export failed: %v", err)
+		})
+		if err != nil {
+			logger.Fatal("failed to configure OTLP export: %v", err)
+		}
+		nc.otlp = exporter
+	}
+
+	if config.Koala.Addr != "" {
+		if !config.Koala.Insecure && (config.ServerCA != "" || config.ServerCert != "") {
+			certs, err := auth.LoadCerts(config.ServerCert, config.ServerKey, config.ServerCA, config.TLSReload, func(err error) {
+				logger.Warn("Koala Server certificate reload failed: %v", err)
+			})
+			if err != nil {
+				logger.Fatal("failed to load Koala Server certificates: %v", err)
+			}
+			nc.serverCerts = certs
+			config.Koala.TLS = certs.ClientConfig()
+		}
+		exporter, err := koala.NewExporter(config.Koala, func(err error) {
+			logger.Warn("Koala Server export failed: %v", err)
+		})
+		if err != nil {
+			logger.Fatal("failed to configure Koala Server export: %v", err)
+		}
+		nc.koala = exporter
+	}
+
+	if config.Store.Dir != "" {
+		store, err := flowstore.Open(config.Store, func(err error) {
+			logger.Warn("flow store write failed: %v", err)
+		})
+		if err != nil {
+			logger.Fatal("failed to open flow store: %v", err)
+		}
+		nc.store = store
+	}
+
+	if config.Database.DSN != "" {
+		sink, err := sqlsink.New(config.Database, func(err error) {
+			logger.Warn("database export failed: %v", err)
+		})
+		if err != nil {
+			logger.Fatal("failed to configure database export: %v", err)
+		}
+		nc.db = sink
+	}
+
+	if config.APIAddr != "" {
+		nc.events = newEventHub()
+		nc.setupAPIAuth()
+	}
+
+	if err := nc.openDNSLog(); err != nil {
+		logger.Warn("DNS logging disabled: %v", err)
+	}
+
+	return nc
+}
+
+// exportFlow is called for every flow that closed or went idle.
+func (nc *NetworkCapture) exportFlow(rec FlowRecord) {
+	// Names that were still being looked up while packets went by are
+	// usually known by the time the flow finishes
+	rec.SrcName = nc.names.Name(intToIP(rec.Key.SrcIP))
+	rec.DstName = nc.names.Name(intToIP(rec.Key.DstIP))
+	rec.SrcGeo = lookupGeo(nc.geo, nc.internal, rec.Key.SrcIP)
+	rec.DstGeo = lookupGeo(nc.geo, nc.internal, rec.Key.DstIP)
+
+	if nc.otlp != nil {
+		nc.otlp.EmitLog(flowLog(rec))
+	}
+	if nc.alerting != nil && nc.alerting.Wants(alerting.SourceFlow) {
+		nc.alerting.Observe(alerting.SourceFlow, flowRecord(rec), rec.LastSeen)
+	}
+	if nc.events != nil {
+		nc.events.publish(eventFlow, flowRecord(rec), func() any { return rec })
+	}
+	if nc.koala != nil || nc.store != nil || nc.db != nil {
+		kf := koalaFlow(rec)
+		if nc.koala != nil {
+			nc.koala.AddFlow(kf)
+		}
+		if nc.store != nil {
+			nc.store.Add(kf)
+		}
+		if nc.db != nil {
+			nc.db.AddFlow(kf)
+		}
+	}
+
+	if !nc.config.FlowLog {
+		return
+	}
+	if nc.config.Format == formatJSON {
+		printJSON(rec)
+	} else {
+		fmt.Println(rec.String())
+	}
+}
+
+// emitHTTP prints an HTTP exchange next to the packet lines.
+func (nc *NetworkCapture) emitHTTP(ev HTTPEvent) {
+	if nc.config.Format == formatJSON {
+		printJSON(ev)
+	} else {
+		fmt.Println(ev.String())
+	}
+}
+
+// lookupGeo returns the GeoIP data of an external address, internal
+// addresses are not looked up.
+func lookupGeo(geo *geoip.Enricher, internal *NetworkSet, ip uint32) *geoip.Info {
+	if geo == nil || internal.ContainsV4(ip) {
+		return nil
+	}
+	if info, ok := geo.Lookup(intToIP(ip)); ok {
+		return &info
+	}
+	return nil
+}
+
+// openDNSLog sets up the DNS query/response stream, "-" writes to stdout.
+func (nc *NetworkCapture) openDNSLog() error {
+	switch nc.config.DNSLogPath {
+	case "":
+		return nil
+	case "-":
+		nc.dnsLog = NewDNSLogger(os.Stdout, nc.config.DNSLogTimeout, time.Minute)
+		return nil
+	}
+
+	f, err := os.OpenFile(nc.config.DNSLogPath, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	nc.dnsLogFile = f
+	nc.dnsLog = NewDNSLogger(f, nc.config.DNSLogTimeout, time.Minute)
+	return nil
 }
 
 func NetworkTrafficCapture(log *l.Logger) {
@@ -293,6 +730,66 @@ func NetworkTrafficCapture(log *l.Logger) {
 	// Start statistics reporter
 	capture.startStatsReporter()
 
+	// Start OpenTelemetry export
+	if capture.otlp != nil {
+		go capture.otlp.Run(capture.ctx)
+	}
+
+	// Start shipping to the Koala Server
+	if capture.koala != nil {
+		go capture.koala.Run(capture.ctx)
+	}
+
+	// Start writing flows to disk
+	if capture.store != nil {
+		go capture.store.Run(capture.ctx)
+	}
+
+	// Start writing flows and alerts to the database
+	if capture.db != nil {
+		go capture.db.Run(capture.ctx)
+	}
+
+	// Start the metrics endpoint
+	if config.MetricsAddr != "" {
+		go capture.serveMetrics(capture.ctx)
+	}
+
+	// Start the agent API
+	if config.APIAddr != "" {
+		go capture.serveAPI(capture.ctx)
+	}
+
+	// Start background name lookups
+	capture.names.Start(capture.ctx)
+
+	// Start flow tracking
+	capture.wg.Add(1)
+	go func() {
+		defer capture.wg.Done()
+		capture.flows.Run(capture.ctx)
+	}()
+
+	// Start HTTP request tracking
+	if capture.http != nil {
+		go capture.http.Run(capture.ctx)
+	}
+
+	// Start alert delivery
+	if capture.alerting != nil {
+		go capture.alerting.Run(capture.ctx)
+	}
+
+	// Start detector windows
+	if len(capture.detectors) > 0 {
+		go capture.tickDetectors(capture.ctx)
+	}
+
+	// Start DNS query/response logging
+	if capture.dnsLog != nil {
+		go capture.dnsLog.Run(capture.ctx)
+	}
+
 	// Get interfaces to monitor
 	interfaces, err := capture.getInterfaces()
 	if err != nil {
@@ -306,6 +803,11 @@ func NetworkTrafficCapture(log *l.Logger) {
 	}
 	defer capture.closeEBPF(objs)
 
+	// Start reporting rate limited sources
+	if capture.ratelimit != nil {
+		go capture.ratelimit.Run(capture.ctx, 10*time.Second)
+	}
+
 	// Start capture on all interfaces
 	for _, iface := range interfaces {
 		capture.wg.Add(1)
@@ -323,38 +825,291 @@ func parseConfig() *CaptureConfig {
 	bufferSize := flag.Int("buffer", 100000, "Event channel buffer size")
 	batchSize := flag.Int("batch", 100, "Batch size for packet processing")
 	enableDNS := flag.Bool("dns", true, "Enable DNS resolution for IP addresses")
+	enablePassive := flag.Bool("dns-passive", true, "Learn IP to name mappings from observed DNS responses")
+	enablePTR := flag.Bool("dns-ptr", false, "Fall back to reverse PTR lookups for IPs without an observed name")
 	dnsTimeout := flag.Duration("dns-timeout", 500*time.Millisecond, "DNS query timeout")
 	dnsCacheSize := flag.Int("dns-cache-size", 10000, "Maximum number of DNS cache entries")
-	dnsCacheTTL := flag.Duration("dns-cache-ttl", 5*time.Minute, "DNS cache entry TTL")
-	dnsServers := flag.String("dns-servers", "8.8.8.8:53,1.1.1.1:53", "Comma-separated list of DNS servers")
+	dnsCacheTTL := flag.Duration("dns-cache-ttl", 5*time.Minute, "Upper bound on the TTL of cached PTR answers")
+	dnsCacheMinTTL := flag.Duration("dns-cache-min-ttl", 30*time.Second, "Lower bound on the TTL of cached PTR answers")
+	dnsNegativeTTL := flag.Duration("dns-negative-ttl", time.Minute, "How long an answer without a PTR record is cached")
+	dnsServers := flag.String("dns-servers", "", "Comma-separated list of DNS servers for PTR lookups (default: nameservers from -resolv-conf)")
+	resolvConf := flag.String("resolv-conf", "/etc/resolv.conf", "resolv.conf providing nameservers and search domains")
+	metricsAddr := flag.String("metrics-addr", "", "Address serving Prometheus metrics on /metrics, e.g. :9100 (empty disables)")
+	metricsTopPorts := flag.Int("metrics-top-ports", 20, "Service ports exported with their own series, the rest are summed up")
+	otlpEndpoint := flag.String("otlp-endpoint", "", "OTLP collector, host:port for grpc or a URL for http (empty disables)")
+	otlpProtocol := flag.String("otlp-protocol", otlp.ProtocolGRPC, "OTLP transport: grpc or http")
+	otlpInsecure := flag.Bool("otlp-insecure", false, "Connect to the OTLP collector without TLS")
+	otlpHeaders := flag.String("otlp-headers", "", "Comma-separated key=value headers sent with every OTLP export")
+	otlpInterval := flag.Duration("otlp-interval", 30*time.Second, "How often metrics are exported over OTLP")
+	serverAddr := flag.String("server-addr", "", "Koala Server receiving flows and alerts, host:port (empty disables)")
+	serverInsecure := flag.Bool("server-insecure", false, "Connect to the Koala Server without TLS")
+	nodeName := flag.String("node-name", "", "Node name reported to the Koala Server (default: hostname)")
+	serverCA := flag.String("server-ca", "", "CA bundle verifying the Koala Server (default: system roots)")
+	serverCert := flag.String("server-cert", "", "Client certificate presented to the Koala Server for mutual TLS")
+	serverKey := flag.String("server-key", "", "Key of -server-cert")
+	apiAddr := flag.String("api-addr", "", "Address serving the agent API (stats, flows, interfaces, config, event stream), e.g. 127.0.0.1:9200")
+	apiCert := flag.String("api-tls-cert", "", "Certificate serving the agent API over TLS")
+	apiKey := flag.String("api-tls-key", "", "Key of -api-tls-cert")
+	apiClientCA := flag.String("api-client-ca", "", "CA bundle API clients must present a certificate of (mutual TLS)")
+	apiTokens := flag.String("api-tokens", "", "File of \"name token scopes\" lines, API requests then need a bearer token")
+	auditLog := flag.String("audit-log", "", "File API access is logged to (- for stdout, empty disables)")
+	storeDir := flag.String("store-dir", "", "Directory flows are kept in for the query command (empty disables)")
+	storePartition := flag.Duration("store-partition", time.Hour, "Time span of one flow store segment")
+	storeRetention := flag.Duration("store-retention", 7*24*time.Hour, "How long stored flows are kept (0 keeps them)")
+	storeMaxMB := flag.Int64("store-max-mb", 1024, "Size limit of the flow store in MB, the oldest segments go first (0 disables)")
+	dbDialect := flag.String("db-dialect", "postgres", "SQL dialect of -db-dsn: postgres, clickhouse or sqlite")
+	dbDriver := flag.String("db-driver", "", "database/sql driver name (default: pgx, clickhouse or sqlite by dialect)")
+	dbDSN := flag.String("db-dsn", "", "Database flows and alerts are written to (default: $KERNELKOALA_DB_DSN, empty disables)")
+	dbBatch := flag.Int("db-batch", 1000, "Rows inserted per database transaction")
+	dbBuffer := flag.Int("db-buffer", 200000, "Records held while the database is unreachable, the oldest flows go first")
+	tlsReload := flag.Duration("tls-reload", time.Minute, "How often certificates and the token file are checked for changes (0 disables)")
+	alertConfig := flag.String("alert-config", "", "JSON file of alerting rules and notifiers (webhook, file, syslog)")
+	dnsSources := flag.String("dns-sources", "passive,static,hosts,cidr,ptr", "Order in which name sources are consulted")
+	hostsFile := flag.String("hosts-file", "/etc/hosts", "hosts file used by the hosts source (empty disables)")
+	staticFiles := flag.String("dns-static-files", "", "Comma-separated files of \"ip name\" lines used by the static source")
+	cidrFile := flag.String("dns-cidr-file", "", "File of \"cidr = label\" lines used by the cidr source")
+	internalCIDRs := flag.String("internal-cidrs", strings.Join(defaultInternalCIDRs, ","), "Comma-separated networks treated as internal")
+	internalFile := flag.String("internal-cidrs-file", "", "File with additional internal networks, one CIDR per line (e.g. public ranges, Kubernetes service CIDRs)")
+	stripSearch := flag.Bool("dns-strip-search", false, "Strip resolv.conf search domains from displayed names")
+	dnsWorkers := flag.Int("dns-workers", 4, "Number of goroutines performing PTR lookups in the background")
+	dnsQueue := flag.Int("dns-queue", 1024, "Maximum number of queued PTR lookups, further misses are skipped")
+	dnsLogPath := flag.String("dns-log", "", "Write observed DNS queries and responses as JSON lines to this file (- for stdout)")
+	dnsLogTimeout := flag.Duration("dns-log-timeout", 5*time.Second, "Time after which an unanswered DNS query is logged as a timeout")
+	flowLog := flag.Bool("flows", false, "Print a record for every flow when it closes or goes idle")
+	flowTimeout := flag.Duration("flow-timeout", time.Minute, "Idle time after which a flow is exported")
+	maxFlows := flag.Int("max-flows", 262144, "Maximum flows tracked at once, packets of new connections beyond it are not tracked (0 for no limit)")
+	httpPorts := flag.String("http-ports", "", "Comma-separated TCP ports parsed as plaintext HTTP/1.x, e.g. 80,8080 (empty disables)")
+	httpMaxPath := flag.Int("http-max-path", 256, "Maximum length of a logged HTTP request path")
+	httpRedact := flag.Bool("http-redact-query", true, "Redact query strings from logged HTTP paths")
+	format := flag.String("format", formatText, "Output format for packets, flows and HTTP events: text or json")
+	geoIPCity := flag.String("geoip-city", "", "GeoLite2-City compatible MMDB file used to add country and city to external endpoints")
+	geoIPASN := flag.String("geoip-asn", "", "GeoLite2-ASN compatible MMDB file used to add ASN and organization to external endpoints")
+	geoIPCache := flag.Int("geoip-cache", 10000, "Maximum number of cached GeoIP lookups")
+	geoIPReload := flag.Duration("geoip-reload", time.Minute, "How often the GeoIP files are checked for changes (0 disables)")
+	iocFiles := flag.String("ioc-files", "", "Comma-separated IP/CIDR indicator lists (.txt or .csv) raising threat-intel alerts")
+	iocReload := flag.Duration("ioc-reload", time.Minute, "How often the indicator lists are checked for changes (0 disables)")
+	iocKernel := flag.Bool("ioc-kernel", true, "Match indicators in the kernel via an LPM map")
+	policyMode := flag.String("policy-mode", "", "Deny policy mode: off, dry-run (report would-be drops) or enforce (drop), by default the mode set before a restart, off at first")
+	policyFile := flag.String("policy-file", "", "File of deny rules replacing the installed ones at startup")
+	pinPath := flag.String("bpf-pin-path", policy.DefaultPinPath, "bpffs directory where the policy maps are pinned for the policy command")
+	rateLimitFile := flag.String("ratelimit-file", "", "File of per-port token bucket rules limiting ingress packets per source")
+	detectors := flag.String("detectors", "", "Comma-separated detectors to run: portscan, synflood, anomaly, graph, beacon")
+	portScanWindow := flag.Duration("portscan-window", time.Minute, "Sliding window of the port scan detector")
+	portScanPorts := flag.Int("portscan-ports", 25, "Distinct ports on one host that make a vertical scan")
+	portScanHosts := flag.Int("portscan-hosts", 25, "Distinct hosts on one port that make a horizontal scan")
+	portScanBlock := flag.Int("portscan-block", 10, "Distinct hosts and ports that together make a block scan")
+	synFloodInterval := flag.Duration("synflood-interval", 5*time.Second, "Interval over which SYNs and completed handshakes are compared")
+	synFloodMin := flag.Int("synflood-min-syns", 500, "SYNs per interval to one service before a flood is considered")
+	synFloodRatio := flag.Float64("synflood-ratio", 0.2, "Handshake completion ratio below which a flood starts")
+	anomalyInterval := flag.Duration("anomaly-interval", time.Minute, "Sample length of the traffic baselines")
+	anomalyThreshold := flag.Float64("anomaly-threshold", 4, "Deviation from the baseline, in standard deviations, that counts as anomalous")
+	anomalySustain := flag.Int("anomaly-sustain", 3, "Consecutive anomalous intervals before an alert")
+	anomalyState := flag.String("anomaly-state", "", "File the learned baselines are saved to and restored from")
+	graphLearn := flag.Duration("graph-learn", 24*time.Hour, "How long the connection graph is learned before new edges alert")
+	graphScopes := flag.String("graph-scopes", ScopeEastWest, "Comma-separated traffic scopes the connection graph covers, empty for all")
+	graphState := flag.String("graph-state", "", "File the connection graph is saved to and restored from")
+	graphAllowlist := flag.String("graph-allowlist", "", "File of \"src dst [port[/proto]]\" edges that never alert")
+	beaconWindow := flag.Duration("beacon-window", time.Hour, "How far back connection starts are kept for beacon detection")
+	beaconMinConns := flag.Int("beacon-min-conns", 8, "Connections within the window before a channel is scored")
+	beaconJitter := flag.Float64("beacon-jitter", 0.2, "Largest interval jitter (coefficient of variation) that counts as periodic")
+	beaconScore := flag.Float64("beacon-score", 0.8, "Share of intervals near the median cadence needed for a beacon alert")
+	beaconScopes := flag.String("beacon-scopes", ScopeOutbound, "Comma-separated traffic scopes checked for beaconing, empty for all")
 	flag.Parse()
 
 	config := &CaptureConfig{
-		WorkerCount:  *workers,
-		BufferSize:   *bufferSize,
-		BatchSize:    *batchSize,
-		EnableDNS:    *enableDNS,
-		DNSTimeout:   *dnsTimeout,
-		DNSCacheSize: *dnsCacheSize,
-		DNSCacheTTL:  *dnsCacheTTL,
-	}
-
-	// Parse DNS servers
-	if *enableDNS {
-		servers := []string{}
-		for _, server := range []string{"8.8.8.8:53", "1.1.1.1:53", "208.67.222.222:53"} {
-			if *dnsServers != "" {
-				// Parse custom DNS servers
-				for _, s := range splitString(*dnsServers, ",") {
-					if s != "" {
-						servers = append(servers, s)
-					}
-				}
-				break
-			}
-			servers = append(servers, server)
+		WorkerCount:    *workers,
+		BufferSize:     *bufferSize,
+		BatchSize:      *batchSize,
+		EnableDNS:      *enableDNS,
+		DNSTimeout:     *dnsTimeout,
+		DNSCacheSize:   *dnsCacheSize,
+		DNSCacheTTL:    *dnsCacheTTL,
+		DNSCacheMinTTL: *dnsCacheMinTTL,
+		DNSNegativeTTL: *dnsNegativeTTL,
+		DNSWorkers:     *dnsWorkers,
+		DNSQueueSize:   *dnsQueue,
+
+		ResolvConf:     *resolvConf,
+		HostsFile:      *hostsFile,
+		CIDRFile:       *cidrFile,
+		DNSStripSearch: *stripSearch,
+		InternalFile:   *internalFile,
+
+		EnablePassive: *enablePassive,
+		EnablePTR:     *enablePTR,
+		DNSLogPath:    *dnsLogPath,
+		DNSLogTimeout: *dnsLogTimeout,
+		FlowLog:       *flowLog,
+		FlowTimeout:   *flowTimeout,
+		MaxFlows:      *maxFlows,
+		HTTPMaxPath:   *httpMaxPath,
+		HTTPRedact:    *httpRedact,
+
+		Format:         *format,
+		GeoIPCity:      *geoIPCity,
+		GeoIPASN:       *geoIPASN,
+		GeoIPCacheSize: *geoIPCache,
+		GeoIPReload:    *geoIPReload,
+		IOCReload:      *iocReload,
+		IOCKernel:      *iocKernel,
+		PolicyFile:     *policyFile,
+		PinPath:        *pinPath,
+		RateLimitFile:  *rateLimitFile,
+		AlertConfig:    *alertConfig,
+		MetricsAddr:    *metricsAddr,
+		MetricsTopN:    *metricsTopPorts,
+		APIAddr:        *apiAddr,
+		APICert:        *apiCert,
+		APIKey:         *apiKey,
+		APIClientCA:    *apiClientCA,
+		APITokens:      *apiTokens,
+		AuditLog:       *auditLog,
+		TLSReload:      *tlsReload,
+		ServerCA:       *serverCA,
+		ServerCert:     *serverCert,
+		ServerKey:      *serverKey,
+	}
+
+	config.OTLP = otlp.DefaultConfig()
+	config.OTLP.Endpoint = *otlpEndpoint
+	config.OTLP.Protocol = *otlpProtocol
+	config.OTLP.Insecure = *otlpInsecure
+	config.OTLP.MetricsInterval = *otlpInterval
+	config.OTLP.Resource = otlp.KubernetesResource()
+	for _, header := range splitString(*otlpHeaders, ",") {
+		key, value, ok := strings.Cut(header, "=")
+		if !ok {
+			l.Warn("ignoring OTLP header %q, expected key=value", header)
+			continue
+		}
+		if config.OTLP.Headers == nil {
+			config.OTLP.Headers = make(map[string]string)
+		}
+		config.OTLP.Headers[strings.TrimSpace(key)] = strings.TrimSpace(value)
+	}
+
+	config.Koala = koala.DefaultExporterConfig()
+	config.Koala.Addr = *serverAddr
+	config.Koala.Insecure = *serverInsecure
+	config.Koala.Node = *nodeName
+	if config.Koala.Node == "" {
+		config.Koala.Node, _ = os.Hostname()
+	}
+
+	config.Store = flowstore.DefaultConfig()
+	config.Store.Dir = *storeDir
+	config.Store.Partition = *storePartition
+	config.Store.MaxAge = *storeRetention
+	config.Store.MaxSize = *storeMaxMB << 20
+
+	config.Database = sqlsink.DefaultConfig()
+	config.Database.Dialect = *dbDialect
+	config.Database.Driver = *dbDriver
+	config.Database.DSN = *dbDSN
+	if config.Database.DSN == "" {
+		// Keeps passwords out of the process list
+		config.Database.DSN = os.Getenv("KERNELKOALA_DB_DSN")
+	}
+	config.Database.Node = config.Koala.Node
+	config.Database.BatchSize = *dbBatch
+	config.Database.MaxBuffered = *dbBuffer
+	if config.Database.BatchSize < 1 {
+		l.Fatal("-db-batch must be at least 1")
+	}
+	if config.Database.MaxBuffered < config.Database.BatchSize {
+		l.Fatal("-db-buffer must hold at least one batch of -db-batch records")
+	}
+
+	config.PortScan = detection.DefaultPortScanConfig()
+	config.PortScan.Window = *portScanWindow
+	config.PortScan.VerticalPorts = *portScanPorts
+	config.PortScan.HorizontalHosts = *portScanHosts
+	config.PortScan.BlockHosts = *portScanBlock
+	config.PortScan.BlockPorts = *portScanBlock
+
+	config.SYNFlood = detection.DefaultSYNFloodConfig()
+	config.SYNFlood.Interval = *synFloodInterval
+	config.SYNFlood.MinSYNs = *synFloodMin
+	config.SYNFlood.EnterRatio = *synFloodRatio
+
+	config.Anomaly = detection.DefaultAnomalyConfig()
+	config.Anomaly.Interval = *anomalyInterval
+	config.Anomaly.Threshold = *anomalyThreshold
+	config.Anomaly.Sustain = *anomalySustain
+	config.Anomaly.StatePath = *anomalyState
+	config.Graph = detection.DefaultGraphConfig()
+	config.Graph.LearnFor = *graphLearn
+	config.Graph.Scopes = nil
+	for _, scope := range splitString(*graphScopes, ",") {
+		config.Graph.Scopes = append(config.Graph.Scopes, strings.TrimSpace(scope))
+	}
+	config.Graph.Path = *graphState
+	config.Graph.AllowlistPath = *graphAllowlist
+	config.Beacon = detection.DefaultBeaconConfig()
+	config.Beacon.Window = *beaconWindow
+	config.Beacon.MinConnections = *beaconMinConns
+	config.Beacon.MaxJitter = *beaconJitter
+	config.Beacon.MinScore = *beaconScore
+	config.Beacon.Scopes = nil
+	for _, scope := range splitString(*beaconScopes, ",") {
+		config.Beacon.Scopes = append(config.Beacon.Scopes, strings.TrimSpace(scope))
+	}
+
+	if *policyMode != "" {
+		mode, err := policy.ParseMode(*policyMode)
+		if err != nil {
+			l.Fatal("-policy-mode: %v", err)
+		}
+		config.PolicyMode, config.PolicyModeSet = mode, true
+	}
+
+	if config.Format != formatText && config.Format != formatJSON {
+		l.Warn("unknown output format %q, using %s", config.Format, formatText)
+		config.Format = formatText
+	}
+
+	if config.MetricsTopN < 0 {
+		l.Fatal("-metrics-top-ports must not be negative")
+	}
+
+	if config.DNSWorkers < 1 {
+		// Nothing would drain the lookup queue, -dns-ptr=false turns lookups off
+		l.Warn("-dns-workers must be at least 1, using 1")
+		config.DNSWorkers = 1
+	}
+
+	for _, p := range splitString(*httpPorts, ",") {
+		port, err := strconv.ParseUint(strings.TrimSpace(p), 10, 16)
+		if err != nil || port == 0 {
+			l.Warn("ignoring invalid HTTP port %q", p)
+			continue
 		}
-		config.DNSServers = servers
+		config.HTTPPorts = append(config.HTTPPorts, uint16(port))
+	}
+
+	// Explicit DNS servers override the ones from resolv.conf
+	for _, server := range splitString(*dnsServers, ",") {
+		server = strings.TrimSpace(server)
+		if _, _, err := net.SplitHostPort(server); err != nil {
+			server = net.JoinHostPort(server, "53")
+		}
+		config.DNSServers = append(config.DNSServers, server)
+	}
+
+	for _, source := range splitString(*dnsSources, ",") {
+		config.DNSSources = append(config.DNSSources, strings.TrimSpace(source))
+	}
+	for _, cidr := range splitString(*internalCIDRs, ",") {
+		config.InternalCIDRs = append(config.InternalCIDRs, strings.TrimSpace(cidr))
+	}
+	for _, path := range splitString(*staticFiles, ",") {
+		config.StaticFiles = append(config.StaticFiles, strings.TrimSpace(path))
+	}
+	for _, name := range splitString(*detectors, ",") {
+		config.Detectors = append(config.Detectors, strings.TrimSpace(name))
+	}
+	for _, path := range splitString(*iocFiles, ",") {
+		config.IOCFiles = append(config.IOCFiles, strings.TrimSpace(path))
 	}
 
 	// Resolve interface
@@ -415,7 +1170,22 @@ func (nc *NetworkCapture) startWorkerPool() {
 			logger:      nc.logger,
 			stats:       nc.stats,
 			dnsResolver: nc.dnsResolver,
+			names:       nc.names,
+			dnsLog:      nc.dnsLog,
+			flows:       nc.flows,
+			http:        nc.http,
+			geo:         nc.geo,
+			internal:    nc.internal,
+			format:      nc.config.Format,
+			intel:       nc.intel,
+			iocInKernel: &nc.iocInKernel,
+			alert:       nc.emitAlert,
+			detectors:   nc.detectors,
+			alerting:    nc.alerting,
+			traffic:     newTrafficCounters(),
+			events:      nc.events,
 		}
+		nc.workers = append(nc.workers, worker)
 		go worker.start(nc.ctx)
 	}
 
@@ -469,6 +1239,63 @@ func (nc *NetworkCapture) startStatsReporter() {
 
 				nc.logger.Info("Stats - Processed: %d, Dropped: %d, Queue Full: %d",
 					processed, dropped, queueFull)
+
+				if refused := nc.flows.Refused(); refused > 0 {
+					nc.logger.Warn("Flow table full - Active: %d, Untracked packets: %d", nc.flows.Len(), refused)
+				}
+
+				if nc.dnsResolver.enabled {
+					rs := nc.names.Stats()
+					cs := nc.dnsResolver.CacheStats()
+					nc.logger.Info("DNS - Queue: %d, Hit rate: %.2f, Lookups: %d, Avg: %s, Max: %s, Deduplicated: %d, Skipped: %d",
+						rs.QueueDepth, rs.HitRate(), rs.Lookups, rs.LookupAverage, rs.LookupMax,
+						rs.Deduplicated, rs.QueueFull)
+					nc.logger.Info("DNS cache - Size: %d, Hits: %d, Misses: %d, Evictions: %d, Expired: %d",
+						cs.Size, cs.Hits, cs.Misses, cs.Evictions, cs.Expirations)
+				}
+
+				if nc.policy != nil {
+					// The mode can be changed at runtime through the pinned map
+					if mode, err := nc.policy.Mode(); err == nil && mode != policy.ModeOff {
+						nc.logger.Info("Policy - Mode: %s, Dropped: %d, Would drop: %d", mode,
+							atomic.LoadUint64(&nc.stats.PolicyDropped), atomic.LoadUint64(&nc.stats.PolicyWouldDrop))
+					}
+				}
+
+				if nc.ratelimit != nil {
+					rl := nc.ratelimit.Stats()
+					nc.logger.Info("Rate limit - Sources: %d, Limited: %d, Passed: %d, Dropped: %d",
+						rl.Buckets, rl.Limited, rl.Passed, rl.Dropped)
+				}
+
+				if nc.alerting != nil {
+					as := nc.alerting.Stats()
+					nc.logger.Info("Alerting - Raised: %d, Suppressed: %d, Delivered: %d, Failed: %d, Dropped: %d",
+						as.Raised, as.Suppressed, as.Delivered, as.Failed, as.Dropped)
+				}
+
+				if nc.koala != nil {
+					ks := nc.koala.Stats()
+					nc.logger.Info("Koala Server - Connected: %t, Flows: %d, Alerts: %d, Queued: %d, Dropped: %d, Reconnects: %d",
+						ks.Connected, ks.FlowsSent, ks.AlertsSent, ks.Queued, ks.Dropped, ks.Reconnects)
+				}
+
+				if nc.store != nil {
+					ss := nc.store.Stats()
+					nc.logger.Info("Flow store - Written: %d, Segments: %d, Size: %d MB, Removed: %d, Queued: %d, Dropped: %d",
+						ss.Written, ss.Segments, ss.Size>>20, ss.Removed, ss.Queued, ss.Dropped)
+				}
+
+				if nc.db != nil {
+					ds := nc.db.Stats()
+					nc.logger.Info("Database - Connected: %t, Flows: %d, Alerts: %d, Buffered: %d, Dropped: %d, Failures: %d",
+						ds.Connected, ds.FlowsWritten, ds.AlertsWritten, ds.Buffered, ds.Dropped, ds.Failures)
+				}
+
+				if nc.intel != nil {
+					nc.logger.Info("Threat intel - Indicators: %d, Matches: %d, Kernel: %t",
+						nc.intel.Len(), atomic.LoadUint64(&nc.stats.ThreatMatches), nc.iocInKernel.Load())
+				}
 			}
 		}
 	}()
@@ -481,6 +1308,20 @@ type PacketWorker struct {
 	logger      *l.Logger
 	stats       *Stats
 	dnsResolver *DNSResolver
+	names       *AsyncResolver
+	dnsLog      *DNSLogger
+	flows       *FlowTable
+	http        *HTTPTracker
+	geo         *geoip.Enricher
+	internal    *NetworkSet
+	format      string
+	intel       *threatintel.List
+	iocInKernel *atomic.Bool
+	alert       func(alert.Alert)
+	detectors   []detection.Detector
+	alerting    *alerting.Engine
+	traffic     *trafficCounters
+	events      *eventHub
 }
 
 func (w *PacketWorker) start(ctx context.Context) {
@@ -515,12 +1356,54 @@ func (w *PacketWorker) start(ctx context.Context) {
 
 func (w *PacketWorker) processBatch(batch []PayLoadTc) {
 	for _, event := range batch {
-		w.printPacket(event)
+		if len(event.Payload) > 0 && isDNSEvent(event.Event) {
+			w.handleDNS(event)
+		}
+		flow := w.flows.Update(event)
+		if flow.TLS == nil && event.Event.Protocol == 6 && isTLSHandshake(event.Payload) {
+			if info, err := parseClientHello(event.Payload); err == nil {
+				w.flows.SetTLS(event.Event, info)
+				flow.TLS = info
+			}
+		}
+		if w.http != nil && event.Event.Protocol == 6 && len(event.Payload) > 0 {
+			w.http.Observe(event)
+		}
+		w.checkThreatIntel(event, flow)
+		w.checkPolicy(event, flow)
+		w.checkRateLimit(event)
+		w.runDetectors(event, flow)
+		w.evaluateRules(event, flow)
+		event.SrcGeo = lookupGeo(w.geo, w.internal, event.Event.SrcIP)
+		event.DstGeo = lookupGeo(w.geo, w.internal, event.Event.DstIP)
+		w.printPacket(event, flow)
+		w.publishPacket(event, flow)
+		w.traffic.add(event)
 		atomic.AddUint64(&w.stats.PacketsProcessed, 1)
 	}
 }
 
-func (w *PacketWorker) printPacket(event PayLoadTc) {
+// handleDNS parses a captured DNS payload once and hands it to the passive
+// name learner and the DNS log.
+func (w *PacketWorker) handleDNS(event PayLoadTc) {
+	if !w.dnsResolver.enabled && w.dnsLog == nil {
+		return
+	}
+
+	msg := parseDNSPayload(event.Event.Protocol, event.Payload)
+	if msg == nil {
+		return
+	}
+
+	if w.dnsResolver.enabled {
+		w.dnsResolver.ObserveMessage(msg)
+	}
+	if w.dnsLog != nil {
+		w.dnsLog.Observe(event, msg)
+	}
+}
+
+func (w *PacketWorker) printPacket(event PayLoadTc, flow FlowRecord) {
 	direction := "Ingress"
 	if event.Event.Direction == 1 {
 		direction = "Egress"
@@ -529,36 +1412,49 @@ func (w *PacketWorker) printPacket(event PayLoadTc) {
 	srcIP := intToIP(event.Event.SrcIP)
 	dstIP := intToIP(event.Event.DstIP)
 
-	// Resolve DNS names if enabled
+	// Resolve DNS names if enabled, never waiting on the network
 	var srcDomain, dstDomain string
 	if w.dnsResolver.enabled {
-		srcDomain = w.dnsResolver.ResolveIP(srcIP)
-		dstDomain = w.dnsResolver.ResolveIP(dstIP)
+		srcDomain = w.names.Name(srcIP)
+		dstDomain = w.names.Name(dstIP)
 	} else {
 		srcDomain = "-"
 		dstDomain = "-"
 	}
 
+	if w.format == formatJSON {
+		printJSON(newPacketJSON(event, flow, srcDomain, dstDomain))
+		return
+	}
+
 	// Use a more efficient string builder approach
 	var output string
 	flags := tcpFlagsToString(event.Event.TcpFlags)
 
 	switch event.Event.Protocol {
 	case 6: // TCP
-		output = fmt.Sprintf("%s TCP: src=%s(%s):%d -> dst=%s(%s):%d | flags=%s | iface=%s",
+		output = fmt.Sprintf("%s TCP: src=%s(%s):%d -> dst=%s(%s):%d | flags=%s | iface=%s | scope=%s",
 			direction, srcIP, srcDomain, event.Event.SrcPort,
-			dstIP, dstDomain, event.Event.DstPort, flags, event.Iface)
+			dstIP, dstDomain, event.Event.DstPort, flags, event.Iface, event.Scope)
 	case 17: // UDP
-		output = fmt.Sprintf("%s UDP: src=%s(%s):%d -> dst=%s(%s):%d | flags=%s | iface=%s",
+		output = fmt.Sprintf("%s UDP: src=%s(%s):%d -> dst=%s(%s):%d | flags=%s | iface=%s | scope=%s",
 			direction, srcIP, srcDomain, event.Event.SrcPort,
-			dstIP, dstDomain, event.Event.DstPort, flags, event.Iface)
+			dstIP, dstDomain, event.Event.DstPort, flags, event.Iface, event.Scope)
 	case 1: // ICMP
-		output = fmt.Sprintf("%s ICMP: src=%s(%s) -> dst=%s(%s) | flags=%s | iface=%s",
-			direction, srcIP, srcDomain, dstIP, dstDomain, flags, event.Iface)
+		output = fmt.Sprintf("%s ICMP: src=%s(%s) -> dst=%s(%s) | flags=%s | iface=%s | scope=%s",
+			direction, srcIP, srcDomain, dstIP, dstDomain, flags, event.Iface, event.Scope)
 	default:
-		output = fmt.Sprintf("%s PROTO_%d: src=%s(%s) -> dst=%s(%s) | flags=%s | iface=%s",
+		output = fmt.Sprintf("%s PROTO_%d: src=%s(%s) -> dst=%s(%s) | flags=%s | iface=%s | scope=%s",
 			direction, event.Event.Protocol, srcIP, srcDomain,
-			dstIP, dstDomain, flags, event.Iface)
+			dstIP, dstDomain, flags, event.Iface, event.Scope)
+	}
+
+	if flow.TLS != nil {
+		output += " | " + flow.TLS.String()
+	}
+	output += geoSuffix(event.SrcGeo, event.DstGeo)
+	if action := policyAction(event.Event); action != "" {
+		output += fmt.Sprintf(" | policy=%s rule=%d", action, event.Event.RuleID)
 	}
 
 	fmt.Println(output)
@@ -599,11 +1495,53 @@ func (nc *NetworkCapture) loadEBPF() (*EBPFObjects, error) {
 
 	objs := &EBPFObjects{}
 
+	// Pin the policy maps so the policy command can reach them, without
+	// bpffs they stay private to this process
+	opts := &ebpf.CollectionOptions{Maps: ebpf.MapOptions{PinPath: nc.config.PinPath}}
+	if err := os.MkdirAll(nc.config.PinPath, 0700); err != nil {
+		nc.logger.Warn("cannot pin policy maps in %s, policy command unavailable: %v", nc.config.PinPath, err)
+		for _, name := range []string{policy.RulesMapName, policy.ConfigMapName} {
+			if m, ok := spec.Maps[name]; ok {
+				m.Pinning = ebpf.PinNone
+			}
+		}
+	}
+
 	raiseMemlockLimit()
-	if err := spec.LoadAndAssign(objs, nil); err != nil {
+	if err := spec.LoadAndAssign(objs, opts); err != nil {
 		return nil, fmt.Errorf("eBPF load failed: %v", err)
 	}
 
+	if err := nc.setupPolicy(objs); err != nil {
+		nc.closeEBPF(objs)
+		return nil, fmt.Errorf("failed to set up policy: %v", err)
+	}
+
+	if len(nc.rateRules) > 0 {
+		nc.ratelimit = NewRateLimiter(objs.RateLimitRules, objs.RateLimitBuckets, objs.RateLimitLimited, nc.emitAlert)
+		if err := nc.ratelimit.SetRules(nc.rateRules); err != nil {
+			nc.closeEBPF(objs)
+			return nil, fmt.Errorf("failed to configure rate limits: %v", err)
+		}
+		nc.logger.Info("Rate limiting ingress with %d rules", len(nc.rateRules))
+	}
+
+	// Ask the kernel for payload prefixes on the HTTP ports
+	for _, port := range nc.config.HTTPPorts {
+		if err := objs.CapturePorts.Put(port, uint8(1)); err != nil {
+			nc.closeEBPF(objs)
+			return nil, fmt.Errorf("failed to register capture port %d: %v", port, err)
+		}
+	}
+
+	// Let the kernel flag packets touching threat intel networks
+	if nc.intel != nil && nc.config.IOCKernel {
+		nc.iocMu.Lock()
+		nc.iocMap = objs.IOCLpm
+		nc.iocMu.Unlock()
+		nc.syncIOCMap(nc.intel.Indicators())
+	}
+
 	return objs, nil
 }
 
@@ -611,6 +1549,15 @@ type EBPFObjects struct {
 	TcIngress *ebpf.Program `ebpf:"tc_ingress"`
 	TcEgress  *ebpf.Program `ebpf:"tc_egress"`
 	Events    *ebpf.Map     `ebpf:"events"`
+
+	CapturePorts *ebpf.Map `ebpf:"capture_ports"`
+	IOCLpm       *ebpf.Map `ebpf:"ioc_lpm"`
+	PolicyRules  *ebpf.Map `ebpf:"policy_rules"`
+	PolicyConfig *ebpf.Map `ebpf:"policy_config"`
+
+	RateLimitRules   *ebpf.Map `ebpf:"ratelimit_rules"`
+	RateLimitBuckets *ebpf.Map `ebpf:"ratelimit_buckets"`
+	RateLimitLimited *ebpf.Map `ebpf:"ratelimit_limited"`
 }
 
 func (nc *NetworkCapture) closeEBPF(objs *EBPFObjects) {
@@ -623,6 +1570,31 @@ func (nc *NetworkCapture) closeEBPF(objs *EBPFObjects) {
 	if objs.Events != nil {
 		objs.Events.Close()
 	}
+	if objs.CapturePorts != nil {
+		objs.CapturePorts.Close()
+	}
+	if objs.RateLimitRules != nil {
+		objs.RateLimitRules.Close()
+	}
+	if objs.RateLimitBuckets != nil {
+		objs.RateLimitBuckets.Close()
+	}
+	if objs.RateLimitLimited != nil {
+		objs.RateLimitLimited.Close()
+	}
+	if objs.PolicyRules != nil {
+		objs.PolicyRules.Close()
+	}
+	if objs.PolicyConfig != nil {
+		objs.PolicyConfig.Close()
+	}
+	if objs.IOCLpm != nil {
+		nc.iocMu.Lock()
+		nc.iocMap = nil
+		nc.iocInKernel.Store(false)
+		nc.iocMu.Unlock()
+		objs.IOCLpm.Close()
+	}
 }
 
 func (nc *NetworkCapture) captureInterface(iface net.Interface, objs *EBPFObjects) {
@@ -632,15 +1604,20 @@ func (nc *NetworkCapture) captureInterface(iface net.Interface, objs *EBPFObject
 	link, err := netlink.LinkByName(iface.Name)
 	if err != nil {
 		nc.logger.Warn("link not found: %v", err)
+		nc.setAttachment(attachment{Name: iface.Name, Error: err.Error()})
 		return
 	}
 
 	// Setup TC filters
 	if err := nc.setupTCFilters(link, objs); err != nil {
 		nc.logger.Warn("failed to setup TC filters: %v", err)
+		nc.setAttachment(attachment{Name: iface.Name, Index: link.Attrs().Index, Error: err.Error()})
 		return
 	}
 	defer nc.cleanupTCFilters(link)
+	nc.setAttachment(attachment{Name: iface.Name, Index: link.Attrs().Index,
+		Hooks: []string{"ingress", "egress"}, AttachedAt: time.Now()})
+	defer nc.removeAttachment(iface.Name)
 
 	// Create perf reader with larger buffer
 	reader, err := perf.NewReader(objs.Events, os.Getpagesize()*16) // Larger buffer
@@ -668,6 +1645,7 @@ func (nc *NetworkCapture) captureInterface(iface net.Interface, objs *EBPFObject
 			if record.LostSamples > 0 {
 				nc.logger.Warn("lost %d samples on %s", record.LostSamples, iface.Name)
 				atomic.AddUint64(&nc.stats.PacketsDropped, record.LostSamples)
+				atomic.AddUint64(&nc.stats.LostSamples, record.LostSamples)
 				continue
 			}
 
@@ -683,6 +1661,8 @@ func (nc *NetworkCapture) captureInterface(iface net.Interface, objs *EBPFObject
 			}
 
 			payload := PayLoadTc{Iface: iface.Name, Event: event}
+			payload.Payload = capturedPayload(event, record.RawSample)
+			payload.Scope = nc.internal.Classify(event)
 
 			// Non-blocking send to event channel
 			select {
@@ -785,6 +1765,43 @@ func (nc *NetworkCapture) waitForShutdown() {
 func (nc *NetworkCapture) Shutdown() {
 	nc.cancel()
 	close(nc.eventChan)
+	nc.dnsResolver.Close()
+	nc.closeDetectors()
+	if nc.alerting != nil {
+		nc.alerting.Close(5 * time.Second)
+	}
+	if nc.otlp != nil {
+		nc.otlp.Close(15 * time.Second)
+	}
+	if nc.koala != nil {
+		nc.koala.Close(15 * time.Second)
+	}
+	if nc.store != nil {
+		nc.store.Close(15 * time.Second)
+	}
+	if nc.db != nil {
+		nc.db.Close(45 * time.Second)
+	}
+	if nc.geo != nil {
+		nc.geo.Close()
+	}
+	if nc.intel != nil {
+		nc.intel.Close()
+	}
+	for _, certs := range []*auth.Certs{nc.serverCerts, nc.apiCerts} {
+		if certs != nil {
+			certs.Close()
+		}
+	}
+	if nc.apiTokens != nil {
+		nc.apiTokens.Close()
+	}
+	if nc.audit != nil {
+		nc.audit.Close()
+	}
+	if nc.dnsLogFile != nil {
+		nc.dnsLogFile.Close()
+	}
 	nc.logger.Info("Shutdown complete")
 }
 
@@ -801,8 +1818,21 @@ func loadBpfSpec(path string) (*ebpf.CollectionSpec, error) {
 	return spec, nil
 }
 
+// capturedPayload returns the L4 payload bytes appended after the event, if
+// the kernel captured any for this packet.
+func capturedPayload(event Event, sample []byte) []byte {
+	if event.CapLen == 0 || len(sample) < eventSize+int(event.CapLen) {
+		return nil
+	}
+	packet := sample[eventSize : eventSize+int(event.CapLen)]
+	if int(event.PayloadOff) >= len(packet) {
+		return nil
+	}
+	return packet[event.PayloadOff:]
+}
+
 func isLocalhost(ip uint32) bool {
-	return ip == 0x0100007F // 127.0.0.1 in little-endian
+	return loopbackNetworks.ContainsV4(ip) // 127.0.0.0/8
 }
 
 func shouldDrop(event Event) bool {
@@ -813,7 +1843,11 @@ func tcpFlagsToString(flags uint8) string {
 	if flags == 0 {
 		return "NONE"
 	}
+	return fmt.Sprintf("0x%02x(%v)", flags, tcpFlagNames(flags))
+}
 
+// tcpFlagNames lists the names of the flags set in flags.
+func tcpFlagNames(flags uint8) []string {
 	flagNames := []struct {
 		mask uint8
 		name string
@@ -828,8 +1862,7 @@ func tcpFlagsToString(flags uint8) string {
 			result = append(result, f.name)
 		}
 	}
-
-	return fmt.Sprintf("0x%02x(%v)", flags, result)
+	return result
 }
 
 func intToIP(ip uint32) net.IP {
@@ -0,0 +1,144 @@
+package network
+
+import (
+	"errors"
+	"fmt"
+	"kernelKoala/pkg/alert"
+	"kernelKoala/pkg/alerting"
+	"kernelKoala/pkg/threatintel"
+	"sync/atomic"
+	"time"
+
+	"github.com/cilium/ebpf"
+)
+
+// EventFlagIOC is set by the kernel when an endpoint is in ioc_lpm.
+const EventFlagIOC = 0x01
+
+// iocKey mirrors struct ioc_key in tc.c.
+type iocKey struct {
+	PrefixLen uint32
+	Addr      [4]byte
+}
+
+// syncIOCMap replaces the contents of the kernel IOC map with the IPv4
+// indicators. The kernel flag is only trusted when every indicator made it
+// into the map, while the map is being rewritten userspace matches every
+// packet itself.
+func (nc *NetworkCapture) syncIOCMap(indicators []threatintel.Indicator) {
+	nc.iocMu.Lock()
+	defer nc.iocMu.Unlock()
+
+	if nc.iocMap == nil {
+		return
+	}
+	nc.iocInKernel.Store(false)
+
+	want := make(map[iocKey]struct{}, len(indicators))
+	for _, ind := range indicators {
+		if !ind.Prefix.Addr().Is4() {
+			continue
+		}
+		want[iocKey{PrefixLen: uint32(ind.Prefix.Bits()), Addr: ind.Prefix.Addr().As4()}] = struct{}{}
+	}
+
+	var stale []iocKey
+	var key iocKey
+	var value uint8
+	iter := nc.iocMap.Iterate()
+	for iter.Next(&key, &value) {
+		if _, ok := want[key]; !ok {
+			stale = append(stale, key)
+		}
+	}
+	if err := iter.Err(); err != nil {
+		nc.logger.Warn("failed to read kernel IOC map: %v", err)
+	}
+	for _, k := range stale {
+		if err := nc.iocMap.Delete(k); err != nil && !errors.Is(err, ebpf.ErrKeyNotExist) {
+			nc.logger.Warn("failed to remove %v from kernel IOC map: %v", k, err)
+		}
+	}
+
+	complete := true
+	for k := range want {
+		if err := nc.iocMap.Put(k, uint8(1)); err != nil {
+			complete = false
+			nc.logger.Warn("kernel IOC map update failed, matching in userspace: %v", err)
+			break
+		}
+	}
+	nc.iocInKernel.Store(complete)
+}
+
+// checkThreatIntel raises an alert for the first packet of a flow that
+// touches a listed network.
+func (w *PacketWorker) checkThreatIntel(event PayLoadTc, flow FlowRecord) {
+	if w.intel == nil {
+		return
+	}
+	// Only the first packet of a flow, and with the kernel map complete
+	// only the packets it flagged, are worth the two lookups
+	if !flow.isNew() || (w.iocInKernel.Load() && event.Event.Flags&EventFlagIOC == 0) {
+		return
+	}
+
+	e := event.Event
+	for _, end := range []struct {
+		role string
+		ip   uint32
+	}{{"src", e.SrcIP}, {"dst", e.DstIP}} {
+		ind, ok := w.intel.Match(intToIP(end.ip))
+		if !ok {
+			continue
+		}
+		atomic.AddUint64(&w.stats.ThreatMatches, 1)
+
+		fields := map[string]string{
+			"indicator": ind.Prefix.String(),
+			"source":    ind.Source,
+			"endpoint":  end.role,
+		}
+		if ind.Tag != "" {
+			fields["tag"] = ind.Tag
+		}
+		w.alert(alert.Alert{
+			Time:     time.Now(),
+			Type:     "threat-intel",
+			Severity: alert.SeverityHigh,
+			Message:  "traffic with listed indicator " + ind.String(),
+			Protocol: protocolName(e.Protocol),
+			SrcIP:    intToIP(e.SrcIP).String(),
+			SrcPort:  e.SrcPort,
+			DstIP:    intToIP(e.DstIP).String(),
+			DstPort:  e.DstPort,
+			Iface:    event.Iface,
+			Fields:   fields,
+		})
+	}
+}
+
+// emitAlert prints an alert next to the packet lines and hands it to the
+// alerting engine for delivery.
+func (nc *NetworkCapture) emitAlert(a alert.Alert) {
+	if nc.config.Format == formatJSON {
+		printJSON(a)
+	} else {
+		fmt.Println(a.String())
+	}
+	if nc.alerting != nil {
+		nc.alerting.Notify(a)
+	}
+	if nc.otlp != nil {
+		nc.otlp.EmitLog(alertLog(a))
+	}
+	if nc.events != nil {
+		nc.events.publish(eventAlert, alerting.AlertRecord(a), func() any { return a })
+	}
+	if nc.koala != nil {
+		nc.koala.AddAlert(a)
+	}
+	if nc.db != nil {
+		nc.db.AddAlert(a)
+	}
+}
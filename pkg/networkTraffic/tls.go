@@ -0,0 +1,343 @@
+package network
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// TLS extension types used by the ClientHello parser.
+const (
+	tlsExtServerName          = 0x0000
+	tlsExtSupportedGroups     = 0x000a
+	tlsExtECPointFormats      = 0x000b
+	tlsExtSignatureAlgorithms = 0x000d
+	tlsExtALPN                = 0x0010
+	tlsExtSupportedVersions   = 0x002b
+)
+
+var errNotClientHello = errors.New("not a TLS ClientHello")
+
+// TLSInfo holds what we learn from a connection's ClientHello. When the
+// capture cut the ClientHello short, Truncated is set and JA3 and JA4 are
+// left empty, fingerprints of a partial list of extensions would not match
+// the client's real ones.
+type TLSInfo struct {
+	SNI       string   `json:"sni,omitempty"`
+	ALPN      []string `json:"alpn,omitempty"`
+	Version   string   `json:"version,omitempty"`
+	JA3       string   `json:"ja3,omitempty"`
+	JA4       string   `json:"ja4,omitempty"`
+	Truncated bool     `json:"truncated,omitempty"`
+}
+
+func (i *TLSInfo) String() string {
+	s := fmt.Sprintf("tls=%s sni=%s alpn=%s ja3=%s ja4=%s",
+		i.Version, orDash(i.SNI), orDash(strings.Join(i.ALPN, ",")), orDash(i.JA3), orDash(i.JA4))
+	if i.Truncated {
+		s += " truncated=true"
+	}
+	return s
+}
+
+// clientHello is the raw material for the fingerprints.
+type clientHello struct {
+	version    uint16
+	ciphers    []uint16
+	extensions []uint16
+	groups     []uint16
+	points     []uint8
+	sigAlgs    []uint16
+	versions   []uint16
+	sni        string
+	alpn       []string
+}
+
+// isTLSHandshake reports whether payload starts with a TLS handshake record.
+func isTLSHandshake(payload []byte) bool {
+	return len(payload) >= 6 && payload[0] == 0x16 && payload[1] == 0x03 && payload[5] == 0x01
+}
+
+// parseClientHello extracts SNI, ALPN, the offered version and JA3/JA4 style
+// fingerprints. A ClientHello cut short by the capture length, e.g. a large
+// post-quantum one, still yields whatever extensions fit in it but no
+// fingerprints.
+func parseClientHello(payload []byte) (*TLSInfo, error) {
+	if !isTLSHandshake(payload) || len(payload) < 9 {
+		return nil, errNotClientHello
+	}
+	// The handshake header holds the 24 bit length of the ClientHello
+	length := int(payload[6])<<16 | int(payload[7])<<8 | int(payload[8])
+	truncated := len(payload) < 9+length
+
+	// record header (5) + handshake header (4)
+	b := payload[9:]
+	if len(b) < 2+32+1 {
+		return nil, errNotClientHello
+	}
+
+	var ch clientHello
+	ch.version = binary.BigEndian.Uint16(b)
+	b = b[2+32:]
+
+	// session id
+	n := int(b[0])
+	if len(b) < 1+n+2 {
+		return nil, errNotClientHello
+	}
+	b = b[1+n:]
+
+	// cipher suites
+	n = int(binary.BigEndian.Uint16(b))
+	if len(b) < 2+n+1 {
+		return nil, errNotClientHello
+	}
+	for i := 0; i+1 < n; i += 2 {
+		ch.ciphers = append(ch.ciphers, binary.BigEndian.Uint16(b[2+i:]))
+	}
+	b = b[2+n:]
+
+	// compression methods
+	n = int(b[0])
+	if len(b) < 1+n {
+		return nil, errNotClientHello
+	}
+	b = b[1+n:]
+
+	// extensions, possibly truncated
+	if len(b) >= 2 {
+		b = b[2:]
+		for len(b) >= 4 {
+			typ := binary.BigEndian.Uint16(b)
+			size := int(binary.BigEndian.Uint16(b[2:]))
+			ch.extensions = append(ch.extensions, typ)
+			if len(b) < 4+size {
+				break
+			}
+			ch.parseExtension(typ, b[4:4+size])
+			b = b[4+size:]
+		}
+	}
+
+	info := ch.info()
+	if truncated {
+		info.JA3, info.JA4, info.Truncated = "", "", true
+	}
+	return info, nil
+}
+
+func (ch *clientHello) parseExtension(typ uint16, data []byte) {
+	switch typ {
+	case tlsExtServerName:
+		// server_name_list: len(2) { type(1) len(2) name }
+		if len(data) < 5 || data[2] != 0 {
+			return
+		}
+		n := int(binary.BigEndian.Uint16(data[3:]))
+		if len(data) >= 5+n {
+			ch.sni = string(data[5 : 5+n])
+		}
+	case tlsExtALPN:
+		if len(data) < 2 {
+			return
+		}
+		data = data[2:]
+		for len(data) > 0 {
+			n := int(data[0])
+			if len(data) < 1+n {
+				return
+			}
+			ch.alpn = append(ch.alpn, string(data[1:1+n]))
+			data = data[1+n:]
+		}
+	case tlsExtSupportedGroups:
+		ch.groups = readUint16List(data, 2)
+	case tlsExtSignatureAlgorithms:
+		ch.sigAlgs = readUint16List(data, 2)
+	case tlsExtSupportedVersions:
+		ch.versions = readUint16List(data, 1)
+	case tlsExtECPointFormats:
+		if len(data) < 1 || len(data) < 1+int(data[0]) {
+			return
+		}
+		ch.points = append(ch.points, data[1:1+int(data[0])]...)
+	}
+}
+
+func (ch *clientHello) info() *TLSInfo {
+	version := ch.version
+	for _, v := range ch.versions {
+		if !isGREASE(v) && v > version {
+			version = v
+		}
+	}
+
+	return &TLSInfo{
+		SNI:     ch.sni,
+		ALPN:    ch.alpn,
+		Version: tlsVersionName(version),
+		JA3:     ch.ja3(),
+		JA4:     ch.ja4(version),
+	}
+}
+
+// ja3 returns the MD5 of SSLVersion,Ciphers,Extensions,Groups,PointFormats
+// with GREASE values removed.
+func (ch *clientHello) ja3() string {
+	points := make([]uint16, len(ch.points))
+	for i, p := range ch.points {
+		points[i] = uint16(p)
+	}
+
+	s := strings.Join([]string{
+		strconv.Itoa(int(ch.version)),
+		joinUint16(ch.ciphers, "-", 10),
+		joinUint16(ch.extensions, "-", 10),
+		joinUint16(ch.groups, "-", 10),
+		joinUint16(points, "-", 10),
+	}, ",")
+
+	sum := md5.Sum([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
+
+// ja4 builds a JA4-style fingerprint: a readable prefix followed by truncated
+// hashes of the sorted ciphers and of the sorted extensions plus signature
+// algorithms.
+func (ch *clientHello) ja4(version uint16) string {
+	ciphers := withoutGREASE(ch.ciphers)
+	exts := withoutGREASE(ch.extensions)
+
+	sniFlag := "i"
+	if ch.sni != "" {
+		sniFlag = "d"
+	}
+
+	alpn := "00"
+	if len(ch.alpn) > 0 && len(ch.alpn[0]) > 0 {
+		first := ch.alpn[0]
+		alpn = string(first[0]) + string(first[len(first)-1])
+	}
+
+	prefix := fmt.Sprintf("t%s%s%02d%02d%s", ja4Version(version), sniFlag,
+		min(len(ciphers), 99), min(len(exts), 99), alpn)
+
+	sortedCiphers := append([]uint16(nil), ciphers...)
+	sort.Slice(sortedCiphers, func(i, j int) bool { return sortedCiphers[i] < sortedCiphers[j] })
+
+	var sortedExts []uint16
+	for _, e := range exts {
+		if e != tlsExtServerName && e != tlsExtALPN {
+			sortedExts = append(sortedExts, e)
+		}
+	}
+	sort.Slice(sortedExts, func(i, j int) bool { return sortedExts[i] < sortedExts[j] })
+
+	extPart := joinUint16(sortedExts, ",", 16)
+	if sigs := withoutGREASE(ch.sigAlgs); len(sigs) > 0 {
+		extPart += "_" + joinUint16(sigs, ",", 16)
+	}
+
+	return prefix + "_" + truncatedSHA256(joinUint16(sortedCiphers, ",", 16)) +
+		"_" + truncatedSHA256(extPart)
+}
+
+func readUint16List(data []byte, lenBytes int) []uint16 {
+	if len(data) < lenBytes {
+		return nil
+	}
+	var n int
+	if lenBytes == 1 {
+		n = int(data[0])
+	} else {
+		n = int(binary.BigEndian.Uint16(data))
+	}
+	data = data[lenBytes:]
+	if len(data) < n {
+		n = len(data)
+	}
+
+	list := make([]uint16, 0, n/2)
+	for i := 0; i+1 < n; i += 2 {
+		list = append(list, binary.BigEndian.Uint16(data[i:]))
+	}
+	return list
+}
+
+// isGREASE reports whether v is one of the RFC 8701 reserved values.
+func isGREASE(v uint16) bool {
+	return v&0x0f0f == 0x0a0a && v>>8 == v&0xff
+}
+
+func withoutGREASE(values []uint16) []uint16 {
+	out := make([]uint16, 0, len(values))
+	for _, v := range values {
+		if !isGREASE(v) {
+			out = append(out, v)
+		}
+	}
+	return out
+}
+
+func joinUint16(values []uint16, sep string, base int) string {
+	parts := make([]string, 0, len(values))
+	for _, v := range values {
+		if isGREASE(v) {
+			continue
+		}
+		if base == 16 {
+			parts = append(parts, fmt.Sprintf("%04x", v))
+		} else {
+			parts = append(parts, strconv.Itoa(int(v)))
+		}
+	}
+	return strings.Join(parts, sep)
+}
+
+func truncatedSHA256(s string) string {
+	if s == "" {
+		return "000000000000"
+	}
+	sum := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(sum[:])[:12]
+}
+
+func tlsVersionName(v uint16) string {
+	switch v {
+	case 0x0304:
+		return "TLS1.3"
+	case 0x0303:
+		return "TLS1.2"
+	case 0x0302:
+		return "TLS1.1"
+	case 0x0301:
+		return "TLS1.0"
+	case 0x0300:
+		return "SSL3.0"
+	default:
+		return fmt.Sprintf("0x%04x", v)
+	}
+}
+
+func ja4Version(v uint16) string {
+	switch v {
+	case 0x0304:
+		return "13"
+	case 0x0303:
+		return "12"
+	case 0x0302:
+		return "11"
+	case 0x0301:
+		return "10"
+	case 0x0300:
+		return "s3"
+	default:
+		return "00"
+	}
+}
@@ -0,0 +1,185 @@
+package network
+
+import (
+	"encoding/binary"
+	"slices"
+	"testing"
+)
+
+type tlsExt struct {
+	typ  uint16
+	data []byte
+}
+
+func u16s(values ...uint16) []byte {
+	b := make([]byte, 0, 2*len(values))
+	for _, v := range values {
+		b = binary.BigEndian.AppendUint16(b, v)
+	}
+	return b
+}
+
+// withLen16 prefixes b with its length in two bytes.
+func withLen16(b []byte) []byte {
+	return append(binary.BigEndian.AppendUint16(nil, uint16(len(b))), b...)
+}
+
+func sniExt(name string) tlsExt {
+	entry := append([]byte{0}, withLen16([]byte(name))...)
+	return tlsExt{tlsExtServerName, withLen16(entry)}
+}
+
+func alpnExt(protos ...string) tlsExt {
+	var list []byte
+	for _, p := range protos {
+		list = append(append(list, byte(len(p))), p...)
+	}
+	return tlsExt{tlsExtALPN, withLen16(list)}
+}
+
+func listExt(typ uint16, values ...uint16) tlsExt {
+	return tlsExt{typ, withLen16(u16s(values...))}
+}
+
+// buildClientHello assembles a ClientHello record the way a client sends it.
+func buildClientHello(version uint16, ciphers []uint16, exts []tlsExt) []byte {
+	body := binary.BigEndian.AppendUint16(nil, version)
+	body = append(body, make([]byte, 32)...) // random
+	body = append(body, 32)                  // session id
+	body = append(body, make([]byte, 32)...)
+	body = append(body, withLen16(u16s(ciphers...))...)
+	body = append(body, 1, 0) // null compression
+
+	var ext []byte
+	for _, e := range exts {
+		ext = binary.BigEndian.AppendUint16(ext, e.typ)
+		ext = append(ext, withLen16(e.data)...)
+	}
+	body = append(body, withLen16(ext)...)
+
+	hs := append([]byte{0x01, byte(len(body) >> 16), byte(len(body) >> 8), byte(len(body))}, body...)
+	return append([]byte{0x16, 0x03, 0x01, byte(len(hs) >> 8), byte(len(hs))}, hs...)
+}
+
+func TestJA3(t *testing.T) {
+	// The example from the JA3 README:
+	// 769,47-53-5-10-49161-49162-49171-49172-50-56-19-4,0-10-11,23-24-25,0
+	hello := buildClientHello(0x0301,
+		[]uint16{47, 53, 5, 10, 49161, 49162, 49171, 49172, 50, 56, 19, 4},
+		[]tlsExt{
+			sniExt("example.com"),
+			listExt(tlsExtSupportedGroups, 23, 24, 25),
+			{tlsExtECPointFormats, []byte{1, 0}},
+		})
+
+	info, err := parseClientHello(hello)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.JA3 != "ada70206e40642a3e4461f35503241d5" {
+		t.Errorf("JA3 = %s", info.JA3)
+	}
+	if info.SNI != "example.com" || info.Version != "TLS1.0" || info.Truncated {
+		t.Errorf("info %+v", info)
+	}
+}
+
+// chromeHello is the Chrome ClientHello of the JA4 specification's
+// example, with GREASE values where Chrome puts them.
+func chromeHello() []byte {
+	return buildClientHello(0x0303,
+		[]uint16{0x2a2a, 0x1301, 0x1302, 0x1303, 0xc02b, 0xc02f, 0xc02c, 0xc030, 0xcca9, 0xcca8,
+			0xc013, 0xc014, 0x009c, 0x009d, 0x002f, 0x0035},
+		[]tlsExt{
+			{0x3a3a, nil},
+			listExt(tlsExtSupportedGroups, 0x4a4a, 0x001d, 0x0017, 0x0018),
+			{0x0017, nil},
+			{0x0023, nil},
+			sniExt("www.google.com"),
+			{0x0012, nil},
+			{tlsExtECPointFormats, []byte{1, 0}},
+			{0x001b, []byte{2, 0, 2}},
+			listExt(tlsExtSignatureAlgorithms, 0x0403, 0x0804, 0x0401, 0x0503, 0x0805, 0x0501, 0x0806, 0x0601),
+			{0x0005, []byte{1, 0, 0, 0, 0}},
+			alpnExt("h2", "http/1.1"),
+			{0x4469, []byte{0, 3, 2, 'h', '2'}},
+			{0x002d, []byte{1, 1}},
+			{tlsExtSupportedVersions, append([]byte{6}, u16s(0x5a5a, 0x0304, 0x0303)...)},
+			{0x0033, []byte{0, 0}},
+			{0xff01, []byte{0}},
+			{0x0015, make([]byte, 8)},
+			{0x1a1a, []byte{0}},
+		})
+}
+
+func TestJA4(t *testing.T) {
+	info, err := parseClientHello(chromeHello())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.JA4 != "t13d1516h2_8daaf6152771_e5627efa2ab1" {
+		t.Errorf("JA4 = %s", info.JA4)
+	}
+	if info.SNI != "www.google.com" || info.Version != "TLS1.3" || !slices.Equal(info.ALPN, []string{"h2", "http/1.1"}) {
+		t.Errorf("info %+v", info)
+	}
+	// GREASE values don't change the JA3 either
+	if len(info.JA3) != 32 {
+		t.Errorf("JA3 = %q", info.JA3)
+	}
+}
+
+func TestClientHelloWithoutSNIAndALPN(t *testing.T) {
+	info, err := parseClientHello(buildClientHello(0x0303, []uint16{0x1301}, []tlsExt{
+		listExt(tlsExtSignatureAlgorithms, 0x0403),
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.JA4[:10] != "t12i010100" {
+		t.Errorf("JA4 = %s, want an IP-only TLS 1.2 prefix", info.JA4)
+	}
+}
+
+func TestTruncatedClientHello(t *testing.T) {
+	hello := chromeHello()
+	// Cut inside the extensions, after the server name
+	info, err := parseClientHello(hello[:len(hello)-40])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !info.Truncated || info.JA3 != "" || info.JA4 != "" {
+		t.Errorf("truncated hello fingerprinted: %+v", info)
+	}
+	if info.SNI != "www.google.com" {
+		t.Errorf("SNI %q lost in a truncated hello", info.SNI)
+	}
+}
+
+func TestNotClientHello(t *testing.T) {
+	hello := chromeHello()
+	for name, payload := range map[string][]byte{
+		"empty":       nil,
+		"http":        []byte("GET / HTTP/1.1\r\n\r\n"),
+		"server":      append([]byte{0x16, 0x03, 0x03, 0, 0x40, 0x02}, make([]byte, 64)...),
+		"header only": hello[:9],
+		"no ciphers":  hello[:9+2+32+1+32+1],
+	} {
+		if _, err := parseClientHello(payload); err == nil {
+			t.Errorf("%s parsed as a ClientHello", name)
+		}
+	}
+}
+
+func TestGREASE(t *testing.T) {
+	for _, v := range []uint16{0x0a0a, 0x1a1a, 0xfafa} {
+		if !isGREASE(v) {
+			t.Errorf("%04x not GREASE", v)
+		}
+	}
+	for _, v := range []uint16{0x0a1a, 0x1301, 0x0000} {
+		if isGREASE(v) {
+			t.Errorf("%04x taken for GREASE", v)
+		}
+	}
+}
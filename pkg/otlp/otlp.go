@@ -0,0 +1,403 @@
+// Package otlp exports metrics and log records to an OpenTelemetry
+// collector over OTLP, either gRPC or HTTP with protobuf bodies.
+package otlp
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sync/atomic"
+	"time"
+
+	commonpb "go.opentelemetry.io/proto/otlp/common/v1"
+	logspb "go.opentelemetry.io/proto/otlp/logs/v1"
+	metricspb "go.opentelemetry.io/proto/otlp/metrics/v1"
+	resourcepb "go.opentelemetry.io/proto/otlp/resource/v1"
+)
+
+// Protocols accepted in Config.Protocol.
+const (
+	ProtocolGRPC = "grpc"
+	ProtocolHTTP = "http"
+)
+
+const scopeName = "kernelKoala"
+
+// Config holds the exporter settings.
+type Config struct {
+	// Endpoint is host:port for gRPC and a base URL such as
+	// http://collector:4318 for HTTP.
+	Endpoint string
+	Protocol string
+	Insecure bool
+	Headers  map[string]string
+	Timeout  time.Duration
+	// MetricsInterval is how often metrics are collected and sent.
+	MetricsInterval time.Duration
+	// Log records are sent in batches of up to BatchSize, at least every
+	// FlushInterval, records beyond QueueSize are dropped.
+	BatchSize     int
+	FlushInterval time.Duration
+	QueueSize     int
+	// MaxRetries bounds the attempts for retryable failures.
+	MaxRetries  int
+	ServiceName string
+	// Resource are further attributes of the resource next to the service
+	// and host name.
+	Resource []Attr
+}
+
+func DefaultConfig() Config {
+	return Config{
+		Protocol:        ProtocolGRPC,
+		Timeout:         10 * time.Second,
+		MetricsInterval: 30 * time.Second,
+		BatchSize:       512,
+		FlushInterval:   5 * time.Second,
+		QueueSize:       8192,
+		MaxRetries:      5,
+		ServiceName:     "kernelkoala",
+	}
+}
+
+// kubernetesEnv maps the environment variables a pod spec fills from the
+// downward API to the resource attributes they become.
+var kubernetesEnv = []struct{ env, key string }{
+	{"K8S_POD_NAME", "k8s.pod.name"},
+	{"K8S_NAMESPACE_NAME", "k8s.namespace.name"},
+	{"K8S_NODE_NAME", "k8s.node.name"},
+}
+
+// KubernetesResource returns the k8s.* resource attributes of the pod the
+// agent runs in, none outside Kubernetes.
+func KubernetesResource() []Attr {
+	var attrs []Attr
+	for _, e := range kubernetesEnv {
+		if v := os.Getenv(e.env); v != "" {
+			attrs = append(attrs, String(e.key, v))
+		}
+	}
+	return attrs
+}
+
+// Attr is an attribute, Value is a string, int64, float64 or bool.
+type Attr struct {
+	Key   string
+	Value any
+}
+
+func String(key, value string) Attr { return Attr{Key: key, Value: value} }
+
+func Int(key string, value int64) Attr { return Attr{Key: key, Value: value} }
+
+func Bool(key string, value bool) Attr { return Attr{Key: key, Value: value} }
+
+// LogRecord is one flow or alert.
+type LogRecord struct {
+	Time     time.Time
+	Severity logspb.SeverityNumber
+	Body     string
+	Attrs    []Attr
+}
+
+// Point is one series of a metric.
+type Point struct {
+	Attrs []Attr
+	Value int64
+}
+
+// Metric is a cumulative sum when Monotonic is set and a gauge otherwise.
+type Metric struct {
+	Name        string
+	Description string
+	Unit        string
+	Monotonic   bool
+	Points      []Point
+}
+
+// Stats counts exported and lost records.
+type Stats struct {
+	LogsSent       uint64
+	LogsDropped    uint64
+	MetricsSent    uint64
+	ExportFailures uint64
+}
+
+// exporter is the wire protocol.
+type exporter interface {
+	exportLogs(ctx context.Context, req *logsRequest) error
+	exportMetrics(ctx context.Context, req *metricsRequest) error
+	close() error
+}
+
+// Exporter batches log records and periodically collects metrics.
+type Exporter struct {
+	cfg      Config
+	client   exporter
+	resource *resourcepb.Resource
+	collect  func() []Metric
+	onError  func(error)
+	start    time.Time
+	// backoff is the delay before the first retry
+	backoff time.Duration
+
+	logs chan LogRecord
+	done chan struct{}
+
+	stats Stats
+}
+
+// New connects to the collector. collect is called every MetricsInterval
+// and may be nil, export errors that survive the retries go to onError.
+func New(cfg Config, collect func() []Metric, onError func(error)) (*Exporter, error) {
+	var client exporter
+	var err error
+	switch cfg.Protocol {
+	case ProtocolGRPC, "":
+		client, err = newGRPCExporter(cfg)
+	case ProtocolHTTP:
+		client, err = newHTTPExporter(cfg)
+	default:
+		return nil, fmt.Errorf("unknown OTLP protocol %q", cfg.Protocol)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	host, _ := os.Hostname()
+	return &Exporter{
+		cfg:    cfg,
+		client: client,
+		resource: &resourcepb.Resource{Attributes: keyValues(append([]Attr{
+			String("service.name", cfg.ServiceName),
+			String("host.name", host),
+		}, cfg.Resource...))},
+		collect: collect,
+		onError: onError,
+		start:   time.Now(),
+		backoff: time.Second,
+		logs:    make(chan LogRecord, cfg.QueueSize),
+		done:    make(chan struct{}),
+	}, nil
+}
+
+// EmitLog queues a record without blocking.
+func (e *Exporter) EmitLog(r LogRecord) {
+	select {
+	case e.logs <- r:
+	default:
+		atomic.AddUint64(&e.stats.LogsDropped, 1)
+	}
+}
+
+// Run sends batches and metrics until ctx is done, then flushes what is
+// left.
+func (e *Exporter) Run(ctx context.Context) {
+	defer close(e.done)
+
+	flush := time.NewTicker(e.cfg.FlushInterval)
+	defer flush.Stop()
+	metrics := time.NewTicker(e.cfg.MetricsInterval)
+	defer metrics.Stop()
+
+	batch := make([]LogRecord, 0, e.cfg.BatchSize)
+	send := func(ctx context.Context) {
+		if len(batch) > 0 {
+			e.sendLogs(ctx, batch)
+			batch = batch[:0]
+		}
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			final, cancel := context.WithTimeout(context.Background(), e.cfg.Timeout)
+			defer cancel()
+			for drained := false; !drained; {
+				select {
+				case r := <-e.logs:
+					batch = append(batch, r)
+					if len(batch) >= e.cfg.BatchSize {
+						send(final)
+					}
+				default:
+					drained = true
+				}
+			}
+			send(final)
+			e.sendMetrics(final)
+			return
+		case r := <-e.logs:
+			batch = append(batch, r)
+			if len(batch) >= e.cfg.BatchSize {
+				send(ctx)
+			}
+		case <-flush.C:
+			send(ctx)
+		case <-metrics.C:
+			e.sendMetrics(ctx)
+		}
+	}
+}
+
+func (e *Exporter) sendLogs(ctx context.Context, batch []LogRecord) {
+	records := make([]*logspb.LogRecord, 0, len(batch))
+	for _, r := range batch {
+		records = append(records, &logspb.LogRecord{
+			TimeUnixNano:         uint64(r.Time.UnixNano()),
+			ObservedTimeUnixNano: uint64(time.Now().UnixNano()),
+			SeverityNumber:       r.Severity,
+			SeverityText:         severityText(r.Severity),
+			Body:                 &commonpb.AnyValue{Value: &commonpb.AnyValue_StringValue{StringValue: r.Body}},
+			Attributes:           keyValues(r.Attrs),
+		})
+	}
+	req := newLogsRequest(e.resource, &logspb.ScopeLogs{
+		Scope:      &commonpb.InstrumentationScope{Name: scopeName},
+		LogRecords: records,
+	})
+
+	err := e.retry(ctx, func(ctx context.Context) error { return e.client.exportLogs(ctx, req) })
+	if err != nil {
+		atomic.AddUint64(&e.stats.ExportFailures, 1)
+		atomic.AddUint64(&e.stats.LogsDropped, uint64(len(batch)))
+		e.reportError(fmt.Errorf("exporting %d log records: %v", len(batch), err))
+		return
+	}
+	atomic.AddUint64(&e.stats.LogsSent, uint64(len(batch)))
+}
+
+func (e *Exporter) sendMetrics(ctx context.Context) {
+	if e.collect == nil {
+		return
+	}
+	metrics := e.collect()
+	if len(metrics) == 0 {
+		return
+	}
+
+	now := uint64(time.Now().UnixNano())
+	start := uint64(e.start.UnixNano())
+	out := make([]*metricspb.Metric, 0, len(metrics))
+	for _, m := range metrics {
+		points := make([]*metricspb.NumberDataPoint, 0, len(m.Points))
+		for _, p := range m.Points {
+			points = append(points, &metricspb.NumberDataPoint{
+				Attributes:        keyValues(p.Attrs),
+				StartTimeUnixNano: start,
+				TimeUnixNano:      now,
+				Value:             &metricspb.NumberDataPoint_AsInt{AsInt: p.Value},
+			})
+		}
+		pm := &metricspb.Metric{Name: m.Name, Description: m.Description, Unit: m.Unit}
+		if m.Monotonic {
+			pm.Data = &metricspb.Metric_Sum{Sum: &metricspb.Sum{
+				DataPoints:             points,
+				AggregationTemporality: metricspb.AggregationTemporality_AGGREGATION_TEMPORALITY_CUMULATIVE,
+				IsMonotonic:            true,
+			}}
+		} else {
+			pm.Data = &metricspb.Metric_Gauge{Gauge: &metricspb.Gauge{DataPoints: points}}
+		}
+		out = append(out, pm)
+	}
+	req := newMetricsRequest(e.resource, &metricspb.ScopeMetrics{
+		Scope:   &commonpb.InstrumentationScope{Name: scopeName},
+		Metrics: out,
+	})
+
+	if err := e.retry(ctx, func(ctx context.Context) error { return e.client.exportMetrics(ctx, req) }); err != nil {
+		atomic.AddUint64(&e.stats.ExportFailures, 1)
+		e.reportError(fmt.Errorf("exporting metrics: %v", err))
+		return
+	}
+	atomic.AddUint64(&e.stats.MetricsSent, uint64(len(out)))
+}
+
+// retry calls export until it succeeds, fails permanently or MaxRetries
+// attempts were made, backing off exponentially.
+func (e *Exporter) retry(ctx context.Context, export func(context.Context) error) error {
+	backoff := e.backoff
+	for attempt := 1; ; attempt++ {
+		callCtx, cancel := context.WithTimeout(ctx, e.cfg.Timeout)
+		err := export(callCtx)
+		cancel()
+		if err == nil || !retryable(err) || attempt >= e.cfg.MaxRetries {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(backoff):
+		}
+		if backoff < 30*time.Second {
+			backoff *= 2
+		}
+	}
+}
+
+func (e *Exporter) reportError(err error) {
+	if e.onError != nil {
+		e.onError(err)
+	}
+}
+
+func (e *Exporter) Stats() Stats {
+	return Stats{
+		LogsSent:       atomic.LoadUint64(&e.stats.LogsSent),
+		LogsDropped:    atomic.LoadUint64(&e.stats.LogsDropped),
+		MetricsSent:    atomic.LoadUint64(&e.stats.MetricsSent),
+		ExportFailures: atomic.LoadUint64(&e.stats.ExportFailures),
+	}
+}
+
+// Close waits for Run to flush, if it was started, and closes the
+// connection.
+func (e *Exporter) Close(timeout time.Duration) error {
+	select {
+	case <-e.done:
+	case <-time.After(timeout):
+	}
+	return e.client.close()
+}
+
+func keyValues(attrs []Attr) []*commonpb.KeyValue {
+	kvs := make([]*commonpb.KeyValue, 0, len(attrs))
+	for _, a := range attrs {
+		var v *commonpb.AnyValue
+		switch val := a.Value.(type) {
+		case string:
+			if val == "" {
+				continue
+			}
+			v = &commonpb.AnyValue{Value: &commonpb.AnyValue_StringValue{StringValue: val}}
+		case int64:
+			v = &commonpb.AnyValue{Value: &commonpb.AnyValue_IntValue{IntValue: val}}
+		case int:
+			v = &commonpb.AnyValue{Value: &commonpb.AnyValue_IntValue{IntValue: int64(val)}}
+		case float64:
+			v = &commonpb.AnyValue{Value: &commonpb.AnyValue_DoubleValue{DoubleValue: val}}
+		case bool:
+			v = &commonpb.AnyValue{Value: &commonpb.AnyValue_BoolValue{BoolValue: val}}
+		default:
+			v = &commonpb.AnyValue{Value: &commonpb.AnyValue_StringValue{StringValue: fmt.Sprint(val)}}
+		}
+		kvs = append(kvs, &commonpb.KeyValue{Key: a.Key, Value: v})
+	}
+	return kvs
+}
+
+func severityText(s logspb.SeverityNumber) string {
+	switch {
+	case s >= logspb.SeverityNumber_SEVERITY_NUMBER_FATAL:
+		return "FATAL"
+	case s >= logspb.SeverityNumber_SEVERITY_NUMBER_ERROR:
+		return "ERROR"
+	case s >= logspb.SeverityNumber_SEVERITY_NUMBER_WARN:
+		return "WARN"
+	case s >= logspb.SeverityNumber_SEVERITY_NUMBER_INFO:
+		return "INFO"
+	default:
+		return "DEBUG"
+	}
+}
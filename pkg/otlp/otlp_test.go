@@ -0,0 +1,523 @@
+package otlp
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	collogspb "go.opentelemetry.io/proto/otlp/collector/logs/v1"
+	colmetricspb "go.opentelemetry.io/proto/otlp/collector/metrics/v1"
+	commonpb "go.opentelemetry.io/proto/otlp/common/v1"
+	logspb "go.opentelemetry.io/proto/otlp/logs/v1"
+	metricspb "go.opentelemetry.io/proto/otlp/metrics/v1"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+)
+
+// receiver is an in-process collector. It fails the first failures calls,
+// with a retryable error unless permanent is set, and keeps the requests
+// it accepted.
+type receiver struct {
+	failures  int
+	permanent bool
+
+	mu      sync.Mutex
+	calls   int
+	logs    []*collogspb.ExportLogsServiceRequest
+	metrics []*colmetricspb.ExportMetricsServiceRequest
+	apiKeys []string
+}
+
+// answer counts a call and reports whether it fails.
+func (r *receiver) answer(apiKey string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.calls++
+	r.apiKeys = append(r.apiKeys, apiKey)
+	return r.calls <= r.failures
+}
+
+func (r *receiver) addLogs(req *collogspb.ExportLogsServiceRequest) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.logs = append(r.logs, req)
+}
+
+func (r *receiver) addMetrics(req *colmetricspb.ExportMetricsServiceRequest) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.metrics = append(r.metrics, req)
+}
+
+// logBatches returns the record count of every accepted logs request.
+func (r *receiver) logBatches() []int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var sizes []int
+	for _, req := range r.logs {
+		sizes = append(sizes, len(req.ResourceLogs[0].ScopeLogs[0].LogRecords))
+	}
+	return sizes
+}
+
+func (r *receiver) callCount() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.calls
+}
+
+type grpcLogs struct {
+	collogspb.UnimplementedLogsServiceServer
+	r *receiver
+}
+
+func (g grpcLogs) Export(ctx context.Context, req *collogspb.ExportLogsServiceRequest) (*collogspb.ExportLogsServiceResponse, error) {
+	if err := g.r.grpcAnswer(ctx); err != nil {
+		return nil, err
+	}
+	g.r.addLogs(req)
+	return &collogspb.ExportLogsServiceResponse{}, nil
+}
+
+type grpcMetrics struct {
+	colmetricspb.UnimplementedMetricsServiceServer
+	r *receiver
+}
+
+func (g grpcMetrics) Export(ctx context.Context, req *colmetricspb.ExportMetricsServiceRequest) (*colmetricspb.ExportMetricsServiceResponse, error) {
+	if err := g.r.grpcAnswer(ctx); err != nil {
+		return nil, err
+	}
+	g.r.addMetrics(req)
+	return &colmetricspb.ExportMetricsServiceResponse{}, nil
+}
+
+func (r *receiver) grpcAnswer(ctx context.Context) error {
+	md, _ := metadata.FromIncomingContext(ctx)
+	var key string
+	if v := md.Get("x-api-key"); len(v) > 0 {
+		key = v[0]
+	}
+	if !r.answer(key) {
+		return nil
+	}
+	if r.permanent {
+		return status.Error(codes.InvalidArgument, "bad request")
+	}
+	return status.Error(codes.Unavailable, "collector busy")
+}
+
+func (r *receiver) serveGRPC(t *testing.T) string {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := grpc.NewServer()
+	collogspb.RegisterLogsServiceServer(srv, grpcLogs{r: r})
+	colmetricspb.RegisterMetricsServiceServer(srv, grpcMetrics{r: r})
+	go srv.Serve(lis)
+	t.Cleanup(srv.Stop)
+	return lis.Addr().String()
+}
+
+func (r *receiver) serveHTTP(t *testing.T) string {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Header.Get("Content-Type") != "application/x-protobuf" {
+			http.Error(w, "not protobuf", http.StatusUnsupportedMediaType)
+			return
+		}
+		if r.answer(req.Header.Get("x-api-key")) {
+			if r.permanent {
+				http.Error(w, "bad request", http.StatusBadRequest)
+			} else {
+				http.Error(w, "collector busy", http.StatusServiceUnavailable)
+			}
+			return
+		}
+		body, _ := io.ReadAll(req.Body)
+		switch req.URL.Path {
+		case "/v1/logs":
+			var msg collogspb.ExportLogsServiceRequest
+			if err := proto.Unmarshal(body, &msg); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			r.addLogs(&msg)
+		case "/v1/metrics":
+			var msg colmetricspb.ExportMetricsServiceRequest
+			if err := proto.Unmarshal(body, &msg); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			r.addMetrics(&msg)
+		default:
+			http.NotFound(w, req)
+			return
+		}
+		w.Header().Set("Content-Type", "application/x-protobuf")
+	}))
+	t.Cleanup(srv.Close)
+	return srv.URL
+}
+
+// testExporter runs an exporter against r over protocol. stop flushes and
+// closes it, errors collects what went to onError.
+type testExporter struct {
+	*Exporter
+	cancel context.CancelFunc
+
+	mu     sync.Mutex
+	errors []error
+}
+
+func newTestExporter(t *testing.T, protocol string, r *receiver, collect func() []Metric) *testExporter {
+	cfg := DefaultConfig()
+	cfg.Protocol = protocol
+	cfg.Insecure = true
+	cfg.Headers = map[string]string{"x-api-key": "secret"}
+	cfg.BatchSize = 3
+	cfg.FlushInterval = time.Hour
+	cfg.MetricsInterval = time.Hour
+	cfg.QueueSize = 100
+	cfg.MaxRetries = 3
+	cfg.Timeout = 5 * time.Second
+	cfg.ServiceName = "koala-test"
+	cfg.Resource = []Attr{String("k8s.pod.name", "kernelkoala-x7k2p")}
+	if protocol == ProtocolGRPC {
+		cfg.Endpoint = r.serveGRPC(t)
+	} else {
+		cfg.Endpoint = r.serveHTTP(t)
+	}
+
+	te := &testExporter{}
+	e, err := New(cfg, collect, func(err error) {
+		te.mu.Lock()
+		te.errors = append(te.errors, err)
+		te.mu.Unlock()
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	e.backoff = time.Millisecond
+	te.Exporter = e
+
+	ctx, cancel := context.WithCancel(context.Background())
+	te.cancel = cancel
+	go e.Run(ctx)
+	t.Cleanup(func() { te.stop() })
+	return te
+}
+
+func (te *testExporter) stop() {
+	te.cancel()
+	te.Close(10 * time.Second)
+}
+
+func (te *testExporter) errorCount() int {
+	te.mu.Lock()
+	defer te.mu.Unlock()
+	return len(te.errors)
+}
+
+func eachProtocol(t *testing.T, test func(t *testing.T, protocol string)) {
+	for _, p := range []string{ProtocolGRPC, ProtocolHTTP} {
+		t.Run(p, func(t *testing.T) { test(t, p) })
+	}
+}
+
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(10 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func attrMap(kvs []*commonpb.KeyValue) map[string]any {
+	m := make(map[string]any, len(kvs))
+	for _, kv := range kvs {
+		switch v := kv.Value.Value.(type) {
+		case *commonpb.AnyValue_StringValue:
+			m[kv.Key] = v.StringValue
+		case *commonpb.AnyValue_IntValue:
+			m[kv.Key] = v.IntValue
+		case *commonpb.AnyValue_BoolValue:
+			m[kv.Key] = v.BoolValue
+		case *commonpb.AnyValue_DoubleValue:
+			m[kv.Key] = v.DoubleValue
+		}
+	}
+	return m
+}
+
+func testRecord(i int) LogRecord {
+	return LogRecord{
+		Time:     time.Date(2026, 1, 1, 12, 0, i, 0, time.UTC),
+		Severity: logspb.SeverityNumber_SEVERITY_NUMBER_INFO,
+		Body:     "flow",
+		Attrs:    []Attr{Int("seq", int64(i))},
+	}
+}
+
+func TestExportLogBatches(t *testing.T) {
+	eachProtocol(t, func(t *testing.T, protocol string) {
+		r := &receiver{}
+		e := newTestExporter(t, protocol, r, nil)
+
+		for i := range 7 {
+			e.EmitLog(testRecord(i))
+		}
+		// Full batches go out right away, the rest waits for the flush
+		waitFor(t, "two full batches", func() bool { return len(r.logBatches()) == 2 })
+		e.stop()
+
+		got := r.logBatches()
+		if len(got) != 3 || got[0] != 3 || got[1] != 3 || got[2] != 1 {
+			t.Fatalf("batch sizes %v, want [3 3 1]", got)
+		}
+		var seq []int64
+		for _, req := range r.logs {
+			for _, rec := range req.ResourceLogs[0].ScopeLogs[0].LogRecords {
+				seq = append(seq, attrMap(rec.Attributes)["seq"].(int64))
+			}
+		}
+		for i, s := range seq {
+			if s != int64(i) {
+				t.Fatalf("records out of order: %v", seq)
+			}
+		}
+		if s := e.Stats(); s.LogsSent != 7 || s.LogsDropped != 0 || s.ExportFailures != 0 {
+			t.Errorf("stats = %+v", s)
+		}
+	})
+}
+
+func TestExportLogRecord(t *testing.T) {
+	eachProtocol(t, func(t *testing.T, protocol string) {
+		r := &receiver{}
+		e := newTestExporter(t, protocol, r, nil)
+
+		at := time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+		e.EmitLog(LogRecord{
+			Time:     at,
+			Severity: logspb.SeverityNumber_SEVERITY_NUMBER_ERROR,
+			Body:     "port scan",
+			Attrs: []Attr{
+				String("source.address", "203.0.113.7"),
+				Int("destination.port", 22),
+				Bool("kernelkoala.flow.closed", true),
+				{Key: "ratio", Value: 0.5},
+				String("tls.client.server_name", ""),
+			},
+		})
+		e.stop()
+
+		if len(r.logs) != 1 {
+			t.Fatalf("%d requests, want 1", len(r.logs))
+		}
+		rl := r.logs[0].ResourceLogs[0]
+		res := attrMap(rl.Resource.Attributes)
+		if res["service.name"] != "koala-test" || res["host.name"] == "" || res["k8s.pod.name"] != "kernelkoala-x7k2p" {
+			t.Errorf("resource attributes %v", res)
+		}
+		if rl.ScopeLogs[0].Scope.Name != scopeName {
+			t.Errorf("scope %q, want %q", rl.ScopeLogs[0].Scope.Name, scopeName)
+		}
+
+		rec := rl.ScopeLogs[0].LogRecords[0]
+		if rec.TimeUnixNano != uint64(at.UnixNano()) || rec.ObservedTimeUnixNano == 0 {
+			t.Errorf("times %d/%d", rec.TimeUnixNano, rec.ObservedTimeUnixNano)
+		}
+		if rec.SeverityNumber != logspb.SeverityNumber_SEVERITY_NUMBER_ERROR || rec.SeverityText != "ERROR" {
+			t.Errorf("severity %v %q", rec.SeverityNumber, rec.SeverityText)
+		}
+		if rec.Body.GetStringValue() != "port scan" {
+			t.Errorf("body %v", rec.Body)
+		}
+		attrs := attrMap(rec.Attributes)
+		want := map[string]any{
+			"source.address":          "203.0.113.7",
+			"destination.port":        int64(22),
+			"kernelkoala.flow.closed": true,
+			"ratio":                   0.5,
+		}
+		if len(attrs) != len(want) {
+			t.Errorf("attributes %v, want %v without empty strings", attrs, want)
+		}
+		for k, v := range want {
+			if attrs[k] != v {
+				t.Errorf("%s = %v (%T), want %v (%T)", k, attrs[k], attrs[k], v, v)
+			}
+		}
+		if r.apiKeys[0] != "secret" {
+			t.Errorf("header x-api-key = %q", r.apiKeys[0])
+		}
+	})
+}
+
+func TestExportRetries(t *testing.T) {
+	eachProtocol(t, func(t *testing.T, protocol string) {
+		r := &receiver{failures: 2}
+		e := newTestExporter(t, protocol, r, nil)
+
+		for i := range 3 {
+			e.EmitLog(testRecord(i))
+		}
+		e.stop()
+
+		if r.callCount() != 3 || len(r.logs) != 1 {
+			t.Fatalf("%d calls and %d accepted, want 3 and 1", r.callCount(), len(r.logs))
+		}
+		if s := e.Stats(); s.LogsSent != 3 || s.ExportFailures != 0 || e.errorCount() != 0 {
+			t.Errorf("stats = %+v, %d errors", s, e.errorCount())
+		}
+	})
+}
+
+func TestExportGivesUp(t *testing.T) {
+	eachProtocol(t, func(t *testing.T, protocol string) {
+		r := &receiver{failures: 100}
+		e := newTestExporter(t, protocol, r, nil)
+
+		for i := range 3 {
+			e.EmitLog(testRecord(i))
+		}
+		e.stop()
+
+		// MaxRetries attempts, then the batch is dropped
+		if r.callCount() != 3 {
+			t.Errorf("%d calls, want 3", r.callCount())
+		}
+		if s := e.Stats(); s.LogsSent != 0 || s.LogsDropped != 3 || s.ExportFailures != 1 || e.errorCount() != 1 {
+			t.Errorf("stats = %+v, %d errors", s, e.errorCount())
+		}
+	})
+}
+
+func TestExportPermanentFailure(t *testing.T) {
+	eachProtocol(t, func(t *testing.T, protocol string) {
+		r := &receiver{failures: 1, permanent: true}
+		e := newTestExporter(t, protocol, r, nil)
+
+		e.EmitLog(testRecord(0))
+		e.stop()
+
+		if r.callCount() != 1 {
+			t.Errorf("%d calls, a permanent failure is not retried", r.callCount())
+		}
+		if s := e.Stats(); s.LogsDropped != 1 || s.ExportFailures != 1 {
+			t.Errorf("stats = %+v", s)
+		}
+	})
+}
+
+func TestExportMetrics(t *testing.T) {
+	eachProtocol(t, func(t *testing.T, protocol string) {
+		r := &receiver{}
+		collect := func() []Metric {
+			return []Metric{
+				{Name: "kernelkoala.traffic.bytes", Unit: "By", Monotonic: true, Points: []Point{
+					{Attrs: []Attr{String("network.io.direction", "receive")}, Value: 1500},
+					{Attrs: []Attr{String("network.io.direction", "transmit")}, Value: 600},
+				}},
+				{Name: "kernelkoala.flows.active", Unit: "{flow}", Points: []Point{{Value: 42}}},
+			}
+		}
+		e := newTestExporter(t, protocol, r, collect)
+		e.stop()
+
+		if len(r.metrics) != 1 {
+			t.Fatalf("%d metrics requests, want the final one", len(r.metrics))
+		}
+		rm := r.metrics[0].ResourceMetrics[0]
+		if attrMap(rm.Resource.Attributes)["service.name"] != "koala-test" {
+			t.Errorf("resource %v", rm.Resource.Attributes)
+		}
+		metrics := rm.ScopeMetrics[0].Metrics
+		if len(metrics) != 2 {
+			t.Fatalf("%d metrics, want 2", len(metrics))
+		}
+
+		sum := metrics[0].GetSum()
+		if sum == nil || !sum.IsMonotonic ||
+			sum.AggregationTemporality != metricspb.AggregationTemporality_AGGREGATION_TEMPORALITY_CUMULATIVE {
+			t.Fatalf("%s is not a cumulative monotonic sum: %v", metrics[0].Name, metrics[0].Data)
+		}
+		if metrics[0].Unit != "By" || len(sum.DataPoints) != 2 {
+			t.Fatalf("unexpected sum %v", metrics[0])
+		}
+		p := sum.DataPoints[1]
+		if p.GetAsInt() != 600 || attrMap(p.Attributes)["network.io.direction"] != "transmit" ||
+			p.StartTimeUnixNano == 0 || p.TimeUnixNano < p.StartTimeUnixNano {
+			t.Errorf("unexpected point %v", p)
+		}
+
+		gauge := metrics[1].GetGauge()
+		if gauge == nil || gauge.DataPoints[0].GetAsInt() != 42 {
+			t.Errorf("unexpected gauge %v", metrics[1])
+		}
+		if s := e.Stats(); s.MetricsSent != 2 {
+			t.Errorf("stats = %+v", s)
+		}
+	})
+}
+
+func TestEmitLogDropsWhenFull(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.Endpoint = "127.0.0.1:1"
+	cfg.Insecure = true
+	cfg.QueueSize = 2
+	e, err := New(cfg, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer e.Close(0)
+
+	for i := range 5 {
+		e.EmitLog(testRecord(i))
+	}
+	if s := e.Stats(); s.LogsDropped != 3 {
+		t.Errorf("dropped %d, want 3", s.LogsDropped)
+	}
+}
+
+func TestNewRejectsUnknownProtocol(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.Protocol = "udp"
+	if _, err := New(cfg, nil, nil); err == nil {
+		t.Fatal("New accepted protocol udp")
+	}
+}
+
+func TestKubernetesResource(t *testing.T) {
+	for _, e := range kubernetesEnv {
+		t.Setenv(e.env, "")
+	}
+	if attrs := KubernetesResource(); len(attrs) != 0 {
+		t.Errorf("resource %v outside Kubernetes", attrs)
+	}
+
+	t.Setenv("K8S_POD_NAME", "kernelkoala-x7k2p")
+	t.Setenv("K8S_NODE_NAME", "worker-1")
+	attrs := KubernetesResource()
+	want := []Attr{String("k8s.pod.name", "kernelkoala-x7k2p"), String("k8s.node.name", "worker-1")}
+	if len(attrs) != len(want) {
+		t.Fatalf("resource %v, want %v", attrs, want)
+	}
+	for i := range want {
+		if attrs[i] != want[i] {
+			t.Errorf("resource %v, want %v", attrs, want)
+		}
+	}
+}
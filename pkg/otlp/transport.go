@@ -0,0 +1,170 @@
+package otlp
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	collogspb "go.opentelemetry.io/proto/otlp/collector/logs/v1"
+	colmetricspb "go.opentelemetry.io/proto/otlp/collector/metrics/v1"
+	logspb "go.opentelemetry.io/proto/otlp/logs/v1"
+	metricspb "go.opentelemetry.io/proto/otlp/metrics/v1"
+	resourcepb "go.opentelemetry.io/proto/otlp/resource/v1"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+)
+
+type (
+	logsRequest    = collogspb.ExportLogsServiceRequest
+	metricsRequest = colmetricspb.ExportMetricsServiceRequest
+)
+
+func newLogsRequest(resource *resourcepb.Resource, scope *logspb.ScopeLogs) *logsRequest {
+	return &logsRequest{ResourceLogs: []*logspb.ResourceLogs{{
+		Resource:  resource,
+		ScopeLogs: []*logspb.ScopeLogs{scope},
+	}}}
+}
+
+func newMetricsRequest(resource *resourcepb.Resource, scope *metricspb.ScopeMetrics) *metricsRequest {
+	return &metricsRequest{ResourceMetrics: []*metricspb.ResourceMetrics{{
+		Resource:     resource,
+		ScopeMetrics: []*metricspb.ScopeMetrics{scope},
+	}}}
+}
+
+// httpStatusError is a non-2xx answer of an HTTP collector.
+type httpStatusError struct {
+	code int
+	msg  string
+}
+
+func (e *httpStatusError) Error() string {
+	return fmt.Sprintf("collector answered %d: %s", e.code, e.msg)
+}
+
+// retryable reports failures the OTLP spec allows retrying: throttling
+// and unavailability, plus transport errors.
+func retryable(err error) bool {
+	var httpErr *httpStatusError
+	if errors.As(err, &httpErr) {
+		switch httpErr.code {
+		case http.StatusTooManyRequests, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+			return true
+		}
+		return false
+	}
+	if s, ok := status.FromError(err); ok {
+		switch s.Code() {
+		case codes.Canceled, codes.DeadlineExceeded, codes.ResourceExhausted, codes.Aborted,
+			codes.OutOfRange, codes.Unavailable, codes.DataLoss:
+			return true
+		}
+		return false
+	}
+	return true
+}
+
+type grpcExporter struct {
+	conn    *grpc.ClientConn
+	logs    collogspb.LogsServiceClient
+	metrics colmetricspb.MetricsServiceClient
+	md      metadata.MD
+}
+
+func newGRPCExporter(cfg Config) (*grpcExporter, error) {
+	creds := credentials.NewTLS(&tls.Config{MinVersion: tls.VersionTLS12})
+	if cfg.Insecure {
+		creds = insecure.NewCredentials()
+	}
+	conn, err := grpc.NewClient(cfg.Endpoint, grpc.WithTransportCredentials(creds))
+	if err != nil {
+		return nil, err
+	}
+	return &grpcExporter{
+		conn:    conn,
+		logs:    collogspb.NewLogsServiceClient(conn),
+		metrics: colmetricspb.NewMetricsServiceClient(conn),
+		md:      metadata.New(cfg.Headers),
+	}, nil
+}
+
+func (g *grpcExporter) exportLogs(ctx context.Context, req *logsRequest) error {
+	_, err := g.logs.Export(metadata.NewOutgoingContext(ctx, g.md), req)
+	return err
+}
+
+func (g *grpcExporter) exportMetrics(ctx context.Context, req *metricsRequest) error {
+	_, err := g.metrics.Export(metadata.NewOutgoingContext(ctx, g.md), req)
+	return err
+}
+
+func (g *grpcExporter) close() error { return g.conn.Close() }
+
+type httpExporter struct {
+	base    string
+	headers map[string]string
+	client  *http.Client
+}
+
+func newHTTPExporter(cfg Config) (*httpExporter, error) {
+	base := strings.TrimSuffix(cfg.Endpoint, "/")
+	if !strings.HasPrefix(base, "http://") && !strings.HasPrefix(base, "https://") {
+		scheme := "https://"
+		if cfg.Insecure {
+			scheme = "http://"
+		}
+		base = scheme + base
+	}
+	return &httpExporter{base: base, headers: cfg.Headers, client: &http.Client{}}, nil
+}
+
+func (h *httpExporter) exportLogs(ctx context.Context, req *logsRequest) error {
+	return h.post(ctx, "/v1/logs", req)
+}
+
+func (h *httpExporter) exportMetrics(ctx context.Context, req *metricsRequest) error {
+	return h.post(ctx, "/v1/metrics", req)
+}
+
+func (h *httpExporter) post(ctx context.Context, path string, msg proto.Message) error {
+	body, err := proto.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, h.base+path, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-protobuf")
+	for k, v := range h.headers {
+		req.Header.Set(k, v)
+	}
+
+	resp, err := h.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return &httpStatusError{code: resp.StatusCode, msg: strings.TrimSpace(string(msg))}
+	}
+	io.Copy(io.Discard, resp.Body)
+	return nil
+}
+
+func (h *httpExporter) close() error {
+	h.client.CloseIdleConnections()
+	return nil
+}
@@ -0,0 +1,490 @@
+// Package policy manages the deny rules enforced by the tc programs.
+//
+// Rules are kept in two banks of a BPF array. Updates write the inactive
+// bank and then switch the active bank and rule count in one map update, so
+// a packet checked afterwards sees only the new rule set. The datapath
+// doesn't lock the maps, a packet checked while an update lands may be
+// matched against parts of both.
+package policy
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/cilium/ebpf"
+)
+
+// MaxRules mirrors POLICY_MAX_RULES in tc.c.
+const MaxRules = 256
+
+// DefaultPinPath is where the agent pins the policy maps for the CLI.
+const DefaultPinPath = "/sys/fs/bpf/kernelkoala"
+
+// Names of the policy maps in tc.c.
+const (
+	RulesMapName  = "policy_rules"
+	ConfigMapName = "policy_config"
+)
+
+// Mode selects what happens to packets matching a rule.
+type Mode uint32
+
+const (
+	ModeOff Mode = iota
+	ModeDryRun
+	ModeEnforce
+)
+
+func (m Mode) String() string {
+	switch m {
+	case ModeOff:
+		return "off"
+	case ModeDryRun:
+		return "dry-run"
+	case ModeEnforce:
+		return "enforce"
+	default:
+		return fmt.Sprintf("mode(%d)", uint32(m))
+	}
+}
+
+func ParseMode(s string) (Mode, error) {
+	switch s {
+	case "off":
+		return ModeOff, nil
+	case "dry-run":
+		return ModeDryRun, nil
+	case "enforce":
+		return ModeEnforce, nil
+	default:
+		return 0, fmt.Errorf("unknown policy mode %q (off, dry-run, enforce)", s)
+	}
+}
+
+// Direction limits a rule to one side of the tc hook.
+type Direction uint8
+
+const (
+	DirAny Direction = iota
+	DirIngress
+	DirEgress
+)
+
+func (d Direction) String() string {
+	switch d {
+	case DirIngress:
+		return "ingress"
+	case DirEgress:
+		return "egress"
+	default:
+		return "any"
+	}
+}
+
+// Rule denies traffic whose remote address is in Network. The remote
+// address is the source on ingress and the destination on egress. Zero
+// values match everything.
+type Rule struct {
+	ID        uint32       `json:"id"`
+	Network   netip.Prefix `json:"cidr"`
+	PortMin   uint16       `json:"port_min,omitempty"`
+	PortMax   uint16       `json:"port_max,omitempty"`
+	Protocol  uint8        `json:"protocol,omitempty"`
+	Direction Direction    `json:"direction,omitempty"`
+}
+
+// String renders the rule in the syntax accepted by ParseRule.
+func (r Rule) String() string {
+	parts := []string{"id=" + strconv.FormatUint(uint64(r.ID), 10), "cidr=" + r.Network.String()}
+	if r.PortMax != 0 {
+		port := strconv.Itoa(int(r.PortMin))
+		if r.PortMax != r.PortMin {
+			port += "-" + strconv.Itoa(int(r.PortMax))
+		}
+		parts = append(parts, "port="+port)
+	}
+	if r.Protocol != 0 {
+		parts = append(parts, "proto="+protocolName(r.Protocol))
+	}
+	if r.Direction != DirAny {
+		parts = append(parts, "dir="+r.Direction.String())
+	}
+	return strings.Join(parts, " ")
+}
+
+// ParseRule parses "key=value" fields: cidr (required, an address or CIDR),
+// port (N or N-M, destination port), proto (tcp, udp, icmp or a number),
+// dir (ingress, egress, any) and id (assigned automatically when omitted).
+func ParseRule(fields []string) (Rule, error) {
+	var r Rule
+	haveCIDR := false
+
+	for _, field := range fields {
+		key, value, ok := strings.Cut(field, "=")
+		if !ok {
+			return r, fmt.Errorf("expected key=value, got %q", field)
+		}
+		switch key {
+		case "id":
+			id, err := strconv.ParseUint(value, 10, 32)
+			if err != nil || id == 0 {
+				return r, fmt.Errorf("invalid rule id %q", value)
+			}
+			r.ID = uint32(id)
+		case "cidr":
+			prefix, err := netip.ParsePrefix(value)
+			if err != nil {
+				addr, aerr := netip.ParseAddr(value)
+				if aerr != nil {
+					return r, fmt.Errorf("invalid cidr %q", value)
+				}
+				prefix = netip.PrefixFrom(addr, addr.BitLen())
+			}
+			if !prefix.Addr().Is4() {
+				return r, fmt.Errorf("cidr %q: only IPv4 is enforced", value)
+			}
+			r.Network = prefix.Masked()
+			haveCIDR = true
+		case "port":
+			lo, hi, isRange := strings.Cut(value, "-")
+			if !isRange {
+				hi = lo
+			}
+			first, err1 := strconv.ParseUint(lo, 10, 16)
+			last, err2 := strconv.ParseUint(hi, 10, 16)
+			if err1 != nil || err2 != nil || last == 0 || first > last {
+				return r, fmt.Errorf("invalid port %q", value)
+			}
+			r.PortMin, r.PortMax = uint16(first), uint16(last)
+		case "proto":
+			proto, err := parseProtocol(value)
+			if err != nil {
+				return r, err
+			}
+			r.Protocol = proto
+		case "dir":
+			switch value {
+			case "any":
+				r.Direction = DirAny
+			case "ingress":
+				r.Direction = DirIngress
+			case "egress":
+				r.Direction = DirEgress
+			default:
+				return r, fmt.Errorf("invalid direction %q", value)
+			}
+		default:
+			return r, fmt.Errorf("unknown rule field %q", key)
+		}
+	}
+
+	if !haveCIDR {
+		return r, errors.New("rule needs a cidr, use cidr=0.0.0.0/0 to match every address")
+	}
+	return r, nil
+}
+
+// LoadFile reads one rule per line, '#' starts a comment.
+func LoadFile(path string) ([]Rule, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var rules []Rule
+	scanner := bufio.NewScanner(f)
+	lineNo := 0
+	for scanner.Scan() {
+		lineNo++
+		line := scanner.Text()
+		if i := strings.IndexByte(line, '#'); i >= 0 {
+			line = line[:i]
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		rule, err := ParseRule(fields)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", path, lineNo, err)
+		}
+		rules = append(rules, rule)
+	}
+	return rules, scanner.Err()
+}
+
+func parseProtocol(s string) (uint8, error) {
+	switch strings.ToLower(s) {
+	case "any":
+		return 0, nil
+	case "tcp":
+		return 6, nil
+	case "udp":
+		return 17, nil
+	case "icmp":
+		return 1, nil
+	}
+	n, err := strconv.ParseUint(s, 10, 8)
+	if err != nil {
+		return 0, fmt.Errorf("invalid protocol %q", s)
+	}
+	return uint8(n), nil
+}
+
+func protocolName(proto uint8) string {
+	switch proto {
+	case 6:
+		return "tcp"
+	case 17:
+		return "udp"
+	case 1:
+		return "icmp"
+	default:
+		return strconv.Itoa(int(proto))
+	}
+}
+
+// kernelRule mirrors struct policy_rule in tc.c.
+type kernelRule struct {
+	ID        uint32
+	Addr      [4]byte
+	Mask      [4]byte
+	PortMin   uint16
+	PortMax   uint16
+	Protocol  uint8
+	Direction uint8
+	_         uint16
+}
+
+// kernelConfig mirrors struct policy_config in tc.c.
+type kernelConfig struct {
+	Mode   uint32
+	Active uint32
+	Count  uint32
+}
+
+func toKernel(r Rule) kernelRule {
+	var mask [4]byte
+	for i := 0; i < r.Network.Bits(); i++ {
+		mask[i/8] |= 0x80 >> (i % 8)
+	}
+	return kernelRule{
+		ID:        r.ID,
+		Addr:      r.Network.Addr().As4(),
+		Mask:      mask,
+		PortMin:   r.PortMin,
+		PortMax:   r.PortMax,
+		Protocol:  r.Protocol,
+		Direction: uint8(r.Direction),
+	}
+}
+
+func fromKernel(k kernelRule) Rule {
+	bits := 0
+	for _, b := range k.Mask {
+		for ; b != 0; b <<= 1 {
+			bits++
+		}
+	}
+	return Rule{
+		ID:        k.ID,
+		Network:   netip.PrefixFrom(netip.AddrFrom4(k.Addr), bits),
+		PortMin:   k.PortMin,
+		PortMax:   k.PortMax,
+		Protocol:  k.Protocol,
+		Direction: Direction(k.Direction),
+	}
+}
+
+// Table reads and updates the policy maps. Updates from one Table are
+// serialized, concurrent writers in different processes race and the last
+// one wins.
+type Table struct {
+	rules  *ebpf.Map
+	config *ebpf.Map
+	owned  bool
+	mu     sync.Mutex
+}
+
+// New wraps maps loaded by the caller, which keeps ownership of them.
+func New(rules, config *ebpf.Map) *Table {
+	return &Table{rules: rules, config: config}
+}
+
+// OpenPinned opens the maps pinned by a running agent under dir.
+func OpenPinned(dir string) (*Table, error) {
+	rules, err := ebpf.LoadPinnedMap(filepath.Join(dir, RulesMapName), nil)
+	if err != nil {
+		return nil, fmt.Errorf("open %s (is the agent running?): %v", RulesMapName, err)
+	}
+	config, err := ebpf.LoadPinnedMap(filepath.Join(dir, ConfigMapName), nil)
+	if err != nil {
+		rules.Close()
+		return nil, fmt.Errorf("open %s: %v", ConfigMapName, err)
+	}
+	return &Table{rules: rules, config: config, owned: true}, nil
+}
+
+// Close releases maps opened by OpenPinned.
+func (t *Table) Close() {
+	if t.owned {
+		t.rules.Close()
+		t.config.Close()
+	}
+}
+
+func (t *Table) readConfig() (kernelConfig, error) {
+	var cfg kernelConfig
+	err := t.config.Lookup(uint32(0), &cfg)
+	return cfg, err
+}
+
+// Mode returns the current enforcement mode.
+func (t *Table) Mode() (Mode, error) {
+	cfg, err := t.readConfig()
+	return Mode(cfg.Mode), err
+}
+
+// SetMode switches between off, dry-run and enforce without touching the
+// rules.
+func (t *Table) SetMode(mode Mode) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	cfg, err := t.readConfig()
+	if err != nil {
+		return err
+	}
+	cfg.Mode = uint32(mode)
+	return t.config.Put(uint32(0), cfg)
+}
+
+// List returns the live rules in evaluation order.
+func (t *Table) List() ([]Rule, error) {
+	cfg, err := t.readConfig()
+	if err != nil {
+		return nil, err
+	}
+	return t.list(cfg)
+}
+
+func (t *Table) list(cfg kernelConfig) ([]Rule, error) {
+	rules := make([]Rule, 0, cfg.Count)
+	for i := uint32(0); i < cfg.Count && i < MaxRules; i++ {
+		var k kernelRule
+		if err := t.rules.Lookup((cfg.Active&1)*MaxRules+i, &k); err != nil {
+			return nil, err
+		}
+		rules = append(rules, fromKernel(k))
+	}
+	return rules, nil
+}
+
+// Replace installs rules as the complete rule set. Rules without an ID get
+// one above the highest ID in use.
+func (t *Table) Replace(rules []Rule) ([]Rule, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	cfg, err := t.readConfig()
+	if err != nil {
+		return nil, err
+	}
+	return t.replace(cfg, rules)
+}
+
+func (t *Table) replace(cfg kernelConfig, rules []Rule) ([]Rule, error) {
+	if len(rules) > MaxRules {
+		return nil, fmt.Errorf("%d rules exceed the limit of %d", len(rules), MaxRules)
+	}
+
+	rules = append([]Rule(nil), rules...)
+	seen := make(map[uint32]bool, len(rules))
+	next := uint32(1)
+	for _, r := range rules {
+		if r.ID == 0 {
+			continue
+		}
+		if seen[r.ID] {
+			return nil, fmt.Errorf("duplicate rule id %d", r.ID)
+		}
+		seen[r.ID] = true
+		if r.ID >= next {
+			next = r.ID + 1
+		}
+	}
+	for i := range rules {
+		if rules[i].ID == 0 {
+			rules[i].ID = next
+			next++
+		}
+	}
+
+	inactive := (cfg.Active & 1) ^ 1
+	for i, r := range rules {
+		if err := t.rules.Put(inactive*MaxRules+uint32(i), toKernel(r)); err != nil {
+			return nil, fmt.Errorf("write rule %d: %v", r.ID, err)
+		}
+	}
+
+	cfg.Active, cfg.Count = inactive, uint32(len(rules))
+	if err := t.config.Put(uint32(0), cfg); err != nil {
+		return nil, err
+	}
+	return rules, nil
+}
+
+// Add appends a rule and returns it with its ID.
+func (t *Table) Add(rule Rule) (Rule, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	cfg, err := t.readConfig()
+	if err != nil {
+		return rule, err
+	}
+	rules, err := t.list(cfg)
+	if err != nil {
+		return rule, err
+	}
+	rules, err = t.replace(cfg, append(rules, rule))
+	if err != nil {
+		return rule, err
+	}
+	return rules[len(rules)-1], nil
+}
+
+// Remove deletes the rule with the given ID.
+func (t *Table) Remove(id uint32) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	cfg, err := t.readConfig()
+	if err != nil {
+		return err
+	}
+	rules, err := t.list(cfg)
+	if err != nil {
+		return err
+	}
+
+	kept := rules[:0]
+	for _, r := range rules {
+		if r.ID != id {
+			kept = append(kept, r)
+		}
+	}
+	if len(kept) == len(rules) {
+		return fmt.Errorf("no rule with id %d", id)
+	}
+	_, err = t.replace(cfg, kept)
+	return err
+}
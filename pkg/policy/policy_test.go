@@ -0,0 +1,113 @@
+package policy
+
+import (
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestParseRule(t *testing.T) {
+	for _, tc := range []struct {
+		in   string
+		want Rule
+		err  string
+	}{
+		{in: "cidr=203.0.113.7", want: Rule{Network: netip.MustParsePrefix("203.0.113.7/32")}},
+		{in: "cidr=203.0.113.77/24", want: Rule{Network: netip.MustParsePrefix("203.0.113.0/24")}},
+		{
+			in: "id=7 cidr=10.0.0.0/8 port=1000-2000 proto=udp dir=egress",
+			want: Rule{ID: 7, Network: netip.MustParsePrefix("10.0.0.0/8"), PortMin: 1000, PortMax: 2000,
+				Protocol: 17, Direction: DirEgress},
+		},
+		{
+			in:   "cidr=0.0.0.0/0 port=22 proto=47 dir=ingress",
+			want: Rule{Network: netip.MustParsePrefix("0.0.0.0/0"), PortMin: 22, PortMax: 22, Protocol: 47, Direction: DirIngress},
+		},
+		{in: "cidr=0.0.0.0/0 proto=any dir=any", want: Rule{Network: netip.MustParsePrefix("0.0.0.0/0")}},
+		{in: "port=22", err: "needs a cidr"},
+		{in: "cidr=2001:db8::/32", err: "only IPv4"},
+		{in: "cidr=10.0.0.300", err: "invalid cidr"},
+		{in: "cidr=10.0.0.1 port=0", err: "invalid port"},
+		{in: "cidr=10.0.0.1 port=90-80", err: "invalid port"},
+		{in: "cidr=10.0.0.1 port=65536", err: "invalid port"},
+		{in: "cidr=10.0.0.1 proto=sctp", err: "invalid protocol"},
+		{in: "cidr=10.0.0.1 dir=both", err: "invalid direction"},
+		{in: "cidr=10.0.0.1 id=0", err: "invalid rule id"},
+		{in: "cidr=10.0.0.1 action=drop", err: "unknown rule field"},
+		{in: "cidr 10.0.0.1", err: "expected key=value"},
+	} {
+		r, err := ParseRule(strings.Fields(tc.in))
+		if tc.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tc.err) {
+				t.Errorf("%q: err = %v, want %q", tc.in, err, tc.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: %v", tc.in, err)
+			continue
+		}
+		if r != tc.want {
+			t.Errorf("%q = %+v, want %+v", tc.in, r, tc.want)
+		}
+		// String renders what ParseRule reads back, once the rule has an ID
+		r.ID = 9
+		if again, err := ParseRule(strings.Fields(r.String())); err != nil || again != r {
+			t.Errorf("%q renders as %q, parsed back %+v, %v", tc.in, r.String(), again, err)
+		}
+	}
+}
+
+func TestKernelRoundTrip(t *testing.T) {
+	for _, r := range []Rule{
+		{ID: 1, Network: netip.MustParsePrefix("0.0.0.0/0")},
+		{ID: 2, Network: netip.MustParsePrefix("10.0.0.0/8"), PortMin: 22, PortMax: 22, Protocol: 6, Direction: DirIngress},
+		{ID: 3, Network: netip.MustParsePrefix("192.168.128.0/17"), PortMin: 1, PortMax: 65535, Direction: DirEgress},
+		{ID: 4, Network: netip.MustParsePrefix("203.0.113.7/32"), Protocol: 1},
+	} {
+		k := toKernel(r)
+		if got := fromKernel(k); got != r {
+			t.Errorf("%s came back as %s", r, got)
+		}
+	}
+
+	k := toKernel(Rule{Network: netip.MustParsePrefix("172.16.0.0/12")})
+	if k.Addr != [4]byte{172, 16, 0, 0} || k.Mask != [4]byte{255, 240, 0, 0} {
+		t.Errorf("kernel rule %+v", k)
+	}
+}
+
+func TestParseMode(t *testing.T) {
+	for _, m := range []Mode{ModeOff, ModeDryRun, ModeEnforce} {
+		if got, err := ParseMode(m.String()); err != nil || got != m {
+			t.Errorf("%s parsed as %v, %v", m, got, err)
+		}
+	}
+	if _, err := ParseMode("block"); err == nil {
+		t.Error("unknown mode accepted")
+	}
+}
+
+func TestLoadFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "policy")
+	content := "# blocked networks\ncidr=203.0.113.0/24 port=22 # ssh\n\ncidr=198.51.100.1 dir=egress\n"
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	rules, err := LoadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rules) != 2 || rules[0].PortMax != 22 || rules[1].Direction != DirEgress {
+		t.Errorf("rules %v", rules)
+	}
+
+	if err := os.WriteFile(path, []byte(content+"cidr=nowhere\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadFile(path); err == nil || !strings.Contains(err.Error(), ":5:") {
+		t.Errorf("err = %v, want the bad line named", err)
+	}
+}
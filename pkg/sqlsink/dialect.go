@@ -0,0 +1,358 @@
+package sqlsink
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// migration brings the schema from version-1 to version. Statements are
+// idempotent so a migration cut short on a database without transactional
+// DDL can simply run again.
+type migration struct {
+	version    int
+	statements []string
+}
+
+// dialect is what differs between the supported databases: column types,
+// placeholders and how a batch gets in.
+type dialect struct {
+	name string
+	// driver is the database/sql driver used when none is configured.
+	driver string
+	// versionTable holds one row per applied migration.
+	versionTable  string
+	selectVersion string
+	insertVersion string
+	migrations    []migration
+	// transactional runs every migration and its version row in one
+	// transaction, after lock keeps other agents from migrating at the
+	// same time.
+	transactional bool
+	lock          string
+	placeholder   func(n int) string
+	// prepared inserts a batch row by row through one prepared statement
+	// instead of a multi-row VALUES list. ClickHouse drivers send such a
+	// transaction as a single block.
+	prepared bool
+	// maxParams caps the placeholders of one statement.
+	maxParams int
+}
+
+var flowColumns = []string{
+	"node", "protocol", "src_ip", "src_name", "src_port", "dst_ip", "dst_name", "dst_port",
+	"iface", "scope", "first_seen", "last_seen", "packets", "bytes", "tcp_flags", "closed",
+	"sni", "ja3", "src_country", "dst_country", "dst_asn",
+}
+
+var alertColumns = []string{
+	"node", "time", "type", "severity", "message", "protocol",
+	"src_ip", "src_port", "dst_ip", "dst_port", "iface", "fields",
+}
+
+var dialects = map[string]*dialect{
+	"postgres": {
+		name:   "postgres",
+		driver: "pgx",
+		versionTable: `CREATE TABLE IF NOT EXISTS kernelkoala_schema (
+	version INTEGER PRIMARY KEY,
+	applied_at TIMESTAMPTZ NOT NULL DEFAULT now()
+)`,
+		selectVersion: `SELECT COALESCE(MAX(version), 0)::BIGINT FROM kernelkoala_schema`,
+		insertVersion: `INSERT INTO kernelkoala_schema (version) VALUES ($1)`,
+		transactional: true,
+		// Held until the transaction ends
+		lock:        `SELECT pg_advisory_xact_lock(4861093)`,
+		placeholder: func(n int) string { return "$" + strconv.Itoa(n) },
+		maxParams:   65535,
+		migrations: []migration{{1, []string{
+			`CREATE TABLE IF NOT EXISTS flows (
+	id BIGSERIAL PRIMARY KEY,
+	node TEXT NOT NULL,
+	protocol TEXT NOT NULL,
+	src_ip INET NOT NULL,
+	src_name TEXT NOT NULL DEFAULT '',
+	src_port INTEGER NOT NULL,
+	dst_ip INET NOT NULL,
+	dst_name TEXT NOT NULL DEFAULT '',
+	dst_port INTEGER NOT NULL,
+	iface TEXT NOT NULL DEFAULT '',
+	scope TEXT NOT NULL DEFAULT '',
+	first_seen TIMESTAMPTZ NOT NULL,
+	last_seen TIMESTAMPTZ NOT NULL,
+	packets BIGINT NOT NULL,
+	bytes BIGINT NOT NULL,
+	tcp_flags TEXT NOT NULL DEFAULT '',
+	closed BOOLEAN NOT NULL DEFAULT false,
+	sni TEXT NOT NULL DEFAULT '',
+	ja3 TEXT NOT NULL DEFAULT '',
+	src_country TEXT NOT NULL DEFAULT '',
+	dst_country TEXT NOT NULL DEFAULT '',
+	dst_asn BIGINT NOT NULL DEFAULT 0
+)`,
+			`CREATE INDEX IF NOT EXISTS flows_first_seen ON flows (first_seen)`,
+			`CREATE INDEX IF NOT EXISTS flows_src_ip ON flows (src_ip, first_seen)`,
+			`CREATE INDEX IF NOT EXISTS flows_dst_ip ON flows (dst_ip, first_seen)`,
+			`CREATE TABLE IF NOT EXISTS alerts (
+	id BIGSERIAL PRIMARY KEY,
+	node TEXT NOT NULL,
+	time TIMESTAMPTZ NOT NULL,
+	type TEXT NOT NULL,
+	severity TEXT NOT NULL,
+	message TEXT NOT NULL,
+	protocol TEXT NOT NULL DEFAULT '',
+	src_ip TEXT NOT NULL DEFAULT '',
+	src_port INTEGER NOT NULL DEFAULT 0,
+	dst_ip TEXT NOT NULL DEFAULT '',
+	dst_port INTEGER NOT NULL DEFAULT 0,
+	iface TEXT NOT NULL DEFAULT '',
+	fields JSONB NOT NULL DEFAULT '{}'
+)`,
+			`CREATE INDEX IF NOT EXISTS alerts_time ON alerts (time)`,
+		}}},
+	},
+	"clickhouse": {
+		name:   "clickhouse",
+		driver: "clickhouse",
+		versionTable: `CREATE TABLE IF NOT EXISTS kernelkoala_schema (
+	version Int32,
+	applied_at DateTime DEFAULT now()
+) ENGINE = MergeTree ORDER BY version`,
+		selectVersion: `SELECT toInt64(max(version)) FROM kernelkoala_schema`,
+		insertVersion: `INSERT INTO kernelkoala_schema (version) VALUES (?)`,
+		placeholder:   func(int) string { return "?" },
+		prepared:      true,
+		maxParams:     65535,
+		migrations: []migration{{1, []string{
+			`CREATE TABLE IF NOT EXISTS flows (
+	node LowCardinality(String),
+	protocol LowCardinality(String),
+	src_ip String,
+	src_name String,
+	src_port Int32,
+	dst_ip String,
+	dst_name String,
+	dst_port Int32,
+	iface LowCardinality(String),
+	scope LowCardinality(String),
+	first_seen DateTime64(3, 'UTC'),
+	last_seen DateTime64(3, 'UTC'),
+	packets Int64,
+	bytes Int64,
+	tcp_flags String,
+	closed Bool,
+	sni String,
+	ja3 String,
+	src_country LowCardinality(String),
+	dst_country LowCardinality(String),
+	dst_asn Int64
+) ENGINE = MergeTree
+PARTITION BY toDate(first_seen)
+ORDER BY (first_seen, src_ip, dst_ip)`,
+			`CREATE TABLE IF NOT EXISTS alerts (
+	node LowCardinality(String),
+	time DateTime64(3, 'UTC'),
+	type LowCardinality(String),
+	severity LowCardinality(String),
+	message String,
+	protocol LowCardinality(String),
+	src_ip String,
+	src_port Int32,
+	dst_ip String,
+	dst_port Int32,
+	iface LowCardinality(String),
+	fields String
+) ENGINE = MergeTree
+PARTITION BY toDate(time)
+ORDER BY (time, type)`,
+		}}},
+	},
+	// sqlite keeps a sink on one machine, e.g. to try out the schema or
+	// to run checks against an embedded database.
+	"sqlite": {
+		name:   "sqlite",
+		driver: "sqlite",
+		versionTable: `CREATE TABLE IF NOT EXISTS kernelkoala_schema (
+	version INTEGER PRIMARY KEY,
+	applied_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+)`,
+		selectVersion: `SELECT COALESCE(MAX(version), 0) FROM kernelkoala_schema`,
+		insertVersion: `INSERT INTO kernelkoala_schema (version) VALUES (?)`,
+		transactional: true,
+		placeholder:   func(int) string { return "?" },
+		maxParams:     999,
+		migrations: []migration{{1, []string{
+			`CREATE TABLE IF NOT EXISTS flows (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	node TEXT NOT NULL,
+	protocol TEXT NOT NULL,
+	src_ip TEXT NOT NULL,
+	src_name TEXT NOT NULL DEFAULT '',
+	src_port INTEGER NOT NULL,
+	dst_ip TEXT NOT NULL,
+	dst_name TEXT NOT NULL DEFAULT '',
+	dst_port INTEGER NOT NULL,
+	iface TEXT NOT NULL DEFAULT '',
+	scope TEXT NOT NULL DEFAULT '',
+	first_seen TIMESTAMP NOT NULL,
+	last_seen TIMESTAMP NOT NULL,
+	packets INTEGER NOT NULL,
+	bytes INTEGER NOT NULL,
+	tcp_flags TEXT NOT NULL DEFAULT '',
+	closed BOOLEAN NOT NULL DEFAULT 0,
+	sni TEXT NOT NULL DEFAULT '',
+	ja3 TEXT NOT NULL DEFAULT '',
+	src_country TEXT NOT NULL DEFAULT '',
+	dst_country TEXT NOT NULL DEFAULT '',
+	dst_asn INTEGER NOT NULL DEFAULT 0
+)`,
+			`CREATE INDEX IF NOT EXISTS flows_first_seen ON flows (first_seen)`,
+			`CREATE INDEX IF NOT EXISTS flows_src_ip ON flows (src_ip, first_seen)`,
+			`CREATE INDEX IF NOT EXISTS flows_dst_ip ON flows (dst_ip, first_seen)`,
+			`CREATE TABLE IF NOT EXISTS alerts (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	node TEXT NOT NULL,
+	time TIMESTAMP NOT NULL,
+	type TEXT NOT NULL,
+	severity TEXT NOT NULL,
+	message TEXT NOT NULL,
+	protocol TEXT NOT NULL DEFAULT '',
+	src_ip TEXT NOT NULL DEFAULT '',
+	src_port INTEGER NOT NULL DEFAULT 0,
+	dst_ip TEXT NOT NULL DEFAULT '',
+	dst_port INTEGER NOT NULL DEFAULT 0,
+	iface TEXT NOT NULL DEFAULT '',
+	fields TEXT NOT NULL DEFAULT '{}'
+)`,
+			`CREATE INDEX IF NOT EXISTS alerts_time ON alerts (time)`,
+		}}},
+	},
+}
+
+// Dialects lists the supported dialect names.
+func Dialects() []string {
+	return []string{"postgres", "clickhouse", "sqlite"}
+}
+
+// latest is the schema version the dialect's migrations lead to.
+func (d *dialect) latest() int {
+	return d.migrations[len(d.migrations)-1].version
+}
+
+type execer interface {
+	ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error)
+	QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row
+}
+
+// migrate applies the migrations the database lacks and returns the
+// schema version. A database migrated by a newer agent is refused, its
+// tables may not take the rows this one writes.
+func (d *dialect) migrate(ctx context.Context, db *sql.DB) (int, error) {
+	if _, err := db.ExecContext(ctx, d.versionTable); err != nil {
+		return 0, fmt.Errorf("creating schema version table: %v", err)
+	}
+	if !d.transactional {
+		return d.apply(ctx, db)
+	}
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+	if d.lock != "" {
+		if _, err := tx.ExecContext(ctx, d.lock); err != nil {
+			return 0, fmt.Errorf("locking schema: %v", err)
+		}
+	}
+	version, err := d.apply(ctx, tx)
+	if err != nil {
+		return 0, err
+	}
+	return version, tx.Commit()
+}
+
+func (d *dialect) apply(ctx context.Context, db execer) (int, error) {
+	var current int64
+	if err := db.QueryRowContext(ctx, d.selectVersion).Scan(&current); err != nil {
+		return 0, fmt.Errorf("reading schema version: %v", err)
+	}
+	version := int(current)
+	if version > d.latest() {
+		return 0, fmt.Errorf("schema version %d is newer than the supported %d", version, d.latest())
+	}
+	for _, m := range d.migrations {
+		if m.version <= version {
+			continue
+		}
+		for _, stmt := range m.statements {
+			if _, err := db.ExecContext(ctx, stmt); err != nil {
+				return version, fmt.Errorf("migration %d: %v", m.version, err)
+			}
+		}
+		if _, err := db.ExecContext(ctx, d.insertVersion, int32(m.version)); err != nil {
+			return version, fmt.Errorf("migration %d: %v", m.version, err)
+		}
+		version = m.version
+	}
+	return version, nil
+}
+
+// insert writes rows into table in one transaction.
+func (d *dialect) insert(ctx context.Context, db *sql.DB, table string, columns []string, rows [][]any) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	prefix := "INSERT INTO " + table + " (" + strings.Join(columns, ", ") + ")"
+	if d.prepared {
+		stmt, err := tx.PrepareContext(ctx, prefix+" VALUES ("+d.placeholders(1, len(columns))+")")
+		if err != nil {
+			return err
+		}
+		defer stmt.Close()
+		for _, row := range rows {
+			if _, err := stmt.ExecContext(ctx, row...); err != nil {
+				return err
+			}
+		}
+		return tx.Commit()
+	}
+
+	perStatement := max(d.maxParams/len(columns), 1)
+	for len(rows) > 0 {
+		chunk := rows[:min(perStatement, len(rows))]
+		rows = rows[len(chunk):]
+
+		var b strings.Builder
+		b.WriteString(prefix)
+		b.WriteString(" VALUES ")
+		args := make([]any, 0, len(chunk)*len(columns))
+		for i, row := range chunk {
+			if i > 0 {
+				b.WriteString(", ")
+			}
+			b.WriteString("(")
+			b.WriteString(d.placeholders(len(args)+1, len(columns)))
+			b.WriteString(")")
+			args = append(args, row...)
+		}
+		if _, err := tx.ExecContext(ctx, b.String(), args...); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// placeholders returns n comma separated placeholders numbered from first.
+func (d *dialect) placeholders(first, n int) string {
+	p := make([]string, n)
+	for i := range p {
+		p[i] = d.placeholder(first + i)
+	}
+	return strings.Join(p, ", ")
+}
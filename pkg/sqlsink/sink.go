@@ -0,0 +1,363 @@
+// Package sqlsink writes flows and alerts to SQL tables for long-term
+// storage and ad-hoc queries, in PostgreSQL, ClickHouse or SQLite.
+//
+// The tables are created and upgraded by versioned migrations recorded in
+// the kernelkoala_schema table. Rows are inserted in batches, one
+// transaction each. While the database is unreachable records are kept in
+// a bounded buffer and written once it is back. Rows the database itself
+// rejects are found by splitting the failed batch and dropped one by one.
+//
+// The package talks database/sql only, the binary has to link the driver
+// of the database it writes to.
+package sqlsink
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"kernelKoala/pkg/alert"
+	"kernelKoala/pkg/koala"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Config configures a sink.
+type Config struct {
+	// Dialect is postgres, clickhouse or sqlite. Driver is the registered
+	// database/sql driver, by default pgx, clickhouse and sqlite.
+	Dialect string
+	Driver  string
+	DSN     string
+	// Node fills the node column of every row.
+	Node string
+	// Rows are inserted in batches of up to BatchSize, at least one, at
+	// least every FlushInterval, records beyond QueueSize are dropped.
+	BatchSize     int
+	FlushInterval time.Duration
+	QueueSize     int
+	// MaxBuffered bounds the records held while the database can't be
+	// written, the oldest flows and then the oldest alerts go first. It
+	// holds at least one batch.
+	MaxBuffered int
+	// Timeout bounds every write and migration.
+	Timeout time.Duration
+}
+
+func DefaultConfig() Config {
+	return Config{
+		BatchSize:     1000,
+		FlushInterval: 5 * time.Second,
+		QueueSize:     20000,
+		MaxBuffered:   200000,
+		Timeout:       30 * time.Second,
+	}
+}
+
+// Stats counts what the sink wrote and lost.
+type Stats struct {
+	FlowsWritten  uint64
+	AlertsWritten uint64
+	Batches       uint64
+	Failures      uint64
+	Dropped       uint64
+	// Rejected counts the rows the database refused, they are dropped
+	// instead of being retried.
+	Rejected      uint64
+	Buffered      int
+	Queued        int
+	SchemaVersion int
+	Connected     bool
+}
+
+type record struct {
+	flow  *koala.Flow
+	alert *alert.Alert
+}
+
+// Sink batches flows and alerts into a database.
+type Sink struct {
+	cfg     Config
+	dialect *dialect
+	db      *sql.DB
+	onError func(error)
+
+	queue chan record
+	done  chan struct{}
+
+	// Owned by Run
+	flows   [][]any
+	alerts  [][]any
+	backoff time.Duration
+	retryAt time.Time
+
+	flowsWritten  atomic.Uint64
+	alertsWritten atomic.Uint64
+	batches       atomic.Uint64
+	failures      atomic.Uint64
+	dropped       atomic.Uint64
+	rejected      atomic.Uint64
+	buffered      atomic.Int64
+	version       atomic.Int64
+	connected     atomic.Bool
+}
+
+// New prepares the database handle, connections and migrations are made
+// by Run. Write errors go to onError.
+func New(cfg Config, onError func(error)) (*Sink, error) {
+	d, ok := dialects[cfg.Dialect]
+	if !ok {
+		return nil, fmt.Errorf("unknown dialect %q, expected one of %s", cfg.Dialect, strings.Join(Dialects(), ", "))
+	}
+	if cfg.DSN == "" {
+		return nil, fmt.Errorf("data source name is required")
+	}
+	if cfg.BatchSize < 1 {
+		return nil, fmt.Errorf("batch size %d, must be at least 1", cfg.BatchSize)
+	}
+	if cfg.MaxBuffered < cfg.BatchSize {
+		return nil, fmt.Errorf("buffer of %d records doesn't hold a batch of %d", cfg.MaxBuffered, cfg.BatchSize)
+	}
+	if cfg.Driver == "" {
+		cfg.Driver = d.driver
+	}
+	if !slices.Contains(sql.Drivers(), cfg.Driver) {
+		return nil, fmt.Errorf("database driver %q is not linked into this binary", cfg.Driver)
+	}
+	db, err := sql.Open(cfg.Driver, cfg.DSN)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Sink{
+		cfg:     cfg,
+		dialect: d,
+		db:      db,
+		onError: onError,
+		queue:   make(chan record, cfg.QueueSize),
+		done:    make(chan struct{}),
+		backoff: time.Second,
+	}, nil
+}
+
+// AddFlow queues a flow without blocking.
+func (s *Sink) AddFlow(f koala.Flow) {
+	s.enqueue(record{flow: &f})
+}
+
+// AddAlert queues an alert without blocking.
+func (s *Sink) AddAlert(a alert.Alert) {
+	s.enqueue(record{alert: &a})
+}
+
+func (s *Sink) enqueue(r record) {
+	select {
+	case s.queue <- r:
+	default:
+		s.dropped.Add(1)
+	}
+}
+
+// Run writes queued records until ctx is done, then makes one last
+// attempt at what is left. Failed writes are retried with a backoff of up
+// to 30 seconds, meanwhile records pile up in the buffer.
+func (s *Sink) Run(ctx context.Context) {
+	defer close(s.done)
+	flush := time.NewTicker(s.cfg.FlushInterval)
+	defer flush.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			for drained := false; !drained; {
+				select {
+				case r := <-s.queue:
+					s.buffer(r)
+				default:
+					drained = true
+				}
+			}
+			s.write()
+			s.dropped.Add(uint64(len(s.flows) + len(s.alerts)))
+			s.buffered.Store(0)
+			return
+		case r := <-s.queue:
+			s.buffer(r)
+			if len(s.flows)+len(s.alerts) >= s.cfg.BatchSize && !time.Now().Before(s.retryAt) {
+				s.write()
+			}
+		case now := <-flush.C:
+			if !now.Before(s.retryAt) {
+				s.write()
+			}
+		}
+	}
+}
+
+// buffer turns a record into its row, dropping the oldest rows beyond
+// MaxBuffered. Flows go before alerts as there are far more of them.
+func (s *Sink) buffer(r record) {
+	if r.flow != nil {
+		s.flows = append(s.flows, s.flowRow(r.flow))
+	} else {
+		s.alerts = append(s.alerts, s.alertRow(r.alert))
+	}
+	if over := len(s.flows) + len(s.alerts) - s.cfg.MaxBuffered; over > 0 {
+		n := min(over, len(s.flows))
+		s.flows = slices.Delete(s.flows, 0, n)
+		s.alerts = slices.Delete(s.alerts, 0, over-n)
+		s.dropped.Add(uint64(over))
+	}
+	s.buffered.Store(int64(len(s.flows) + len(s.alerts)))
+}
+
+// write migrates the schema if that is still due, then inserts the
+// buffered rows batch by batch. Batches that made it are taken out of the
+// buffer, on the first failure the rest waits for the next attempt.
+func (s *Sink) write() {
+	if len(s.flows)+len(s.alerts) == 0 && s.version.Load() > 0 {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), s.cfg.Timeout)
+	defer cancel()
+
+	err := s.migrate(ctx)
+	if err == nil {
+		err = s.insertAll(ctx, "flows", flowColumns, &s.flows, &s.flowsWritten)
+	}
+	if err == nil {
+		err = s.insertAll(ctx, "alerts", alertColumns, &s.alerts, &s.alertsWritten)
+	}
+	s.buffered.Store(int64(len(s.flows) + len(s.alerts)))
+	if err != nil {
+		s.failures.Add(1)
+		s.connected.Store(false)
+		s.retryAt = time.Now().Add(s.backoff)
+		s.backoff = min(s.backoff*2, 30*time.Second)
+		s.reportError(err)
+		return
+	}
+	s.connected.Store(true)
+	s.retryAt = time.Time{}
+	s.backoff = time.Second
+}
+
+func (s *Sink) migrate(ctx context.Context) error {
+	if s.version.Load() > 0 {
+		return nil
+	}
+	version, err := s.dialect.migrate(ctx, s.db)
+	if err != nil {
+		return fmt.Errorf("migrating %s schema: %v", s.dialect.name, err)
+	}
+	s.version.Store(int64(version))
+	return nil
+}
+
+// insertAll inserts rows batch by batch. A batch the database refuses
+// while it is reachable holds a row it will never take: the batch is
+// halved until the row is alone, then the row is dropped and the batches
+// grow back. Other errors leave the rows for the next attempt.
+func (s *Sink) insertAll(ctx context.Context, table string, columns []string, rows *[][]any, written *atomic.Uint64) error {
+	size := s.cfg.BatchSize
+	for len(*rows) > 0 {
+		batch := (*rows)[:min(size, len(*rows))]
+		if err := s.dialect.insert(ctx, s.db, table, columns, batch); err != nil {
+			if !s.refused(ctx, err) {
+				return fmt.Errorf("inserting %d rows into %s: %v", len(batch), table, err)
+			}
+			if len(batch) > 1 {
+				size = (len(batch) + 1) / 2
+				continue
+			}
+			*rows = slices.Delete(*rows, 0, 1)
+			s.rejected.Add(1)
+			s.reportError(fmt.Errorf("dropped a row %s refused: %v", table, err))
+			size = s.cfg.BatchSize
+			continue
+		}
+		*rows = slices.Delete(*rows, 0, len(batch))
+		written.Add(uint64(len(batch)))
+		s.batches.Add(1)
+	}
+	return nil
+}
+
+// refused tells whether err is the database turning down the rows rather
+// than a lost connection or a timeout. database/sql doesn't classify the
+// errors of its drivers, so a database that still answers a ping has
+// refused the data.
+func (s *Sink) refused(ctx context.Context, err error) bool {
+	if ctx.Err() != nil || errors.Is(err, driver.ErrBadConn) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+	return s.db.PingContext(ctx) == nil
+}
+
+// flowRow lists the values of flowColumns. Every dialect takes the same
+// Go types, ClickHouse drivers don't convert between integer widths.
+func (s *Sink) flowRow(f *koala.Flow) []any {
+	var srcCountry, dstCountry string
+	var dstASN int64
+	if f.SrcGeo != nil {
+		srcCountry = f.SrcGeo.Country
+	}
+	if f.DstGeo != nil {
+		dstCountry = f.DstGeo.Country
+		dstASN = int64(f.DstGeo.ASN)
+	}
+	return []any{
+		s.cfg.Node, f.Protocol, f.SrcIP, f.SrcName, int32(f.SrcPort), f.DstIP, f.DstName, int32(f.DstPort),
+		f.Iface, f.Scope, f.FirstSeen.UTC(), f.LastSeen.UTC(), int64(f.Packets), int64(f.Bytes),
+		strings.Join(f.TCPFlags, "|"), f.Closed, f.SNI, f.JA3, srcCountry, dstCountry, dstASN,
+	}
+}
+
+// alertRow lists the values of alertColumns, the detector fields as a
+// JSON object.
+func (s *Sink) alertRow(a *alert.Alert) []any {
+	fields := "{}"
+	if len(a.Fields) > 0 {
+		b, _ := json.Marshal(a.Fields)
+		fields = string(b)
+	}
+	return []any{
+		s.cfg.Node, a.Time.UTC(), a.Type, string(a.Severity), a.Message, a.Protocol,
+		a.SrcIP, int32(a.SrcPort), a.DstIP, int32(a.DstPort), a.Iface, fields,
+	}
+}
+
+func (s *Sink) reportError(err error) {
+	if s.onError != nil {
+		s.onError(err)
+	}
+}
+
+func (s *Sink) Stats() Stats {
+	return Stats{
+		FlowsWritten:  s.flowsWritten.Load(),
+		AlertsWritten: s.alertsWritten.Load(),
+		Batches:       s.batches.Load(),
+		Failures:      s.failures.Load(),
+		Dropped:       s.dropped.Load(),
+		Rejected:      s.rejected.Load(),
+		Buffered:      int(s.buffered.Load()),
+		Queued:        len(s.queue),
+		SchemaVersion: int(s.version.Load()),
+		Connected:     s.connected.Load(),
+	}
+}
+
+// Close waits for Run to finish, if it was started, and closes the
+// database handle.
+func (s *Sink) Close(timeout time.Duration) error {
+	select {
+	case <-s.done:
+	case <-time.After(timeout):
+	}
+	return s.db.Close()
+}
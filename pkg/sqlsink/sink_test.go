@@ -0,0 +1,339 @@
+package sqlsink
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"kernelKoala/pkg/alert"
+	"kernelKoala/pkg/koala"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	_ "modernc.org/sqlite"
+)
+
+// flakyDriver is the SQLite driver with an off switch: while down every
+// new connection fails, as if the database were unreachable.
+type flakyDriver struct {
+	down atomic.Bool
+}
+
+var flaky = &flakyDriver{}
+
+func init() {
+	sql.Register("flaky-sqlite", flaky)
+}
+
+func (d *flakyDriver) Open(name string) (driver.Conn, error) {
+	if d.down.Load() {
+		return nil, errors.New("connection refused")
+	}
+	db, err := sql.Open("sqlite", name)
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+	return db.Driver().Open(name)
+}
+
+var sinkT0 = time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+
+func testFlow(port uint16) koala.Flow {
+	return koala.Flow{
+		Protocol: "TCP", SrcIP: "10.0.0.1", SrcPort: port, DstIP: "10.0.0.2", DstPort: 443,
+		FirstSeen: sinkT0, LastSeen: sinkT0.Add(time.Second), Packets: 10, Bytes: 1000,
+		TCPFlags: []string{"SYN", "ACK"},
+	}
+}
+
+// errorLog collects the errors a sink reports.
+type errorLog struct {
+	mu   sync.Mutex
+	errs []error
+}
+
+func (l *errorLog) add(err error) {
+	l.mu.Lock()
+	l.errs = append(l.errs, err)
+	l.mu.Unlock()
+}
+
+func (l *errorLog) last() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if len(l.errs) == 0 {
+		return nil
+	}
+	return l.errs[len(l.errs)-1]
+}
+
+func newTestSink(t *testing.T, dsn string, cfg Config) (*Sink, *errorLog) {
+	cfg.Dialect = "sqlite"
+	cfg.DSN = dsn
+	cfg.Node = "node-a"
+	if cfg.Driver == "" {
+		cfg.Driver = "sqlite"
+	}
+	errs := &errorLog{}
+	s, err := New(cfg, errs.add)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s, errs
+}
+
+func openDB(t *testing.T, dsn string) *sql.DB {
+	db, err := sql.Open("sqlite", dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+func count(t *testing.T, db *sql.DB, query string) int {
+	t.Helper()
+	var n int
+	if err := db.QueryRow(query).Scan(&n); err != nil {
+		t.Fatal(err)
+	}
+	return n
+}
+
+func TestMigrations(t *testing.T) {
+	dsn := filepath.Join(t.TempDir(), "flows.db")
+	s, errs := newTestSink(t, dsn, DefaultConfig())
+	s.write()
+	if err := errs.last(); err != nil {
+		t.Fatal(err)
+	}
+	if v := s.Stats().SchemaVersion; v != 1 {
+		t.Fatalf("schema version %d, want 1", v)
+	}
+	s.Close(0)
+
+	db := openDB(t, dsn)
+	if n := count(t, db, `SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name IN ('flows', 'alerts')`); n != 2 {
+		t.Fatalf("%d of the tables created", n)
+	}
+
+	// A second agent finds the schema current and applies nothing again
+	s, errs = newTestSink(t, dsn, DefaultConfig())
+	s.write()
+	s.Close(0)
+	if err := errs.last(); err != nil || s.Stats().SchemaVersion != 1 {
+		t.Fatalf("remigrating: version %d, %v", s.Stats().SchemaVersion, err)
+	}
+	if n := count(t, db, `SELECT COUNT(*) FROM kernelkoala_schema`); n != 1 {
+		t.Errorf("%d schema versions recorded, want 1", n)
+	}
+
+	// A schema from a newer agent is left alone
+	if _, err := db.Exec(`INSERT INTO kernelkoala_schema (version) VALUES (2)`); err != nil {
+		t.Fatal(err)
+	}
+	s, errs = newTestSink(t, dsn, DefaultConfig())
+	s.buffer(record{flow: &koala.Flow{}})
+	s.write()
+	s.Close(0)
+	if err := errs.last(); err == nil || !strings.Contains(err.Error(), "newer than the supported 1") {
+		t.Fatalf("err = %v, want the schema refused", err)
+	}
+	if st := s.Stats(); st.SchemaVersion != 0 || st.Failures != 1 || st.Buffered != 1 {
+		t.Errorf("stats %+v", st)
+	}
+}
+
+func TestBatches(t *testing.T) {
+	dsn := filepath.Join(t.TempDir(), "flows.db")
+	cfg := DefaultConfig()
+	cfg.BatchSize = 4
+	cfg.FlushInterval = time.Hour
+	s, errs := newTestSink(t, dsn, cfg)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go s.Run(ctx)
+	for i := range 10 {
+		s.AddFlow(testFlow(uint16(40000 + i)))
+	}
+	s.AddAlert(alert.Alert{
+		Time: sinkT0, Type: "port-scan", Severity: alert.SeverityHigh, Message: "scan",
+		SrcIP: "203.0.113.7", Fields: map[string]string{"kind": "block"},
+	})
+
+	// Full batches go out without waiting for the flush interval
+	deadline := time.Now().Add(5 * time.Second)
+	for s.Stats().FlowsWritten < 8 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if st := s.Stats(); st.FlowsWritten != 8 || st.Batches != 2 {
+		t.Fatalf("stats before the flush %+v, want two full batches", st)
+	}
+
+	// The rest is written on shutdown
+	cancel()
+	s.Close(5 * time.Second)
+	if err := errs.last(); err != nil {
+		t.Fatal(err)
+	}
+	st := s.Stats()
+	if st.FlowsWritten != 10 || st.AlertsWritten != 1 || st.Batches != 4 || st.Dropped != 0 || st.Buffered != 0 {
+		t.Errorf("stats %+v", st)
+	}
+
+	db := openDB(t, dsn)
+	if n := count(t, db, `SELECT COUNT(*) FROM flows WHERE node = 'node-a' AND tcp_flags = 'SYN|ACK' AND packets = 10`); n != 10 {
+		t.Errorf("%d flow rows, want 10", n)
+	}
+	var fields string
+	if err := db.QueryRow(`SELECT fields FROM alerts WHERE type = 'port-scan'`).Scan(&fields); err != nil || fields != `{"kind":"block"}` {
+		t.Errorf("alert fields %q, %v", fields, err)
+	}
+}
+
+func TestInsertSplitsStatements(t *testing.T) {
+	dsn := filepath.Join(t.TempDir(), "flows.db")
+	s, _ := newTestSink(t, dsn, DefaultConfig())
+	defer s.Close(0)
+	if err := s.migrate(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	// Two rows of 21 columns per statement, five rows need three
+	d := *s.dialect
+	d.maxParams = 2*len(flowColumns) + 1
+	var rows [][]any
+	for i := range 5 {
+		f := testFlow(uint16(40000 + i))
+		rows = append(rows, s.flowRow(&f))
+	}
+	if err := d.insert(context.Background(), s.db, "flows", flowColumns, rows); err != nil {
+		t.Fatal(err)
+	}
+	if n := count(t, s.db, `SELECT COUNT(DISTINCT src_port) FROM flows`); n != 5 {
+		t.Errorf("%d rows inserted, want 5", n)
+	}
+}
+
+func TestOutageBuffersAndRetries(t *testing.T) {
+	dsn := filepath.Join(t.TempDir(), "flows.db")
+	cfg := DefaultConfig()
+	cfg.Driver = "flaky-sqlite"
+	cfg.BatchSize = 2
+	cfg.FlushInterval = 10 * time.Millisecond
+	cfg.MaxBuffered = 3
+	s, errs := newTestSink(t, dsn, cfg)
+	// Every write needs a new connection, so the outage hits at once
+	s.db.SetMaxIdleConns(0)
+	s.backoff = 10 * time.Millisecond
+
+	flaky.down.Store(true)
+	defer flaky.down.Store(false)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go s.Run(ctx)
+
+	for i := range 5 {
+		s.AddFlow(testFlow(uint16(40000 + i)))
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for (s.Stats().Failures < 2 || s.Stats().Queued > 0) && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	// The oldest flows made room for the newest
+	st := s.Stats()
+	if st.Buffered != 3 || st.Dropped != 2 || st.FlowsWritten != 0 || st.Connected {
+		t.Fatalf("stats during the outage %+v", st)
+	}
+	if err := errs.last(); err == nil || !strings.Contains(err.Error(), "connection refused") {
+		t.Errorf("err = %v, want the outage reported", err)
+	}
+
+	flaky.down.Store(false)
+	for s.Stats().FlowsWritten < 3 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	cancel()
+	s.Close(5 * time.Second)
+
+	st = s.Stats()
+	if st.FlowsWritten != 3 || st.Buffered != 0 || st.Dropped != 2 || !st.Connected || st.SchemaVersion != 1 {
+		t.Errorf("stats after the outage %+v", st)
+	}
+	db := openDB(t, dsn)
+	if n := count(t, db, `SELECT COUNT(*) FROM flows WHERE src_port >= 40002`); n != 3 {
+		t.Errorf("%d of the newest flows written, want 3", n)
+	}
+}
+
+func TestRejectedRowsAreDropped(t *testing.T) {
+	dsn := filepath.Join(t.TempDir(), "flows.db")
+	cfg := DefaultConfig()
+	cfg.BatchSize = 8
+	s, errs := newTestSink(t, dsn, cfg)
+	defer s.Close(0)
+	if err := s.migrate(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	// The database turns down two of the flows for good
+	if _, err := s.db.Exec(`CREATE TRIGGER reject_flow BEFORE INSERT ON flows
+		WHEN NEW.src_port IN (40003, 40011) BEGIN SELECT RAISE(ABORT, 'rejected'); END`); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := range 20 {
+		s.buffer(record{flow: ptr(testFlow(uint16(40000 + i)))})
+	}
+	s.write()
+
+	st := s.Stats()
+	if st.Rejected != 2 || st.FlowsWritten != 18 || st.Buffered != 0 || st.Dropped != 0 || st.Failures != 0 || !st.Connected {
+		t.Errorf("stats %+v", st)
+	}
+	if err := errs.last(); err == nil || !strings.Contains(err.Error(), "rejected") {
+		t.Errorf("err = %v, want the dropped row reported", err)
+	}
+	if n := count(t, s.db, `SELECT COUNT(*) FROM flows WHERE src_port NOT IN (40003, 40011)`); n != 18 {
+		t.Errorf("%d rows written, want 18", n)
+	}
+}
+
+func TestOutageKeepsRows(t *testing.T) {
+	dsn := filepath.Join(t.TempDir(), "flows.db")
+	cfg := DefaultConfig()
+	cfg.Driver = "flaky-sqlite"
+	s, _ := newTestSink(t, dsn, cfg)
+	defer s.Close(0)
+	s.db.SetMaxIdleConns(0)
+	if err := s.migrate(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	// An unreachable database refuses nothing, the rows wait
+	flaky.down.Store(true)
+	defer flaky.down.Store(false)
+	s.buffer(record{flow: ptr(testFlow(40000))})
+	s.write()
+	if st := s.Stats(); st.Rejected != 0 || st.Buffered != 1 || st.Failures != 1 {
+		t.Errorf("stats %+v", st)
+	}
+}
+
+func TestConfigLimits(t *testing.T) {
+	for _, c := range []struct{ batch, buffer int }{{0, 10}, {-1, 10}, {10, 0}, {10, 9}} {
+		cfg := DefaultConfig()
+		cfg.Dialect, cfg.DSN = "sqlite", ":memory:"
+		cfg.BatchSize, cfg.MaxBuffered = c.batch, c.buffer
+		if s, err := New(cfg, nil); err == nil {
+			s.Close(0)
+			t.Errorf("batch %d, buffer %d accepted", c.batch, c.buffer)
+		}
+	}
+}
+
+func ptr[T any](v T) *T { return &v }
@@ -0,0 +1,255 @@
+// Package threatintel matches addresses against indicator of compromise
+// (IOC) lists of IPs and CIDRs loaded from local files.
+package threatintel
+
+import (
+	"bufio"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"kernelKoala/pkg/iptrie"
+	"net"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Indicator is one listed network and where it came from.
+type Indicator struct {
+	Prefix netip.Prefix `json:"indicator"`
+	Source string       `json:"source"`
+	Tag    string       `json:"tag,omitempty"`
+}
+
+func (i Indicator) String() string {
+	s := i.Prefix.String() + " (" + i.Source
+	if i.Tag != "" {
+		s += "/" + i.Tag
+	}
+	return s + ")"
+}
+
+// listFile is one IOC file, reloaded when its size or mtime changes.
+type listFile struct {
+	path       string
+	modTime    time.Time
+	size       int64
+	indicators []Indicator
+}
+
+// List holds the indicators of all configured files in a prefix trie.
+type List struct {
+	files []*listFile
+	trie  atomic.Pointer[iptrie.Trie[Indicator]]
+
+	onReload func([]Indicator)
+	errors   func(error)
+	stop     chan struct{}
+	once     sync.Once
+}
+
+// New loads the given files. Files ending in .csv hold
+// "indicator,source,tag" records, anything else one IP or CIDR per line
+// optionally followed by a tag. The source defaults to the file name.
+//
+// The files are checked for changes every reloadInterval. After a reload
+// onReload receives the full indicator set, failures are passed to onError
+// and the previous indicators of that file stay in use.
+func New(paths []string, reloadInterval time.Duration, onReload func([]Indicator), onError func(error)) (*List, error) {
+	l := &List{
+		onReload: onReload,
+		errors:   onError,
+		stop:     make(chan struct{}),
+	}
+
+	for _, path := range paths {
+		f := &listFile{path: path}
+		if _, err := f.load(); err != nil {
+			return nil, err
+		}
+		l.files = append(l.files, f)
+	}
+	l.rebuild()
+
+	if reloadInterval > 0 {
+		go l.watch(reloadInterval)
+	}
+
+	return l, nil
+}
+
+// Match returns the most specific indicator containing ip.
+func (l *List) Match(ip net.IP) (Indicator, bool) {
+	ind, _, ok := l.trie.Load().Lookup(iptrie.AddrFromIP(ip))
+	return ind, ok
+}
+
+// Len is the number of distinct indicators loaded.
+func (l *List) Len() int {
+	return l.trie.Load().Len()
+}
+
+// Indicators returns every loaded indicator.
+func (l *List) Indicators() []Indicator {
+	var all []Indicator
+	l.trie.Load().Walk(func(_ netip.Prefix, ind Indicator) bool {
+		all = append(all, ind)
+		return true
+	})
+	return all
+}
+
+// Close stops watching the files.
+func (l *List) Close() {
+	l.once.Do(func() { close(l.stop) })
+}
+
+// rebuild swaps in a trie built from the current file contents, earlier
+// files win when the same prefix is listed twice.
+func (l *List) rebuild() {
+	trie := iptrie.New[Indicator]()
+	for i := len(l.files) - 1; i >= 0; i-- {
+		for _, ind := range l.files[i].indicators {
+			trie.Insert(ind.Prefix, ind)
+		}
+	}
+	l.trie.Store(trie)
+}
+
+func (l *List) watch(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-l.stop:
+			return
+		case <-ticker.C:
+			reloaded := false
+			for _, f := range l.files {
+				changed, err := f.load()
+				if err != nil && l.errors != nil {
+					l.errors(err)
+				}
+				reloaded = reloaded || changed
+			}
+			if reloaded {
+				l.rebuild()
+				if l.onReload != nil {
+					l.onReload(l.Indicators())
+				}
+			}
+		}
+	}
+}
+
+func (f *listFile) load() (bool, error) {
+	st, err := os.Stat(f.path)
+	if err != nil {
+		return false, err
+	}
+	if f.indicators != nil && st.ModTime().Equal(f.modTime) && st.Size() == f.size {
+		return false, nil
+	}
+
+	file, err := os.Open(f.path)
+	if err != nil {
+		return false, err
+	}
+	defer file.Close()
+
+	source := strings.TrimSuffix(filepath.Base(f.path), filepath.Ext(f.path))
+	var indicators []Indicator
+	if strings.EqualFold(filepath.Ext(f.path), ".csv") {
+		indicators, err = parseCSV(file, source)
+	} else {
+		indicators, err = parseText(file, source)
+	}
+	if err != nil {
+		return false, fmt.Errorf("%s: %v", f.path, err)
+	}
+
+	// Keep an empty list distinguishable from one never loaded
+	if indicators == nil {
+		indicators = []Indicator{}
+	}
+	f.indicators = indicators
+	f.modTime, f.size = st.ModTime(), st.Size()
+	return true, nil
+}
+
+// parseText reads "ip-or-cidr [tag]" lines, ignoring '#' comments.
+func parseText(r io.Reader, source string) ([]Indicator, error) {
+	var indicators []Indicator
+
+	scanner := bufio.NewScanner(r)
+	lineNo := 0
+	for scanner.Scan() {
+		lineNo++
+		line := scanner.Text()
+		if i := strings.IndexByte(line, '#'); i >= 0 {
+			line = line[:i]
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+
+		prefix, err := iptrie.ParsePrefix(fields[0])
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", lineNo, err)
+		}
+		ind := Indicator{Prefix: prefix, Source: source}
+		if len(fields) > 1 {
+			ind.Tag = strings.Join(fields[1:], " ")
+		}
+		indicators = append(indicators, ind)
+	}
+	return indicators, scanner.Err()
+}
+
+// parseCSV reads "indicator,source,tag" records, source and tag are
+// optional. A first record whose indicator doesn't parse is taken as a
+// header.
+func parseCSV(r io.Reader, source string) ([]Indicator, error) {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1
+	reader.Comment = '#'
+	reader.TrimLeadingSpace = true
+
+	var indicators []Indicator
+	for record := 1; ; record++ {
+		fields, err := reader.Read()
+		if err == io.EOF {
+			return indicators, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if len(fields) == 0 || strings.TrimSpace(fields[0]) == "" {
+			continue
+		}
+
+		prefix, err := iptrie.ParsePrefix(strings.TrimSpace(fields[0]))
+		if err != nil {
+			if record == 1 {
+				continue
+			}
+			line, _ := reader.FieldPos(0)
+			return nil, fmt.Errorf("line %d: %v", line, err)
+		}
+
+		ind := Indicator{Prefix: prefix, Source: source}
+		if len(fields) > 1 && strings.TrimSpace(fields[1]) != "" {
+			ind.Source = strings.TrimSpace(fields[1])
+		}
+		if len(fields) > 2 {
+			ind.Tag = strings.TrimSpace(fields[2])
+		}
+		indicators = append(indicators, ind)
+	}
+}
@@ -0,0 +1,143 @@
+package threatintel
+
+import (
+	"net"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func indicator(prefix, source, tag string) Indicator {
+	return Indicator{Prefix: netip.MustParsePrefix(prefix), Source: source, Tag: tag}
+}
+
+func TestParseText(t *testing.T) {
+	got, err := parseText(strings.NewReader(`
+# feed header
+203.0.113.7
+198.51.100.0/24   botnet c2   # trailing comment
+198.51.100.77/24
+2001:db8::/32 lab
+::ffff:192.0.2.1
+`), "feed")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Indicator{
+		indicator("203.0.113.7/32", "feed", ""),
+		indicator("198.51.100.0/24", "feed", "botnet c2"),
+		indicator("198.51.100.0/24", "feed", ""),
+		indicator("2001:db8::/32", "feed", "lab"),
+		indicator("192.0.2.1/32", "feed", ""),
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v\nwant %v", got, want)
+	}
+
+	if _, err := parseText(strings.NewReader("203.0.113.7\nexample.com\n"), "feed"); err == nil || !strings.Contains(err.Error(), "line 2") {
+		t.Errorf("bad line: %v", err)
+	}
+}
+
+func TestParseCSV(t *testing.T) {
+	got, err := parseCSV(strings.NewReader(`indicator,source,tag
+# comment
+203.0.113.7,abuse.ch,botnet
+198.51.100.0/24
+192.0.2.0/24,,"scanner, aggressive"
+ 2001:db8::1 , partner ,
+`), "file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Indicator{
+		indicator("203.0.113.7/32", "abuse.ch", "botnet"),
+		indicator("198.51.100.0/24", "file", ""),
+		indicator("192.0.2.0/24", "file", "scanner, aggressive"),
+		indicator("2001:db8::1/128", "partner", ""),
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v\nwant %v", got, want)
+	}
+
+	// Only the first record may be a header
+	if _, err := parseCSV(strings.NewReader("203.0.113.7\nindicator,source\n"), "file"); err == nil || !strings.Contains(err.Error(), "line 2") {
+		t.Errorf("bad record: %v", err)
+	}
+	if _, err := parseCSV(strings.NewReader("\"unterminated\n"), "file"); err == nil {
+		t.Error("broken CSV parsed")
+	}
+}
+
+func writeList(t *testing.T, dir, name, content string) string {
+	t.Helper()
+	path := filepath.Join(dir, name)
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestList(t *testing.T) {
+	dir := t.TempDir()
+	first := writeList(t, dir, "blocklist.txt", "203.0.113.0/24 first\n")
+	second := writeList(t, dir, "partner.CSV", "203.0.113.0/24,,second\n203.0.113.7,,host\n")
+
+	l, err := New([]string{first, second}, 0, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	if l.Len() != 2 {
+		t.Errorf("%d indicators, the same prefix counts once", l.Len())
+	}
+	for ip, want := range map[string]string{
+		"203.0.113.7":        "203.0.113.7/32 (partner/host)",
+		"203.0.113.8":        "203.0.113.0/24 (blocklist/first)", // earlier files win
+		"::ffff:203.0.113.9": "203.0.113.0/24 (blocklist/first)",
+		"198.51.100.1":       "",
+	} {
+		ind, ok := l.Match(net.ParseIP(ip))
+		if got := ind.String(); ok != (want != "") || (ok && got != want) {
+			t.Errorf("Match(%s) = %s %v, want %q", ip, got, ok, want)
+		}
+	}
+
+	if _, err := New([]string{writeList(t, dir, "bad.txt", "nope\n")}, 0, nil, nil); err == nil || !strings.Contains(err.Error(), "bad.txt") {
+		t.Errorf("bad file: %v", err)
+	}
+}
+
+func TestListReload(t *testing.T) {
+	dir := t.TempDir()
+	path := writeList(t, dir, "feed.txt", "203.0.113.7\n")
+	reloaded := make(chan []Indicator, 10)
+	l, err := New([]string{path}, 10*time.Millisecond, func(all []Indicator) { reloaded <- all }, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	// Replaced in one step, the way feeds should be updated
+	if err := os.Rename(writeList(t, dir, "feed.tmp", "198.51.100.0/24\n192.0.2.1\n"), path); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case all := <-reloaded:
+		if len(all) != 2 {
+			t.Errorf("reloaded %v", all)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("list not reloaded")
+	}
+	if _, ok := l.Match(net.ParseIP("203.0.113.7")); ok {
+		t.Error("removed indicator still matches")
+	}
+	if _, ok := l.Match(net.ParseIP("198.51.100.3")); !ok {
+		t.Error("new indicator doesn't match")
+	}
+}